@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"infosystem-musicapp/musicxml"
+)
+
+// GenerateSheetsRequest is the request body of POST /music/:music_id/sheets/generate.
+type GenerateSheetsRequest struct {
+	Difficulties []int `json:"difficulties"` // Optional: every difficulty below the source sheet if empty
+	Overwrite    bool  `json:"overwrite"`    // Optional: regenerate difficulties that already have a generated sheet
+	// Optional: the part to arrange (see SheetPart); every part with a hand-made sheet if the instrument is empty
+	SheetPart
+}
+
+// GeneratedSheet reports what GenerateEasierSheets did for one difficulty of a part.
+type GeneratedSheet struct {
+	Instrument string `json:"instrument"`
+	Part       string `json:"part"`
+	Difficulty int    `json:"difficulty"`
+	SheetID    int    `json:"sheet_id,omitempty"`
+	Status     string `json:"status"` // "created", "replaced" or "skipped"
+	Reason     string `json:"reason,omitempty"`
+}
+
+// GenerateEasierSheets arranges the hardest hand-made sheet of each part of a music into easier
+// sheets and stores them as generated Sheets rows. Hand-made sheets are never replaced.
+// The part of the request must already have been validated.
+func GenerateEasierSheets(db *sql.DB, musicID int, req GenerateSheetsRequest) ([]GeneratedSheet, error) {
+	var parts []SheetPart
+	if req.Instrument != "" {
+		part, err := resolveSheetPart(db, musicID, req.SheetPart)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	} else {
+		rows, err := db.Query("SELECT DISTINCT instrument, part FROM Sheets WHERE music_id = ? AND difficulty != ? AND generated = 0 ORDER BY instrument, part",
+			musicID, accompanimentDifficulty)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query parts of music_id %d: %w", musicID, err)
+		}
+		for rows.Next() {
+			var part SheetPart
+			if err := rows.Scan(&part.Instrument, &part.Part); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan part of music_id %d: %w", musicID, err)
+			}
+			parts = append(parts, part)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating parts of music_id %d: %w", musicID, err)
+		}
+		if len(parts) == 0 {
+			return nil, ErrSheetNotFound
+		}
+	}
+
+	results := []GeneratedSheet{}
+	for _, part := range parts {
+		partResults, err := generateEasierPartSheets(db, musicID, part, req.Difficulties, req.Overwrite)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, partResults...)
+	}
+	return results, nil
+}
+
+// generateEasierPartSheets arranges the hardest hand-made sheet of one part into easier sheets.
+func generateEasierPartSheets(db *sql.DB, musicID int, part SheetPart, difficulties []int, overwrite bool) ([]GeneratedSheet, error) {
+	rows, err := db.Query("SELECT difficulty, sheet, generated FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty != ?",
+		musicID, part.Instrument, part.Part, accompanimentDifficulty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sheets for music_id %d: %w", musicID, err)
+	}
+	existing := make(map[int]bool) // difficulty -> generated
+	sourceDifficulty, source := 0, ""
+	for rows.Next() {
+		var difficulty int
+		var sheet string
+		var generated bool
+		if err := rows.Scan(&difficulty, &sheet, &generated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan sheet row for music_id %d: %w", musicID, err)
+		}
+		existing[difficulty] = generated
+		if !generated && difficulty > sourceDifficulty {
+			sourceDifficulty, source = difficulty, sheet
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sheet rows for music_id %d: %w", musicID, err)
+	}
+	if source == "" {
+		return nil, ErrSheetNotFound
+	}
+
+	score, err := musicxml.ParseString(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source sheet (music_id: %d, difficulty: %d): %w", musicID, sourceDifficulty, err)
+	}
+
+	if len(difficulties) == 0 {
+		for d := minSheetDifficulty; d < sourceDifficulty; d++ {
+			difficulties = append(difficulties, d)
+		}
+	}
+
+	results := []GeneratedSheet{}
+	for _, d := range difficulties {
+		result := GeneratedSheet{Instrument: part.Instrument, Part: part.Part, Difficulty: d, Status: "skipped"}
+		generated, exists := existing[d]
+		switch {
+		case d < minSheetDifficulty || d >= sourceDifficulty:
+			result.Reason = fmt.Sprintf("only difficulties from %d to %d can be arranged from the difficulty %d sheet", minSheetDifficulty, sourceDifficulty-1, sourceDifficulty)
+		case exists && !generated:
+			result.Reason = "a hand-made sheet already exists"
+		case exists && !overwrite:
+			result.Reason = "already generated"
+		default:
+			sheet, err := musicxml.MarshalString(musicxml.Simplify(score, musicxml.OptionsForLevel(d)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to write arrangement (music_id: %d, difficulty: %d): %w", musicID, d, err)
+			}
+			id, err := replaceGeneratedSheet(db, musicID, part, d, sheet)
+			if err != nil {
+				return nil, err
+			}
+			result.SheetID = id
+			result.Status = "created"
+			if exists {
+				result.Status = "replaced"
+			}
+			existing[d] = true
+			log.Printf("Generated sheet %d (music_id: %d, instrument: %s, part: %q, difficulty: %d) from difficulty %d",
+				id, musicID, part.Instrument, part.Part, d, sourceDifficulty)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// replaceGeneratedSheet stores a generated sheet, replacing the previously generated one of that part and difficulty.
+func replaceGeneratedSheet(db *sql.DB, musicID int, part SheetPart, difficulty int, sheet string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for generated sheet: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.Exec("DELETE FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ? AND generated = 1",
+		musicID, part.Instrument, part.Part, difficulty); err != nil {
+		return 0, fmt.Errorf("failed to delete generated sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	res, err := tx.Exec("INSERT INTO Sheets (music_id, instrument, part, difficulty, sheet, generated) VALUES (?, ?, ?, ?, ?, 1)",
+		musicID, part.Instrument, part.Part, difficulty, sheet)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert generated sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get generated sheet id: %w", err)
+	}
+	if err := refreshMusicMetadata(tx, musicID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit generated sheet: %w", err)
+	}
+	successfulCommit = true
+	return int(id), nil
+}
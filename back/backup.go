@@ -0,0 +1,1234 @@
+/*
+ * Full backup and restore of the database as a portable zip archive:
+ * GET /admin/export and POST /admin/import, or "back export" and "back restore" from the command line.
+ *
+ * The archive holds a manifest, one JSON file per entity and the raw MusicXML of every sheet:
+ *
+ *	manifest.json               {"format": "musicapp-backup", "version": 5, "created_at": "...", "counts": {"music": 12, ...}}
+ *	genres.json                 [{"slug": "ANIME", "names": {"ja": "アニメ", "en": "Anime"}}]
+ *	music.json                  [{"id": 1, "title": "新時代", "artist": "Ado", "genres": ["ANIME"], ...}]
+ *	sheets.json                 [{"music_id": 1, "instrument": "guitar", "part": "", "difficulty": 3, "generated": false,
+ *	                              "file": "sheets/1/guitar/3.musicxml"}]
+ *	sheets/<music_id>/<instrument>[/<part>]/<difficulty>.musicxml
+ *	users.json                  [{"id": 1, "username": "default", "password_hash": "...", "created_at": "..."}]
+ *	instruments.json            [{"user_id": 1, "instrument": "guitar", "proficiency": 0.4, "selected": true, "current": true}]
+ *	favorites.json, difficulty_settings.json, query_history.json, view_history.json, practice_progress.json
+ *	proficiency_history.json    [{"user_id": 1, "instrument": "guitar", "proficiency": 0.5, "previous": 0.4, "source": "measure",
+ *	                              "music_id": 1, "measure": 4, "difficulty": 3, "recorded_at": "..."}]
+ *
+ * Only archives of the current version are read. Users are matched by username; tokens, including
+ * the Spotify tokens, are not archived.
+ *
+ * Every entity refers to music by its ID in music.json. The search index, the thumbnail
+ * cache and the song metadata are not archived: they are rebuilt from the restored rows.
+ *
+ * A restore is checked as a whole before anything is written and runs in a single transaction,
+ * in one of three modes:
+ *
+ *	merge      (default) add the archive to the database. Music is matched by title and artist
+ *	           (ignoring case) and genres by slug; rows that already exist are kept as they are.
+ *	overwrite  like merge, but rows that already exist are updated with the archived values.
+ *	replace    delete the catalog and every user data first, then restore the archive with its IDs.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupFormat  = "musicapp-backup"
+	backupVersion = 5
+	// maxBackupSize bounds an uploaded archive and every file read from an archive.
+	maxBackupSize = 256 << 20
+)
+
+var (
+	ErrInvalidBackup      = errors.New("invalid backup archive")
+	ErrUnknownRestoreMode = errors.New("unknown restore mode")
+)
+
+// RestoreMode tells how a restore handles rows that already exist in the database.
+type RestoreMode string
+
+const (
+	RestoreMerge     RestoreMode = "merge"
+	RestoreOverwrite RestoreMode = "overwrite"
+	RestoreReplace   RestoreMode = "replace"
+)
+
+// ParseRestoreMode parses the mode of a restore; an empty string is the default merge.
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	switch mode := RestoreMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return RestoreMerge, nil
+	case RestoreMerge, RestoreOverwrite, RestoreReplace:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%w: %q (expected merge, overwrite or replace)", ErrUnknownRestoreMode, s)
+}
+
+// BackupManifest describes an archive.
+type BackupManifest struct {
+	Format    string         `json:"format"`
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Counts    map[string]int `json:"counts"` // Number of rows of each entity
+}
+
+type backupGenre struct {
+	Slug  string            `json:"slug"`
+	Names map[string]string `json:"names"`
+}
+
+type backupMusic struct {
+	ID             int      `json:"id"`
+	Title          string   `json:"title"`
+	Artist         string   `json:"artist"`
+	BaseDifficulty *int     `json:"base_difficulty"`
+	Genres         []string `json:"genres"` // Genre slugs, the primary genre first
+	Thumbnail      string   `json:"thumbnail"`
+	Reading        string   `json:"reading"`
+}
+
+type backupSheet struct {
+	MusicID    int    `json:"music_id"`
+	Instrument string `json:"instrument"`
+	Part       string `json:"part"`
+	Difficulty int    `json:"difficulty"`
+	Generated  bool   `json:"generated"`
+	File       string `json:"file"` // Path of the MusicXML in the archive
+	sheet      string
+}
+
+type backupUser struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"` // Empty: no password login
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type backupInstrument struct {
+	UserID      int     `json:"user_id"`
+	Instrument  string  `json:"instrument"`
+	Proficiency float64 `json:"proficiency"`
+	Selected    bool    `json:"selected"`
+	Current     bool    `json:"current"`
+}
+
+type backupFavorite struct {
+	UserID   int `json:"user_id"`
+	MusicID  int `json:"music_id"`
+	OrderKey int `json:"order_key"`
+}
+
+type backupDifficultySetting struct {
+	UserID     int    `json:"user_id"`
+	MusicID    int    `json:"music_id"`
+	Instrument string `json:"instrument"`
+	Measure    int    `json:"measure"`
+	Difficulty int    `json:"difficulty"`
+}
+
+type backupQuery struct {
+	UserID     int       `json:"user_id"`
+	Query      string    `json:"query"`
+	Normalized string    `json:"normalized"`
+	SearchedAt time.Time `json:"searched_at"`
+}
+
+type backupView struct {
+	UserID   int       `json:"user_id"`
+	MusicID  int       `json:"music_id"`
+	ViewedAt time.Time `json:"viewed_at"`
+}
+
+type backupProgress struct {
+	UserID       int       `json:"user_id"`
+	MusicID      int       `json:"music_id"`
+	Instrument   string    `json:"instrument"`
+	Part         string    `json:"part"`
+	Difficulty   int       `json:"difficulty"`
+	LastMeasure  int       `json:"last_measure"`
+	Position     int       `json:"position"`
+	MeasureCount int       `json:"measure_count"`
+	PracticedAt  time.Time `json:"practiced_at"`
+}
+
+type backupProficiencyChange struct {
+	UserID      int       `json:"user_id"`
+	Instrument  string    `json:"instrument"`
+	Proficiency float64   `json:"proficiency"`
+	Previous    float64   `json:"previous"`
+	Source      string    `json:"source"`
+	MusicID     *int      `json:"music_id,omitempty"` // Nil once the music was deleted
+	Measure     *int      `json:"measure,omitempty"`
+	Difficulty  *int      `json:"difficulty,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// backupData is the content of an archive.
+type backupData struct {
+	Genres             []backupGenre
+	Music              []backupMusic
+	Sheets             []backupSheet
+	Users              []backupUser
+	Instruments        []backupInstrument
+	Favorites          []backupFavorite
+	DifficultySettings []backupDifficultySetting
+	QueryHistory       []backupQuery
+	ViewHistory        []backupView
+	PracticeProgress   []backupProgress
+	ProficiencyHistory []backupProficiencyChange
+}
+
+// backupEntity is a JSON file of an archive.
+type backupEntity struct {
+	name  string // File name without ".json", also the key of the manifest counts
+	value any    // Pointer to the field of backupData holding its rows
+	count int
+}
+
+func (b *backupData) entities() []backupEntity {
+	return []backupEntity{
+		{"genres", &b.Genres, len(b.Genres)},
+		{"music", &b.Music, len(b.Music)},
+		{"sheets", &b.Sheets, len(b.Sheets)},
+		{"users", &b.Users, len(b.Users)},
+		{"instruments", &b.Instruments, len(b.Instruments)},
+		{"favorites", &b.Favorites, len(b.Favorites)},
+		{"difficulty_settings", &b.DifficultySettings, len(b.DifficultySettings)},
+		{"query_history", &b.QueryHistory, len(b.QueryHistory)},
+		{"view_history", &b.ViewHistory, len(b.ViewHistory)},
+		{"practice_progress", &b.PracticeProgress, len(b.PracticeProgress)},
+		{"proficiency_history", &b.ProficiencyHistory, len(b.ProficiencyHistory)},
+	}
+}
+
+// sheetFileName returns the path of the MusicXML of a sheet in the archive.
+func sheetFileName(s backupSheet) string {
+	dir := path.Join("sheets", strconv.Itoa(s.MusicID), url.PathEscape(s.Instrument))
+	if s.Part != "" {
+		dir = path.Join(dir, url.PathEscape(s.Part))
+	}
+	return path.Join(dir, strconv.Itoa(s.Difficulty)+".musicxml")
+}
+
+// ExportBackup writes an archive of the whole database to w and returns its manifest.
+func ExportBackup(db *sql.DB, w io.Writer) (*BackupManifest, error) {
+	// Read everything in one transaction for a consistent snapshot
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction for export: %w", err)
+	}
+	defer tx.Rollback()
+	data, err := readBackupData(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{Format: backupFormat, Version: backupVersion, CreatedAt: time.Now().UTC(), Counts: map[string]int{}}
+	for _, e := range data.entities() {
+		manifest.Counts[e.name] = e.count
+	}
+
+	zw := zip.NewWriter(w)
+	create := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: manifest.CreatedAt})
+	}
+	writeJSON := func(name string, v any) error {
+		f, err := create(name)
+		if err != nil {
+			return fmt.Errorf("failed to add %s to the archive: %w", name, err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("failed to write %s to the archive: %w", name, err)
+		}
+		return nil
+	}
+	if err := writeJSON("manifest.json", manifest); err != nil {
+		return nil, err
+	}
+	for _, e := range data.entities() {
+		if err := writeJSON(e.name+".json", e.value); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range data.Sheets {
+		f, err := create(s.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to the archive: %w", s.File, err)
+		}
+		if _, err := io.WriteString(f, s.sheet); err != nil {
+			return nil, fmt.Errorf("failed to write %s to the archive: %w", s.File, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish the archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// queryEach runs a query and calls scan for each row.
+func queryEach(db execer, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readBackupData reads every row to archive.
+func readBackupData(db execer) (*backupData, error) {
+	data := &backupData{
+		Genres: []backupGenre{}, Music: []backupMusic{}, Sheets: []backupSheet{}, Users: []backupUser{}, Instruments: []backupInstrument{}, Favorites: []backupFavorite{},
+		DifficultySettings: []backupDifficultySetting{}, QueryHistory: []backupQuery{}, ViewHistory: []backupView{},
+		PracticeProgress: []backupProgress{}, ProficiencyHistory: []backupProficiencyChange{},
+	}
+
+	err := queryEach(db, "SELECT g.slug, n.locale, n.name FROM Genres g LEFT JOIN GenreNames n ON n.genre_id = g.id ORDER BY g.id, n.locale", func(rows *sql.Rows) error {
+		var slug string
+		var locale, name sql.NullString
+		if err := rows.Scan(&slug, &locale, &name); err != nil {
+			return err
+		}
+		if n := len(data.Genres); n == 0 || data.Genres[n-1].Slug != slug {
+			data.Genres = append(data.Genres, backupGenre{Slug: slug, Names: map[string]string{}})
+		}
+		if locale.Valid {
+			data.Genres[len(data.Genres)-1].Names[locale.String] = name.String
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genres for export: %w", err)
+	}
+
+	index := make(map[int]int) // music ID -> position in data.Music
+	err = queryEach(db, "SELECT id, title, COALESCE(artist, ''), base_difficulty, COALESCE(thumbnail, ''), COALESCE(reading, '') FROM Music ORDER BY id", func(rows *sql.Rows) error {
+		var m backupMusic
+		var baseDifficulty sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.Title, &m.Artist, &baseDifficulty, &m.Thumbnail, &m.Reading); err != nil {
+			return err
+		}
+		if baseDifficulty.Valid {
+			d := int(baseDifficulty.Int64)
+			m.BaseDifficulty = &d
+		}
+		m.Genres = []string{}
+		index[m.ID] = len(data.Music)
+		data.Music = append(data.Music, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read music for export: %w", err)
+	}
+	err = queryEach(db, "SELECT mg.music_id, g.slug FROM MusicGenres mg JOIN Genres g ON g.id = mg.genre_id ORDER BY mg.music_id, mg.position", func(rows *sql.Rows) error {
+		var musicID int
+		var slug string
+		if err := rows.Scan(&musicID, &slug); err != nil {
+			return err
+		}
+		if i, ok := index[musicID]; ok {
+			data.Music[i].Genres = append(data.Music[i].Genres, slug)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genre tags for export: %w", err)
+	}
+
+	err = queryEach(db, `
+		SELECT s.music_id, s.instrument, s.part, s.difficulty, s.generated, s.sheet FROM Sheets s JOIN Music m ON m.id = s.music_id
+		ORDER BY s.music_id, s.instrument, s.part, s.difficulty`, func(rows *sql.Rows) error {
+		var s backupSheet
+		if err := rows.Scan(&s.MusicID, &s.Instrument, &s.Part, &s.Difficulty, &s.Generated, &s.sheet); err != nil {
+			return err
+		}
+		s.File = sheetFileName(s)
+		data.Sheets = append(data.Sheets, s)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sheets for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT id, username, password_hash, created_at FROM Users ORDER BY id", func(rows *sql.Rows) error {
+		var u backupUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.CreatedAt); err != nil {
+			return err
+		}
+		data.Users = append(data.Users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, instrument, proficiency, selected, current FROM UserInstruments ORDER BY user_id, instrument", func(rows *sql.Rows) error {
+		var ui backupInstrument
+		if err := rows.Scan(&ui.UserID, &ui.Instrument, &ui.Proficiency, &ui.Selected, &ui.Current); err != nil {
+			return err
+		}
+		data.Instruments = append(data.Instruments, ui)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instruments for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, music_id, order_key FROM Favorites ORDER BY user_id, order_key", func(rows *sql.Rows) error {
+		var f backupFavorite
+		if err := rows.Scan(&f.UserID, &f.MusicID, &f.OrderKey); err != nil {
+			return err
+		}
+		data.Favorites = append(data.Favorites, f)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read favorites for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, music_id, instrument, measure, difficulty FROM UserMusicDifficultySettings ORDER BY user_id, music_id, instrument, measure", func(rows *sql.Rows) error {
+		var s backupDifficultySetting
+		if err := rows.Scan(&s.UserID, &s.MusicID, &s.Instrument, &s.Measure, &s.Difficulty); err != nil {
+			return err
+		}
+		data.DifficultySettings = append(data.DifficultySettings, s)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read difficulty settings for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, query, normalized, searched_at FROM QueryHistory ORDER BY user_id, searched_at", func(rows *sql.Rows) error {
+		var q backupQuery
+		if err := rows.Scan(&q.UserID, &q.Query, &q.Normalized, &q.SearchedAt); err != nil {
+			return err
+		}
+		data.QueryHistory = append(data.QueryHistory, q)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read query history for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, music_id, viewed_at FROM ViewHistory ORDER BY user_id, viewed_at", func(rows *sql.Rows) error {
+		var v backupView
+		if err := rows.Scan(&v.UserID, &v.MusicID, &v.ViewedAt); err != nil {
+			return err
+		}
+		data.ViewHistory = append(data.ViewHistory, v)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read view history for export: %w", err)
+	}
+
+	err = queryEach(db, "SELECT user_id, music_id, instrument, part, difficulty, last_measure, position, measure_count, practiced_at FROM PracticeProgress ORDER BY user_id, music_id, instrument, part", func(rows *sql.Rows) error {
+		var p backupProgress
+		if err := rows.Scan(&p.UserID, &p.MusicID, &p.Instrument, &p.Part, &p.Difficulty, &p.LastMeasure, &p.Position, &p.MeasureCount, &p.PracticedAt); err != nil {
+			return err
+		}
+		data.PracticeProgress = append(data.PracticeProgress, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read practice progress for export: %w", err)
+	}
+
+	err = queryEach(db, `
+		SELECT user_id, instrument, proficiency, previous, source, music_id, measure, difficulty, recorded_at
+		FROM ProficiencyHistory ORDER BY user_id, recorded_at, id`, func(rows *sql.Rows) error {
+		var c backupProficiencyChange
+		var musicID, measure, difficulty sql.NullInt64
+		if err := rows.Scan(&c.UserID, &c.Instrument, &c.Proficiency, &c.Previous, &c.Source, &musicID, &measure, &difficulty, &c.RecordedAt); err != nil {
+			return err
+		}
+		c.MusicID, c.Measure, c.Difficulty = nullIntPtr(musicID), nullIntPtr(measure), nullIntPtr(difficulty)
+		data.ProficiencyHistory = append(data.ProficiencyHistory, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proficiency history for export: %w", err)
+	}
+	return data, nil
+}
+
+// readBackupArchive reads and checks an archive. Every file but manifest.json and music.json
+// may be left out, e.g. from an archive written by hand.
+func readBackupArchive(archive []byte) (*BackupManifest, *backupData, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	readFile := func(name string) ([]byte, bool, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, false, nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, true, fmt.Errorf("%w: failed to open %s: %v", ErrInvalidBackup, name, err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(io.LimitReader(rc, maxBackupSize+1))
+		if err != nil {
+			return nil, true, fmt.Errorf("%w: failed to read %s: %v", ErrInvalidBackup, name, err)
+		}
+		if len(b) > maxBackupSize {
+			return nil, true, fmt.Errorf("%w: %s is too large", ErrInvalidBackup, name)
+		}
+		return b, true, nil
+	}
+
+	var manifest BackupManifest
+	b, ok, err := readFile("manifest.json")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: manifest.json is missing", ErrInvalidBackup)
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: manifest.json: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Format != backupFormat {
+		return nil, nil, fmt.Errorf("%w: format %q is not %q", ErrInvalidBackup, manifest.Format, backupFormat)
+	}
+	if manifest.Version != backupVersion {
+		return nil, nil, fmt.Errorf("%w: version %d is not supported (expected: %d)", ErrInvalidBackup, manifest.Version, backupVersion)
+	}
+
+	data := &backupData{}
+	for _, e := range data.entities() {
+		b, ok, err := readFile(e.name + ".json")
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			if e.name == "music" {
+				return nil, nil, fmt.Errorf("%w: music.json is missing", ErrInvalidBackup)
+			}
+			continue
+		}
+		if err := json.Unmarshal(b, e.value); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s.json: %v", ErrInvalidBackup, e.name, err)
+		}
+	}
+	for i := range data.Sheets {
+		s := &data.Sheets[i]
+		if s.File == "" {
+			return nil, nil, fmt.Errorf("%w: sheets.json: file is required", ErrInvalidBackup)
+		}
+		b, ok, err := readFile(s.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s is missing", ErrInvalidBackup, s.File)
+		}
+		s.sheet = string(b)
+	}
+	if err := data.validate(); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	return &manifest, data, nil
+}
+
+// validate checks the rows of an archive and that they only refer to archived music and genres.
+func (b *backupData) validate() error {
+	genres := make(map[string]bool)
+	for i := range b.Genres {
+		in := GenreInput{Slug: b.Genres[i].Slug, Names: b.Genres[i].Names}
+		if err := in.Validate(); err != nil {
+			return fmt.Errorf("genre %q: %v", b.Genres[i].Slug, err)
+		}
+		if genres[in.Slug] {
+			return fmt.Errorf("genre %s is archived twice", in.Slug)
+		}
+		b.Genres[i].Slug = in.Slug
+		genres[in.Slug] = true
+	}
+
+	music := make(map[int]bool)
+	for i := range b.Music {
+		m := &b.Music[i]
+		if m.ID <= 0 || music[m.ID] {
+			return fmt.Errorf("music id %d is invalid or archived twice", m.ID)
+		}
+		music[m.ID] = true
+		// Not MusicInput.Validate: music created before the catalog API may have no artist
+		m.Title = strings.TrimSpace(m.Title)
+		m.Artist = strings.TrimSpace(m.Artist)
+		if m.Title == "" {
+			return fmt.Errorf("music %d: title is required", m.ID)
+		}
+		if m.BaseDifficulty != nil && (*m.BaseDifficulty < 0 || *m.BaseDifficulty > maxBaseDifficulty) {
+			return fmt.Errorf("music %d: base_difficulty must be between 0 and %d", m.ID, maxBaseDifficulty)
+		}
+		if m.Genres == nil {
+			m.Genres = []string{}
+		}
+		for j, slug := range m.Genres {
+			m.Genres[j] = strings.ToUpper(strings.TrimSpace(slug))
+			if !genres[m.Genres[j]] {
+				return fmt.Errorf("music %d: genre %s is not archived", m.ID, slug)
+			}
+		}
+	}
+
+	checkMusic := func(entity string, musicID int) error {
+		if !music[musicID] {
+			return fmt.Errorf("%s: music id %d is not archived", entity, musicID)
+		}
+		return nil
+	}
+	type sheetKey struct {
+		musicID    int
+		part       SheetPart
+		difficulty int
+	}
+	sheets := make(map[sheetKey]bool)
+	for i := range b.Sheets {
+		s := &b.Sheets[i]
+		if err := checkMusic("sheets", s.MusicID); err != nil {
+			return err
+		}
+		in := SheetInput{Sheet: s.sheet, SheetPart: SheetPart{Instrument: s.Instrument, Part: s.Part}, Difficulty: s.Difficulty}
+		if s.Difficulty == 0 || strings.TrimSpace(s.Instrument) == "" {
+			return fmt.Errorf("%s: instrument and difficulty are required", s.File)
+		}
+		if err := in.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", s.File, err)
+		}
+		s.Instrument, s.Part = in.Instrument, in.Part
+		key := sheetKey{s.MusicID, in.SheetPart, s.Difficulty}
+		if sheets[key] {
+			return fmt.Errorf("sheet of music %d for %s %q with difficulty %d is archived twice", s.MusicID, s.Instrument, s.Part, s.Difficulty)
+		}
+		sheets[key] = true
+	}
+
+	users := make(map[int]bool)
+	usernames := make(map[string]bool)
+	for i := range b.Users {
+		u := &b.Users[i]
+		u.Username = strings.TrimSpace(u.Username)
+		if err := validateUsername(u.Username); err != nil {
+			return fmt.Errorf("user %d: %v", u.ID, err)
+		}
+		if u.ID <= 0 || users[u.ID] || usernames[strings.ToLower(u.Username)] {
+			return fmt.Errorf("user %d (%s) is invalid or archived twice", u.ID, u.Username)
+		}
+		users[u.ID] = true
+		usernames[strings.ToLower(u.Username)] = true
+	}
+	checkUser := func(entity string, userID int) error {
+		if !users[userID] {
+			return fmt.Errorf("%s: user id %d is not archived", entity, userID)
+		}
+		return nil
+	}
+
+	type userInstrument struct {
+		userID     int
+		instrument string
+	}
+	instruments := make(map[userInstrument]bool)
+	current := make(map[int]bool)
+	for i := range b.Instruments {
+		ui := &b.Instruments[i]
+		if err := checkUser("instruments", ui.UserID); err != nil {
+			return err
+		}
+		p := SheetPart{Instrument: ui.Instrument}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("instruments: %v", err)
+		}
+		key := userInstrument{ui.UserID, p.Instrument}
+		if p.Instrument == "" || instruments[key] {
+			return fmt.Errorf("instruments: instrument %q is empty or archived twice", ui.Instrument)
+		}
+		if ui.Current && (current[ui.UserID] || !ui.Selected) {
+			return errors.New("instruments: exactly one selected instrument of a user may be current")
+		}
+		ui.Instrument = p.Instrument
+		instruments[key] = true
+		current[ui.UserID] = current[ui.UserID] || ui.Current
+	}
+	for _, f := range b.Favorites {
+		if err := checkUser("favorites", f.UserID); err != nil {
+			return err
+		}
+		if err := checkMusic("favorites", f.MusicID); err != nil {
+			return err
+		}
+	}
+	for i := range b.DifficultySettings {
+		s := &b.DifficultySettings[i]
+		if err := checkUser("difficulty_settings", s.UserID); err != nil {
+			return err
+		}
+		if err := checkMusic("difficulty_settings", s.MusicID); err != nil {
+			return err
+		}
+		p := SheetPart{Instrument: s.Instrument}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("difficulty_settings: %v", err)
+		}
+		if s.Instrument = p.Instrument; s.Instrument == "" {
+			return errors.New("difficulty_settings: instrument is required")
+		}
+	}
+	for _, v := range b.ViewHistory {
+		if err := checkUser("view_history", v.UserID); err != nil {
+			return err
+		}
+		if err := checkMusic("view_history", v.MusicID); err != nil {
+			return err
+		}
+	}
+	for i := range b.PracticeProgress {
+		p := &b.PracticeProgress[i]
+		if err := checkUser("practice_progress", p.UserID); err != nil {
+			return err
+		}
+		if err := checkMusic("practice_progress", p.MusicID); err != nil {
+			return err
+		}
+		part := SheetPart{Instrument: p.Instrument, Part: p.Part}
+		if err := part.Validate(); err != nil {
+			return fmt.Errorf("practice_progress: %v", err)
+		}
+		if p.Instrument, p.Part = part.Instrument, part.Part; p.Instrument == "" {
+			return errors.New("practice_progress: instrument is required")
+		}
+	}
+	for _, q := range b.QueryHistory {
+		if err := checkUser("query_history", q.UserID); err != nil {
+			return err
+		}
+		if strings.TrimSpace(q.Query) == "" || q.Normalized == "" {
+			return errors.New("query_history: query and normalized are required")
+		}
+	}
+	for i := range b.ProficiencyHistory {
+		c := &b.ProficiencyHistory[i]
+		if err := checkUser("proficiency_history", c.UserID); err != nil {
+			return err
+		}
+		if c.MusicID != nil {
+			if err := checkMusic("proficiency_history", *c.MusicID); err != nil {
+				return err
+			}
+		}
+		p := SheetPart{Instrument: c.Instrument}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("proficiency_history: %v", err)
+		}
+		if c.Instrument = p.Instrument; c.Instrument == "" {
+			return errors.New("proficiency_history: instrument is required")
+		}
+		if !slices.Contains(proficiencySources, c.Source) {
+			return fmt.Errorf("proficiency_history: unknown source %q", c.Source)
+		}
+	}
+	return nil
+}
+
+func (m backupMusic) input() MusicInput {
+	return MusicInput{Title: m.Title, Artist: m.Artist, BaseDifficulty: m.BaseDifficulty, Genres: m.Genres, Thumbnail: m.Thumbnail, Reading: m.Reading}
+}
+
+// RestoreCount is the outcome of a restore for one entity.
+type RestoreCount struct {
+	Added    int `json:"added"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"` // Rows kept as they were in the database (merge mode)
+}
+
+// RestoreReport is the outcome of a restore.
+type RestoreReport struct {
+	Mode     RestoreMode              `json:"mode"`
+	DryRun   bool                     `json:"dry_run"`
+	Manifest BackupManifest           `json:"manifest"`
+	Counts   map[string]*RestoreCount `json:"counts"` // By entity, as in the manifest
+}
+
+// Print writes a summary of the restore, one line per entity.
+func (r *RestoreReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "backup of %s (version %d), mode %s\n", r.Manifest.CreatedAt.Format(time.RFC3339), r.Manifest.Version, r.Mode)
+	names := make([]string, 0, len(r.Counts))
+	for name := range r.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := r.Counts[name]
+		fmt.Fprintf(w, "%-20s %d added, %d replaced, %d skipped\n", name+":", c.Added, c.Replaced, c.Skipped)
+	}
+	if r.DryRun {
+		fmt.Fprintln(w, "dry run, nothing restored")
+	}
+}
+
+// restorer writes the rows of an archive within a transaction.
+type restorer struct {
+	tx      *sql.Tx
+	mode    RestoreMode
+	report  *RestoreReport
+	musicID map[int]int // Archived music ID -> music ID in the database
+	userID  map[int]int // Archived user ID -> user ID in the database
+}
+
+// put stores a row. insert and update take the same arguments, referred to as ?1, ?2...
+// When the row exists, it is updated in overwrite mode and kept otherwise.
+func (rs *restorer) put(entity string, exists bool, insert, update string, args ...any) error {
+	count := rs.report.Counts[entity]
+	switch {
+	case !exists:
+		if _, err := rs.tx.Exec(insert, args...); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entity, err)
+		}
+		count.Added++
+	case rs.mode == RestoreOverwrite:
+		if _, err := rs.tx.Exec(update, args...); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entity, err)
+		}
+		count.Replaced++
+	default:
+		count.Skipped++
+	}
+	return nil
+}
+
+// exists tells whether a query returns a row.
+func (rs *restorer) exists(query string, args ...any) (bool, error) {
+	var one int
+	err := rs.tx.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up existing rows: %w", err)
+	}
+	return true, nil
+}
+
+// RestoreBackup restores an archive written by ExportBackup. Nothing is written when the
+// archive is invalid or when dryRun is true.
+func RestoreBackup(db *sql.DB, archive []byte, mode RestoreMode, dryRun bool) (*RestoreReport, error) {
+	manifest, data, err := readBackupArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	report := &RestoreReport{Mode: mode, DryRun: dryRun, Manifest: *manifest, Counts: map[string]*RestoreCount{}}
+	for _, e := range data.entities() {
+		report.Counts[e.name] = &RestoreCount{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction for restore: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	rs := &restorer{tx: tx, mode: mode, report: report, musicID: make(map[int]int), userID: make(map[int]int)}
+	if mode == RestoreReplace {
+		if err := rs.clear(); err != nil {
+			return nil, err
+		}
+	}
+	steps := []func(*backupData) error{
+		rs.restoreGenres, rs.restoreMusic, rs.restoreSheets, rs.restoreUsers, rs.restoreUserData,
+	}
+	for _, step := range steps {
+		if err := step(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit restore: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Restored a backup of %s in %s mode (%d music)", manifest.CreatedAt.Format(time.RFC3339), mode, len(data.Music))
+	refreshSuggestions(db)
+	return report, nil
+}
+
+// clear deletes the catalog, the accounts and every user data before a restore in replace mode,
+// which logs every user out and disconnects their Spotify accounts. The thumbnail cache is kept,
+// as it only depends on the image URLs.
+func (rs *restorer) clear() error {
+	tables := []string{
+		"Favorites", "UserMusicDifficultySettings", "ViewHistory", "QueryHistory", "PracticeProgress", "ProficiencyHistory", "UserInstruments",
+		"UserTokens", "SpotifyLogins", "SpotifyTokens", "Users",
+		"MusicGenres", "GenreNames", "Genres", "MusicSearch", "Sheets", "Music",
+	}
+	for _, table := range tables {
+		if _, err := rs.tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (rs *restorer) restoreGenres(data *backupData) error {
+	count := rs.report.Counts["genres"]
+	for _, g := range data.Genres {
+		exists, err := rs.exists("SELECT 1 FROM Genres WHERE slug = ?", g.Slug)
+		if err != nil {
+			return err
+		}
+		// Existing genres gain the archived names they lack, and take them over in overwrite mode
+		id, err := insertGenre(rs.tx, GenreInput{Slug: g.Slug, Names: g.Names}, true)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !exists:
+			count.Added++
+		case rs.mode == RestoreOverwrite:
+			for locale, name := range g.Names {
+				if _, err := rs.tx.Exec("UPDATE GenreNames SET name = ? WHERE genre_id = ? AND locale = ?", name, id, locale); err != nil {
+					return fmt.Errorf("failed to restore name of genre %s: %w", g.Slug, err)
+				}
+			}
+			count.Replaced++
+		default:
+			count.Skipped++
+		}
+	}
+	return nil
+}
+
+func (rs *restorer) restoreMusic(data *backupData) error {
+	count := rs.report.Counts["music"]
+	for _, m := range data.Music {
+		in := m.input()
+		var id int
+		err := rs.tx.QueryRow("SELECT id FROM Music WHERE title = ? COLLATE NOCASE AND COALESCE(artist, '') = ? COLLATE NOCASE ORDER BY id LIMIT 1",
+			in.Title, in.Artist).Scan(&id)
+		switch {
+		case err == nil && rs.mode == RestoreOverwrite:
+			if err := updateMusic(rs.tx, id, in); err != nil {
+				return err
+			}
+			count.Replaced++
+		case err == nil:
+			count.Skipped++
+		case err == sql.ErrNoRows:
+			if id, err = rs.insertMusic(m.ID, in); err != nil {
+				return err
+			}
+			count.Added++
+		default:
+			return fmt.Errorf("failed to look up music %s / %s: %w", in.Title, in.Artist, err)
+		}
+		rs.musicID[m.ID] = id
+	}
+	return nil
+}
+
+// insertMusic inserts an archived music, keeping its archived ID unless another music already has it.
+func (rs *restorer) insertMusic(archivedID int, in MusicInput) (int, error) {
+	taken, err := rs.exists("SELECT 1 FROM Music WHERE id = ?", archivedID)
+	if err != nil {
+		return 0, err
+	}
+	var id any
+	if !taken {
+		id = archivedID
+	}
+	res, err := rs.tx.Exec("INSERT INTO Music (id, title, artist, base_difficulty, thumbnail, reading) VALUES (?, ?, ?, ?, ?, ?)",
+		id, in.Title, in.Artist, in.BaseDifficulty, in.Thumbnail, in.Reading)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore music %s / %s: %w", in.Title, in.Artist, err)
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get restored music id: %w", err)
+	}
+	genreIDs, err := resolveGenreIDs(rs.tx, in.Genres)
+	if err != nil {
+		return 0, err
+	}
+	if err := setMusicGenres(rs.tx, int(newID), genreIDs); err != nil {
+		return 0, err
+	}
+	if err := registerImage(rs.tx, in.Thumbnail); err != nil {
+		return 0, err
+	}
+	if err := indexMusic(rs.tx, int(newID)); err != nil {
+		return 0, err
+	}
+	return int(newID), nil
+}
+
+func (rs *restorer) restoreSheets(data *backupData) error {
+	for _, s := range data.Sheets {
+		musicID := rs.musicID[s.MusicID]
+		exists, err := rs.exists("SELECT 1 FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ?",
+			musicID, s.Instrument, s.Part, s.Difficulty)
+		if err != nil {
+			return err
+		}
+		err = rs.put("sheets", exists,
+			"INSERT INTO Sheets (music_id, instrument, part, difficulty, sheet, generated) VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+			"UPDATE Sheets SET sheet = ?5, generated = ?6 WHERE music_id = ?1 AND instrument = ?2 AND part = ?3 AND difficulty = ?4",
+			musicID, s.Instrument, s.Part, s.Difficulty, s.sheet, s.Generated)
+		if err != nil {
+			return err
+		}
+	}
+	// Every restored music, including those whose sheets were all kept
+	for _, musicID := range rs.musicID {
+		if err := refreshMusicMetadata(rs.tx, musicID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreUsers restores the accounts, matched by username, and makes sure the default account
+// exists. Passwords are taken over in overwrite mode.
+func (rs *restorer) restoreUsers(data *backupData) error {
+	for _, u := range data.Users {
+		exists, err := rs.exists("SELECT 1 FROM Users WHERE username = ?", u.Username)
+		if err != nil {
+			return err
+		}
+		var id any
+		if !exists {
+			// Keep the archived ID unless another user already has it
+			taken, err := rs.exists("SELECT 1 FROM Users WHERE id = ?", u.ID)
+			if err != nil {
+				return err
+			}
+			if !taken {
+				id = u.ID
+			}
+		}
+		err = rs.put("users", exists,
+			"INSERT INTO Users (id, username, password_hash, created_at) VALUES (?1, ?2, ?3, ?4)",
+			"UPDATE Users SET password_hash = ?3 WHERE username = ?2",
+			id, u.Username, u.PasswordHash, u.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if rs.userID[u.ID], err = rs.lookupUser(u.Username); err != nil {
+			return err
+		}
+	}
+
+	_, err := rs.tx.Exec(`
+		INSERT INTO Users (id, username, created_at)
+		SELECT CASE WHEN EXISTS (SELECT 1 FROM Users WHERE id = ?3) THEN NULL ELSE ?3 END, ?1, ?2
+		WHERE NOT EXISTS (SELECT 1 FROM Users WHERE username = ?1)`,
+		defaultUsername, time.Now().UTC(), defaultUserID)
+	if err != nil {
+		return fmt.Errorf("failed to restore the default account: %w", err)
+	}
+	return nil
+}
+
+func (rs *restorer) lookupUser(username string) (int, error) {
+	var id int
+	if err := rs.tx.QueryRow("SELECT id FROM Users WHERE username = ?", username).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to look up restored user %s: %w", username, err)
+	}
+	return id, nil
+}
+
+// restoreUserData restores the instruments, favorites, difficulty settings, histories, practice progress
+// and proficiency history.
+func (rs *restorer) restoreUserData(data *backupData) error {
+	if err := rs.restoreInstruments(data); err != nil {
+		return err
+	}
+
+	for _, f := range data.Favorites {
+		userID, musicID := rs.userID[f.UserID], rs.musicID[f.MusicID]
+		exists, err := rs.exists("SELECT 1 FROM Favorites WHERE user_id = ? AND music_id = ?", userID, musicID)
+		if err != nil {
+			return err
+		}
+		err = rs.put("favorites", exists,
+			"INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?1, ?2, ?3)",
+			"UPDATE Favorites SET order_key = ?3 WHERE user_id = ?1 AND music_id = ?2",
+			userID, musicID, f.OrderKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range data.DifficultySettings {
+		userID, musicID := rs.userID[s.UserID], rs.musicID[s.MusicID]
+		exists, err := rs.exists("SELECT 1 FROM UserMusicDifficultySettings WHERE user_id = ? AND music_id = ? AND instrument = ? AND measure = ?",
+			userID, musicID, s.Instrument, s.Measure)
+		if err != nil {
+			return err
+		}
+		err = rs.put("difficulty_settings", exists,
+			"INSERT INTO UserMusicDifficultySettings (user_id, music_id, instrument, measure, difficulty) VALUES (?1, ?2, ?3, ?4, ?5)",
+			"UPDATE UserMusicDifficultySettings SET difficulty = ?5 WHERE user_id = ?1 AND music_id = ?2 AND instrument = ?3 AND measure = ?4",
+			userID, musicID, s.Instrument, s.Measure, s.Difficulty)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, q := range data.QueryHistory {
+		userID := rs.userID[q.UserID]
+		exists, err := rs.exists("SELECT 1 FROM QueryHistory WHERE user_id = ? AND normalized = ?", userID, q.Normalized)
+		if err != nil {
+			return err
+		}
+		err = rs.put("query_history", exists,
+			"INSERT INTO QueryHistory (user_id, query, normalized, searched_at) VALUES (?4, ?1, ?2, ?3)",
+			"UPDATE QueryHistory SET query = ?1, searched_at = ?3 WHERE user_id = ?4 AND normalized = ?2",
+			q.Query, q.Normalized, q.SearchedAt, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range data.ViewHistory {
+		userID, musicID := rs.userID[v.UserID], rs.musicID[v.MusicID]
+		exists, err := rs.exists("SELECT 1 FROM ViewHistory WHERE user_id = ? AND music_id = ?", userID, musicID)
+		if err != nil {
+			return err
+		}
+		err = rs.put("view_history", exists,
+			"INSERT INTO ViewHistory (user_id, music_id, viewed_at) VALUES (?3, ?1, ?2)",
+			"UPDATE ViewHistory SET viewed_at = ?2 WHERE user_id = ?3 AND music_id = ?1",
+			musicID, v.ViewedAt, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range data.PracticeProgress {
+		userID, musicID := rs.userID[p.UserID], rs.musicID[p.MusicID]
+		exists, err := rs.exists("SELECT 1 FROM PracticeProgress WHERE user_id = ? AND music_id = ? AND instrument = ? AND part = ?",
+			userID, musicID, p.Instrument, p.Part)
+		if err != nil {
+			return err
+		}
+		err = rs.put("practice_progress", exists,
+			`INSERT INTO PracticeProgress (user_id, music_id, instrument, part, difficulty, last_measure, position, measure_count, practiced_at)
+			VALUES (?7, ?1, ?8, ?9, ?2, ?3, ?4, ?5, ?6)`,
+			`UPDATE PracticeProgress SET difficulty = ?2, last_measure = ?3, position = ?4, measure_count = ?5, practiced_at = ?6
+			WHERE user_id = ?7 AND music_id = ?1 AND instrument = ?8 AND part = ?9`,
+			musicID, p.Difficulty, p.LastMeasure, p.Position, p.MeasureCount, p.PracticedAt, userID, p.Instrument, p.Part)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A change is identified by its user, instrument, source and time
+	for _, c := range data.ProficiencyHistory {
+		userID := rs.userID[c.UserID]
+		var musicID *int
+		if c.MusicID != nil {
+			id := rs.musicID[*c.MusicID]
+			musicID = &id
+		}
+		exists, err := rs.exists("SELECT 1 FROM ProficiencyHistory WHERE user_id = ? AND instrument = ? AND source = ? AND recorded_at = ?",
+			userID, c.Instrument, c.Source, c.RecordedAt)
+		if err != nil {
+			return err
+		}
+		err = rs.put("proficiency_history", exists,
+			`INSERT INTO ProficiencyHistory (user_id, instrument, source, recorded_at, proficiency, previous, music_id, measure, difficulty)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`,
+			`UPDATE ProficiencyHistory SET proficiency = ?5, previous = ?6, music_id = ?7, measure = ?8, difficulty = ?9
+			WHERE user_id = ?1 AND instrument = ?2 AND source = ?3 AND recorded_at = ?4`,
+			userID, c.Instrument, c.Source, c.RecordedAt, c.Proficiency, c.Previous, musicID, c.Measure, c.Difficulty)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreInstruments restores the instruments with their proficiency. The current instrument is
+// taken over in overwrite and replace modes; every user is left with a current instrument.
+func (rs *restorer) restoreInstruments(data *backupData) error {
+	current := make(map[int]string) // User ID in the database -> current instrument
+	for _, ui := range data.Instruments {
+		userID := rs.userID[ui.UserID]
+		exists, err := rs.exists("SELECT 1 FROM UserInstruments WHERE user_id = ? AND instrument = ?", userID, ui.Instrument)
+		if err != nil {
+			return err
+		}
+		err = rs.put("instruments", exists,
+			"INSERT INTO UserInstruments (user_id, instrument, proficiency, selected, current) VALUES (?4, ?1, ?2, ?3, 0)",
+			"UPDATE UserInstruments SET proficiency = ?2, selected = ?3 WHERE user_id = ?4 AND instrument = ?1",
+			ui.Instrument, ui.Proficiency, ui.Selected, userID)
+		if err != nil {
+			return err
+		}
+		if ui.Current {
+			current[userID] = ui.Instrument
+		}
+	}
+	if rs.mode != RestoreMerge {
+		for userID, instrument := range current {
+			// In two steps, as the unique index on current is checked row by row
+			_, err := rs.tx.Exec("UPDATE UserInstruments SET current = 0 WHERE user_id = ?", userID)
+			if err == nil {
+				_, err = rs.tx.Exec("UPDATE UserInstruments SET current = 1 WHERE user_id = ? AND instrument = ?", userID, instrument)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to restore current instrument of user %d: %w", userID, err)
+			}
+		}
+	}
+	// E.g. after a replace with an archive without instruments
+	_, err := rs.tx.Exec(`
+		INSERT INTO UserInstruments (user_id, instrument, selected, current)
+		SELECT u.id, ?, 1, 1 FROM Users u WHERE NOT EXISTS (SELECT 1 FROM UserInstruments WHERE user_id = u.id AND current = 1)
+		ON CONFLICT (user_id, instrument) DO UPDATE SET selected = 1, current = 1`, defaultInstrument)
+	if err != nil {
+		return fmt.Errorf("failed to restore current instrument: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// userRows lists the user-scoped rows of a database by username and music title, which are kept
+// across a restore when the IDs are not.
+func userRows(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT 'favorite ' || u.username || ' ' || m.title FROM Favorites f
+			JOIN Users u ON u.id = f.user_id JOIN Music m ON m.id = f.music_id
+		UNION ALL SELECT 'view ' || u.username || ' ' || m.title FROM ViewHistory v
+			JOIN Users u ON u.id = v.user_id JOIN Music m ON m.id = v.music_id
+		UNION ALL SELECT 'query ' || u.username || ' ' || q.query FROM QueryHistory q
+			JOIN Users u ON u.id = q.user_id
+		UNION ALL SELECT 'progress ' || u.username || ' ' || m.title || ' ' || p.instrument || ' ' || p.last_measure FROM PracticeProgress p
+			JOIN Users u ON u.id = p.user_id JOIN Music m ON m.id = p.music_id
+		UNION ALL SELECT 'instrument ' || u.username || ' ' || i.instrument || ' ' || i.proficiency || ' ' || i.current FROM UserInstruments i
+			JOIN Users u ON u.id = i.user_id
+		UNION ALL SELECT 'proficiency ' || u.username || ' ' || c.instrument || ' ' || c.proficiency || ' ' || COALESCE(m.title, '') FROM ProficiencyHistory c
+			JOIN Users u ON u.id = c.user_id LEFT JOIN Music m ON m.id = c.music_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := []string{}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	return got
+}
+
+func musicIDs(t *testing.T, db *sql.DB) map[string]int {
+	t.Helper()
+	rows, err := db.Query("SELECT id, title FROM Music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ids := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var title string
+		if err := rows.Scan(&id, &title); err != nil {
+			t.Fatal(err)
+		}
+		ids[title] = id
+	}
+	return ids
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := openTestDB(t)
+	alpha := insertTestMusic(t, src, "Alpha")
+	beta := insertTestMusic(t, src, "Beta")
+	alice := mustCreateUser(t, src, "alice", "correct horse")
+	now := time.Now().UTC()
+	for _, cmd := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?, ?, 1)", []any{defaultUserID, alpha}},
+		{"INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?, ?, 1)", []any{alice.ID, beta}},
+		{"INSERT INTO ViewHistory (user_id, music_id, viewed_at) VALUES (?, ?, ?)", []any{alice.ID, alpha, now}},
+		{"INSERT INTO QueryHistory (user_id, query, normalized, searched_at) VALUES (?, 'Beta', 'beta', ?)", []any{alice.ID, now}},
+		{`INSERT INTO PracticeProgress (user_id, music_id, instrument, part, difficulty, last_measure, position, measure_count, practiced_at)
+			VALUES (?, ?, 'guitar', '', 1, 4, 0, 8, ?)`, []any{alice.ID, beta, now}},
+		{"UPDATE UserInstruments SET proficiency = 0.5 WHERE user_id = ?", []any{alice.ID}},
+		{`INSERT INTO ProficiencyHistory (user_id, instrument, proficiency, previous, source, music_id, measure, difficulty, recorded_at)
+			VALUES (?, 'guitar', 0.5, 0.0, ?, ?, 4, 1, ?)`, []any{alice.ID, proficiencySourceMeasure, beta, now}},
+	} {
+		if _, err := src.Exec(cmd.query, cmd.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantRows := userRows(t, src)
+
+	var archive bytes.Buffer
+	manifest, err := ExportBackup(src, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != backupVersion || manifest.Counts["music"] != 2 || manifest.Counts["users"] != 2 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+
+	for _, mode := range []RestoreMode{RestoreMerge, RestoreOverwrite, RestoreReplace} {
+		t.Run(string(mode), func(t *testing.T) {
+			// The IDs of the archive are taken by other music and another user
+			dst := openTestDB(t)
+			insertTestMusic(t, dst, "Other 1")
+			insertTestMusic(t, dst, "Other 2")
+			mustCreateUser(t, dst, "carol", "")
+
+			report, err := RestoreBackup(dst, archive.Bytes(), mode, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := report.Counts["music"]; c.Added != 2 {
+				t.Errorf("music: %+v, want 2 added", c)
+			}
+
+			ids := musicIDs(t, dst)
+			got := userRows(t, dst)
+			if mode == RestoreReplace {
+				if len(ids) != 2 || ids["Alpha"] != alpha || ids["Beta"] != beta {
+					t.Errorf("music = %v, want the archived IDs", ids)
+				}
+				if !slices.Equal(got, wantRows) {
+					t.Errorf("rows = %v, want %v", got, wantRows)
+				}
+				return
+			}
+			if len(ids) != 4 || ids["Alpha"] == alpha || ids["Beta"] == beta {
+				t.Errorf("music = %v, want Alpha and Beta remapped", ids)
+			}
+			var aliceID int
+			if err := dst.QueryRow("SELECT id FROM Users WHERE username = 'alice'").Scan(&aliceID); err != nil {
+				t.Fatal(err)
+			}
+			if aliceID == alice.ID {
+				t.Errorf("alice kept id %d, taken by carol", aliceID)
+			}
+			// carol keeps the default instrument
+			want := slices.Concat(wantRows, []string{"instrument carol guitar 0.0 1"})
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("rows = %v, want %v", got, want)
+			}
+
+			// Restoring again only finds rows that exist
+			report, err = RestoreBackup(dst, archive.Bytes(), mode, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, c := range report.Counts {
+				if c.Added != 0 {
+					t.Errorf("%s: %+v after a second restore, want nothing added", name, c)
+				}
+			}
+			if got := userRows(t, dst); !slices.Equal(got, want) {
+				t.Errorf("rows after a second restore = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRestoreBackupRefusesOtherVersions(t *testing.T) {
+	src := openTestDB(t)
+	insertTestMusic(t, src, "Alpha")
+	var archive bytes.Buffer
+	if _, err := ExportBackup(src, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same archive with a version 4 manifest
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old bytes.Buffer
+	zw := zip.NewWriter(&old)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "manifest.json" {
+			var m BackupManifest
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+			m.Version = 4
+			if b, err = json.Marshal(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := openTestDB(t)
+	if _, err := RestoreBackup(dst, old.Bytes(), RestoreMerge, false); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("RestoreBackup(version 4) = %v, want ErrInvalidBackup", err)
+	}
+	if ids := musicIDs(t, dst); len(ids) != 0 {
+		t.Errorf("music = %v, want nothing restored", ids)
+	}
+}
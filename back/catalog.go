@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"infosystem-musicapp/musicxml"
+)
+
+const (
+	// accompanimentDifficulty is the Sheets.difficulty value reserved for the accompaniment track.
+	accompanimentDifficulty = -1
+	// minSheetDifficulty and maxSheetDifficulty bound the playable sheet difficulties.
+	minSheetDifficulty = 1
+	maxSheetDifficulty = 5
+	// maxBaseDifficulty is the upper bound of Music.base_difficulty (same scale as the proficiency).
+	maxBaseDifficulty = 10
+)
+
+var (
+	ErrMusicNotFound = errors.New("music not found")
+	ErrSheetNotFound = errors.New("sheet not found")
+	ErrSheetExists   = errors.New("a sheet with this difficulty already exists for this part")
+)
+
+// MusicInput is the request body for creating or updating a Music row.
+// BaseDifficulty may be omitted: it is then estimated from the sheets when the first one is added,
+// and left unchanged on update. Genres are given by slug or localized name; the single Genre
+// field is still accepted and becomes the primary genre. Omitting both keeps the genres on update.
+type MusicInput struct {
+	Title          string   `json:"title"`
+	Artist         string   `json:"artist"`
+	BaseDifficulty *int     `json:"base_difficulty"`
+	Genre          string   `json:"genre"`
+	Genres         []string `json:"genres"`
+	Thumbnail      string   `json:"thumbnail"`
+	Reading        string   `json:"reading"` // Kana reading of the title for search, e.g. "しんじだい" for 新時代
+}
+
+// Validate trims the text fields and checks that every field holds an acceptable value.
+func (in *MusicInput) Validate() error {
+	in.Title = strings.TrimSpace(in.Title)
+	in.Artist = strings.TrimSpace(in.Artist)
+	in.Genre = strings.TrimSpace(in.Genre)
+	if in.Genre != "" && !slices.Contains(in.Genres, in.Genre) {
+		in.Genres = append([]string{in.Genre}, in.Genres...)
+	}
+	for i, g := range in.Genres {
+		if in.Genres[i] = strings.TrimSpace(g); in.Genres[i] == "" {
+			return errors.New("genres must not be empty")
+		}
+	}
+	in.Thumbnail = strings.TrimSpace(in.Thumbnail)
+	in.Reading = strings.TrimSpace(in.Reading)
+
+	if in.Title == "" {
+		return errors.New("title is required")
+	}
+	if in.Artist == "" {
+		return errors.New("artist is required")
+	}
+	if in.BaseDifficulty != nil && (*in.BaseDifficulty < 0 || *in.BaseDifficulty > maxBaseDifficulty) {
+		return fmt.Errorf("base_difficulty must be between 0 and %d", maxBaseDifficulty)
+	}
+	return nil
+}
+
+// SheetInput is the request body for adding a sheet to a Music row.
+// A difficulty of 0 (or omitted) lets the server assign the estimated difficulty, and an
+// omitted instrument is read from the MusicXML (defaultInstrument if it does not tell).
+type SheetInput struct {
+	Difficulty int    `json:"difficulty"`
+	Sheet      string `json:"sheet"`
+	SheetPart
+}
+
+// Validate checks the sheet difficulty and part, and that the sheet body is not empty.
+func (in *SheetInput) Validate() error {
+	if err := in.SheetPart.Validate(); err != nil {
+		return err
+	}
+	if in.Difficulty != 0 && !isValidSheetDifficulty(in.Difficulty) {
+		return fmt.Errorf("difficulty must be %d (accompaniment) or between %d and %d", accompanimentDifficulty, minSheetDifficulty, maxSheetDifficulty)
+	}
+	if strings.TrimSpace(in.Sheet) == "" {
+		return errors.New("sheet is required")
+	}
+	return nil
+}
+
+// Analyze parses the sheet and estimates its difficulty,
+// filling in Difficulty and Instrument when they were left to the server.
+func (in *SheetInput) Analyze() (musicxml.Analysis, error) {
+	score, err := musicxml.ParseString(in.Sheet)
+	if err != nil {
+		return musicxml.Analysis{}, err
+	}
+	a := musicxml.Analyze(score)
+	if in.Difficulty == 0 {
+		in.Difficulty = suggestedSheetDifficulty(a)
+	}
+	if in.Instrument == "" {
+		in.Instrument = scoreInstrument(score)
+	}
+	return a, nil
+}
+
+func isValidSheetDifficulty(difficulty int) bool {
+	return difficulty == accompanimentDifficulty || (difficulty >= minSheetDifficulty && difficulty <= maxSheetDifficulty)
+}
+
+// CreateMusic inserts a new Music row with its genres and returns its ID.
+// The input must already have been validated.
+func CreateMusic(db *sql.DB, in MusicInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for creating music: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	id, err := insertMusic(tx, in)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit music creation: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Created music_id %d (%s / %s)", id, in.Title, in.Artist)
+	refreshSuggestions(db)
+	return id, nil
+}
+
+// insertMusic inserts a Music row with its genres, thumbnail and search index entry within tx.
+func insertMusic(tx *sql.Tx, in MusicInput) (int, error) {
+	genreIDs, err := resolveGenreIDs(tx, in.Genres)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO Music (title, artist, base_difficulty, thumbnail, reading) VALUES (?, ?, ?, ?, ?)",
+		in.Title, in.Artist, in.BaseDifficulty, in.Thumbnail, in.Reading)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert music: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get inserted music id: %w", err)
+	}
+	if err := setMusicGenres(tx, int(id), genreIDs); err != nil {
+		return 0, err
+	}
+	if err := registerImage(tx, in.Thumbnail); err != nil {
+		return 0, err
+	}
+	if err := indexMusic(tx, int(id)); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// UpdateMusic overwrites the metadata of an existing Music row, and its genres when given.
+// The input must already have been validated.
+func UpdateMusic(db *sql.DB, musicID int, in MusicInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for updating music: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	if err := updateMusic(tx, musicID, in); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit music update: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Updated music_id %d", musicID)
+	refreshSuggestions(db)
+	return nil
+}
+
+// updateMusic overwrites a Music row, its genres when given, its thumbnail and its search index entry within tx.
+func updateMusic(tx *sql.Tx, musicID int, in MusicInput) error {
+	res, err := tx.Exec("UPDATE Music SET title = ?, artist = ?, base_difficulty = COALESCE(?, base_difficulty), thumbnail = ?, reading = ? WHERE id = ?",
+		in.Title, in.Artist, in.BaseDifficulty, in.Thumbnail, in.Reading, musicID)
+	if err != nil {
+		return fmt.Errorf("failed to update music_id %d: %w", musicID, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check updated rows for music_id %d: %w", musicID, err)
+	}
+	if n == 0 {
+		return ErrMusicNotFound
+	}
+	if in.Genres != nil {
+		genreIDs, err := resolveGenreIDs(tx, in.Genres)
+		if err != nil {
+			return err
+		}
+		if err := setMusicGenres(tx, musicID, genreIDs); err != nil {
+			return err
+		}
+	}
+	if err := indexMusic(tx, musicID); err != nil {
+		return err
+	}
+	return registerImage(tx, in.Thumbnail)
+}
+
+// DeleteMusic removes a Music row together with its sheets and every row that references it
+// (favorites, per-measure difficulty settings, view history, practice progress, genre tags and the search index entry)
+// in a single transaction. The proficiency history keeps its changes without the music.
+func DeleteMusic(db *sql.DB, musicID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for deleting music: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	dependents := []string{
+		"DELETE FROM Favorites WHERE music_id = ?",
+		"DELETE FROM UserMusicDifficultySettings WHERE music_id = ?",
+		"DELETE FROM ViewHistory WHERE music_id = ?",
+		"DELETE FROM PracticeProgress WHERE music_id = ?",
+		"UPDATE ProficiencyHistory SET music_id = NULL WHERE music_id = ?", // The progress of the users is kept
+		"DELETE FROM MusicGenres WHERE music_id = ?",
+		"DELETE FROM MusicSearch WHERE rowid = ?",
+		"DELETE FROM Sheets WHERE music_id = ?",
+	}
+	for _, stmt := range dependents {
+		if _, err := tx.Exec(stmt, musicID); err != nil {
+			return fmt.Errorf("failed to delete rows referencing music_id %d (%s): %w", musicID, stmt, err)
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM Music WHERE id = ?", musicID)
+	if err != nil {
+		return fmt.Errorf("failed to delete music_id %d: %w", musicID, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check deleted rows for music_id %d: %w", musicID, err)
+	}
+	if n == 0 {
+		return ErrMusicNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit music deletion: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Deleted music_id %d", musicID)
+	refreshSuggestions(db)
+	return nil
+}
+
+// AddSheet stores a new sheet for an existing Music row and returns the sheet ID.
+// Each part of a music can hold at most one sheet per difficulty; a generated sheet of the
+// same difficulty is replaced by the hand-made one. The input must already have been analyzed.
+func AddSheet(db *sql.DB, musicID int, in SheetInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for adding sheet: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Music WHERE id = ?", musicID).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check music_id %d: %w", musicID, err)
+	}
+	if exists == 0 {
+		return 0, ErrMusicNotFound
+	}
+
+	var duplicates int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ? AND generated = 0",
+		musicID, in.Instrument, in.Part, in.Difficulty).Scan(&duplicates); err != nil {
+		return 0, fmt.Errorf("failed to check existing sheets for music_id %d: %w", musicID, err)
+	}
+	if duplicates > 0 {
+		return 0, ErrSheetExists
+	}
+	if _, err := tx.Exec("DELETE FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ? AND generated = 1",
+		musicID, in.Instrument, in.Part, in.Difficulty); err != nil {
+		return 0, fmt.Errorf("failed to replace generated sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+	}
+
+	res, err := tx.Exec("INSERT INTO Sheets (music_id, instrument, part, difficulty, sheet) VALUES (?, ?, ?, ?, ?)",
+		musicID, in.Instrument, in.Part, in.Difficulty, in.Sheet)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get inserted sheet id: %w", err)
+	}
+	if err := refreshMusicMetadata(tx, musicID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit sheet insertion: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Added sheet %d (music_id: %d, instrument: %s, part: %q, difficulty: %d)", id, musicID, in.Instrument, in.Part, in.Difficulty)
+	return int(id), nil
+}
+
+// DeleteSheet removes the sheet of the given part and difficulty from a Music row.
+func DeleteSheet(db *sql.DB, musicID int, part SheetPart, difficulty int) error {
+	part, err := resolveSheetPart(db, musicID, part)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("DELETE FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ?",
+		musicID, part.Instrument, part.Part, difficulty)
+	if err != nil {
+		return fmt.Errorf("failed to delete sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check deleted sheets for music_id %d: %w", musicID, err)
+	}
+	if n == 0 {
+		return ErrSheetNotFound
+	}
+	log.Printf("Deleted sheet (music_id: %d, instrument: %s, part: %q, difficulty: %d)", musicID, part.Instrument, part.Part, difficulty)
+	return refreshMusicMetadata(db, musicID)
+}
+
+// GetSheet returns the MusicXML of the sheet of the given part (see SheetPart) and difficulty.
+func GetSheet(db *sql.DB, musicID int, part SheetPart, difficulty int) (string, error) {
+	part, err := resolveSheetPart(db, musicID, part)
+	if err != nil {
+		return "", err
+	}
+	var sheet string
+	err = db.QueryRow("SELECT sheet FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ?",
+		musicID, part.Instrument, part.Part, difficulty).Scan(&sheet)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrSheetNotFound
+		}
+		return "", fmt.Errorf("failed to query sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	return sheet, nil
+}
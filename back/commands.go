@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand runs a maintenance subcommand of the backend binary.
+//
+//	back recompute-difficulty [-dry-run]   re-rate base_difficulty of the whole catalog from its sheets
+//	back cache-images                      download every thumbnail not cached yet, for offline use
+//	back import [-dry-run] <dir>           import the songs of a manifest and MusicXML directory
+//	back export <file.zip>                 write a backup archive of the whole database
+//	back restore [-mode=merge|overwrite|replace] [-dry-run] <file.zip>
+//	                                       restore a backup archive (see backup.go for the modes)
+//	back migrate status                    list the schema migrations and which are applied
+//	back migrate up [-to=N]                apply the pending migrations (up to version N)
+//	back migrate down [-to=N]              roll back the latest migration (or every one above version N)
+//	back user list                         list the accounts
+//	back user add <username>               create an account; its password is read from stdin (empty: none)
+//	back user password <username>          set the password of an account from stdin (empty: none)
+//	back user token [-name=cli] <username> print a new API token of an account
+func runCommand(db *sql.DB, name string, args []string) error {
+	switch name {
+	case "recompute-difficulty":
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only report the changes without writing them")
+		fs.Parse(args)
+		return RecomputeCatalogDifficulty(db, *dryRun, os.Stdout)
+	case "cache-images":
+		return CacheAllImages(db, os.Stdout)
+	case "import":
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only report what would be imported without writing it")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s import [-dry-run] <dir>", os.Args[0])
+		}
+		return ImportCatalog(db, fs.Arg(0), *dryRun, os.Stdout)
+	case "export":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s export <file.zip>", os.Args[0])
+		}
+		return exportBackupFile(db, args[0], os.Stdout)
+	case "restore":
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		modeFlag := fs.String("mode", string(RestoreMerge), "how to handle rows that already exist: merge, overwrite or replace")
+		dryRun := fs.Bool("dry-run", false, "only report what would be restored without writing it")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s restore [-mode=merge|overwrite|replace] [-dry-run] <file.zip>", os.Args[0])
+		}
+		mode, err := ParseRestoreMode(*modeFlag)
+		if err != nil {
+			return err
+		}
+		archive, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		report, err := RestoreBackup(db, archive, mode, *dryRun)
+		if err != nil {
+			return err
+		}
+		report.Print(os.Stdout)
+		return nil
+	case "migrate":
+		return runMigrateCommand(db, args)
+	case "user":
+		return runUserCommand(db, args, os.Stdin, os.Stdout)
+	}
+	return fmt.Errorf("unknown command: %s", name)
+}
+
+// runMigrateCommand runs "back migrate status|up|down".
+func runMigrateCommand(db *sql.DB, args []string) error {
+	usage := fmt.Errorf("usage: %s migrate status | up [-to=N] | down [-to=N]", os.Args[0])
+	if len(args) == 0 {
+		return usage
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := fs.Int("to", -1, "target schema version")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "status":
+		return PrintMigrationStatus(db, os.Stdout)
+	case "up":
+		if *to < 0 {
+			*to = latestSchemaVersion()
+		}
+		return MigrateUp(db, *to, os.Stdout)
+	case "down":
+		if *to < 0 {
+			_, current, err := schemaStatus(db)
+			if err != nil {
+				return err
+			}
+			*to = max(current-1, 0)
+		}
+		return MigrateDown(db, *to, os.Stdout)
+	}
+	return usage
+}
+
+// runUserCommand runs "back user list|add|password|token". Passwords are read from the first
+// line of stdin, so that they do not show in the shell history.
+func runUserCommand(db *sql.DB, args []string, stdin io.Reader, w io.Writer) error {
+	usage := fmt.Errorf("usage: %s user list | add <username> | password <username> | token [-name=cli] <username>", os.Args[0])
+	if len(args) == 0 {
+		return usage
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	name := fs.String("name", "cli", "name of the API token")
+	fs.Parse(args[1:])
+	if args[0] == "list" {
+		if fs.NArg() != 0 {
+			return usage
+		}
+		users, err := ListUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Fprintf(w, "%4d  %-32s  created %s\n", u.ID, u.Username, u.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return usage
+	}
+	readPassword := func() (string, error) {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read the password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	switch args[0] {
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		user, err := CreateUser(db, fs.Arg(0), password)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "created user %d (%s)\n", user.ID, user.Username)
+		return nil
+	case "password":
+		user, err := GetUserByName(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := SetPassword(db, user.ID, password); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "password of %s updated\n", user.Username)
+		return nil
+	case "token":
+		user, err := GetUserByName(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		token, _, err := IssueToken(db, user.ID, tokenKindAPI, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, token)
+		return nil
+	}
+	return usage
+}
+
+// exportBackupFile writes a backup archive to path, replacing it only once the archive is complete.
+func exportBackupFile(db *sql.DB, path string, w io.Writer) error {
+	var buf bytes.Buffer
+	manifest, err := ExportBackup(db, &buf)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	fmt.Fprintf(w, "exported %d music, %d sheets and %d genres to %s\n",
+		manifest.Counts["music"], manifest.Counts["sheets"], manifest.Counts["genres"], path)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"infosystem-musicapp/musicxml"
+)
+
+// sheetLevelForProficiency maps a proficiency (0-10) to a sheet difficulty,
+// the same way the frontend picks the automatic difficulty.
+func sheetLevelForProficiency(proficiency float64) int {
+	return max(minSheetDifficulty, min(maxSheetDifficulty, int(math.Floor(proficiency/2))))
+}
+
+// ComposeSheet builds one MusicXML document for a part of a music, taking each measure from the
+// sheet of the difficulty chosen by a user in UserMusicDifficultySettings for the instrument.
+// Measures without a setting, or whose chosen sheet does not exist, come from the sheet of
+// defaultDifficulty; when that is 0 it is derived from the user's proficiency on the instrument.
+// If the default sheet does not exist, the nearest difficulty is used instead.
+func ComposeSheet(db *sql.DB, userID, musicID int, sheetPart SheetPart, defaultDifficulty int, t TransposeOptions) (string, error) {
+	sheetPart.Normalize()
+	var err error
+	if sheetPart.Instrument, err = resolveInstrument(db, userID, sheetPart.Instrument); err != nil {
+		return "", err
+	}
+	if sheetPart, err = resolveSheetPart(db, musicID, sheetPart); err != nil {
+		return "", err
+	}
+	rows, err := db.Query("SELECT difficulty, sheet FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty != ?",
+		musicID, sheetPart.Instrument, sheetPart.Part, accompanimentDifficulty)
+	if err != nil {
+		return "", fmt.Errorf("failed to query sheets for music_id %d: %w", musicID, err)
+	}
+	sheets := make(map[int]string)
+	for rows.Next() {
+		var difficulty int
+		var sheet string
+		if err := rows.Scan(&difficulty, &sheet); err != nil {
+			rows.Close()
+			return "", fmt.Errorf("failed to scan sheet row for music_id %d: %w", musicID, err)
+		}
+		sheets[difficulty] = sheet
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("error iterating sheet rows for music_id %d: %w", musicID, err)
+	}
+	if len(sheets) == 0 {
+		return "", ErrSheetNotFound
+	}
+
+	if defaultDifficulty == 0 {
+		// An instrument the user has not selected is played at the lowest level
+		proficiency, err := GetProficiency(db, userID, sheetPart.Instrument)
+		if err != nil && !errors.Is(err, ErrInstrumentNotSelected) {
+			return "", err
+		}
+		defaultDifficulty = sheetLevelForProficiency(proficiency)
+	}
+	nearest := -1
+	for d := range sheets {
+		if nearest < 0 || abs(d-defaultDifficulty) < abs(nearest-defaultDifficulty) ||
+			(abs(d-defaultDifficulty) == abs(nearest-defaultDifficulty) && d < nearest) {
+			nearest = d
+		}
+	}
+
+	settings, err := GetUserMusicDifficultySettings(db, userID, musicID, sheetPart.Instrument)
+	if err != nil {
+		return "", err
+	}
+
+	scores := make(map[int]*musicxml.Score)
+	parse := func(difficulty int) (*musicxml.Score, error) {
+		if score, ok := scores[difficulty]; ok {
+			return score, nil
+		}
+		score, err := musicxml.ParseString(sheets[difficulty])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+		}
+		scores[difficulty] = score
+		return score, nil
+	}
+	base, err := parse(nearest)
+	if err != nil {
+		return "", err
+	}
+	chosen := make(map[string]*musicxml.Score)
+	for _, s := range settings {
+		if _, ok := sheets[s.Difficulty]; !ok || s.Difficulty == nearest {
+			continue
+		}
+		score, err := parse(s.Difficulty)
+		if err != nil {
+			return "", err
+		}
+		chosen[strconv.Itoa(s.Measure)] = score
+	}
+
+	composed := musicxml.Compose(base, func(number string) *musicxml.Score { return chosen[number] })
+	if composed, _, err = t.Apply(composed); err != nil {
+		return "", fmt.Errorf("failed to transpose composed sheet for music_id %d: %w", musicID, err)
+	}
+	return musicxml.MarshalString(composed)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
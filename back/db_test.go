@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB returns an in-memory database with the schema and the search index of the backend.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := openEmptyTestDB(t)
+	if err := setupDBSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openTestDBAt returns an in-memory database migrated up to a schema version.
+func openTestDBAt(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	db := openEmptyTestDB(t)
+	if err := MigrateUp(db, version, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openEmptyTestDB opens an in-memory database. A single connection keeps every query on the
+// same in-memory database.
+func openEmptyTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertTestMusic adds a music with the guitar sheet of tech/data/testsheet.xml in difficulty 1.
+func insertTestMusic(t *testing.T, db *sql.DB, title string) int {
+	t.Helper()
+	sheet, err := os.ReadFile(filepath.Join("..", "tech", "data", "testsheet.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO Music (title, artist, thumbnail) VALUES (?, 'Artist', '')", title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO Sheets (music_id, instrument, difficulty, sheet) VALUES (?, 'guitar', 1, ?)", id, string(sheet)); err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
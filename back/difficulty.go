@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"infosystem-musicapp/musicxml"
+)
+
+// AnalyzeSheet parses a MusicXML sheet and estimates its difficulty.
+func AnalyzeSheet(sheet string) (musicxml.Analysis, error) {
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return musicxml.Analysis{}, err
+	}
+	return musicxml.Analyze(score), nil
+}
+
+// suggestedSheetDifficulty maps an analysis to a playable sheet difficulty (1-5).
+func suggestedSheetDifficulty(a musicxml.Analysis) int {
+	return a.SheetLevel(minSheetDifficulty, maxSheetDifficulty)
+}
+
+// estimateBaseDifficulty rates a music by its hardest playable sheet,
+// since base_difficulty describes the original song rather than its easier arrangements.
+// ok is false when the music has no playable sheet.
+func estimateBaseDifficulty(db *sql.DB, musicID int) (rating float64, ok bool, err error) {
+	var sheet string
+	err = db.QueryRow(`
+		SELECT sheet FROM Sheets
+		WHERE music_id = ? AND difficulty != ? AND generated = 0
+		ORDER BY difficulty DESC
+		LIMIT 1`, musicID, accompanimentDifficulty).Scan(&sheet)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to query hardest sheet for music_id %d: %w", musicID, err)
+	}
+	a, err := AnalyzeSheet(sheet)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to analyze hardest sheet for music_id %d: %w", musicID, err)
+	}
+	return a.Rating, true, nil
+}
+
+// FillBaseDifficulty sets Music.base_difficulty from the sheets when it has not been assigned yet.
+func FillBaseDifficulty(db *sql.DB, musicID int) error {
+	rating, ok, err := estimateBaseDifficulty(db, musicID)
+	if err != nil || !ok {
+		return err
+	}
+	res, err := db.Exec("UPDATE Music SET base_difficulty = ? WHERE id = ? AND base_difficulty IS NULL", int(math.Round(rating)), musicID)
+	if err != nil {
+		return fmt.Errorf("failed to fill base_difficulty for music_id %d: %w", musicID, err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Filled base_difficulty of music_id %d with %d (rating %.1f)", musicID, int(math.Round(rating)), rating)
+	}
+	return nil
+}
+
+// RecomputeCatalogDifficulty re-rates every music of the catalog from its sheets.
+// Every change is reported to w, and nothing is written when dryRun is true.
+// Stored sheet difficulties are only compared with the estimate, because they
+// identify each arrangement and are never changed automatically.
+func RecomputeCatalogDifficulty(db *sql.DB, dryRun bool, w io.Writer) error {
+	type musicRow struct {
+		id             int
+		title          string
+		baseDifficulty sql.NullInt64
+	}
+	rows, err := db.Query("SELECT id, title, base_difficulty FROM Music ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to query music: %w", err)
+	}
+	var catalog []musicRow
+	for rows.Next() {
+		var m musicRow
+		if err := rows.Scan(&m.id, &m.title, &m.baseDifficulty); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan music row: %w", err)
+		}
+		catalog = append(catalog, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating music rows: %w", err)
+	}
+
+	updated := 0
+	for _, m := range catalog {
+		if err := reportSheetDifficulties(db, m.id, m.title, w); err != nil {
+			return err
+		}
+
+		rating, ok, err := estimateBaseDifficulty(db, m.id)
+		if err != nil {
+			fmt.Fprintf(w, "music %d (%s): %v\n", m.id, m.title, err)
+			continue
+		}
+		if !ok {
+			fmt.Fprintf(w, "music %d (%s): no playable sheet, skipped\n", m.id, m.title)
+			continue
+		}
+		newDifficulty := int(math.Round(rating))
+		if m.baseDifficulty.Valid && int(m.baseDifficulty.Int64) == newDifficulty {
+			continue
+		}
+
+		old := "unset"
+		if m.baseDifficulty.Valid {
+			old = fmt.Sprint(m.baseDifficulty.Int64)
+		}
+		fmt.Fprintf(w, "music %d (%s): base_difficulty %s -> %d (rating %.1f)\n", m.id, m.title, old, newDifficulty, rating)
+		if dryRun {
+			continue
+		}
+		if _, err := db.Exec("UPDATE Music SET base_difficulty = ? WHERE id = ?", newDifficulty, m.id); err != nil {
+			return fmt.Errorf("failed to update base_difficulty for music_id %d: %w", m.id, err)
+		}
+		updated++
+	}
+
+	fmt.Fprintf(w, "%d music rated, %d updated\n", len(catalog), updated)
+	return nil
+}
+
+// reportSheetDifficulties writes the sheets whose stored difficulty differs from the estimate.
+func reportSheetDifficulties(db *sql.DB, musicID int, title string, w io.Writer) error {
+	rows, err := db.Query("SELECT difficulty, sheet FROM Sheets WHERE music_id = ? AND difficulty != ? ORDER BY difficulty", musicID, accompanimentDifficulty)
+	if err != nil {
+		return fmt.Errorf("failed to query sheets for music_id %d: %w", musicID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var difficulty int
+		var sheet string
+		if err := rows.Scan(&difficulty, &sheet); err != nil {
+			return fmt.Errorf("failed to scan sheet row for music_id %d: %w", musicID, err)
+		}
+		a, err := AnalyzeSheet(sheet)
+		if err != nil {
+			fmt.Fprintf(w, "music %d (%s): sheet %d cannot be analyzed: %v\n", musicID, title, difficulty, err)
+			continue
+		}
+		if suggested := suggestedSheetDifficulty(a); suggested != difficulty {
+			fmt.Fprintf(w, "music %d (%s): sheet %d is estimated at %d (rating %.1f)\n", musicID, title, difficulty, suggested, a.Rating)
+		}
+	}
+	return rows.Err()
+}
@@ -12,23 +12,23 @@ type DifficultySetting struct {
 	Difficulty int `json:"difficulty"`
 }
 
-// SetUserMusicDifficultySettings saves or updates the difficulty settings for a given music ID.
-// It first deletes any existing settings for the music ID, then inserts the new ones.
-func SetUserMusicDifficultySettings(db *sql.DB, musicID int, settings []DifficultySetting) error {
+// SetUserMusicDifficultySettings saves or updates the difficulty settings of a user for a given
+// music ID and instrument. It first deletes any existing settings for them, then inserts the new ones.
+func SetUserMusicDifficultySettings(db *sql.DB, userID, musicID int, instrument string, settings []DifficultySetting) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction for difficulty settings: %w", err)
 	}
 
 	// Delete existing settings for this music_id
-	_, err = tx.Exec("DELETE FROM UserMusicDifficultySettings WHERE music_id = ?", musicID)
+	_, err = tx.Exec("DELETE FROM UserMusicDifficultySettings WHERE user_id = ? AND music_id = ? AND instrument = ?", userID, musicID, instrument)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to delete existing difficulty settings for music_id %d: %w", musicID, err)
 	}
 
 	// Prepare statement for inserting new settings
-	stmt, err := tx.Prepare("INSERT INTO UserMusicDifficultySettings (music_id, measure, difficulty) VALUES (?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO UserMusicDifficultySettings (user_id, music_id, instrument, measure, difficulty) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to prepare insert statement for difficulty settings: %w", err)
@@ -36,20 +36,21 @@ func SetUserMusicDifficultySettings(db *sql.DB, musicID int, settings []Difficul
 	defer stmt.Close()
 
 	for _, setting := range settings {
-		_, err := stmt.Exec(musicID, setting.Measure, setting.Difficulty)
+		_, err := stmt.Exec(userID, musicID, instrument, setting.Measure, setting.Difficulty)
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("failed to insert difficulty setting (music_id: %d, measure: %d, difficulty: %d): %w", musicID, setting.Measure, setting.Difficulty, err)
 		}
 	}
 
-	log.Printf("Successfully set %d difficulty settings for music_id %d", len(settings), musicID)
+	log.Printf("Successfully set %d difficulty settings for music_id %d on %s", len(settings), musicID, instrument)
 	return tx.Commit()
 }
 
-// GetUserMusicDifficultySettings retrieves the difficulty settings for a given music ID.
-func GetUserMusicDifficultySettings(db *sql.DB, musicID int) ([]DifficultySetting, error) {
-	rows, err := db.Query("SELECT measure, difficulty FROM UserMusicDifficultySettings WHERE music_id = ? ORDER BY measure ASC", musicID)
+// GetUserMusicDifficultySettings retrieves the difficulty settings of a user for a given music ID and instrument.
+func GetUserMusicDifficultySettings(db *sql.DB, userID, musicID int, instrument string) ([]DifficultySetting, error) {
+	rows, err := db.Query("SELECT measure, difficulty FROM UserMusicDifficultySettings WHERE user_id = ? AND music_id = ? AND instrument = ? ORDER BY measure ASC",
+		userID, musicID, instrument)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query difficulty settings for music_id %d: %w", musicID, err)
 	}
@@ -73,6 +74,6 @@ func GetUserMusicDifficultySettings(db *sql.DB, musicID int) ([]DifficultySettin
 		return []DifficultySetting{}, nil
 	}
 
-	log.Printf("Retrieved %d difficulty settings for music_id %d", len(settings), musicID)
+	log.Printf("Retrieved %d difficulty settings for music_id %d on %s", len(settings), musicID, instrument)
 	return settings, nil
 }
@@ -8,9 +8,9 @@ import (
 
 // Add a music item to the user's favorites.
 // It appends the music to the end of the current favorites list.
-func AddFavorite(db *sql.DB, musicID int) error {
+func AddFavorite(db *sql.DB, userID, musicID int) error {
 	var maxOrderKey sql.NullInt64
-	err := db.QueryRow("SELECT MAX(order_key) FROM Favorites").Scan(&maxOrderKey)
+	err := db.QueryRow("SELECT MAX(order_key) FROM Favorites WHERE user_id = ?", userID).Scan(&maxOrderKey)
 	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("failed to query max order_key: %w", err)
 	}
@@ -20,22 +20,23 @@ func AddFavorite(db *sql.DB, musicID int) error {
 		newOrderKey = int(maxOrderKey.Int64) + 1
 	}
 
-	_, err = db.Exec("INSERT INTO Favorites (music_id, order_key) VALUES (?, ?)", musicID, newOrderKey)
+	_, err = db.Exec("INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?, ?, ?)", userID, musicID, newOrderKey)
 	if err != nil {
 		return fmt.Errorf("failed to insert favorite: %w", err)
 	}
-	log.Printf("Added music_id %d to favorites with order_key %d", musicID, newOrderKey)
+	log.Printf("Added music_id %d to favorites of user %d with order_key %d", musicID, userID, newOrderKey)
 	return nil
 }
 
 // Retrieve the user's favorite music items, ordered by their preference.
-func GetFavorites(db *sql.DB) ([]DisplayMusic, error) {
+func GetFavorites(db *sql.DB, userID int) ([]DisplayMusic, error) {
 	rows, err := db.Query(`
 		SELECT m.id, m.title, m.artist, m.thumbnail 
 		FROM Music m
 		JOIN Favorites f ON m.id = f.music_id
+		WHERE f.user_id = ?
 		ORDER BY f.order_key ASC
-	`)
+	`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query favorites: %w", err)
 	}
@@ -47,6 +48,7 @@ func GetFavorites(db *sql.DB) ([]DisplayMusic, error) {
 		if err := rows.Scan(&dm.MusicID, &dm.Title, &dm.Artist, &dm.Thumbnail); err != nil {
 			return nil, fmt.Errorf("failed to scan favorite row: %w", err)
 		}
+		dm.ThumbnailURL = cachedImagePath(dm.Thumbnail)
 		favorites = append(favorites, dm)
 	}
 
@@ -58,19 +60,19 @@ func GetFavorites(db *sql.DB) ([]DisplayMusic, error) {
 }
 
 // Overwrite the user's current favorite list with the provided ordered list of music IDs.
-func SetFavorites(db *sql.DB, musicIDs []int) error {
+func SetFavorites(db *sql.DB, userID int, musicIDs []int) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
-	_, err = tx.Exec("DELETE FROM Favorites")
+	_, err = tx.Exec("DELETE FROM Favorites WHERE user_id = ?", userID)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to delete existing favorites: %w", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO Favorites (music_id, order_key) VALUES (?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to prepare insert statement for favorites: %w", err)
@@ -78,13 +80,13 @@ func SetFavorites(db *sql.DB, musicIDs []int) error {
 	defer stmt.Close()
 
 	for i, musicID := range musicIDs {
-		_, err := stmt.Exec(musicID, i+1) // order_key is 1-based
+		_, err := stmt.Exec(userID, musicID, i+1) // order_key is 1-based
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("failed to insert favorite (music_id: %d, order_key: %d): %w", musicID, i+1, err)
 		}
 	}
 
-	log.Printf("Set %d favorites successfully", len(musicIDs))
+	log.Printf("Set %d favorites of user %d successfully", len(musicIDs), userID)
 	return tx.Commit()
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// fuzzyMinExactResults is the number of exact matches below which a text search
+	// is completed by fuzzy matches.
+	fuzzyMinExactResults = 3
+	// fuzzyMinSimilarity is the lowest similarity (0-1) of a fuzzy match.
+	fuzzyMinSimilarity = 0.35
+)
+
+// fuzzyHit is a music whose title, artist or reading is similar to a search text.
+type fuzzyHit struct {
+	MusicID    int
+	Similarity float64
+	Suggestion string // The title or artist that matched, as written in the catalog
+}
+
+// fuzzyMatches compares a search text with every entry of the search index and returns
+// the similar ones, most similar first. The catalog is small enough to be scanned.
+func fuzzyMatches(db *sql.DB, text string) ([]fuzzyHit, error) {
+	query := normalizeSearchText(text)
+	if strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT Music.id, Music.title, COALESCE(Music.artist, ''), MusicSearch.title, MusicSearch.artist, MusicSearch.reading
+		FROM MusicSearch JOIN Music ON Music.id = MusicSearch.rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the search index: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []fuzzyHit
+	for rows.Next() {
+		var id int
+		var title, artist, normTitle, normArtist, normReading string
+		if err := rows.Scan(&id, &title, &artist, &normTitle, &normArtist, &normReading); err != nil {
+			return nil, fmt.Errorf("failed to scan search index entry: %w", err)
+		}
+		hit := fuzzyHit{MusicID: id}
+		for _, field := range []struct{ normalized, original string }{
+			{normTitle, title},
+			{normReading, title},
+			{normArtist, artist},
+		} {
+			if s := textSimilarity(query, field.normalized); s > hit.Similarity {
+				hit.Similarity, hit.Suggestion = s, field.original
+			}
+		}
+		if hit.Similarity >= fuzzyMinSimilarity {
+			hits = append(hits, hit)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating the search index: %w", err)
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Similarity > hits[j].Similarity })
+	return hits, nil
+}
+
+// addFuzzyMatches appends the fuzzy matches that pass the other filters of q to the exact
+// results of a text search, and suggests the title or artist of the best of them.
+func addFuzzyMatches(db *sql.DB, q SearchQuery, result SearchResult) (SearchResult, error) {
+	hits, err := fuzzyMatches(db, q.TextSearch)
+	if err != nil || len(hits) == 0 {
+		return result, err
+	}
+
+	filters := q
+	filters.TextSearch = ""
+	clauses, err := searchFilters(db, filters)
+	if err != nil {
+		return result, err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(hits)), ", ")
+	clauses.where = append(clauses.where, "id IN ("+placeholders+")")
+	for _, h := range hits {
+		clauses.args = append(clauses.args, h.MusicID)
+	}
+
+	rows, err := db.Query("SELECT id, title, artist, thumbnail"+clauses.sql(), clauses.args...)
+	if err != nil {
+		return result, fmt.Errorf("failed to query fuzzy matches: %w", err)
+	}
+	defer rows.Close()
+	matched := make(map[int]DisplayMusic)
+	for rows.Next() {
+		var dm DisplayMusic
+		var artist, thumbnail sql.NullString
+		if err := rows.Scan(&dm.MusicID, &dm.Title, &artist, &thumbnail); err != nil {
+			return result, fmt.Errorf("failed to scan fuzzy match: %w", err)
+		}
+		dm.Artist, dm.Thumbnail = artist.String, thumbnail.String
+		dm.ThumbnailURL = cachedImagePath(dm.Thumbnail)
+		matched[dm.MusicID] = dm
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating fuzzy matches: %w", err)
+	}
+
+	found := make(map[int]bool)
+	for _, item := range result.Items {
+		found[item.MusicID] = true
+	}
+	for _, h := range hits {
+		dm, ok := matched[h.MusicID]
+		if !ok || found[h.MusicID] {
+			continue
+		}
+		found[h.MusicID] = true
+		if result.DidYouMean == "" {
+			result.DidYouMean = h.Suggestion
+		}
+		result.Total++
+		result.Fuzzy = true
+		if len(result.Items) < q.Limit {
+			result.Items = append(result.Items, dm)
+		}
+	}
+	return result, nil
+}
+
+// textSimilarity rates how similar a normalized search text is to a normalized field (0-1).
+// It is the better of the trigram similarity of the whole texts, ignoring spaces, and the
+// average similarity of each query word to its closest word of the field, so that both
+// misspelled names ("hige dandism") and words in another order ("yonezu kenshi") match.
+func textSimilarity(query, field string) float64 {
+	best := trigramSimilarity(strings.Join(strings.Fields(query), ""), strings.Join(strings.Fields(field), ""))
+
+	queryWords, fieldWords := strings.Fields(query), strings.Fields(field)
+	if len(queryWords) == 0 || len(fieldWords) == 0 {
+		return best
+	}
+	total := 0.0
+	for _, qw := range queryWords {
+		closest := 0.0
+		for _, fw := range fieldWords {
+			closest = max(closest, trigramSimilarity(qw, fw))
+		}
+		total += closest
+	}
+	return max(best, total/float64(len(queryWords)))
+}
+
+// trigramSimilarity is the Jaccard index of the character trigrams of a and b,
+// padded like pg_trgm so that short words and word starts count.
+func trigramSimilarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	ta, tb := trigrams(a), trigrams(b)
+	common := 0
+	for t := range ta {
+		if tb[t] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(ta)+len(tb)-common)
+}
+
+func trigrams(s string) map[string]bool {
+	runes := []rune("  " + strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) {
+			return -1
+		}
+		return r
+	}, s) + " ")
+	set := make(map[string]bool)
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+	return set
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestTrigramSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want float64
+	}{
+		{"identical", "pretender", "pretender", 1},
+		{"empty", "", "pretender", 0},
+		{"both empty", "", "", 0},
+		{"nothing in common", "lemon", "pretender", 0},
+		{"one letter changed", "abc", "abd", 2.0 / 6},
+		{"letter missing", "pretendr", "pretender", 7.0 / 12},
+		{"punctuation ignored", "kin'en", "kinen", 1},
+		{"symmetric", "pretender", "pretendr", 7.0 / 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trigramSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("trigramSimilarity(%q, %q) = %.4f, want %.4f", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextSimilarity(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		field       string
+		want        float64
+		wantMatched bool // similar enough for a fuzzy match
+	}{
+		{"misspelled title", "pretendr", "pretender", 7.0 / 12, true},
+		{"words of the field", "hige dandism", "official hige dandism", 1, true},
+		{"words in another order", "yonezu kenshi", "kenshi yonezu", 1, true},
+		{"letter missing in a short word", "lemn", "lemon", 3.0 / 8, true},
+		{"first letter changed", "remon", "lemon", 1.0 / 3, false},
+		{"unrelated", "lemon", "pretender", 0, false},
+		{"empty query", "", "lemon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := textSimilarity(tt.query, tt.field)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("textSimilarity(%q, %q) = %.4f, want %.4f", tt.query, tt.field, got, tt.want)
+			}
+			if matched := got >= fuzzyMinSimilarity; matched != tt.wantMatched {
+				t.Errorf("textSimilarity(%q, %q) = %.4f, matched = %v, want %v", tt.query, tt.field, got, matched, tt.wantMatched)
+			}
+		})
+	}
+}
+
+func TestSearchMusicFuzzy(t *testing.T) {
+	db := openTestDB(t)
+	for _, m := range []struct{ title, artist, reading string }{
+		{"Pretender", "Official髭男dism", "ぷりてんだー"},
+		{"Mixed Nuts", "Official髭男dism", "みっくすなっつ"},
+		{"Lemon", "米津玄師", "れもん"},
+	} {
+		res, err := db.Exec("INSERT INTO Music (title, artist, reading, thumbnail) VALUES (?, ?, ?, '')", m.title, m.artist, m.reading)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		if err := indexMusic(db, int(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		query          SearchQuery
+		firstPage      bool
+		wantTitles     []string
+		wantFuzzy      bool
+		wantDidYouMean string
+	}{
+		{
+			name:           "misspelled title",
+			query:          SearchQuery{TextSearch: "pretendr"},
+			firstPage:      true,
+			wantTitles:     []string{"Pretender"},
+			wantFuzzy:      true,
+			wantDidYouMean: "Pretender",
+		},
+		{
+			name:       "exact match is not suggested",
+			query:      SearchQuery{TextSearch: "lemon"},
+			firstPage:  true,
+			wantTitles: []string{"Lemon"},
+		},
+		{
+			name:      "below the similarity threshold",
+			query:     SearchQuery{TextSearch: "zzzz"},
+			firstPage: true,
+		},
+		{
+			name:      "fuzzy matches pass the other filters",
+			query:     SearchQuery{TextSearch: "pretendr", Artist: "米津玄師"},
+			firstPage: true,
+		},
+		{
+			name:  "not on later pages",
+			query: SearchQuery{TextSearch: "pretendr"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			if err := q.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.firstPage {
+				q.Cursor = searchCursor{Sort: q.Sort, Value: 0.0, MusicID: 1}.encode()
+			}
+			result, err := SearchMusic(db, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var titles []string
+			for _, item := range result.Items {
+				titles = append(titles, item.Title)
+			}
+			if !slices.Equal(titles, tt.wantTitles) {
+				t.Errorf("titles = %v, want %v", titles, tt.wantTitles)
+			}
+			if result.Fuzzy != tt.wantFuzzy || result.DidYouMean != tt.wantDidYouMean {
+				t.Errorf("fuzzy = %v, did_you_mean = %q, want %v, %q", result.Fuzzy, result.DidYouMean, tt.wantFuzzy, tt.wantDidYouMean)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultLocale is the locale whose genre names are used when a genre has no name in the requested one.
+const defaultLocale = "ja"
+
+var (
+	ErrUnknownGenre = errors.New("unknown genre")
+	ErrGenreExists  = errors.New("a genre with this slug already exists")
+)
+
+// genreSlugPattern restricts slugs to the style of the seeded genres (e.g. "J-POP").
+var genreSlugPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]*$`)
+
+// GenreInfo is a genre as returned to clients. Name is the display name in the requested locale.
+type GenreInfo struct {
+	ID    int               `json:"id"`
+	Slug  string            `json:"slug"`
+	Name  string            `json:"name"`
+	Names map[string]string `json:"names,omitempty"`
+}
+
+// GenreInput is the request body for creating a genre.
+type GenreInput struct {
+	Slug  string            `json:"slug"`
+	Names map[string]string `json:"names"` // locale -> display name, e.g. {"ja": "アニメ", "en": "Anime"}
+}
+
+// Validate normalizes the slug and checks the localized names.
+func (in *GenreInput) Validate() error {
+	in.Slug = strings.ToUpper(strings.TrimSpace(in.Slug))
+	if !genreSlugPattern.MatchString(in.Slug) {
+		return errors.New("slug must consist of letters, digits, '-' and '_'")
+	}
+	for locale, name := range in.Names {
+		if strings.TrimSpace(locale) == "" || strings.TrimSpace(name) == "" {
+			return errors.New("names must map non-empty locales to non-empty names")
+		}
+	}
+	return nil
+}
+
+// defaultGenres are the genres every database starts with. The first three were
+// the values of the former hardcoded Genre enum; the rest match the frontend's list.
+var defaultGenres = []GenreInput{
+	{Slug: "POPS", Names: map[string]string{"ja": "ポップス", "en": "Pops"}},
+	{Slug: "ROCK", Names: map[string]string{"ja": "ロック", "en": "Rock"}},
+	{Slug: "ANIME", Names: map[string]string{"ja": "アニメ", "en": "Anime"}},
+	{Slug: "J-POP", Names: map[string]string{"ja": "J-POP", "en": "J-Pop"}},
+	{Slug: "K-POP", Names: map[string]string{"ja": "K-POP", "en": "K-Pop"}},
+	{Slug: "CLASSIC", Names: map[string]string{"ja": "クラシック", "en": "Classical"}},
+	{Slug: "HIPHOP", Names: map[string]string{"ja": "ヒップホップ", "en": "Hip Hop"}},
+	{Slug: "JAZZ", Names: map[string]string{"ja": "ジャズ", "en": "Jazz"}},
+	{Slug: "BLUES", Names: map[string]string{"ja": "ブルース", "en": "Blues"}},
+	{Slug: "REGGAE", Names: map[string]string{"ja": "レゲエ", "en": "Reggae"}},
+	{Slug: "FUNK", Names: map[string]string{"ja": "ファンク", "en": "Funk"}},
+	{Slug: "DISCO", Names: map[string]string{"ja": "ディスコ", "en": "Disco"}},
+	{Slug: "METAL", Names: map[string]string{"ja": "メタル", "en": "Metal"}},
+	{Slug: "PUNK", Names: map[string]string{"ja": "パンク", "en": "Punk"}},
+	{Slug: "FOLK", Names: map[string]string{"ja": "フォーク", "en": "Folk"}},
+	{Slug: "COUNTRY", Names: map[string]string{"ja": "カントリー", "en": "Country"}},
+	{Slug: "ELECTRONIC", Names: map[string]string{"ja": "エレクトロニック", "en": "Electronic"}},
+	{Slug: "VOCALOID", Names: map[string]string{"ja": "ボカロ", "en": "Vocaloid"}},
+	{Slug: "GAME", Names: map[string]string{"ja": "ゲーム音楽", "en": "Game Music"}},
+}
+
+// setupGenres creates the genre tables, seeds the default genres and tags every music that
+// still only has the legacy Music.genre column. Unknown legacy values become new genres,
+// so that no existing tag is lost.
+func setupGenres(db execer) error {
+	cmds := []string{
+		`CREATE TABLE IF NOT EXISTS Genres (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			slug TEXT NOT NULL UNIQUE
+		)`,
+		`CREATE TABLE IF NOT EXISTS GenreNames (
+			genre_id INTEGER NOT NULL,
+			locale TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (genre_id, locale),
+			FOREIGN KEY (genre_id) REFERENCES Genres(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS MusicGenres (
+			music_id INTEGER NOT NULL,
+			genre_id INTEGER NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (music_id, genre_id),
+			FOREIGN KEY (music_id) REFERENCES Music(id),
+			FOREIGN KEY (genre_id) REFERENCES Genres(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_musicgenres_genre ON MusicGenres(genre_id)`,
+	}
+	for _, cmd := range cmds {
+		if _, err := db.Exec(cmd); err != nil {
+			return fmt.Errorf("failed to create genre tables: %w", err)
+		}
+	}
+
+	for _, g := range defaultGenres {
+		if _, err := insertGenre(db, g, true); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT id, genre FROM Music
+		WHERE genre IS NOT NULL AND TRIM(genre) != ''
+		AND id NOT IN (SELECT music_id FROM MusicGenres)`)
+	if err != nil {
+		return fmt.Errorf("failed to query untagged music: %w", err)
+	}
+	legacy := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var genre string
+		if err := rows.Scan(&id, &genre); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan untagged music: %w", err)
+		}
+		legacy[id] = genre
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating untagged music: %w", err)
+	}
+
+	for musicID, genre := range legacy {
+		ids, err := resolveGenreIDs(db, []string{genre})
+		if errors.Is(err, ErrUnknownGenre) {
+			id, insertErr := insertGenre(db, GenreInput{Slug: strings.ToUpper(strings.TrimSpace(genre)), Names: map[string]string{defaultLocale: strings.TrimSpace(genre)}}, true)
+			if insertErr != nil {
+				return insertErr
+			}
+			log.Printf("Created genre %q for the legacy genre of music_id %d", genre, musicID)
+			ids, err = []int{id}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO MusicGenres (music_id, genre_id, position) VALUES (?, ?, 0)", musicID, ids[0]); err != nil {
+			return fmt.Errorf("failed to tag music_id %d with its legacy genre: %w", musicID, err)
+		}
+	}
+	return nil
+}
+
+// execer is the part of *sql.DB and *sql.Tx used by the genre helpers.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// insertGenre creates a genre with its localized names and returns its ID.
+// With ignoreExisting, an existing slug is not an error: its missing names are added.
+func insertGenre(db execer, in GenreInput, ignoreExisting bool) (int, error) {
+	// Look the slug up first: "INSERT OR IGNORE" would use up an AUTOINCREMENT id on every startup.
+	var id int
+	err := db.QueryRow("SELECT id FROM Genres WHERE slug = ?", in.Slug).Scan(&id)
+	switch {
+	case err == nil && !ignoreExisting:
+		return 0, ErrGenreExists
+	case err == sql.ErrNoRows:
+		res, err := db.Exec("INSERT INTO Genres (slug) VALUES (?)", in.Slug)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert genre %s: %w", in.Slug, err)
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get id of genre %s: %w", in.Slug, err)
+		}
+		id = int(newID)
+	case err != nil:
+		return 0, fmt.Errorf("failed to look up genre %s: %w", in.Slug, err)
+	}
+	for locale, name := range in.Names {
+		if _, err := db.Exec("INSERT OR IGNORE INTO GenreNames (genre_id, locale, name) VALUES (?, ?, ?)", id, strings.TrimSpace(locale), strings.TrimSpace(name)); err != nil {
+			return 0, fmt.Errorf("failed to insert name of genre %s: %w", in.Slug, err)
+		}
+	}
+	return id, nil
+}
+
+// CreateGenre adds a genre with its localized names.
+func CreateGenre(db *sql.DB, in GenreInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for genre: %w", err)
+	}
+	id, err := insertGenre(tx, in, false)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit genre: %w", err)
+	}
+	log.Printf("Created genre %d (%s)", id, in.Slug)
+	refreshSuggestions(db)
+	return id, nil
+}
+
+// resolveGenreIDs looks up genres by slug or by any of their localized names, ignoring case,
+// and returns their IDs in the given order without duplicates.
+func resolveGenreIDs(db execer, names []string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, name := range names {
+		var id int
+		err := db.QueryRow(`
+			SELECT id FROM Genres WHERE slug = UPPER(?1)
+			UNION ALL
+			SELECT genre_id FROM GenreNames WHERE LOWER(name) = LOWER(?1)
+			LIMIT 1`, strings.TrimSpace(name)).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownGenre, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up genre %q: %w", name, err)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// setMusicGenres replaces the genres of a music. The first genre is also kept in the legacy
+// Music.genre column as the primary genre.
+func setMusicGenres(tx *sql.Tx, musicID int, genreIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM MusicGenres WHERE music_id = ?", musicID); err != nil {
+		return fmt.Errorf("failed to clear genres of music_id %d: %w", musicID, err)
+	}
+	primary := ""
+	for i, id := range genreIDs {
+		if _, err := tx.Exec("INSERT INTO MusicGenres (music_id, genre_id, position) VALUES (?, ?, ?)", musicID, id, i); err != nil {
+			return fmt.Errorf("failed to tag music_id %d with genre %d: %w", musicID, id, err)
+		}
+		if i == 0 {
+			if err := tx.QueryRow("SELECT slug FROM Genres WHERE id = ?", id).Scan(&primary); err != nil {
+				return fmt.Errorf("failed to read slug of genre %d: %w", id, err)
+			}
+		}
+	}
+	if _, err := tx.Exec("UPDATE Music SET genre = ? WHERE id = ?", primary, musicID); err != nil {
+		return fmt.Errorf("failed to update primary genre of music_id %d: %w", musicID, err)
+	}
+	return nil
+}
+
+// genreNameSQL selects the display name of the genre g in the locale bound to the first parameter.
+const genreNameSQL = `COALESCE(
+	(SELECT name FROM GenreNames WHERE genre_id = g.id AND locale = ?),
+	(SELECT name FROM GenreNames WHERE genre_id = g.id AND locale = '` + defaultLocale + `'),
+	g.slug)`
+
+// ListGenres returns every genre with its display name in locale and all its localized names.
+func ListGenres(db *sql.DB, locale string) ([]GenreInfo, error) {
+	rows, err := db.Query("SELECT g.id, g.slug, "+genreNameSQL+" FROM Genres g ORDER BY g.id", locale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query genres: %w", err)
+	}
+	genres := []GenreInfo{}
+	index := make(map[int]int)
+	for rows.Next() {
+		g := GenreInfo{Names: map[string]string{}}
+		if err := rows.Scan(&g.ID, &g.Slug, &g.Name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan genre row: %w", err)
+		}
+		index[g.ID] = len(genres)
+		genres = append(genres, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating genre rows: %w", err)
+	}
+
+	rows, err = db.Query("SELECT genre_id, locale, name FROM GenreNames")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query genre names: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var locale, name string
+		if err := rows.Scan(&id, &locale, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan genre name row: %w", err)
+		}
+		if i, ok := index[id]; ok {
+			genres[i].Names[locale] = name
+		}
+	}
+	return genres, rows.Err()
+}
+
+// GetMusicGenres returns the genres of a music in tagging order, named in locale.
+func GetMusicGenres(db *sql.DB, musicID int, locale string) ([]GenreInfo, error) {
+	rows, err := db.Query(`
+		SELECT g.id, g.slug, `+genreNameSQL+`
+		FROM MusicGenres mg JOIN Genres g ON g.id = mg.genre_id
+		WHERE mg.music_id = ?
+		ORDER BY mg.position, g.id`, locale, musicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query genres of music_id %d: %w", musicID, err)
+	}
+	defer rows.Close()
+
+	genres := []GenreInfo{}
+	for rows.Next() {
+		var g GenreInfo
+		if err := rows.Scan(&g.ID, &g.Slug, &g.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan genre of music_id %d: %w", musicID, err)
+		}
+		genres = append(genres, g)
+	}
+	return genres, rows.Err()
+}
+
+// requestLocale returns the explicitly requested locale, or else the primary language
+// of the Accept-Language header, or else defaultLocale.
+func requestLocale(ctx *gin.Context, explicit string) string {
+	if explicit = strings.TrimSpace(explicit); explicit != "" {
+		return strings.ToLower(explicit)
+	}
+	header := ctx.GetHeader("Accept-Language")
+	first, _, _ := strings.Cut(header, ",")
+	first, _, _ = strings.Cut(first, ";")
+	language, _, _ := strings.Cut(strings.TrimSpace(first), "-")
+	if language == "" || language == "*" {
+		return defaultLocale
+	}
+	return strings.ToLower(language)
+}
@@ -2,108 +2,279 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
 const (
-	// maxStoredHistoryItems は SearchHistory テーブルに保持する最大アイテム数です。
+	// maxStoredHistoryItems は各履歴テーブル (QueryHistory, ViewHistory) にユーザーごとに保持する最大アイテム数です。
 	maxStoredHistoryItems = 20
-	// defaultHistoryLimit は /history/searches エンドポイントで返されるデフォルトのアイテム数です。
+	// defaultHistoryLimit は履歴一覧エンドポイントで返されるデフォルトのアイテム数です。
 	defaultHistoryLimit = 10
 )
 
-// AddSearchEntriesToHistory は検索結果の楽曲リストを検索履歴に追加します。
-// 追加後、履歴テーブルが最大保持数を超えないように古いエントリを削除します。
-func AddSearchEntriesToHistory(db *sql.DB, items []DisplayMusic) error {
-	if len(items) == 0 {
-		return nil
+// ErrHistoryEntryNotFound は指定された履歴エントリが存在しない場合のエラーです。
+var ErrHistoryEntryNotFound = errors.New("history entry not found")
+
+// QueryHistoryEntry はユーザーが入力した検索文字列の履歴です。
+type QueryHistoryEntry struct {
+	ID         int       `json:"id"`
+	Query      string    `json:"query"`
+	SearchedAt time.Time `json:"searched_at"`
+}
+
+// ViewHistoryEntry はユーザーが /select で開いた楽曲の履歴です。
+type ViewHistoryEntry struct {
+	ID int `json:"id"`
+	DisplayMusic
+	ViewedAt time.Time `json:"viewed_at"`
+}
+
+// setupHistory は検索文字列と閲覧楽曲の履歴テーブルを作成します。
+// 検索結果をそのまま記録していた旧 SearchHistory テーブルの行は、楽曲を閲覧履歴に、
+// 曲名を検索文字列の履歴に移してから削除します (dropHistory で元に戻せます)。
+func setupHistory(db execer) error {
+	cmd := `CREATE TABLE IF NOT EXISTS QueryHistory (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		query TEXT NOT NULL,
+		normalized TEXT NOT NULL UNIQUE,
+		searched_at DATETIME NOT NULL
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create QueryHistory table: %w", err)
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("検索履歴のトランザクション開始に失敗しました: %w", err)
+	cmd = `CREATE TABLE IF NOT EXISTS ViewHistory (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		music_id INTEGER NOT NULL UNIQUE,
+		viewed_at DATETIME NOT NULL,
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create ViewHistory table: %w", err)
 	}
-	// エラー時にロールバックを保証します
-	successfulCommit := false
-	defer func() {
-		if !successfulCommit {
-			tx.Rollback()
-		}
-	}()
 
-	stmt, err := tx.Prepare("INSERT INTO SearchHistory (music_id, title, artist, thumbnail, searched_at) VALUES (?, ?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("検索履歴のINSERT準備に失敗しました: %w", err)
+	var legacy bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'SearchHistory')").Scan(&legacy); err != nil {
+		return fmt.Errorf("failed to look up SearchHistory table: %w", err)
+	}
+	if !legacy {
+		return nil
 	}
-	defer stmt.Close()
 
-	currentTime := time.Now().UTC() // このバッチ内の全アイテムに同じタイムスタンプを使用
+	// 同じ楽曲は最後に表示された日時で閲覧履歴に入れます (削除済みの楽曲は除きます)
+	cmd = `INSERT OR IGNORE INTO ViewHistory (music_id, viewed_at)
+		SELECT h.music_id, h.searched_at FROM SearchHistory h
+		WHERE h.music_id IN (SELECT id FROM Music)
+		ORDER BY h.searched_at DESC, h.id DESC`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to copy SearchHistory into ViewHistory: %w", err)
+	}
 
-	for _, item := range items {
-		_, err = stmt.Exec(item.MusicID, item.Title, item.Artist, item.Thumbnail, currentTime)
+	rows, err := db.Query("SELECT title, searched_at FROM SearchHistory ORDER BY searched_at DESC, id DESC")
+	if err != nil {
+		return fmt.Errorf("failed to query SearchHistory: %w", err)
+	}
+	type legacyQuery struct {
+		title      string
+		searchedAt time.Time
+	}
+	var queries []legacyQuery
+	for rows.Next() {
+		var q legacyQuery
+		if err := rows.Scan(&q.title, &q.searchedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan SearchHistory: %w", err)
+		}
+		queries = append(queries, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating SearchHistory: %w", err)
+	}
+	for _, q := range queries {
+		normalized := strings.Join(strings.Fields(normalizeSearchText(q.title)), " ")
+		if normalized == "" {
+			continue
+		}
+		_, err := db.Exec("INSERT OR IGNORE INTO QueryHistory (query, normalized, searched_at) VALUES (?, ?, ?)",
+			strings.TrimSpace(q.title), normalized, q.searchedAt)
 		if err != nil {
-			return fmt.Errorf("検索履歴エントリの挿入に失敗しました (music_id: %d): %w", item.MusicID, err)
+			return fmt.Errorf("failed to copy SearchHistory into QueryHistory: %w", err)
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("検索履歴のコミットに失敗しました: %w", err)
+	if _, err := db.Exec("DROP TABLE SearchHistory"); err != nil {
+		return fmt.Errorf("failed to drop SearchHistory table: %w", err)
+	}
+	log.Printf("Moved %d entries of SearchHistory into ViewHistory and QueryHistory", len(queries))
+	return nil
+}
+
+// dropHistory は setupHistory の逆のマイグレーションです。閲覧履歴の楽曲を旧 SearchHistory
+// テーブルに戻します。旧テーブルに対応するもののない検索文字列の履歴は失われます。
+func dropHistory(db execer) error {
+	return execAll(
+		`CREATE TABLE IF NOT EXISTS SearchHistory (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			music_id INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			artist TEXT,
+			thumbnail TEXT,
+			searched_at DATETIME NOT NULL
+		)`,
+		`INSERT INTO SearchHistory (music_id, title, artist, thumbnail, searched_at)
+			SELECT m.id, m.title, m.artist, m.thumbnail, h.viewed_at
+			FROM ViewHistory h JOIN Music m ON m.id = h.music_id
+			ORDER BY h.viewed_at, h.id`,
+		"DROP TABLE IF EXISTS ViewHistory",
+		"DROP TABLE IF EXISTS QueryHistory",
+	)(db)
+}
+
+// AddQueryToHistory はユーザーが入力した検索文字列をそのユーザーの履歴に追加します。
+// 表記揺れ (かな/ローマ字, 全角/半角, 大文字/小文字) だけが異なる検索は同じエントリとして扱い、
+// 最新の入力と日時で上書きします。
+func AddQueryToHistory(db *sql.DB, userID int, query string) error {
+	query = strings.TrimSpace(query)
+	normalized := strings.Join(strings.Fields(normalizeSearchText(query)), " ")
+	if normalized == "" {
+		return nil
 	}
-	successfulCommit = true // コミット成功
 
-	// 新しいエントリのコミット成功後に古いエントリを削除
-	if err := PruneSearchHistory(db, maxStoredHistoryItems); err != nil {
+	_, err := db.Exec(`
+		INSERT INTO QueryHistory (user_id, query, normalized, searched_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, normalized) DO UPDATE SET query = excluded.query, searched_at = excluded.searched_at`,
+		userID, query, normalized, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("検索文字列の履歴への追加に失敗しました: %w", err)
+	}
+	if err := pruneHistory(db, userID, "QueryHistory", "searched_at"); err != nil {
 		// このエラーはログに記録しますが、履歴追加の主操作を失敗させません
-		log.Printf("警告: 検索履歴の削除に失敗しました: %v", err)
+		log.Printf("警告: 検索文字列の履歴の削除に失敗しました: %v", err)
 	}
+	return nil
+}
 
-	log.Printf("%d 件のエントリを検索履歴に追加しました。", len(items))
+// AddViewToHistory はユーザーが開いた楽曲をそのユーザーの閲覧履歴に追加します。
+// 同じ楽曲を再度開いた場合は閲覧日時だけを更新します。
+func AddViewToHistory(db *sql.DB, userID, musicID int) error {
+	_, err := db.Exec(`
+		INSERT INTO ViewHistory (user_id, music_id, viewed_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, music_id) DO UPDATE SET viewed_at = excluded.viewed_at`,
+		userID, musicID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("閲覧履歴への追加に失敗しました (music_id: %d): %w", musicID, err)
+	}
+	if err := pruneHistory(db, userID, "ViewHistory", "viewed_at"); err != nil {
+		log.Printf("警告: 閲覧履歴の削除に失敗しました: %v", err)
+	}
 	return nil
 }
 
-// PruneSearchHistory は SearchHistory テーブルに最新の 'keepCount' 件のアイテムのみを保持します。
-func PruneSearchHistory(db *sql.DB, keepCount int) error {
-	query := `
-		DELETE FROM SearchHistory
-		WHERE id NOT IN (
+// pruneHistory は履歴テーブルにユーザーの最新の maxStoredHistoryItems 件のみを保持します。
+func pruneHistory(db *sql.DB, userID int, table, timeColumn string) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %[1]s
+		WHERE user_id = ?1 AND id NOT IN (
 			SELECT id
-			FROM SearchHistory
-			ORDER BY searched_at DESC, id DESC
-			LIMIT ?
-		)
-	`
-	_, err := db.Exec(query, keepCount)
-	if err != nil {
-		return fmt.Errorf("検索履歴の削除クエリ実行に失敗しました: %w", err)
+			FROM %[1]s
+			WHERE user_id = ?1
+			ORDER BY %[2]s DESC, id DESC
+			LIMIT ?2
+		)`, table, timeColumn)
+	if _, err := db.Exec(query, userID, maxStoredHistoryItems); err != nil {
+		return fmt.Errorf("%s の削除クエリ実行に失敗しました: %w", table, err)
 	}
 	return nil
 }
 
-// GetSearchHistory は最新の検索履歴アイテムを取得します。
-func GetSearchHistory(db *sql.DB, limit int) ([]DisplayMusic, error) {
+// GetQueryHistory はユーザーの最新の検索文字列の履歴を取得します。
+func GetQueryHistory(db *sql.DB, userID, limit int) ([]QueryHistoryEntry, error) {
 	if limit <= 0 {
 		limit = defaultHistoryLimit
 	}
 
-	rows, err := db.Query("SELECT music_id, title, artist, thumbnail FROM SearchHistory ORDER BY searched_at DESC, id DESC LIMIT ?", limit)
+	rows, err := db.Query("SELECT id, query, searched_at FROM QueryHistory WHERE user_id = ? ORDER BY searched_at DESC, id DESC LIMIT ?", userID, limit)
 	if err != nil {
-		return nil, fmt.Errorf("検索履歴のクエリ実行に失敗しました: %w", err)
+		return nil, fmt.Errorf("検索文字列の履歴のクエリ実行に失敗しました: %w", err)
 	}
 	defer rows.Close()
 
-	var history []DisplayMusic
+	history := []QueryHistoryEntry{}
 	for rows.Next() {
-		var dm DisplayMusic
-		if err := rows.Scan(&dm.MusicID, &dm.Title, &dm.Artist, &dm.Thumbnail); err != nil {
-			return nil, fmt.Errorf("検索履歴行のスキャンに失敗しました: %w", err)
+		var e QueryHistoryEntry
+		if err := rows.Scan(&e.ID, &e.Query, &e.SearchedAt); err != nil {
+			return nil, fmt.Errorf("検索文字列の履歴行のスキャンに失敗しました: %w", err)
 		}
-		history = append(history, dm)
+		history = append(history, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("検索文字列の履歴行のイテレーションエラー: %w", err)
+	}
+	return history, nil
+}
+
+// GetViewHistory はユーザーが最近開いた楽曲を新しい順に取得します。
+func GetViewHistory(db *sql.DB, userID, limit int) ([]ViewHistoryEntry, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	rows, err := db.Query(`
+		SELECT h.id, m.id, m.title, COALESCE(m.artist, ''), COALESCE(m.thumbnail, ''), h.viewed_at
+		FROM ViewHistory h JOIN Music m ON m.id = h.music_id
+		WHERE h.user_id = ?
+		ORDER BY h.viewed_at DESC, h.id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("閲覧履歴のクエリ実行に失敗しました: %w", err)
 	}
+	defer rows.Close()
 
+	history := []ViewHistoryEntry{}
+	for rows.Next() {
+		var e ViewHistoryEntry
+		if err := rows.Scan(&e.ID, &e.MusicID, &e.Title, &e.Artist, &e.Thumbnail, &e.ViewedAt); err != nil {
+			return nil, fmt.Errorf("閲覧履歴行のスキャンに失敗しました: %w", err)
+		}
+		e.ThumbnailURL = cachedImagePath(e.Thumbnail)
+		history = append(history, e)
+	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("検索履歴行のイテレーションエラー: %w", err)
+		return nil, fmt.Errorf("閲覧履歴行のイテレーションエラー: %w", err)
 	}
 	return history, nil
 }
+
+// DeleteHistoryEntry は履歴テーブル (QueryHistory または ViewHistory) からユーザーのエントリを1件削除します。
+func DeleteHistoryEntry(db *sql.DB, userID int, table string, id int) error {
+	res, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ? AND user_id = ?", table), id, userID)
+	if err != nil {
+		return fmt.Errorf("%s のエントリ %d の削除に失敗しました: %w", table, id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s の削除件数の確認に失敗しました: %w", table, err)
+	}
+	if n == 0 {
+		return ErrHistoryEntryNotFound
+	}
+	return nil
+}
+
+// ClearHistory は履歴テーブル (QueryHistory または ViewHistory) からユーザーのエントリを全て削除し、削除件数を返します。
+func ClearHistory(db *sql.DB, userID int, table string) (int64, error) {
+	res, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", table), userID)
+	if err != nil {
+		return 0, fmt.Errorf("%s の消去に失敗しました: %w", table, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s の削除件数の確認に失敗しました: %w", table, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestSetupHistoryMovesSearchHistory checks that migration 2 moves the rows of the SearchHistory
+// table of older databases into the new histories, and that rolling it back restores them.
+func TestSetupHistoryMovesSearchHistory(t *testing.T) {
+	db := openTestDBAt(t, 1)
+	if _, err := db.Exec("INSERT INTO Music (id, title, artist, thumbnail) VALUES (1, 'アイドル', 'YOASOBI', 'a.jpg'), (2, 'Lemon', '米津玄師', 'b.jpg')"); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i, row := range []struct {
+		musicID int
+		title   string
+	}{
+		{1, "アイドル"},
+		{2, "Lemon"},
+		{1, "アイドル"},
+		{3, "Deleted Song"}, // No longer in Music
+	} {
+		_, err := db.Exec("INSERT INTO SearchHistory (music_id, title, searched_at) VALUES (?, ?, ?)", row.musicID, row.title, base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateUp(db, 2, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var views []int
+	rows, err := db.Query("SELECT music_id, viewed_at FROM ViewHistory ORDER BY viewed_at DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var musicID int
+		var viewedAt time.Time
+		if err := rows.Scan(&musicID, &viewedAt); err != nil {
+			t.Fatal(err)
+		}
+		if musicID == 1 && !viewedAt.Equal(base.Add(2*time.Minute)) {
+			t.Errorf("music 1 viewed at %v, want its last search at %v", viewedAt, base.Add(2*time.Minute))
+		}
+		views = append(views, musicID)
+	}
+	rows.Close()
+	if want := []int{1, 2}; !slices.Equal(views, want) {
+		t.Errorf("ViewHistory = %v, want %v", views, want)
+	}
+	var queries []string
+	rows, err = db.Query("SELECT query FROM QueryHistory ORDER BY searched_at DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var query string
+		if err := rows.Scan(&query); err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, query)
+	}
+	rows.Close()
+	if want := []string{"Deleted Song", "アイドル", "Lemon"}; !slices.Equal(queries, want) {
+		t.Errorf("QueryHistory = %v, want %v", queries, want)
+	}
+
+	if err := MigrateDown(db, 1, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var restored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM SearchHistory WHERE title IN ('アイドル', 'Lemon') AND thumbnail IS NOT NULL").Scan(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored != 2 {
+		t.Errorf("SearchHistory has %d of the viewed music after the rollback, want 2", restored)
+	}
+}
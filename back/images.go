@@ -0,0 +1,462 @@
+/*
+ * Local cache of the thumbnails of the catalog and of Spotify tracks.
+ *
+ * Thumbnails are remote URLs (e.g. i.scdn.co). Every URL seen by the backend is registered in
+ * the Images table under an ID derived from the URL, and /images/:id serves it from a local
+ * store: the original is downloaded on the first request (or by "back cache-images") and
+ * resized variants are derived from it on demand. A placeholder is served when the source
+ * cannot be downloaded and nothing is cached.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxImageBytes caps the size of a downloaded thumbnail.
+	maxImageBytes = 10 << 20
+	// maxImagePixels caps the dimensions of the images that are decoded to derive variants.
+	maxImagePixels = 4096 * 4096
+	// imageRetryInterval is how long a failed download is not retried.
+	imageRetryInterval = 10 * time.Minute
+	variantJPEGQuality = 85
+)
+
+// imageVariants are the sizes served by /images/:id?size=, as the longest side in pixels.
+// "original" serves the downloaded file untouched.
+var imageVariants = map[string]int{
+	"thumb":  64,
+	"small":  160,
+	"medium": 320,
+	"large":  640,
+}
+
+const defaultImageVariant = "medium"
+
+var (
+	ErrImageNotFound      = errors.New("image not found")
+	ErrUnknownImageSize   = errors.New("unknown image size")
+	ErrImageSourceMissing = errors.New("image source is unavailable")
+	ErrImageTooLarge      = errors.New("image is too large to resize")
+	ErrImageAddressDenied = errors.New("image source is not a public address")
+)
+
+// imageCacheDir is the local store of the downloaded thumbnails and their variants.
+var imageCacheDir = func() string {
+	if dir := os.Getenv("IMAGE_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	return "images"
+}()
+
+// imageHTTPClient downloads the thumbnails. Image URLs come from admins and from Spotify
+// responses, so it only connects to public addresses: an URL (or a redirect) cannot make the
+// backend reach itself or the local network. Proxies are not used, as the check is on the
+// address actually dialed.
+var imageHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// nonPublicPrefixes are the IPv4 ranges that are not private in the sense of netip but are
+// not reachable on the internet either ("this network" and carrier-grade NAT).
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// dialPublicOnly refuses connections to loopback, private, link-local and other non-public
+// addresses. It runs after name resolution, for every connection including redirects.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || !isPublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrImageAddressDenied, address)
+	}
+	return nil
+}
+
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageLocks serializes the download and resizing of each image.
+var imageLocks sync.Map // image ID -> *sync.Mutex
+
+// CachedImage is a file ready to be served by /images/:id.
+type CachedImage struct {
+	Path        string
+	ContentType string
+	ETag        string
+}
+
+func setupImages(db execer) error {
+	cmd := `CREATE TABLE IF NOT EXISTS Images (
+		id TEXT PRIMARY KEY,
+		source_url TEXT NOT NULL,
+		content_type TEXT,
+		fetched_at DATETIME,
+		failed_at DATETIME,
+		missing INTEGER NOT NULL DEFAULT 0
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create Images table: %w", err)
+	}
+
+	// Register the thumbnails of music created before the cache existed
+	rows, err := db.Query("SELECT DISTINCT thumbnail FROM Music WHERE thumbnail LIKE 'http%'")
+	if err != nil {
+		return fmt.Errorf("failed to query music thumbnails: %w", err)
+	}
+	var sources []string
+	for rows.Next() {
+		var source string
+		if err := rows.Scan(&source); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan music thumbnail: %w", err)
+		}
+		sources = append(sources, source)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating music thumbnails: %w", err)
+	}
+	for _, source := range sources {
+		if err := registerImage(db, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRemoteImage reports whether a thumbnail is a URL that can be cached.
+// Thumbnails stored inline (base64) are served by the client as they are.
+func isRemoteImage(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+const imageIDLength = 24
+
+func imageID(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:imageIDLength/2])
+}
+
+// isImageID reports whether id has the form of the IDs of imageID, lowercase hex.
+func isImageID(id string) bool {
+	if len(id) != imageIDLength {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedImagePath returns the path under which /images/:id serves a remote thumbnail,
+// or "" when the thumbnail is not a URL. The URL must have been registered with registerImage.
+func cachedImagePath(source string) string {
+	if !isRemoteImage(source) {
+		return ""
+	}
+	return "/images/" + imageID(source)
+}
+
+// registerImage makes a remote thumbnail servable by /images/:id. It does not download it.
+func registerImage(db execer, source string) error {
+	if !isRemoteImage(source) {
+		return nil
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO Images (id, source_url) VALUES (?, ?)", imageID(source), source); err != nil {
+		return fmt.Errorf("failed to register image %s: %w", source, err)
+	}
+	return nil
+}
+
+// GetCachedImage returns the file of an image in the given size, downloading the original
+// and deriving the variant when they are not cached yet.
+func GetCachedImage(db *sql.DB, id, size string) (CachedImage, error) {
+	maxSide, ok := imageVariants[size]
+	if !ok && size != "original" {
+		return CachedImage{}, ErrUnknownImageSize
+	}
+
+	// Only registered images get a lock, as the IDs come from public requests
+	if !isImageID(id) {
+		return CachedImage{}, ErrImageNotFound
+	}
+	var registered bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM Images WHERE id = ?)", id).Scan(&registered); err != nil {
+		return CachedImage{}, fmt.Errorf("failed to query image %s: %w", id, err)
+	}
+	if !registered {
+		return CachedImage{}, ErrImageNotFound
+	}
+	lock, _ := imageLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// Read again under the lock: a concurrent request may have downloaded the image
+	var source string
+	var contentType sql.NullString
+	var fetchedAt, failedAt sql.NullTime
+	var missing bool
+	err := db.QueryRow("SELECT source_url, content_type, fetched_at, failed_at, missing FROM Images WHERE id = ?", id).
+		Scan(&source, &contentType, &fetchedAt, &failedAt, &missing)
+	if err == sql.ErrNoRows {
+		return CachedImage{}, ErrImageNotFound
+	}
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("failed to query image %s: %w", id, err)
+	}
+
+	original := filepath.Join(imageCacheDir, id, "original")
+	if _, err := os.Stat(original); err != nil {
+		if missing || (failedAt.Valid && time.Since(failedAt.Time) < imageRetryInterval) {
+			return CachedImage{}, ErrImageSourceMissing
+		}
+		ct, err := downloadImage(source, original)
+		if err != nil {
+			missing = errors.Is(err, ErrImageSourceMissing)
+			if _, dbErr := db.Exec("UPDATE Images SET failed_at = ?, missing = ? WHERE id = ?", time.Now().UTC(), missing, id); dbErr != nil {
+				log.Printf("Warning: Failed to record download failure of image %s: %v", id, dbErr)
+			}
+			return CachedImage{}, err
+		}
+		fetchedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+		contentType = sql.NullString{String: ct, Valid: true}
+		if _, err := db.Exec("UPDATE Images SET content_type = ?, fetched_at = ?, failed_at = NULL, missing = 0 WHERE id = ?",
+			ct, fetchedAt.Time, id); err != nil {
+			return CachedImage{}, fmt.Errorf("failed to record download of image %s: %w", id, err)
+		}
+	}
+
+	etag := fmt.Sprintf(`"%s-%s-%d"`, id, size, fetchedAt.Time.Unix())
+	if size == "original" {
+		return CachedImage{Path: original, ContentType: contentType.String, ETag: etag}, nil
+	}
+	variant := filepath.Join(imageCacheDir, id, size+".jpg")
+	if _, err := os.Stat(variant); err == nil {
+		return CachedImage{Path: variant, ContentType: "image/jpeg", ETag: etag}, nil
+	}
+	if err := writeImageVariant(original, variant, maxSide); err != nil {
+		// Formats the standard library cannot decode (e.g. WebP) and images too large to decode are served as downloaded
+		log.Printf("Warning: Failed to resize image %s to %s, serving the original: %v", id, size, err)
+		return CachedImage{Path: original, ContentType: contentType.String, ETag: etag}, nil
+	}
+	return CachedImage{Path: variant, ContentType: "image/jpeg", ETag: etag}, nil
+}
+
+// downloadImage stores the image at url into path and returns its content type.
+// It returns ErrImageSourceMissing when the source no longer exists.
+func downloadImage(url, path string) (string, error) {
+	resp, err := imageHTTPClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return "", fmt.Errorf("%w: %s returned %d", ErrImageSourceMissing, url, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("failed to download image %s: status code %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read image %s: %w", url, err)
+	}
+	if len(data) > maxImageBytes {
+		return "", fmt.Errorf("image %s is larger than %d bytes", url, maxImageBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("%w: %s is not an image (%s)", ErrImageSourceMissing, url, contentType)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+// writeImageVariant scales the image at src down to fit in maxSide x maxSide and stores it as JPEG.
+// Smaller images are re-encoded without being enlarged. Images of more than maxImagePixels
+// are not decoded and return ErrImageTooLarge.
+func writeImageVariant(src, dst string, maxSide int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", src, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImagePixels/config.Height {
+		return fmt.Errorf("%w: %s is %dx%d", ErrImageTooLarge, src, config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", src, err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeImage(img, maxSide), &jpeg.Options{Quality: variantJPEGQuality}); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", dst, err)
+	}
+	return writeFileAtomic(dst, buf.Bytes())
+}
+
+// resizeImage scales img down to fit in maxSide x maxSide by averaging the source pixels
+// covered by each destination pixel. Transparent areas become white, as JPEG has no alpha.
+func resizeImage(img image.Image, maxSide int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			w, h = maxSide, max(1, h*maxSide/b.Dx())
+		} else {
+			w, h = max(1, w*maxSide/b.Dy()), maxSide
+		}
+	}
+
+	// The source is read in place rather than copied: it may be up to maxImagePixels.
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+max((y+1)*b.Dy()/h, y*b.Dy()/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+max((x+1)*b.Dx()/w, x*b.Dx()/w+1)
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// Premultiplied colors over white
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, n = r+uint64(cr+0xffff-ca), g+uint64(cg+0xffff-ca), bl+uint64(cb+0xffff-ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff})
+		}
+	}
+	return dst
+}
+
+// writeFileAtomic writes a file of the cache so that a concurrent reader never sees it half written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+var (
+	placeholderMu     sync.Mutex
+	placeholderImages = map[string][]byte{}
+)
+
+// placeholderImage returns a plain grey PNG of the size of a variant, served when an image is unavailable.
+func placeholderImage(size string) []byte {
+	placeholderMu.Lock()
+	defer placeholderMu.Unlock()
+	if data, ok := placeholderImages[size]; ok {
+		return data
+	}
+	side, ok := imageVariants[size]
+	if !ok {
+		side = imageVariants["large"]
+	}
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xd0, 0xd0, 0xd0, 0xff}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	placeholderImages[size] = buf.Bytes()
+	return placeholderImages[size]
+}
+
+// CacheAllImages downloads every registered image that is not cached yet, so that the
+// thumbnails are available offline, and reports the ones that failed.
+func CacheAllImages(db *sql.DB, out io.Writer) error {
+	rows, err := db.Query("SELECT id, source_url FROM Images WHERE fetched_at IS NULL ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to query images: %w", err)
+	}
+	type pending struct{ id, source string }
+	var images []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.source); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating images: %w", err)
+	}
+
+	cached := 0
+	for _, p := range images {
+		// Retry sources that failed before: this is an explicit request to fetch them
+		if _, err := db.Exec("UPDATE Images SET failed_at = NULL, missing = 0 WHERE id = ?", p.id); err != nil {
+			return fmt.Errorf("failed to reset image %s: %w", p.id, err)
+		}
+		if _, err := GetCachedImage(db, p.id, "original"); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", p.source, err)
+			continue
+		}
+		cached++
+	}
+	fmt.Fprintf(out, "cached %d of %d images\n", cached, len(images))
+	return nil
+}
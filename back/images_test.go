@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"151.101.2.1", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false}, // Cloud metadata service
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:192.168.1.10", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// TestGetCachedImageRefusesPrivateAddresses checks that a registered image URL on a local
+// address is never requested.
+func TestGetCachedImageRefusesPrivateAddresses(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(placeholderImage("thumb"))
+	}))
+	t.Cleanup(server.Close)
+
+	saved := imageCacheDir
+	imageCacheDir = t.TempDir()
+	t.Cleanup(func() { imageCacheDir = saved })
+
+	if _, err := downloadImage(server.URL+"/a.png", filepath.Join(imageCacheDir, "a.png")); !errors.Is(err, ErrImageAddressDenied) {
+		t.Errorf("downloadImage of %s: err = %v, want ErrImageAddressDenied", server.URL, err)
+	}
+
+	db := openTestDB(t)
+	source := server.URL + "/b.png"
+	if err := registerImage(db, source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetCachedImage(db, imageID(source), "thumb"); !errors.Is(err, ErrImageAddressDenied) {
+		t.Errorf("GetCachedImage of %s: err = %v, want ErrImageAddressDenied", source, err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("the local server received %d requests", n)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * Bulk import of a catalog directory: "back import [-dry-run] ./catalog/".
+ *
+ * The directory holds MusicXML sheets and a manifest describing the songs, either
+ * manifest.json:
+ *
+ *	[{"title": "新時代", "artist": "Ado", "genres": ["ANIME"], "thumbnail": "https://...", "reading": "しんじだい",
+ *	  "sheets": [{"file": "shinjidai_5.musicxml", "difficulty": 5}, {"file": "shinjidai_1.musicxml"},
+ *	             {"file": "shinjidai_piano.musicxml", "instrument": "piano", "part": "right hand"}]}]
+ *
+ * or manifest.csv, with one row per sheet and a header naming the columns (title, artist, genre,
+ * thumbnail, reading, base_difficulty, file, difficulty, instrument, part). Rows with the same
+ * title and artist are sheets of the same song, and genre may list several genres separated by ";".
+ *
+ * A song that already exists (same title and artist, ignoring case) is updated instead of
+ * duplicated, and its sheets of the imported parts and difficulties are replaced. A sheet without
+ * a difficulty gets the estimated one, and a sheet without an instrument the one its MusicXML
+ * tells (see SheetInput). Every song is imported in a single transaction: when a
+ * file or a song is invalid, every error is reported and nothing is written.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// importSheet is a sheet of the manifest. A difficulty of 0 (or omitted) is estimated from the sheet.
+type importSheet struct {
+	File       string `json:"file"`
+	Difficulty int    `json:"difficulty"`
+	SheetPart
+}
+
+// importSong is a song of the manifest.
+type importSong struct {
+	MusicInput
+	Sheets []importSheet `json:"sheets"`
+	origin string        // Where the song is declared, for the report (e.g. "manifest.csv:3")
+}
+
+// ImportCatalog imports the songs of a catalog directory and reports what was created,
+// updated or invalid to w. Nothing is written when dryRun is true or when anything is invalid.
+func ImportCatalog(db *sql.DB, dir string, dryRun bool, w io.Writer) error {
+	songs, err := readImportManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	// Read and check every sheet before touching the database
+	failed := 0
+	sheets := make([][]SheetInput, len(songs))
+	listed := make(map[string]bool)
+	for i := range songs {
+		song := &songs[i]
+		if err := song.MusicInput.Validate(); err != nil {
+			fmt.Fprintf(w, "%s: %v\n", song.origin, err)
+			failed++
+			continue
+		}
+		difficulties := make(map[string]string) // part and difficulty -> file
+		for _, s := range song.Sheets {
+			listed[filepath.Clean(s.File)] = true
+			in, err := readImportSheet(dir, s)
+			if err != nil {
+				fmt.Fprintf(w, "%s: %v\n", s.File, err)
+				failed++
+				continue
+			}
+			key := fmt.Sprintf("%s\x00%s\x00%d", in.Instrument, in.Part, in.Difficulty)
+			if other, ok := difficulties[key]; ok {
+				fmt.Fprintf(w, "%s: difficulty %d of %q (%s) is also given to %s\n", s.File, in.Difficulty, song.Title, importSheetLabel(in), other)
+				failed++
+				continue
+			}
+			difficulties[key] = s.File
+			sheets[i] = append(sheets[i], in)
+		}
+	}
+	reportUnlistedSheets(dir, listed, w)
+	if failed > 0 {
+		return fmt.Errorf("%d errors in %s, nothing imported", failed, dir)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for importing the catalog: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	created, updated := 0, 0
+	musicIDs := make([]int, 0, len(songs))
+	for i, song := range songs {
+		id, isNew, err := importMusic(tx, song.MusicInput)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", song.origin, err)
+			failed++
+			continue
+		}
+		musicIDs = append(musicIDs, id)
+
+		changes := []string{}
+		for _, in := range sheets[i] {
+			change, err := putImportedSheet(tx, id, in)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, fmt.Sprintf("%s %d %s", importSheetLabel(in), in.Difficulty, change))
+		}
+		if err := refreshMusicMetadata(tx, id); err != nil {
+			return err
+		}
+		action := "updated"
+		if isNew {
+			action = "created"
+			created++
+		} else {
+			updated++
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "none")
+		}
+		fmt.Fprintf(w, "music %d (%s / %s): %s, sheets: %s\n", id, song.Title, song.Artist, action, strings.Join(changes, ", "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d errors in %s, nothing imported", failed, dir)
+	}
+	if dryRun {
+		fmt.Fprintf(w, "%d music would be created, %d updated (dry run, nothing written)\n", created, updated)
+		return nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit catalog import: %w", err)
+	}
+	successfulCommit = true
+	for _, id := range musicIDs {
+		if err := FillBaseDifficulty(db, id); err != nil {
+			log.Printf("Warning: Failed to estimate base_difficulty of music_id %d: %v", id, err)
+		}
+	}
+	refreshSuggestions(db)
+	fmt.Fprintf(w, "%d music created, %d updated\n", created, updated)
+	return nil
+}
+
+// readImportManifest reads manifest.json or manifest.csv from a catalog directory.
+func readImportManifest(dir string) ([]importSong, error) {
+	jsonPath, csvPath := filepath.Join(dir, "manifest.json"), filepath.Join(dir, "manifest.csv")
+	_, jsonErr := os.Stat(jsonPath)
+	_, csvErr := os.Stat(csvPath)
+	switch {
+	case jsonErr == nil && csvErr == nil:
+		return nil, fmt.Errorf("%s holds both manifest.json and manifest.csv", dir)
+	case jsonErr == nil:
+		return readJSONManifest(jsonPath)
+	case csvErr == nil:
+		return readCSVManifest(csvPath)
+	}
+	return nil, fmt.Errorf("%s holds no manifest.json or manifest.csv", dir)
+}
+
+func readJSONManifest(path string) ([]importSong, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var songs []importSong
+	if err := json.Unmarshal(data, &songs); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	for i := range songs {
+		songs[i].origin = fmt.Sprintf("%s: song %d (%s)", filepath.Base(path), i+1, songs[i].Title)
+	}
+	return songs, nil
+}
+
+var csvManifestColumns = []string{"title", "artist", "genre", "genres", "thumbnail", "reading", "base_difficulty", "file", "difficulty", "instrument", "part"}
+
+func readCSVManifest(path string) ([]importSong, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !slices.Contains(csvManifestColumns, name) {
+			return nil, fmt.Errorf("invalid manifest %s: unknown column %q", path, name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, fmt.Errorf("invalid manifest %s: the title column is required", path)
+	}
+
+	var songs []importSong
+	songIndex := make(map[string]int)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		origin := fmt.Sprintf("%s:%d", filepath.Base(path), line)
+		cell := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		key := strings.ToLower(cell("title")) + "\x00" + strings.ToLower(cell("artist"))
+		i, ok := songIndex[key]
+		if !ok {
+			song := importSong{origin: origin}
+			song.Title, song.Artist = cell("title"), cell("artist")
+			song.Thumbnail, song.Reading = cell("thumbnail"), cell("reading")
+			for _, g := range strings.Split(cell("genre")+";"+cell("genres"), ";") {
+				if g = strings.TrimSpace(g); g != "" {
+					song.Genres = append(song.Genres, g)
+				}
+			}
+			if s := cell("base_difficulty"); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("%s: base_difficulty must be a number", origin)
+				}
+				song.BaseDifficulty = &n
+			}
+			i = len(songs)
+			songIndex[key] = i
+			songs = append(songs, song)
+		}
+
+		if file := cell("file"); file != "" {
+			sheet := importSheet{File: file, SheetPart: SheetPart{Instrument: cell("instrument"), Part: cell("part")}}
+			if s := cell("difficulty"); s != "" {
+				if sheet.Difficulty, err = strconv.Atoi(s); err != nil {
+					return nil, fmt.Errorf("%s: difficulty must be a number", origin)
+				}
+			}
+			songs[i].Sheets = append(songs[i].Sheets, sheet)
+		}
+	}
+	return songs, nil
+}
+
+// readImportSheet reads a MusicXML file of the catalog and checks that it can be parsed.
+func readImportSheet(dir string, s importSheet) (SheetInput, error) {
+	data, err := os.ReadFile(filepath.Join(dir, s.File))
+	if err != nil {
+		return SheetInput{}, err
+	}
+	in := SheetInput{Difficulty: s.Difficulty, Sheet: string(data), SheetPart: s.SheetPart}
+	if err := in.Validate(); err != nil {
+		return SheetInput{}, err
+	}
+	if _, err := in.Analyze(); err != nil {
+		return SheetInput{}, fmt.Errorf("invalid MusicXML: %w", err)
+	}
+	return in, nil
+}
+
+// reportUnlistedSheets warns about MusicXML files of the directory that the manifest does not mention.
+func reportUnlistedSheets(dir string, listed map[string]bool, w io.Writer) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".musicxml" && ext != ".xml") || listed[e.Name()] {
+			continue
+		}
+		fmt.Fprintf(w, "%s: not listed in the manifest, skipped\n", e.Name())
+	}
+}
+
+// importMusic updates the music with the same title and artist, or creates it.
+func importMusic(tx *sql.Tx, in MusicInput) (id int, created bool, err error) {
+	err = tx.QueryRow("SELECT id FROM Music WHERE title = ? COLLATE NOCASE AND artist = ? COLLATE NOCASE ORDER BY id LIMIT 1",
+		in.Title, in.Artist).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		id, err = insertMusic(tx, in)
+		return id, true, err
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to look up music %q: %w", in.Title, err)
+	}
+	return id, false, updateMusic(tx, id, in)
+}
+
+// importSheetLabel names the part of an imported sheet in the report, e.g. "piano/right hand".
+func importSheetLabel(in SheetInput) string {
+	if in.Part == "" {
+		return in.Instrument
+	}
+	return in.Instrument + "/" + in.Part
+}
+
+// putImportedSheet stores a sheet of an imported song, replacing the sheet of the same part and difficulty.
+// It returns "added", "replaced" or "unchanged".
+func putImportedSheet(tx *sql.Tx, musicID int, in SheetInput) (string, error) {
+	res, err := tx.Exec("DELETE FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ? AND generated = 1",
+		musicID, in.Instrument, in.Part, in.Difficulty)
+	if err != nil {
+		return "", fmt.Errorf("failed to replace generated sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+	}
+	replacedGenerated, _ := res.RowsAffected()
+
+	var id int
+	var sheet string
+	err = tx.QueryRow("SELECT id, sheet FROM Sheets WHERE music_id = ? AND instrument = ? AND part = ? AND difficulty = ?",
+		musicID, in.Instrument, in.Part, in.Difficulty).Scan(&id, &sheet)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if _, err := tx.Exec("INSERT INTO Sheets (music_id, instrument, part, difficulty, sheet) VALUES (?, ?, ?, ?, ?)",
+			musicID, in.Instrument, in.Part, in.Difficulty, in.Sheet); err != nil {
+			return "", fmt.Errorf("failed to insert sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+		}
+		if replacedGenerated > 0 {
+			return "replaced", nil
+		}
+		return "added", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to query sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+	case sheet == in.Sheet:
+		return "unchanged", nil
+	}
+	if _, err := tx.Exec("UPDATE Sheets SET sheet = ? WHERE id = ?", in.Sheet, id); err != nil {
+		return "", fmt.Errorf("failed to update sheet (music_id: %d, difficulty: %d): %w", musicID, in.Difficulty, err)
+	}
+	return "replaced", nil
+}
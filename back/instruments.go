@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"infosystem-musicapp/musicxml"
+)
+
+const (
+	// defaultInstrument is the instrument of sheets stored before sheets were tagged, and of
+	// sheets whose MusicXML does not tell it. The proficiency of older databases belongs to it.
+	defaultInstrument = "guitar"
+	// maxInstrumentNameLength bounds instrument and part names (in characters).
+	maxInstrumentNameLength = 40
+)
+
+var (
+	ErrInstrumentNotSelected = errors.New("the instrument is not selected")
+	ErrNoInstrumentSelected  = errors.New("at least one instrument must be selected")
+)
+
+// SheetPart identifies the sheets of one part of a music for one instrument, such as the
+// "soprano" part for "recorder". The unnamed part "" is the whole arrangement for the instrument.
+// In requests, an empty Instrument stands for the user's current instrument, and an empty Part
+// for the first part of the instrument (the unnamed one when there is one).
+type SheetPart struct {
+	Instrument string `json:"instrument" form:"instrument"`
+	Part       string `json:"part" form:"part"`
+}
+
+// Normalize lower-cases the instrument and trims both names.
+func (p *SheetPart) Normalize() {
+	p.Instrument = strings.ToLower(strings.TrimSpace(p.Instrument))
+	p.Part = strings.TrimSpace(p.Part)
+}
+
+// Validate normalizes the names and checks their length.
+func (p *SheetPart) Validate() error {
+	p.Normalize()
+	if utf8.RuneCountInString(p.Instrument) > maxInstrumentNameLength || utf8.RuneCountInString(p.Part) > maxInstrumentNameLength {
+		return fmt.Errorf("instrument and part must be at most %d characters", maxInstrumentNameLength)
+	}
+	return nil
+}
+
+// UserInstrument is an instrument the user practices, with the proficiency on it.
+type UserInstrument struct {
+	Instrument  string  `json:"instrument"`
+	Proficiency float64 `json:"proficiency"`
+	Current     bool    `json:"current"` // The instrument used when a request does not name one
+}
+
+// InstrumentSelection is the request body of PUT /instruments.
+type InstrumentSelection struct {
+	Instruments []string `json:"instruments"`
+	Current     string   `json:"current"` // Optional: the first instrument if omitted
+}
+
+// Validate normalizes the names, removes duplicates and defaults the current instrument.
+func (in *InstrumentSelection) Validate() error {
+	var instruments []string
+	for _, name := range in.Instruments {
+		p := SheetPart{Instrument: name}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if p.Instrument == "" {
+			return errors.New("instrument names must not be empty")
+		}
+		if !slices.Contains(instruments, p.Instrument) {
+			instruments = append(instruments, p.Instrument)
+		}
+	}
+	if len(instruments) == 0 {
+		return ErrNoInstrumentSelected
+	}
+	in.Instruments = instruments
+	in.Current = strings.ToLower(strings.TrimSpace(in.Current))
+	if in.Current == "" {
+		in.Current = instruments[0]
+	}
+	if !slices.Contains(instruments, in.Current) {
+		return errors.New("'current' must be one of 'instruments'")
+	}
+	return nil
+}
+
+// setupInstruments tags sheets and user data by instrument. Untagged sheets, the proficiency
+// and the difficulty settings of older databases belong to defaultInstrument.
+func setupInstruments(db execer) error {
+	stmts := []string{
+		"ALTER TABLE Sheets ADD COLUMN part TEXT NOT NULL DEFAULT ''",
+		"UPDATE Sheets SET instrument = '" + defaultInstrument + "' WHERE instrument IS NULL OR instrument = ''",
+		"UPDATE Music SET instrument = '" + defaultInstrument + "' WHERE instrument = ''",
+		"DROP INDEX IF EXISTS idx_sheets_music_difficulty",
+		"CREATE UNIQUE INDEX idx_sheets_music_part ON Sheets(music_id, instrument, part, difficulty)",
+
+		// Selected instruments with their proficiency; exactly one of them is current
+		`CREATE TABLE UserInstruments (
+			instrument TEXT PRIMARY KEY,
+			proficiency REAL NOT NULL DEFAULT 0.0,
+			selected INTEGER NOT NULL DEFAULT 1,
+			current INTEGER NOT NULL DEFAULT 0
+		)`,
+		"CREATE UNIQUE INDEX idx_user_instruments_current ON UserInstruments(current) WHERE current = 1",
+		`INSERT INTO UserInstruments (instrument, proficiency, selected, current)
+			SELECT '` + defaultInstrument + `', COALESCE((SELECT proficiency FROM UserProficiency WHERE singleton_key = 1), 0.0), 1, 1`,
+		"DROP TABLE UserProficiency",
+
+		// The primary key of the settings gains the instrument, so the table is rebuilt
+		`CREATE TABLE UserMusicDifficultySettings_new (
+			music_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			measure INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			PRIMARY KEY (music_id, instrument, measure),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		`INSERT INTO UserMusicDifficultySettings_new (music_id, instrument, measure, difficulty)
+			SELECT music_id, '` + defaultInstrument + `', measure, difficulty FROM UserMusicDifficultySettings`,
+		"DROP TABLE UserMusicDifficultySettings",
+		"ALTER TABLE UserMusicDifficultySettings_new RENAME TO UserMusicDifficultySettings",
+	}
+	return execAll(stmts...)(db)
+}
+
+// dropInstruments is the down step of setupInstruments. Only the proficiency and the difficulty
+// settings of the current instrument are kept, and of sheets with the same difficulty, the
+// first one inserted.
+func dropInstruments(db execer) error {
+	stmts := []string{
+		`CREATE TABLE UserMusicDifficultySettings_old (
+			music_id INTEGER NOT NULL,
+			measure INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			PRIMARY KEY (music_id, measure),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		`INSERT INTO UserMusicDifficultySettings_old (music_id, measure, difficulty)
+			SELECT music_id, measure, difficulty FROM UserMusicDifficultySettings
+			WHERE instrument = (SELECT instrument FROM UserInstruments WHERE current = 1)`,
+		"DROP TABLE UserMusicDifficultySettings",
+		"ALTER TABLE UserMusicDifficultySettings_old RENAME TO UserMusicDifficultySettings",
+
+		`CREATE TABLE UserProficiency (
+			singleton_key INTEGER PRIMARY KEY DEFAULT 1 CHECK (singleton_key = 1),
+			proficiency REAL NOT NULL DEFAULT 0.0
+		)`,
+		`INSERT INTO UserProficiency (singleton_key, proficiency)
+			SELECT 1, COALESCE((SELECT proficiency FROM UserInstruments WHERE current = 1), 0.0)`,
+		"DROP TABLE UserInstruments",
+
+		"DROP INDEX IF EXISTS idx_sheets_music_part",
+		"ALTER TABLE Sheets DROP COLUMN part",
+	}
+	if err := execAll(stmts...)(db); err != nil {
+		return err
+	}
+	return uniqueSheetDifficulty(db)
+}
+
+// scoreInstrument returns the instrument a score is written for, or defaultInstrument.
+func scoreInstrument(score *musicxml.Score) string {
+	if len(score.Parts) > 0 {
+		if instrument := score.Parts[0].Instrument(); instrument != "" {
+			return instrument
+		}
+	}
+	return defaultInstrument
+}
+
+// currentInstrument returns the instrument a user practices by default.
+func currentInstrument(db execer, userID int) (string, error) {
+	var instrument string
+	err := db.QueryRow("SELECT instrument FROM UserInstruments WHERE user_id = ? AND current = 1", userID).Scan(&instrument)
+	if err == sql.ErrNoRows {
+		return defaultInstrument, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch current instrument: %w", err)
+	}
+	return instrument, nil
+}
+
+// resolveInstrument normalizes an instrument name from a request; empty is the current instrument
+// of the user.
+func resolveInstrument(db execer, userID int, instrument string) (string, error) {
+	if instrument = strings.ToLower(strings.TrimSpace(instrument)); instrument != "" {
+		return instrument, nil
+	}
+	return currentInstrument(db, userID)
+}
+
+// resolveSheetPart fills in the instrument and the part of a request for the sheets of a music.
+// An empty instrument is defaultInstrument: requests of a user resolve it with resolveInstrument
+// first. It returns ErrSheetNotFound when the music has no sheet for the instrument.
+func resolveSheetPart(db execer, musicID int, p SheetPart) (SheetPart, error) {
+	p.Normalize()
+	if p.Instrument == "" {
+		p.Instrument = defaultInstrument
+	}
+	if p.Part != "" {
+		return p, nil
+	}
+	err := db.QueryRow("SELECT part FROM Sheets WHERE music_id = ? AND instrument = ? ORDER BY part LIMIT 1",
+		musicID, p.Instrument).Scan(&p.Part)
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("%w for %s", ErrSheetNotFound, p.Instrument)
+	}
+	if err != nil {
+		return p, fmt.Errorf("failed to query parts of music_id %d: %w", musicID, err)
+	}
+	return p, nil
+}
+
+// ListUserInstruments returns the instruments selected by a user, the current one first.
+func ListUserInstruments(db *sql.DB, userID int) ([]UserInstrument, error) {
+	rows, err := db.Query("SELECT instrument, proficiency, current FROM UserInstruments WHERE user_id = ? AND selected = 1 ORDER BY current DESC, instrument", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instruments: %w", err)
+	}
+	defer rows.Close()
+
+	instruments := []UserInstrument{}
+	for rows.Next() {
+		var ui UserInstrument
+		if err := rows.Scan(&ui.Instrument, &ui.Proficiency, &ui.Current); err != nil {
+			return nil, fmt.Errorf("failed to scan instrument: %w", err)
+		}
+		instruments = append(instruments, ui)
+	}
+	return instruments, rows.Err()
+}
+
+// SetUserInstruments replaces the selection of instruments of a user. Deselected instruments keep their
+// proficiency, which applies again when they are selected back. The input must already have
+// been validated.
+func SetUserInstruments(db *sql.DB, userID int, in InstrumentSelection) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for instruments: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.Exec("UPDATE UserInstruments SET selected = 0, current = 0 WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to clear instrument selection: %w", err)
+	}
+	for _, instrument := range in.Instruments {
+		_, err := tx.Exec(`
+			INSERT INTO UserInstruments (user_id, instrument, selected, current) VALUES (?, ?, 1, ?)
+			ON CONFLICT (user_id, instrument) DO UPDATE SET selected = 1, current = excluded.current`,
+			userID, instrument, instrument == in.Current)
+		if err != nil {
+			return fmt.Errorf("failed to select instrument %s: %w", instrument, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit instrument selection: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Selected instruments %v for user %d (current: %s)", in.Instruments, userID, in.Current)
+	return nil
+}
+
+// GetProficiency returns the proficiency of a user on a selected instrument (empty: the current one).
+func GetProficiency(db execer, userID int, instrument string) (float64, error) {
+	instrument, err := resolveInstrument(db, userID, instrument)
+	if err != nil {
+		return 0, err
+	}
+	var proficiency float64
+	err = db.QueryRow("SELECT proficiency FROM UserInstruments WHERE user_id = ? AND instrument = ? AND selected = 1",
+		userID, instrument).Scan(&proficiency)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrInstrumentNotSelected, instrument)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch proficiency on %s: %w", instrument, err)
+	}
+	return proficiency, nil
+}
+
+// SetProficiency updates the proficiency of a user on a selected instrument (empty: the current one)
+// and records the change in the proficiency history.
+func SetProficiency(db *sql.DB, userID int, instrument string, proficiency float64, change ProficiencyChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for proficiency: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	if instrument, err = resolveInstrument(tx, userID, instrument); err != nil {
+		return err
+	}
+	previous, err := GetProficiency(tx, userID, instrument)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE UserInstruments SET proficiency = ? WHERE user_id = ? AND instrument = ? AND selected = 1",
+		proficiency, userID, instrument); err != nil {
+		return fmt.Errorf("failed to update proficiency on %s: %w", instrument, err)
+	}
+	if err := recordProficiencyChange(tx, userID, instrument, previous, proficiency, change); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit proficiency on %s: %w", instrument, err)
+	}
+	successfulCommit = true
+	return nil
+}
+
+// musicInstruments returns the instruments that have sheets for a music.
+func musicInstruments(db *sql.DB, musicID int) ([]string, error) {
+	return queryInstruments(db, "SELECT DISTINCT instrument FROM Sheets WHERE music_id = ? AND difficulty != ? ORDER BY instrument",
+		musicID, accompanimentDifficulty)
+}
+
+// CatalogInstruments returns the instruments that have sheets in the catalog.
+func CatalogInstruments(db *sql.DB) ([]string, error) {
+	return queryInstruments(db, "SELECT DISTINCT instrument FROM Sheets WHERE difficulty != ? ORDER BY instrument", accompanimentDifficulty)
+}
+
+func queryInstruments(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instruments: %w", err)
+	}
+	defer rows.Close()
+
+	instruments := []string{}
+	for rows.Next() {
+		var instrument string
+		if err := rows.Scan(&instrument); err != nil {
+			return nil, fmt.Errorf("failed to scan instrument: %w", err)
+		}
+		instruments = append(instruments, instrument)
+	}
+	return instruments, rows.Err()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeSearchText folds text into the form stored in the search index, so that a query
+// matches regardless of how it was typed: "アイドル", "あいどる", "ｱｲﾄﾞﾙ" and "Aidoru" all become "aidoru".
+// Widths are unified by NFKC, case is folded, kana is romanized (Hepburn), romaji typed in other
+// styles (e.g. "tubasa", "sinzidai") is respelled in Hepburn, and long vowels are shortened.
+// ん before a vowel or y is written "n'" as in Hepburn, so "きんえん" ("kin'en") and "きねん" ("kinen") stay apart.
+// Kanji and other scripts are kept as they are.
+func normalizeSearchText(s string) string {
+	s = strings.ToLower(norm.NFKC.String(s))
+	s = macronReplacer.Replace(s)
+
+	var b strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case isKana(r):
+			end := len(s)
+			for i, r := range s {
+				if !isKana(r) {
+					end = i
+					break
+				}
+			}
+			b.WriteString(kanaToRomaji(s[:end]))
+			s = s[end:]
+		case r >= 'a' && r <= 'z':
+			end := len(s)
+			for i := 0; i < len(s); i++ {
+				if s[i] < 'a' || s[i] > 'z' {
+					end = i
+					break
+				}
+			}
+			b.WriteString(canonicalRomaji(s[:end]))
+			s = s[end:]
+		default:
+			b.WriteRune(r)
+			s = s[size:]
+		}
+	}
+	return b.String()
+}
+
+// macronReplacer spells out long vowels written with a macron or circumflex (e.g. "Tōkyō").
+var macronReplacer = strings.NewReplacer(
+	"ā", "aa", "ī", "ii", "ū", "uu", "ē", "ee", "ō", "ou",
+	"â", "aa", "î", "ii", "û", "uu", "ê", "ee", "ô", "ou",
+)
+
+// isKana reports whether r is a hiragana, a katakana or the long vowel mark.
+func isKana(r rune) bool {
+	return (r >= 'ぁ' && r <= 'ゖ') || (r >= 'ァ' && r <= 'ヺ') || r == 'ー'
+}
+
+// toHiragana maps a katakana to the corresponding hiragana.
+func toHiragana(r rune) rune {
+	switch {
+	case r >= 'ァ' && r <= 'ヶ':
+		return r - 'ァ' + 'ぁ'
+	case r == 'ヷ':
+		return 'わ'
+	case r == 'ヸ':
+		return 'い'
+	case r == 'ヹ':
+		return 'え'
+	case r == 'ヺ':
+		return 'を'
+	}
+	return r
+}
+
+// kanaToRomaji romanizes a run of kana in Hepburn and shortens its long vowels.
+func kanaToRomaji(kana string) string {
+	var runes []rune
+	for _, r := range kana {
+		runes = append(runes, toHiragana(r))
+	}
+
+	var b strings.Builder
+	double := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == 'っ' {
+			double = true
+			continue
+		}
+		if r == 'ー' {
+			continue
+		}
+		syllable := ""
+		if i+1 < len(runes) {
+			if s, ok := kanaDigraphs[string(runes[i:i+2])]; ok {
+				syllable = s
+				i++
+			}
+		}
+		if syllable == "" {
+			syllable = kanaSyllables[r]
+		}
+		if r == 'ん' && i+1 < len(runes) {
+			// Hepburn separates ん from a following vowel or y with an apostrophe ("shin'ya").
+			if next := kanaSyllables[runes[i+1]]; next != "" && strings.ContainsRune("aiueoy", rune(next[0])) {
+				syllable = "n'"
+			}
+		}
+		if double && syllable != "" && !strings.ContainsRune("aiueon", rune(syllable[0])) {
+			if strings.HasPrefix(syllable, "ch") {
+				b.WriteByte('t')
+			} else {
+				b.WriteByte(syllable[0])
+			}
+		}
+		double = false
+		b.WriteString(syllable)
+	}
+	return shortenLongVowels(b.String())
+}
+
+// canonicalRomaji respells a word of romaji in Hepburn. Words that are not romaji
+// (e.g. English titles) are returned unchanged.
+func canonicalRomaji(word string) string {
+	kana, ok := romajiToKana(word)
+	if !ok {
+		return word
+	}
+	return kanaToRomaji(kana)
+}
+
+// romajiToKana reads a lowercase word as romaji, accepting Hepburn, Kunrei and common IME spellings.
+// ok is false when some part of the word is not romaji.
+func romajiToKana(word string) (kana string, ok bool) {
+	var b strings.Builder
+	for i := 0; i < len(word); {
+		c := word[i]
+		var next, afterNext byte
+		if i+1 < len(word) {
+			next = word[i+1]
+		}
+		if i+2 < len(word) {
+			afterNext = word[i+2]
+		}
+
+		switch {
+		case c == 'n' && !isRomajiVowel(next) && next != 'y':
+			// "n" before a consonant or at the end, and "nn" not followed by a vowel, are ん.
+			b.WriteRune('ん')
+			i++
+			if next == 'n' && !isRomajiVowel(afterNext) && afterNext != 'y' {
+				i++
+			}
+			continue
+		case next != 0 && !isRomajiVowel(c) && (c == next || (c == 't' && next == 'c')):
+			// A doubled consonant ("kk", "tch") is a small っ.
+			b.WriteRune('っ')
+			i++
+			continue
+		}
+
+		matched := false
+		for n := min(3, len(word)-i); n > 0; n-- {
+			if k, found := romajiSyllables[word[i:i+n]]; found {
+				b.WriteString(k)
+				i += n
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+func isRomajiVowel(c byte) bool {
+	return c == 'a' || c == 'i' || c == 'u' || c == 'e' || c == 'o'
+}
+
+// shortenLongVowels writes every long vowel as a single one ("toukyou" -> "tokyo", "kawaii" -> "kawai"),
+// because they are spelled inconsistently in romaji.
+func shortenLongVowels(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	b := []byte{s[0]}
+	for i := 1; i < len(s); i++ {
+		prev := b[len(b)-1]
+		if isRomajiVowel(s[i]) && (s[i] == prev || (prev == 'o' && s[i] == 'u')) {
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// kanaSyllables romanizes single hiragana.
+var kanaSyllables = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゎ': "wa", 'ゕ': "ka", 'ゖ': "ke",
+}
+
+// kanaDigraphs romanizes kana followed by a small kana that together form one syllable.
+var kanaDigraphs = map[string]string{
+	"きゃ": "kya", "きゅ": "kyu", "きょ": "kyo",
+	"ぎゃ": "gya", "ぎゅ": "gyu", "ぎょ": "gyo",
+	"しゃ": "sha", "しゅ": "shu", "しぇ": "she", "しょ": "sho",
+	"じゃ": "ja", "じゅ": "ju", "じぇ": "je", "じょ": "jo",
+	"ちゃ": "cha", "ちゅ": "chu", "ちぇ": "che", "ちょ": "cho",
+	"ぢゃ": "ja", "ぢゅ": "ju", "ぢょ": "jo",
+	"にゃ": "nya", "にゅ": "nyu", "にょ": "nyo",
+	"ひゃ": "hya", "ひゅ": "hyu", "ひょ": "hyo",
+	"びゃ": "bya", "びゅ": "byu", "びょ": "byo",
+	"ぴゃ": "pya", "ぴゅ": "pyu", "ぴょ": "pyo",
+	"みゃ": "mya", "みゅ": "myu", "みょ": "myo",
+	"りゃ": "rya", "りゅ": "ryu", "りょ": "ryo",
+	"ふぁ": "fa", "ふぃ": "fi", "ふぇ": "fe", "ふぉ": "fo",
+	"ゔぁ": "va", "ゔぃ": "vi", "ゔぇ": "ve", "ゔぉ": "vo",
+	"てぃ": "ti", "でぃ": "di", "とぅ": "tu", "どぅ": "du",
+	"うぃ": "wi", "うぇ": "we", "うぉ": "wo", "いぇ": "ye",
+}
+
+// romajiSyllables reads romaji syllables as hiragana. Kunrei and IME spellings ("si", "tu", "zya")
+// map to the same kana as Hepburn, so that they are respelled consistently.
+var romajiSyllables = map[string]string{
+	"a": "あ", "i": "い", "u": "う", "e": "え", "o": "お",
+	"ka": "か", "ki": "き", "ku": "く", "ke": "け", "ko": "こ",
+	"ga": "が", "gi": "ぎ", "gu": "ぐ", "ge": "げ", "go": "ご",
+	"sa": "さ", "shi": "し", "si": "し", "su": "す", "se": "せ", "so": "そ",
+	"za": "ざ", "ji": "じ", "zi": "じ", "zu": "ず", "ze": "ぜ", "zo": "ぞ",
+	"ta": "た", "chi": "ち", "ti": "ち", "tsu": "つ", "tu": "つ", "te": "て", "to": "と",
+	"da": "だ", "di": "ぢ", "du": "づ", "de": "で", "do": "ど",
+	"na": "な", "ni": "に", "nu": "ぬ", "ne": "ね", "no": "の",
+	"ha": "は", "hi": "ひ", "fu": "ふ", "hu": "ふ", "he": "へ", "ho": "ほ",
+	"ba": "ば", "bi": "び", "bu": "ぶ", "be": "べ", "bo": "ぼ",
+	"pa": "ぱ", "pi": "ぴ", "pu": "ぷ", "pe": "ぺ", "po": "ぽ",
+	"ma": "ま", "mi": "み", "mu": "む", "me": "め", "mo": "も",
+	"ya": "や", "yu": "ゆ", "yo": "よ", "ye": "いぇ",
+	"ra": "ら", "ri": "り", "ru": "る", "re": "れ", "ro": "ろ",
+	"wa": "わ", "wi": "うぃ", "we": "うぇ", "wo": "を",
+	"kya": "きゃ", "kyu": "きゅ", "kyo": "きょ",
+	"gya": "ぎゃ", "gyu": "ぎゅ", "gyo": "ぎょ",
+	"sha": "しゃ", "shu": "しゅ", "she": "しぇ", "sho": "しょ",
+	"sya": "しゃ", "syu": "しゅ", "syo": "しょ",
+	"ja": "じゃ", "ju": "じゅ", "je": "じぇ", "jo": "じょ",
+	"jya": "じゃ", "jyu": "じゅ", "jyo": "じょ",
+	"zya": "じゃ", "zyu": "じゅ", "zyo": "じょ",
+	"cha": "ちゃ", "chu": "ちゅ", "che": "ちぇ", "cho": "ちょ",
+	"tya": "ちゃ", "tyu": "ちゅ", "tyo": "ちょ",
+	"cya": "ちゃ", "cyu": "ちゅ", "cyo": "ちょ",
+	"nya": "にゃ", "nyu": "にゅ", "nyo": "にょ",
+	"hya": "ひゃ", "hyu": "ひゅ", "hyo": "ひょ",
+	"bya": "びゃ", "byu": "びゅ", "byo": "びょ",
+	"pya": "ぴゃ", "pyu": "ぴゅ", "pyo": "ぴょ",
+	"mya": "みゃ", "myu": "みゅ", "myo": "みょ",
+	"rya": "りゃ", "ryu": "りゅ", "ryo": "りょ",
+	"fa": "ふぁ", "fi": "ふぃ", "fe": "ふぇ", "fo": "ふぉ",
+	"va": "ゔぁ", "vi": "ゔぃ", "vu": "ゔ", "ve": "ゔぇ", "vo": "ゔぉ",
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestNormalizeSearchText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"katakana", "アイドル", "aidoru"},
+		{"hiragana", "あいどる", "aidoru"},
+		{"half-width katakana", "ｱｲﾄﾞﾙ", "aidoru"},
+		{"capitalized romaji", "Aidoru", "aidoru"},
+		{"full-width romaji", "ＡＩＤＯＲＵ", "aidoru"},
+		{"kunrei romaji", "tubasa", "tsubasa"},
+		{"kunrei romaji with z", "sinzidai", "shinjidai"},
+		{"IME romaji", "zyanru", "janru"},
+		{"long vowel mark", "コーヒー", "kohi"},
+		{"long vowel in kana", "とうきょう", "tokyo"},
+		{"macron", "Tōkyō", "tokyo"},
+		{"doubled vowel in romaji", "kawaii", "kawai"},
+		{"small tsu", "がっこう", "gakko"},
+		{"small tsu before chi", "まっちゃ", "matcha"},
+		{"doubled consonant in romaji", "matcha", "matcha"},
+		{"digraph", "しゃしん", "shashin"},
+		{"n before consonant", "さんぽ", "sanpo"},
+		{"n at the end", "ほん", "hon"},
+		{"n before n", "こんにちは", "konnichiha"},
+		{"n before vowel", "きんえん", "kin'en"},
+		{"n before syllable with n", "きねん", "kinen"},
+		{"n before y", "しんや", "shin'ya"},
+		{"n before digraph with n", "しにゃ", "shinya"},
+		{"n first", "んあ", "n'a"},
+		{"n before vowel in romaji", "kin'en", "kin'en"},
+		{"n before small tsu", "ぽんっ", "pon"},
+		{"english words", "Hello World", "hello world"},
+		{"kanji kept", "東京タワー", "東京tawa"},
+		{"kana between kanji", "夜に駆ける YOASOBI", "夜ni駆keru yoasobi"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeSearchText(tt.in); got != tt.want {
+				t.Errorf("normalizeSearchText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeSearchTextKeepsReadingsApart(t *testing.T) {
+	pairs := [][2]string{
+		{"きんえん", "きねん"},
+		{"んあ", "な"},
+		{"しんや", "しにゃ"},
+		{"かんい", "かに"},
+	}
+	for _, p := range pairs {
+		if a, b := normalizeSearchText(p[0]), normalizeSearchText(p[1]); a == b {
+			t.Errorf("%s and %s both normalize to %q", p[0], p[1], a)
+		}
+	}
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
+
+	"infosystem-musicapp/musicxml"
 )
 
 func main() {
@@ -25,9 +32,19 @@ func main() {
 	}
 	defer db.Close()
 
-	// setup db schema
-	if err := setupDBSchema(db); err != nil {
-		log.Fatal(err)
+	// setup db schema ("back migrate" manages the schema version itself)
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		if err := setupDBSchema(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// run a maintenance command (e.g. "back recompute-difficulty") instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	// setup gin router
@@ -37,6 +54,8 @@ func main() {
 		AllowMethods: []string{
 			"POST",
 			"GET",
+			"PUT",
+			"DELETE",
 			"OPTIONS",
 		},
 		AllowHeaders: []string{
@@ -50,20 +69,36 @@ func main() {
 	}))
 
 	hello(r)
+	auth_api(r, db)
+	spotify_auth_api(r, db)
 
-	search_api(r, db)
+	// Endpoints serving the data of the logged-in user (see userAuthRequired)
+	user := r.Group("/", userAuthRequired(db))
 
-	select_api(r, db)
+	search_api(user, db)
+	search_suggest_api(r, db)
 
-	proficiency_api(r, db)
+	select_api(user, db)
 
-	spotify_recommend_api(r)
-	proficiency_recommend_api(r, db)
+	proficiency_api(user, db)
+	instruments_api(user, db)
 
-	favorites_api(r, db)
-	history_api(r, db)
-	difficulty_settings_api(r, db)
-	calc_proficiency_api(r, db) // db を渡すように変更
+	spotify_recommend_api(user, db)
+	proficiency_recommend_api(user, db)
+
+	favorites_api(user, db)
+	history_api(user, db)
+	quick_access_api(user, db)
+	difficulty_settings_api(user, db)
+	calc_proficiency_api(user, db) // db を渡すように変更
+	catalog_api(r, db)
+	backup_api(r, db)
+	sheet_pitches_api(user, db)
+	sheet_midi_api(user, db)
+	sheet_tab_api(r, db)
+	composed_sheet_api(user, db)
+	genres_api(r, db)
+	images_api(r, db)
 
 	r.Run(":8080")
 
@@ -71,25 +106,24 @@ func main() {
 
 // SpotifyRecommendRequest defines the structure for the recommendation request body.
 type SpotifyRecommendRequest struct {
-	AccessToken string `json:"access_token"`
-	Limit       int    `json:"limit"` // Optional: Max number of recently played tracks to fetch from Spotify (default: 10)
-	Count       int    `json:"count"` // Optional: Number of tracks to recommend (default: 2)
+	Limit int `json:"limit"` // Optional: Max number of recently played tracks to fetch from Spotify (default: 10)
+	Count int `json:"count"` // Optional: Number of tracks to recommend (default: 2)
 }
 
 /*
  * Handles requests to the /recommendations/spotify endpoint.
  *
  * This API endpoint provides song recommendations based on the user's recently played tracks
- * on Spotify. It requires a valid Spotify access token.
+ * on Spotify. The user must have connected a Spotify account with /auth/spotify/login; the
+ * backend uses and refreshes the stored tokens of that account.
  *
  * Method: POST
  * URL: /recommendations/spotify
  *
- * Request Body (JSON):
+ * Request Body (JSON, optional):
  * {
- *   "access_token": "YOUR_SPOTIFY_ACCESS_TOKEN", // Required: User's Spotify access token
- *   "limit": 10,                                  // Optional: How many recent tracks to consider (default: 10)
- *   "count": 2                                    // Optional: How many recommendations to return (default: 2)
+ *   "limit": 10, // Optional: How many recent tracks to consider (default: 10)
+ *   "count": 2   // Optional: How many recommendations to return (default: 2)
  * }
  *
  * Successful Response (200 OK, JSON):
@@ -114,22 +148,41 @@ type SpotifyRecommendRequest struct {
  * Error Responses:
  * - 400 Bad Request (JSON): If the request body is invalid.
  *   { "error": "Invalid request body" }
+ * - 409 Conflict (JSON): If the user has not connected a Spotify account, or has revoked its access.
+ * - 502 Bad Gateway (JSON): If Spotify could not be reached or answered with an error.
  * - 500 Internal Server Error (JSON): If there's an error fetching or processing recommendations.
  *   { "error": "Description of the error" }
  */
-func spotify_recommend_api(r *gin.Engine) {
+func spotify_recommend_api(r gin.IRouter, db *sql.DB) {
 	r.POST("/recommendations/spotify", func(ctx *gin.Context) {
 		var request SpotifyRecommendRequest
-		if err := ctx.BindJSON(&request); err != nil {
+		if err := ctx.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 			return
 		}
 
-		recommendations, err := GetRecommendationsFromRecentlyPlayed(request.AccessToken, request.Limit, request.Count)
+		user := currentUser(ctx)
+		recommendations, err := GetRecommendationsFromRecentlyPlayed(db, user.ID, request.Limit, request.Count)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			switch {
+			case errors.Is(err, ErrSpotifyNotConnected):
+				ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrSpotifyRequestFailed):
+				log.Printf("Error getting recently played tracks of user %d: %v", user.ID, err)
+				ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			default:
+				log.Printf("Error getting Spotify recommendations for user %d: %v", user.ID, err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
+		for i := range recommendations {
+			if err := registerImage(db, recommendations[i].ImageURL); err != nil {
+				log.Printf("Warning: Failed to register the image of track %s: %v", recommendations[i].ID, err)
+				continue
+			}
+			recommendations[i].CachedImageURL = cachedImagePath(recommendations[i].ImageURL)
+		}
 
 		ctx.JSON(http.StatusOK, recommendations)
 	})
@@ -144,163 +197,124 @@ func hello(r *gin.Engine) {
 	})
 }
 
+// setupDBSchema brings the schema up to date (see migrations.go) and prepares the search index.
 func setupDBSchema(db *sql.DB) error {
-	cmd := `create table if not exists Music(
-	id integer primary key autoincrement,
-	title text not null,
-	artist text,
-	base_difficulty integer,
-	genre text,
-	thumbnail text
-	)`
-
-	if _, err := db.Exec(cmd); err != nil {
-		return err
-	}
-
-	cmd = `create table if not exists Sheets(
-	id integer primary key autoincrement,
-	music_id integer,
-	difficulty integer not null,
-	sheet text not null,
-	foreign key (music_id) references Music(id)
-	)`
-
-	if _, err := db.Exec(cmd); err != nil {
-		return err
-	}
-
-	// UserProficiency table
-	cmd = `CREATE TABLE IF NOT EXISTS UserProficiency (
-		singleton_key INTEGER PRIMARY KEY DEFAULT 1 CHECK (singleton_key = 1),
-		proficiency REAL NOT NULL DEFAULT 0.0
-	)`
-	if _, err := db.Exec(cmd); err != nil {
-		return fmt.Errorf("failed to create UserProficiency table: %w", err)
-	}
-	// Initialize proficiency if it doesn't exist
-	cmd = `INSERT OR IGNORE INTO UserProficiency (singleton_key, proficiency) VALUES (1, 0.0)`
-	if _, err := db.Exec(cmd); err != nil {
-		return fmt.Errorf("failed to initialize UserProficiency: %w", err)
-	}
-
-	// Favorites table
-	cmd = `CREATE TABLE IF NOT EXISTS Favorites (
-		music_id INTEGER PRIMARY KEY,
-		order_key INTEGER NOT NULL,
-		FOREIGN KEY (music_id) REFERENCES Music(id)
-	)`
-	if _, err := db.Exec(cmd); err != nil {
-		return fmt.Errorf("failed to create Favorites table: %w", err)
-	}
-
-	// UserMusicDifficultySettings table
-	cmd = `CREATE TABLE IF NOT EXISTS UserMusicDifficultySettings (
-		music_id INTEGER NOT NULL,
-		measure INTEGER NOT NULL,
-		difficulty INTEGER NOT NULL,
-		PRIMARY KEY (music_id, measure),
-		FOREIGN KEY (music_id) REFERENCES Music(id)
-	)`
-	if _, err := db.Exec(cmd); err != nil {
+	if err := migrateOnStartup(db); err != nil {
 		return err
 	}
 
-	// SearchHistory table
-	cmd = `CREATE TABLE IF NOT EXISTS SearchHistory (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		music_id INTEGER NOT NULL,
-		title TEXT NOT NULL,
-		artist TEXT,
-		thumbnail TEXT,
-		searched_at DATETIME NOT NULL
-	)`
-	if _, err := db.Exec(cmd); err != nil {
-		return fmt.Errorf("failed to create SearchHistory table: %w", err)
-	}
-	return nil
+	// Full-text search index of the catalog. Its kind depends on the build (FTS5 or not),
+	// so it is checked on every start rather than by a migration.
+	return setupSearchIndex(db)
 }
 
-func search_api(r *gin.Engine, db *sql.DB) {
+/*
+ * Search music (POST /search)
+ * Body: SearchQuery, e.g. {"text_search": "love", "genres": ["ROCK"], "min_difficulty": 2,
+ *       "has_sheet": 3, "fits_proficiency": true, "sort": "-difficulty", "limit": 20}
+ * Musical metadata filters: "min_tempo"/"max_tempo" (BPM), "keys" (["G", "Em"]), "time_signatures"
+ * (["3/4"]), "min_duration"/"max_duration" (seconds), "min_measures"/"max_measures",
+ * "lowest_pitch"/"highest_pitch" (the whole range of the music must fit, e.g. "E2"/"E5") and
+ * "instruments" (["guitar"]); "sort" also accepts "tempo" and "duration".
+ * Filters are combined with AND; pass the returned next_cursor as "cursor" to get the next page.
+ * When a text search finds fewer than 3 music, similar titles and artists are appended ("fuzzy": true)
+ * and the best of them is suggested as "did_you_mean".
+ * Response: {"items": [DisplayMusic], "total": n, "next_cursor": "...", "fuzzy": true, "did_you_mean": "..."}
+ */
+func search_api(r gin.IRouter, db *sql.DB) {
 	r.POST("/search", func(ctx *gin.Context) {
+		user := currentUser(ctx)
 		var query SearchQuery
 		if err := ctx.BindJSON(&query); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if err := query.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search query: " + err.Error()})
+			return
+		}
+		query.userID = user.ID
 
-		var result []DisplayMusic
-		var rows *sql.Rows
-		var err error
-		baseQuery := "SELECT id, title, artist, thumbnail FROM Music "
-		var args []interface{}
-
-		fmt.Println(query)
-
-		/*
-			switch query.SearchCategory {
-			case DiffSearch.String():
-				baseQuery += "WHERE base_difficulty = ?"
-				args = append(args, query.DiffSearch)
-			case KeywordSearch.String():
-		*/
-		searchText := "%" + query.TextSearch + "%"
-		baseQuery += "WHERE title LIKE ? OR artist LIKE ?"
-		args = append(args, searchText, searchText)
-		/*
-			case GenreSearch.String():
-				baseQuery += "WHERE genre = ?"
-				args = append(args, query.GenreSearch)
-			default:
-				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search category"})
+		result, err := SearchMusic(db, query)
+		if err != nil {
+			if errors.Is(err, ErrUnknownGenre) || errors.Is(err, ErrInvalidCursor) || errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-		*/
-
-		log.Printf("Executing search query: %s with args: %v", baseQuery, args) // For debugging
-
-		rows, err = db.Query(baseQuery, args...)
-		if err != nil {
-			log.Printf("Error executing search query: %v", err) // Changed log.Fatal to log.Printf
+			log.Printf("Error executing search query: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error executing query"})
 			return
 		}
-		defer rows.Close()
 
-		for rows.Next() {
-			var dm DisplayMusic
-			if scanErr := rows.Scan(&dm.MusicID, &dm.Title, &dm.Artist, &dm.Thumbnail); scanErr != nil {
-				log.Printf("Database scan error in search: %v", scanErr)
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Database scan error"})
-				return
+		// Only the first page is a new search typed by the user
+		if query.Cursor == "" {
+			if err := AddQueryToHistory(db, user.ID, query.TextSearch); err != nil {
+				// Log error but don't fail the search request itself
+				log.Printf("Warning: Failed to add query to search history: %v", err)
 			}
-			result = append(result, dm)
-		}
-		// Add search results to history
-		if err := AddSearchEntriesToHistory(db, result); err != nil {
-			// Log error but don't fail the search request itself
-			log.Printf("Warning: Failed to add entries to search history: %v", err)
 		}
 
 		ctx.IndentedJSON(http.StatusOK, result)
 	})
 }
 
-func select_api(r *gin.Engine, db *sql.DB) {
+/*
+ * Search-as-you-type completions (GET /search/suggest?q=aido&limit=10)
+ * Returns titles, artists and genres whose words start with q, matched like /search
+ * (kana, romaji, width and case are ignored). Served from memory; nothing is written to the history.
+ * Response: [{"type": "title", "text": "アイドル", "music_id": 1}, {"type": "genre", "text": "アニメ", "slug": "ANIME"}]
+ */
+func search_suggest_api(r *gin.Engine, db *sql.DB) {
+	if err := catalogSuggestions.Rebuild(db); err != nil {
+		log.Printf("Warning: Failed to build the suggestion index: %v", err)
+	}
+
+	r.GET("/search/suggest", func(ctx *gin.Context) {
+		limit := defaultSuggestLimit
+		if s := ctx.Query("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'limit' must be a positive integer"})
+				return
+			}
+			limit = min(n, maxSuggestLimit)
+		}
+		ctx.JSON(http.StatusOK, catalogSuggestions.Lookup(ctx.Query("q"), limit))
+	})
+}
+
+func select_api(r gin.IRouter, db *sql.DB) {
 	r.POST("/select", func(ctx *gin.Context) {
+		user := currentUser(ctx)
 		var req SelectRequest
 		if err := ctx.BindJSON(&req); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
 			return
 		}
+		if err := req.TransposeOptions.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if err := req.SheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		instrument, err := resolveInstrument(db, user.ID, req.Instrument)
+		if err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sheets"})
+			return
+		}
 
 		musicData := Music{MusicID: req.MusicID}
-		var genreStr string
 
 		// Fetch music metadata
-		err := db.QueryRow("SELECT title, artist, genre, thumbnail FROM Music WHERE id = ?", req.MusicID).Scan(
-			&musicData.Title, &musicData.Artist, &genreStr, &musicData.Thumbnail,
+		var md metadataRow
+		err = db.QueryRow("SELECT title, artist, thumbnail, "+metadataColumns+" FROM Music WHERE id = ?", req.MusicID).Scan(
+			append([]any{&musicData.Title, &musicData.Artist, &musicData.Thumbnail}, md.dest()...)...,
 		)
+		musicData.ThumbnailURL = cachedImagePath(musicData.Thumbnail)
+		musicData.SongMetadata = md.metadata()
 		if err != nil {
 			if err == sql.ErrNoRows {
 				ctx.JSON(http.StatusNotFound, gin.H{"error": "Music not found"})
@@ -311,17 +325,31 @@ func select_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		parsedGenre, genreErr := ParseGenre(genreStr)
-		if genreErr != nil {
-			log.Printf("Error parsing genre '%s' for music_id %d: %v", genreStr, req.MusicID, genreErr)
-			// Decide if this is a fatal error or if you want to proceed with a default/unknown genre
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse genre information"})
+		// Genres are informative only: a failure to read them must not prevent playing the music
+		genres, err := GetMusicGenres(db, req.MusicID, requestLocale(ctx, req.Locale))
+		if err != nil {
+			log.Printf("Warning: Failed to get genres for music_id %d: %v", req.MusicID, err)
+			genres = []GenreInfo{}
+		}
+		musicData.Genres = genres
+		if len(genres) > 0 {
+			musicData.Genre = genres[0].Slug
+		}
+
+		// Every instrument of the music, so that the client can offer to switch
+		musicData.Instruments, err = musicInstruments(db, req.MusicID)
+		if err != nil {
+			log.Printf("Database error querying instruments (music_id: %d): %v", req.MusicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sheets"})
 			return
 		}
-		musicData.Genre = parsedGenre
 
-		// Fetch sheets for the music
-		rows, err := db.Query("SELECT sheet, difficulty FROM Sheets WHERE music_id = ?", req.MusicID)
+		// Fetch sheets for the music, the instrument and the part
+		rows, err := db.Query(`
+			SELECT sheet, difficulty, generated, part, `+metadataColumns+` FROM Sheets
+			WHERE music_id = ? AND (difficulty = ? OR (instrument = ? AND (? = '' OR part = ?)))
+			ORDER BY part, difficulty`,
+			req.MusicID, accompanimentDifficulty, instrument, req.Part, req.Part)
 		if err != nil {
 			log.Printf("Database error querying sheets (music_id: %d): %v", req.MusicID, err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sheets"})
@@ -332,11 +360,30 @@ func select_api(r *gin.Engine, db *sql.DB) {
 		var sheets []Sheet
 		for rows.Next() {
 			var s Sheet
-			if scanErr := rows.Scan(&s.Sheet, &s.Difficulty); scanErr != nil {
+			var md metadataRow
+			if scanErr := rows.Scan(append([]any{&s.Sheet, &s.Difficulty, &s.Generated, &s.Part}, md.dest()...)...); scanErr != nil {
 				log.Printf("Database scan error for sheet (music_id: %d): %v", req.MusicID, scanErr)
 				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan sheet data"})
 				return
 			}
+			s.SongMetadata = md.metadata()
+			if !req.TransposeOptions.IsZero() {
+				transposed, semitones, err := transposeSheet(s.Sheet, req.TransposeOptions)
+				if err != nil {
+					if errors.Is(err, musicxml.ErrKeyMismatch) {
+						ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+						return
+					}
+					log.Printf("Error transposing sheet (music_id: %d, difficulty: %d): %v", req.MusicID, s.Difficulty, err)
+					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transpose sheet"})
+					return
+				}
+				s.Sheet, s.Transpose = transposed, semitones
+				// The key and the pitch range follow the transposition
+				if transposedMD, err := describeSheet(s.Sheet); err == nil {
+					s.SongMetadata = transposedMD
+				}
+			}
 			sheets = append(sheets, s)
 		}
 		if err = rows.Err(); err != nil {
@@ -345,6 +392,10 @@ func select_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 		musicData.Sheets = sheets
+
+		if err := AddViewToHistory(db, user.ID, req.MusicID); err != nil {
+			log.Printf("Warning: Failed to add music_id %d to view history: %v", req.MusicID, err)
+		}
 		ctx.IndentedJSON(http.StatusOK, musicData)
 	})
 }
@@ -352,19 +403,30 @@ func select_api(r *gin.Engine, db *sql.DB) {
 // ProficiencyAPIRequest defines the structure for updating proficiency
 type UpdateProficiencyRequest struct {
 	Proficiency float64 `json:"proficiency"`
+	Instrument  string  `json:"instrument"` // Optional: the current instrument if omitted
+	Source      string  `json:"source"`     // Optional: "manual" (default) or "placement", for the history
 }
 
-func proficiency_api(r *gin.Engine, db *sql.DB) {
+/*
+ * Proficiency is tracked per instrument (see /instruments).
+ * GET /proficiency?instrument=piano  Proficiency on the instrument (the current one if omitted)
+ * PUT /proficiency                   Body: { "proficiency": 3.5, "instrument": "piano", "source": "placement" }
+ * GET /proficiency/history           Every change of the proficiency on the instrument, from PUT /proficiency
+ *                                    and /calc_proficiency. Query: ProficiencyHistoryQuery, e.g.
+ *                                    ?group=week&tz=Asia/Tokyo&from=2025-04-01. Returns a ProficiencyHistory:
+ *                                    { "instrument": "piano", "entries": [ProficiencyHistoryEntry], "periods": [] } oldest first, or
+ *                                    with group=day|week { "instrument": "piano", "group": "week", "time_zone": "Asia/Tokyo",
+ *                                    "entries": [], "periods": [{ "start": "...", "open": 3.0, "close": 3.4, "min": 2.9, "max": 3.5,
+ *                                    "average": 3.2, "count": 12, "sources": { "measure": 12 } }] }
+ * All return 400 for an instrument that is not selected.
+ */
+func proficiency_api(r gin.IRouter, db *sql.DB) {
 	// Get current proficiency
 	r.GET("/proficiency", func(ctx *gin.Context) {
-		var proficiency float64
-		err := db.QueryRow("SELECT proficiency FROM UserProficiency WHERE singleton_key = 1").Scan(&proficiency)
+		proficiency, err := GetProficiency(db, currentUser(ctx).ID, ctx.Query("instrument"))
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// This case should ideally be handled by initialization,
-				// but as a fallback, return 0.0 or an appropriate error.
-				log.Printf("UserProficiency record not found, returning default 0.0")
-				ctx.JSON(http.StatusOK, 0.0) // Or http.StatusInternalServerError
+			if errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 			log.Printf("Error fetching proficiency: %v", err)
@@ -382,18 +444,105 @@ func proficiency_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		_, err := db.Exec("UPDATE UserProficiency SET proficiency = ? WHERE singleton_key = 1", req.Proficiency)
-		if err != nil {
+		switch req.Source = strings.ToLower(strings.TrimSpace(req.Source)); req.Source {
+		case "":
+			req.Source = proficiencySourceManual
+		case proficiencySourceManual, proficiencySourcePlacement:
+		default:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "'source' must be manual or placement"})
+			return
+		}
+
+		change := ProficiencyChange{Source: req.Source}
+		if err := SetProficiency(db, currentUser(ctx).ID, req.Instrument, req.Proficiency, change); err != nil {
+			if errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			log.Printf("Error updating proficiency: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update proficiency"})
 			return
 		}
 		ctx.JSON(http.StatusOK, gin.H{"message": "Proficiency updated successfully", "proficiency": req.Proficiency})
 	})
+
+	r.GET("/proficiency/history", func(ctx *gin.Context) {
+		var query ProficiencyHistoryQuery
+		if err := ctx.ShouldBindQuery(&query); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := query.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		history, err := GetProficiencyHistory(db, currentUser(ctx).ID, query)
+		if err != nil {
+			if errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error fetching proficiency history: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch proficiency history"})
+			return
+		}
+		ctx.JSON(http.StatusOK, history)
+	})
+}
+
+/*
+ * Instruments the user practices.
+ * GET /instruments  Returns { "instruments": [UserInstrument], "available": ["guitar", "piano"] }:
+ *                   the selected instruments, the current one first, and the instruments of the catalog
+ * PUT /instruments  Select instruments. Body: InstrumentSelection, e.g.
+ *                   { "instruments": ["recorder", "piano", "voice"], "current": "piano" }.
+ *                   Proficiency, difficulty settings and recommendations are kept per instrument, and
+ *                   requests that do not name an instrument use the current one.
+ */
+func instruments_api(r gin.IRouter, db *sql.DB) {
+	r.GET("/instruments", func(ctx *gin.Context) {
+		instruments, err := ListUserInstruments(db, currentUser(ctx).ID)
+		if err != nil {
+			log.Printf("Error listing instruments: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get instruments"})
+			return
+		}
+		available, err := CatalogInstruments(db)
+		if err != nil {
+			log.Printf("Error listing catalog instruments: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get instruments"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"instruments": instruments, "available": available})
+	})
+
+	r.PUT("/instruments", func(ctx *gin.Context) {
+		var req InstrumentSelection
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := SetUserInstruments(db, currentUser(ctx).ID, req); err != nil {
+			log.Printf("Error selecting instruments: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to select instruments"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Instruments updated successfully", "instruments": req.Instruments, "current": req.Current})
+	})
 }
 
-func proficiency_recommend_api(r *gin.Engine, db *sql.DB) {
+/*
+ * GET /recommendations/proficiency?count=5&tolerance=1&instrument=piano
+ * Random music within tolerance of the proficiency on the instrument (the current one if
+ * omitted) that has a sheet for that instrument.
+ */
+func proficiency_recommend_api(r gin.IRouter, db *sql.DB) {
 	r.GET("/recommendations/proficiency", func(ctx *gin.Context) {
+		user := currentUser(ctx)
 		// Default values
 		defaultCount := 5
 		defaultTolerance := 1
@@ -412,14 +561,17 @@ func proficiency_recommend_api(r *gin.Engine, db *sql.DB) {
 			log.Printf("Invalid 'tolerance' query parameter, using default %d", tolerance)
 		}
 
-		// 1. Get User Proficiency
-		var userProficiencyFloat float64
-		err = db.QueryRow("SELECT proficiency FROM UserProficiency WHERE singleton_key = 1").Scan(&userProficiencyFloat)
+		// 1. Get User Proficiency on the instrument
+		instrument, err := resolveInstrument(db, user.ID, ctx.Query("instrument"))
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// Should be initialized, but handle defensively
-				log.Printf("UserProficiency record not found, cannot make proficiency-based recommendations.")
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User proficiency not found"})
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user proficiency"})
+			return
+		}
+		userProficiencyFloat, err := GetProficiency(db, user.ID, instrument)
+		if err != nil {
+			if errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 			log.Printf("Error fetching user proficiency: %v", err)
@@ -439,10 +591,11 @@ func proficiency_recommend_api(r *gin.Engine, db *sql.DB) {
 			SELECT id, title, artist, thumbnail
 			FROM Music
 			WHERE base_difficulty >= ? AND base_difficulty <= ?
+				AND EXISTS (SELECT 1 FROM Sheets WHERE Sheets.music_id = Music.id AND Sheets.instrument = ?)
 			ORDER BY RANDOM()
 			LIMIT ?`
 
-		rows, err := db.Query(query, minDifficulty, maxDifficulty, count)
+		rows, err := db.Query(query, minDifficulty, maxDifficulty, instrument, count)
 		if err != nil {
 			log.Printf("Error querying proficiency-based recommendations: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query recommendations"})
@@ -458,6 +611,7 @@ func proficiency_recommend_api(r *gin.Engine, db *sql.DB) {
 				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process recommendation data"})
 				return
 			}
+			dm.ThumbnailURL = cachedImagePath(dm.Thumbnail)
 			recommendations = append(recommendations, dm)
 		}
 		ctx.JSON(http.StatusOK, recommendations)
@@ -465,13 +619,20 @@ func proficiency_recommend_api(r *gin.Engine, db *sql.DB) {
 }
 
 // CalculateProficiencyRequest defines the structure for the proficiency calculation request.
+// Either music_id and measure (the expected pitches are then derived from the stored sheet
+// of the given difficulty, transposed like /select) or correct_pitches must be provided.
 type CalculateProficiencyRequest struct {
 	Audio          []float64   `json:"audio" binding:"required"`
 	Difficulty     int         `json:"difficulty"` // 0も有効な値として送信
-	CorrectPitches [][]float64 `json:"correct_pitches" binding:"required"`
+	CorrectPitches [][]float64 `json:"correct_pitches"`
+	MusicID        int         `json:"music_id"`
+	Measure        int         `json:"measure"`
+	TransposeOptions
+	SheetPart // The instrument also selects the current proficiency (the current instrument if omitted)
 }
 
 // CalculateProficiencyResponse defines the structure for the proficiency calculation response.
+// The new proficiency is stored on the instrument and recorded in the proficiency history.
 type CalculateProficiencyResponse struct {
 	Proficiency float64 `json:"proficiency"`
 }
@@ -480,54 +641,31 @@ type Difficulty int
 
 type Proficiency float64
 
-type Genre int
-
-const (
-	Pops Genre = iota
-	Rock
-	Anime //TODO
-)
-
-func (g Genre) String() string {
-	switch g {
-	case Pops:
-		return "Pops"
-	case Rock:
-		return "Rock"
-	case Anime:
-		return "Anime"
-	}
-	return "Unknown" // Default for unhandled cases
-}
-
-func ParseGenre(s string) (Genre, error) {
-	switch s {
-	case "Pops":
-		return Pops, nil
-	case "Rock":
-		return Rock, nil
-	case "Anime":
-		return Anime, nil
-	}
-	return -1, errors.New("unknown genre: " + s) // Return an invalid Genre value and an error
-}
-
 type Sheet struct {
 	Sheet      string `json:"sheet"`
 	Difficulty int    `json:"difficulty"`
+	Generated  bool   `json:"generated"` // true if the sheet was arranged automatically from a harder one
+	Transpose  int    `json:"transpose"` // semitones the sheet was transposed by for this response
+	Part       string `json:"part"`      // Part of the instrument (see SheetPart); the instrument is in SongMetadata
+	SongMetadata
 }
 
 type Music struct {
-	Sheets    []Sheet `json:"sheets"`
-	Title     string  `json:"title"`
-	MusicID   int     `json:"music_id"`
-	Artist    string  `json:"artist"`
-	Genre     Genre   `json:"genre"`
-	Thumbnail string  `json:"thumbnail"`
+	Sheets    []Sheet     `json:"sheets"`
+	Title     string      `json:"title"`
+	MusicID   int         `json:"music_id"`
+	Artist    string      `json:"artist"`
+	Genre     string      `json:"genre"`  // slug of the primary genre, empty if the music has none
+	Genres    []GenreInfo `json:"genres"` // every genre of the music, primary first
+	Thumbnail string      `json:"thumbnail"`
+	// ThumbnailURL is the path of the thumbnail in the local cache ("/images/<id>"), empty unless the thumbnail is a URL
+	ThumbnailURL string   `json:"thumbnail_url,omitempty"`
+	SongMetadata          // Metadata of the reference sheet
+	Instruments  []string `json:"instruments,omitempty"` // Instruments with sheets (filled by /select)
 }
 
-func NewMusic(sheets []Sheet, title string, id int, artist string, genre Genre, thumbnail string) *Music {
-	return &Music{Sheets: sheets, Title: title, MusicID: id, Artist: artist, Genre: genre, Thumbnail: thumbnail}
+func NewMusic(sheets []Sheet, title string, id int, artist string, genre string, thumbnail string) *Music {
+	return &Music{Sheets: sheets, Title: title, MusicID: id, Artist: artist, Genre: genre, Thumbnail: thumbnail, ThumbnailURL: cachedImagePath(thumbnail)}
 }
 
 type MusicSegment struct {
@@ -544,10 +682,12 @@ type DisplayMusic struct {
 	MusicID   int    `json:"music_id"`
 	Artist    string `json:"artist"`
 	Thumbnail string `json:"thumbnail"`
+	// ThumbnailURL is the path of the thumbnail in the local cache ("/images/<id>"), empty unless the thumbnail is a URL
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
 }
 
 func NewDisplayMusic(title string, id int, artist string, thumbnail string) *DisplayMusic {
-	return &DisplayMusic{Title: title, MusicID: id, Artist: artist, Thumbnail: thumbnail}
+	return &DisplayMusic{Title: title, MusicID: id, Artist: artist, Thumbnail: thumbnail, ThumbnailURL: cachedImagePath(thumbnail)}
 }
 
 type SearchCategory int
@@ -608,12 +748,13 @@ func ParseSearchCategory(s string) (SearchCategory, error) {
 	return -1, errors.New("unknown category: " + s) // Return an invalid Genre value and an error
 }
 
-type SearchQuery struct {
-	TextSearch string `json:"text_search"`
-}
-
 type SelectRequest struct {
-	MusicID int `json:"music_id"`
+	MusicID int    `json:"music_id"`
+	Locale  string `json:"locale"` // Optional: locale of the genre names (Accept-Language if empty)
+	TransposeOptions
+	// Optional: only the sheets of this instrument (the current one if empty) and of this part
+	// (every part if empty) are returned, with the accompaniment
+	SheetPart
 }
 
 type AddFavoriteRequest struct {
@@ -624,7 +765,7 @@ type SetFavoritesRequest struct {
 	MusicIDs []int `json:"music_ids"`
 }
 
-func favorites_api(r *gin.Engine, db *sql.DB) {
+func favorites_api(r gin.IRouter, db *sql.DB) {
 	// Add a favorite
 	r.POST("/favorites", func(ctx *gin.Context) {
 		var req AddFavoriteRequest
@@ -637,7 +778,7 @@ func favorites_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		if err := AddFavorite(db, req.MusicID); err != nil {
+		if err := AddFavorite(db, currentUser(ctx).ID, req.MusicID); err != nil {
 			log.Printf("Error adding favorite: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add favorite"})
 			return
@@ -647,7 +788,7 @@ func favorites_api(r *gin.Engine, db *sql.DB) {
 
 	// Get all favorites
 	r.GET("/favorites", func(ctx *gin.Context) {
-		favorites, err := GetFavorites(db)
+		favorites, err := GetFavorites(db, currentUser(ctx).ID)
 		if err != nil {
 			log.Printf("Error getting favorites: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get favorites"})
@@ -664,7 +805,7 @@ func favorites_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		if err := SetFavorites(db, req.MusicIDs); err != nil {
+		if err := SetFavorites(db, currentUser(ctx).ID, req.MusicIDs); err != nil {
 			log.Printf("Error setting favorites: %v", err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set favorites"})
 			return
@@ -673,25 +814,124 @@ func favorites_api(r *gin.Engine, db *sql.DB) {
 	})
 }
 
-func history_api(r *gin.Engine, db *sql.DB) {
-	// Get recent search history
-	r.GET("/history/searches", func(ctx *gin.Context) {
-		limitStr := ctx.DefaultQuery("limit", strconv.Itoa(defaultHistoryLimit)) // Use constant from history.go
-		limit, err := strconv.Atoi(limitStr)
+/*
+ * Search and view histories
+ * GET    /history/queries?limit=10  queries typed into /search, newest first: [{"id", "query", "searched_at"}]
+ * DELETE /history/queries/:id       delete one query
+ * DELETE /history/queries           clear the query history
+ * GET    /history/views?limit=10    music opened with /select, newest first: [{"id", "music_id", "title", "artist", "thumbnail", "viewed_at"}]
+ * DELETE /history/views/:id         delete one view
+ * DELETE /history/views             clear the view history
+ * GET    /history/searches          deprecated: the view history as a DisplayMusic list
+ * Each history keeps its latest 20 entries; repeating a query or a view only moves it to the top.
+ */
+func history_api(r gin.IRouter, db *sql.DB) {
+	historyLimit := func(ctx *gin.Context) int {
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultHistoryLimit)))
 		if err != nil || limit <= 0 {
-			limit = defaultHistoryLimit // Use constant from history.go
+			limit = defaultHistoryLimit
 		}
+		return limit
+	}
+
+	r.GET("/history/queries", func(ctx *gin.Context) {
+		history, err := GetQueryHistory(db, currentUser(ctx).ID, historyLimit(ctx))
+		if err != nil {
+			log.Printf("Error getting query history: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get query history"})
+			return
+		}
+		ctx.JSON(http.StatusOK, history)
+	})
 
-		history, err := GetSearchHistory(db, limit)
+	r.GET("/history/views", func(ctx *gin.Context) {
+		history, err := GetViewHistory(db, currentUser(ctx).ID, historyLimit(ctx))
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get search history: " + err.Error()})
+			log.Printf("Error getting view history: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get view history"})
 			return
 		}
 		ctx.JSON(http.StatusOK, history)
 	})
+
+	// Kept for older clients, which listed the searched music
+	r.GET("/history/searches", func(ctx *gin.Context) {
+		history, err := GetViewHistory(db, currentUser(ctx).ID, historyLimit(ctx))
+		if err != nil {
+			log.Printf("Error getting view history: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get search history"})
+			return
+		}
+		music := []DisplayMusic{}
+		for _, e := range history {
+			music = append(music, e.DisplayMusic)
+		}
+		ctx.JSON(http.StatusOK, music)
+	})
+
+	for path, table := range map[string]string{"/history/queries": "QueryHistory", "/history/views": "ViewHistory"} {
+		r.DELETE(path+"/:id", func(ctx *gin.Context) {
+			id, err := strconv.Atoi(ctx.Param("id"))
+			if err != nil || id <= 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id in path"})
+				return
+			}
+			if err := DeleteHistoryEntry(db, currentUser(ctx).ID, table, id); err != nil {
+				if errors.Is(err, ErrHistoryEntryNotFound) {
+					ctx.JSON(http.StatusNotFound, gin.H{"error": "History entry not found"})
+					return
+				}
+				log.Printf("Error deleting history entry %d from %s: %v", id, table, err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete history entry"})
+				return
+			}
+			ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("History entry %d deleted successfully", id)})
+		})
+
+		r.DELETE(path, func(ctx *gin.Context) {
+			n, err := ClearHistory(db, currentUser(ctx).ID, table)
+			if err != nil {
+				log.Printf("Error clearing %s: %v", table, err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear history"})
+				return
+			}
+			ctx.JSON(http.StatusOK, gin.H{"message": "History cleared successfully", "deleted": n})
+		})
+	}
+}
+
+/*
+ * Continue practicing (GET /getquickaccess?limit=10)
+ * Lists the music recently opened with /select or practiced with /calc_proficiency. Recent music
+ * comes first, and music practiced part of the way is preferred to finished music.
+ * Open /practice?musicID=<music_id>&difficulty=<difficulty>&measure=<resume_measure> to resume.
+ * Every part keeps its own progress; the one practiced last is resumed.
+ * Response: [{"music_id", "title", "artist", "thumbnail", "instrument", "part", "difficulty",
+ *             "last_measure", "measure_count", "progress", "resume_measure", "last_activity"}]
+ */
+func quick_access_api(r gin.IRouter, db *sql.DB) {
+	r.GET("/getquickaccess", func(ctx *gin.Context) {
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultQuickAccessLimit)))
+		if err != nil || limit <= 0 {
+			limit = defaultQuickAccessLimit
+		}
+		items, err := GetQuickAccess(db, currentUser(ctx).ID, min(limit, maxQuickAccessLimit))
+		if err != nil {
+			log.Printf("Error getting quick access: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get quick access"})
+			return
+		}
+		ctx.JSON(http.StatusOK, items)
+	})
 }
 
-func difficulty_settings_api(r *gin.Engine, db *sql.DB) {
+/*
+ * Per-measure difficulty settings of a music, kept per instrument.
+ * PUT /music/:music_id/difficulty-settings?instrument=piano  Body: [{ "measure": 1, "difficulty": 2 }, ...]
+ * GET /music/:music_id/difficulty-settings?instrument=piano
+ * The current instrument is used when ?instrument is omitted.
+ */
+func difficulty_settings_api(r gin.IRouter, db *sql.DB) {
 	// Set/Update difficulty settings for a music
 	r.PUT("/music/:music_id/difficulty-settings", func(ctx *gin.Context) {
 		musicIDStr := ctx.Param("music_id")
@@ -707,12 +947,18 @@ func difficulty_settings_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		if err := SetUserMusicDifficultySettings(db, musicID, settings); err != nil {
+		instrument, err := resolveInstrument(db, currentUser(ctx).ID, ctx.Query("instrument"))
+		if err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set difficulty settings"})
+			return
+		}
+		if err := SetUserMusicDifficultySettings(db, currentUser(ctx).ID, musicID, instrument, settings); err != nil {
 			log.Printf("Error setting difficulty settings for music_id %d: %v", musicID, err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set difficulty settings"})
 			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Difficulty settings for music_id %d updated successfully", musicID)})
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Difficulty settings for music_id %d on %s updated successfully", musicID, instrument)})
 	})
 
 	// Get difficulty settings for a music
@@ -724,7 +970,13 @@ func difficulty_settings_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
-		settings, err := GetUserMusicDifficultySettings(db, musicID)
+		instrument, err := resolveInstrument(db, currentUser(ctx).ID, ctx.Query("instrument"))
+		if err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get difficulty settings"})
+			return
+		}
+		settings, err := GetUserMusicDifficultySettings(db, currentUser(ctx).ID, musicID, instrument)
 		if err != nil {
 			log.Printf("Error getting difficulty settings for music_id %d: %v", musicID, err)
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get difficulty settings"})
@@ -734,70 +986,1167 @@ func difficulty_settings_api(r *gin.Engine, db *sql.DB) {
 	})
 }
 
-func calc_proficiency_api(r *gin.Engine, db *sql.DB) {
-	r.POST("/calc_proficiency", func(ctx *gin.Context) {
-		const fixedSamplingRate = 48000.0
-
-		// Declare variables
-		var currentProficiency float64
-		var req CalculateProficiencyRequest // Request body structure
-		if err := ctx.ShouldBindJSON(&req); err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+// adminAuthRequired rejects requests that do not carry the admin token
+// (environment variable ADMIN_TOKEN) as "Authorization: Bearer <token>".
+// If ADMIN_TOKEN is not set, every admin endpoint is disabled.
+func adminAuthRequired() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled (ADMIN_TOKEN is not set)"})
+			return
+		}
+		if !hasAdminToken(ctx) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing admin token"})
 			return
 		}
+		ctx.Next()
+	}
+}
 
-		// CorrectPitches の各要素が2つのfloatであることを検証 (オプションだが推奨)
-		for i, pitchPair := range req.CorrectPitches {
-			if len(pitchPair) != 2 {
-				ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid format for 'correct_pitches' at index %d. Each item must be an array of two floats.", i)})
+// hasAdminToken tells whether a request carries the admin token.
+func hasAdminToken(ctx *gin.Context) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	return adminToken != "" && ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// userAuthRequired authenticates the user of a request from "Authorization: Bearer <token>",
+// with a session token from POST /auth/login or an API token from POST /auth/tokens. Requests
+// without a token are served as the account named by the environment variable ANONYMOUS_USER
+// when it is set, or as the default account while no account has a password (the frontend does
+// not log in), and rejected otherwise.
+func userAuthRequired(db *sql.DB) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var user User
+		var err error
+		if token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer "); ok {
+			user, err = UserByToken(db, token)
+		} else {
+			var anonymous bool
+			user, anonymous, err = AnonymousUser(db, os.Getenv("ANONYMOUS_USER"))
+			if err == nil && !anonymous {
+				ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
 				return
 			}
 		}
-
-		// 1. Get current proficiency from DB (after validating request body)
-		err := db.QueryRow("SELECT proficiency FROM UserProficiency WHERE singleton_key = 1").Scan(&currentProficiency) // Assign to existing err
 		if err != nil {
-			if err == sql.ErrNoRows {
-				log.Printf("UserProficiency record not found, cannot calculate proficiency.")
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User proficiency not found, cannot calculate proficiency"})
+			if errors.Is(err, ErrInvalidToken) {
+				ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 				return
 			}
-			log.Printf("Error fetching current proficiency: %v", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch current proficiency"})
+			log.Printf("Error authenticating request: %v", err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate request"})
 			return
 		}
+		ctx.Set(userContextKey, user)
+		ctx.Next()
+	}
+}
 
-		// 2. Prepare data for Python script
-		pythonInputData := map[string]interface{}{
-			"audio":               req.Audio,
-			"difficulty":          req.Difficulty,
-			"current_proficiency": currentProficiency,
-			"correct_pitches":     req.CorrectPitches,
-			"sampling_rate":       fixedSamplingRate,
-		}
-		reqBytes, err := json.Marshal(pythonInputData)
+// userContextKey holds the User of a request authenticated by userAuthRequired.
+const userContextKey = "user"
+
+// currentUser returns the user of a request behind userAuthRequired.
+func currentUser(ctx *gin.Context) User {
+	return ctx.MustGet(userContextKey).(User)
+}
+
+// ChangePasswordRequest is the request body of PUT /auth/password.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+/*
+ * Accounts and login. Every other endpoint serving user data (instruments, proficiency,
+ * favorites, histories, difficulty settings...) needs "Authorization: Bearer <token>"
+ * (see userAuthRequired) and only sees the data of that user.
+ *
+ * POST   /auth/register   Create an account. Body: { "username": "alice", "password": "..." }
+ *                         (3-32 letters, digits, '_', '.' or '-'; password of 8-72 bytes).
+ *                         Returns 201 like /auth/login, or 409 if the username is taken.
+ *                         Returns 403 while the default account has no password (see RegistrationOpen),
+ *                         unless the request carries the admin token
+ * POST   /auth/login      Body: { "username": "alice", "password": "..." }.
+ *                         Returns { "token": "...", "expires_at": "...", "user": User }: a session of 30 days
+ * POST   /auth/logout     Revoke the token of the request
+ * GET    /auth/me         The User of the token
+ * PUT    /auth/password   Body: ChangePasswordRequest. Returns 403 if the account has no password yet:
+ *                         the first one is set by an admin (PUT /admin/users/:username/password)
+ * POST   /auth/tokens     Create an API token that does not expire, e.g. for scripts. Body: { "name": "cli" }.
+ *                         Returns 201 { "token": "...", "info": UserToken }; the token is only shown once
+ * GET    /auth/tokens     List the sessions and API tokens of the user: [UserToken]
+ * DELETE /auth/tokens/:id Revoke a session or an API token
+ *
+ * PUT    /admin/users/:username/password  Set the password of an account, like "back user password".
+ *                                         Requires the admin token. Body: { "password": "..." }
+ */
+func auth_api(r *gin.Engine, db *sql.DB) {
+	login := func(ctx *gin.Context, user User, status int) {
+		token, info, err := IssueToken(db, user.ID, tokenKindSession, ctx.Request.UserAgent())
 		if err != nil {
-			log.Printf("Error marshalling request for Python script: %v", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare data for proficiency calculation"})
+			log.Printf("Error issuing session for user %d: %v", user.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
 			return
 		}
+		ctx.JSON(status, gin.H{"token": token, "expires_at": info.ExpiresAt, "user": user})
+	}
 
-		// 3. Call external proficiency calculation API
-		const proficiencyApiUrl = "http://localhost:8008/calculate_proficiency"
-		resp, err := http.Post(proficiencyApiUrl, "application/json", bytes.NewReader(reqBytes))
+	r.POST("/auth/register", func(ctx *gin.Context) {
+		var req Credentials
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		open, err := RegistrationOpen(db)
 		if err != nil {
-			log.Printf("Error calling proficiency calculation API: %v", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to call proficiency calculation service"})
+			log.Printf("Error checking registration: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 			return
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			var errBody bytes.Buffer
-			_, _ = errBody.ReadFrom(resp.Body)
-			log.Printf("Proficiency calculation API returned error: %s, status code: %d, body: %s", err, resp.StatusCode, errBody.String())
-			// Try to parse error from API response
-			var apiError struct {
+		if !open && !hasAdminToken(ctx) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "Registration is closed until the default account has a password"})
+			return
+		}
+		user, err := CreateUser(db, req.Username, req.Password)
+		if err != nil {
+			if errors.Is(err, ErrUserExists) {
+				ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error creating user %s: %v", req.Username, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+			return
+		}
+		login(ctx, user, http.StatusCreated)
+	})
+
+	r.POST("/auth/login", func(ctx *gin.Context) {
+		var req Credentials
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		user, err := Authenticate(db, req.Username, req.Password)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error authenticating user %s: %v", req.Username, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			return
+		}
+		login(ctx, user, http.StatusOK)
+	})
+
+	auth := r.Group("/auth", userAuthRequired(db))
+
+	auth.POST("/logout", func(ctx *gin.Context) {
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "The request has no token to revoke"})
+			return
+		}
+		if err := RevokeToken(db, token); err != nil && !errors.Is(err, ErrTokenNotFound) {
+			log.Printf("Error revoking token of user %d: %v", currentUser(ctx).ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+	})
+
+	auth.GET("/me", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, currentUser(ctx))
+	})
+
+	auth.PUT("/password", func(ctx *gin.Context) {
+		user := currentUser(ctx)
+		var req ChangePasswordRequest
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := validatePassword(req.NewPassword); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := ChangePassword(db, user.ID, req.CurrentPassword, req.NewPassword); err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				ctx.JSON(http.StatusForbidden, gin.H{"error": "'current_password' is wrong"})
+				return
+			}
+			if errors.Is(err, ErrNoPassword) {
+				ctx.JSON(http.StatusForbidden, gin.H{"error": "The account has no password yet; an admin must set the first one"})
+				return
+			}
+			log.Printf("Error changing password of user %d: %v", user.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+	})
+
+	auth.POST("/tokens", func(ctx *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		user := currentUser(ctx)
+		token, info, err := IssueToken(db, user.ID, tokenKindAPI, req.Name)
+		if err != nil {
+			log.Printf("Error issuing API token for user %d: %v", user.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{"token": token, "info": info})
+	})
+
+	auth.GET("/tokens", func(ctx *gin.Context) {
+		tokens, err := ListTokens(db, currentUser(ctx).ID)
+		if err != nil {
+			log.Printf("Error listing tokens: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tokens"})
+			return
+		}
+		ctx.JSON(http.StatusOK, tokens)
+	})
+
+	auth.DELETE("/tokens/:id", func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil || id <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id in path"})
+			return
+		}
+		if err := DeleteToken(db, currentUser(ctx).ID, id); err != nil {
+			if errors.Is(err, ErrTokenNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error deleting token %d: %v", id, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Token %d revoked successfully", id)})
+	})
+
+	admin := r.Group("/admin/users", adminAuthRequired())
+
+	admin.PUT("/:username/password", func(ctx *gin.Context) {
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := validatePassword(req.Password); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := GetUserByName(db, ctx.Param("username"))
+		if err == nil {
+			err = SetPassword(db, user.ID, req.Password)
+		}
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error setting password of user %s: %v", ctx.Param("username"), err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set password"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Password of %s set successfully", user.Username)})
+	})
+}
+
+/*
+ * Spotify account of the logged-in user (see spotifyauth.go), used by /recommendations/spotify.
+ *
+ * GET    /auth/spotify/login    Start a login. Returns { "authorize_url": "https://accounts.spotify.com/authorize?..." }
+ *                               to open in the browser; it must be completed within 10 minutes.
+ *                               503 if SPOTIFY_CLIENT_ID is not set
+ * GET    /auth/spotify/callback Redirect URI of the Spotify app. Query: code, state (or error, state).
+ *                               Stores the tokens of the user who started the login, then redirects to
+ *                               SPOTIFY_LOGIN_REDIRECT with ?spotify=connected or ?spotify=error&error=...,
+ *                               or answers { "message": "..." } / { "error": "..." } if it is not set
+ * GET    /auth/spotify          SpotifyConnection of the user
+ * DELETE /auth/spotify          Forget the Spotify tokens of the user
+ */
+func spotify_auth_api(r *gin.Engine, db *sql.DB) {
+	r.GET("/auth/spotify/login", userAuthRequired(db), func(ctx *gin.Context) {
+		user := currentUser(ctx)
+		authorizeURL, err := StartSpotifyLogin(db, user.ID)
+		if err != nil {
+			if errors.Is(err, ErrSpotifyNotConfigured) {
+				ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error starting Spotify login of user %d: %v", user.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start Spotify login"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"authorize_url": authorizeURL})
+	})
+
+	r.GET("/auth/spotify/callback", func(ctx *gin.Context) {
+		finish := func(status int, message string) {
+			if target := spotifyConfig.LoginRedirect; target != "" {
+				params := url.Values{"spotify": {"connected"}}
+				if status != http.StatusOK {
+					params = url.Values{"spotify": {"error"}, "error": {message}}
+				}
+				sep := "?"
+				if strings.Contains(target, "?") {
+					sep = "&"
+				}
+				ctx.Redirect(http.StatusFound, target+sep+params.Encode())
+				return
+			}
+			if status != http.StatusOK {
+				ctx.JSON(status, gin.H{"error": message})
+				return
+			}
+			ctx.JSON(status, gin.H{"message": message})
+		}
+
+		state := ctx.Query("state")
+		if denied := ctx.Query("error"); denied != "" {
+			if err := CancelSpotifyLogin(db, state); err != nil && !errors.Is(err, ErrSpotifyLoginState) {
+				log.Printf("Error cancelling Spotify login: %v", err)
+			}
+			finish(http.StatusBadRequest, "Spotify login failed: "+denied)
+			return
+		}
+		code := ctx.Query("code")
+		if state == "" || code == "" {
+			finish(http.StatusBadRequest, "'code' and 'state' are required")
+			return
+		}
+		userID, err := FinishSpotifyLogin(db, state, code)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrSpotifyLoginState):
+				finish(http.StatusBadRequest, err.Error())
+			case errors.Is(err, errSpotifyInvalidGrant):
+				finish(http.StatusBadRequest, "Spotify rejected the authorization code")
+			case errors.Is(err, ErrSpotifyRequestFailed):
+				log.Printf("Error exchanging Spotify code of user %d: %v", userID, err)
+				finish(http.StatusBadGateway, "Failed to get tokens from Spotify")
+			default:
+				log.Printf("Error finishing Spotify login of user %d: %v", userID, err)
+				finish(http.StatusInternalServerError, "Failed to finish Spotify login")
+			}
+			return
+		}
+		log.Printf("Connected the Spotify account of user %d", userID)
+		finish(http.StatusOK, "Spotify account connected successfully")
+	})
+
+	account := r.Group("/auth/spotify", userAuthRequired(db))
+
+	account.GET("", func(ctx *gin.Context) {
+		conn, err := GetSpotifyConnection(db, currentUser(ctx).ID)
+		if err != nil {
+			log.Printf("Error getting Spotify connection: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Spotify connection"})
+			return
+		}
+		ctx.JSON(http.StatusOK, conn)
+	})
+
+	account.DELETE("", func(ctx *gin.Context) {
+		if err := DisconnectSpotify(db, currentUser(ctx).ID); err != nil {
+			log.Printf("Error disconnecting Spotify: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect Spotify"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Spotify account disconnected successfully"})
+	})
+}
+
+/*
+ * Catalog management endpoints for Music and Sheets.
+ * All of them require the admin token (see adminAuthRequired).
+ *
+ * POST   /music                              Create a music. Body: MusicInput. Returns { "music_id": 1 }
+ * PUT    /music/:music_id                    Update a music. Body: MusicInput
+ * DELETE /music/:music_id                    Delete a music with its sheets, favorites, difficulty settings, history and genre tags
+ * POST   /music/:music_id/sheets             Add a sheet. Body: SheetInput (difficulty 0 = estimated,
+ *                                            instrument empty = read from the MusicXML, part empty = unnamed).
+ *                                            Returns { "sheet_id": 1, "difficulty": 3, "instrument": "piano", "part": "", "analysis": {...} }
+ * POST   /music/:music_id/sheets/midi        Add a sheet converted from a Standard MIDI File.
+ *                                            multipart/form-data: file (.mid), difficulty (0 or empty = estimated),
+ *                                            grid (shortest note per quarter, default 4 = 16ths), instrument, part.
+ *                                            Returns like POST .../sheets
+ * DELETE /music/:music_id/sheets/:difficulty Delete the sheet of the given difficulty.
+ *                                            Query: instrument, part (see SheetPart)
+ * POST   /music/:music_id/sheets/generate    Generate easier arrangements from the hardest hand-made sheet.
+ *                                            Body: { "difficulties": [1, 2], "overwrite": false, "instrument": "piano", "part": "" }
+ *                                            (all easier levels if empty, every part if no instrument).
+ *                                            Returns a list of GeneratedSheet
+ * POST   /genres                             Create a genre. Body: { "slug": "CITY-POP", "names": { "ja": "シティポップ", "en": "City Pop" } }.
+ *                                            Returns { "genre_id": 20 }
+ * POST   /sheets/analyze                     Estimate the difficulty of a sheet without storing it.
+ *                                            Body: { "sheet": "<MusicXML>" }. Returns { "suggested_difficulty": 3, "analysis": {...} }
+ */
+func catalog_api(r *gin.Engine, db *sql.DB) {
+	admin := r.Group("/", adminAuthRequired())
+
+	admin.POST("/music", func(ctx *gin.Context) {
+		var req MusicInput
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		musicID, err := CreateMusic(db, req)
+		if err != nil {
+			if errors.Is(err, ErrUnknownGenre) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error creating music: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create music"})
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{"music_id": musicID})
+	})
+
+	admin.PUT("/music/:music_id", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+
+		var req MusicInput
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := UpdateMusic(db, musicID, req); err != nil {
+			if errors.Is(err, ErrMusicNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "Music not found"})
+				return
+			}
+			if errors.Is(err, ErrUnknownGenre) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error updating music_id %d: %v", musicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update music"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Music %d updated successfully", musicID)})
+	})
+
+	admin.DELETE("/music/:music_id", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+
+		if err := DeleteMusic(db, musicID); err != nil {
+			if errors.Is(err, ErrMusicNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "Music not found"})
+				return
+			}
+			log.Printf("Error deleting music_id %d: %v", musicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete music"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Music %d deleted successfully", musicID)})
+	})
+
+	admin.POST("/music/:music_id/sheets", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+
+		var req SheetInput
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		addSheet(ctx, db, musicID, req)
+	})
+
+	admin.POST("/music/:music_id/sheets/midi", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+
+		req := SheetInput{SheetPart: SheetPart{Instrument: ctx.PostForm("instrument"), Part: ctx.PostForm("part")}}
+		if s := ctx.PostForm("difficulty"); s != "" {
+			if req.Difficulty, err = strconv.Atoi(s); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid difficulty"})
+				return
+			}
+		}
+		grid := 0
+		if s := ctx.PostForm("grid"); s != "" {
+			if grid, err = strconv.Atoi(s); err != nil || grid <= 0 || grid > 16 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "grid must be between 1 and 16"})
+				return
+			}
+		}
+		fileHeader, err := ctx.FormFile("file")
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "A .mid file is required in the 'file' field"})
+			return
+		}
+		if fileHeader.Size > maxMIDIFileSize {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "MIDI file is too large"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			log.Printf("Error opening uploaded MIDI file: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			log.Printf("Error reading uploaded MIDI file: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+
+		if req.Sheet, err = ConvertMIDIToSheet(data, grid); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid MIDI file: " + err.Error()})
+			return
+		}
+		addSheet(ctx, db, musicID, req)
+	})
+
+	admin.DELETE("/music/:music_id/sheets/:difficulty", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+		difficulty, err := strconv.Atoi(ctx.Param("difficulty"))
+		if err != nil || !isValidSheetDifficulty(difficulty) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid difficulty in path"})
+			return
+		}
+		var sheetPart SheetPart
+		if err := ctx.ShouldBindQuery(&sheetPart); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := sheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+
+		if err := DeleteSheet(db, musicID, sheetPart, difficulty); err != nil {
+			if errors.Is(err, ErrSheetNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "Sheet not found"})
+				return
+			}
+			log.Printf("Error deleting sheet (music_id: %d, difficulty: %d): %v", musicID, difficulty, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sheet"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Sheet deleted successfully"})
+	})
+
+	admin.POST("/music/:music_id/sheets/generate", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+
+		var req GenerateSheetsRequest
+		if ctx.Request.ContentLength != 0 {
+			if err := ctx.BindJSON(&req); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+				return
+			}
+		}
+		if err := req.SheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+
+		results, err := GenerateEasierSheets(db, musicID, req)
+		if err != nil {
+			if errors.Is(err, ErrSheetNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "No hand-made sheet to arrange from"})
+				return
+			}
+			log.Printf("Error generating sheets for music_id %d: %v", musicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate sheets"})
+			return
+		}
+		ctx.JSON(http.StatusOK, results)
+	})
+
+	admin.POST("/genres", func(ctx *gin.Context) {
+		var req GenreInput
+		if err := ctx.BindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		genreID, err := CreateGenre(db, req)
+		if err != nil {
+			if errors.Is(err, ErrGenreExists) {
+				ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error creating genre %s: %v", req.Slug, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create genre"})
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{"genre_id": genreID})
+	})
+
+	admin.POST("/sheets/analyze", func(ctx *gin.Context) {
+		var req struct {
+			Sheet string `json:"sheet" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+
+		analysis, err := AnalyzeSheet(req.Sheet)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid MusicXML: " + err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"suggested_difficulty": suggestedSheetDifficulty(analysis), "analysis": analysis})
+	})
+}
+
+/*
+ * Backup endpoints (see backup.go for the archive layout and the restore modes).
+ * Both require the admin token (see adminAuthRequired).
+ *
+ * GET  /admin/export  Download a zip archive of the catalog, the sheets and every user data
+ * POST /admin/import  Restore an archive. multipart/form-data: file (.zip).
+ *                     Query: mode = merge (default) | overwrite | replace, dry_run = true to only report.
+ *                     Returns a RestoreReport with the number of rows added, replaced and skipped per entity
+ */
+func backup_api(r *gin.Engine, db *sql.DB) {
+	admin := r.Group("/admin", adminAuthRequired())
+
+	admin.GET("/export", func(ctx *gin.Context) {
+		// Build the archive first so that a failure can still be reported as an error
+		var buf bytes.Buffer
+		manifest, err := ExportBackup(db, &buf)
+		if err != nil {
+			log.Printf("Error exporting backup: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export backup"})
+			return
+		}
+		filename := fmt.Sprintf("musicapp-backup-%s.zip", manifest.CreatedAt.Format("20060102-150405"))
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		ctx.Data(http.StatusOK, "application/zip", buf.Bytes())
+	})
+
+	admin.POST("/import", func(ctx *gin.Context) {
+		mode, err := ParseRestoreMode(ctx.Query("mode"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		dryRun := ctx.Query("dry_run") == "true"
+
+		fileHeader, err := ctx.FormFile("file")
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "A .zip backup is required in the 'file' field"})
+			return
+		}
+		if fileHeader.Size > maxBackupSize {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Backup archive is too large"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			log.Printf("Error opening uploaded backup: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+		defer file.Close()
+		archive, err := io.ReadAll(file)
+		if err != nil {
+			log.Printf("Error reading uploaded backup: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+
+		report, err := RestoreBackup(db, archive, mode, dryRun)
+		if err != nil {
+			if errors.Is(err, ErrInvalidBackup) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error restoring backup: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore backup"})
+			return
+		}
+		ctx.JSON(http.StatusOK, report)
+	})
+}
+
+// addSheet validates, analyzes and stores a sheet for the sheet upload endpoints and writes the response.
+func addSheet(ctx *gin.Context, db *sql.DB, musicID int, req SheetInput) {
+	if err := req.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	analysis, err := req.Analyze()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid MusicXML: " + err.Error()})
+		return
+	}
+
+	sheetID, err := AddSheet(db, musicID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrMusicNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Music not found"})
+		case errors.Is(err, ErrSheetExists):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("Error adding sheet to music_id %d: %v", musicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add sheet"})
+		}
+		return
+	}
+	if err := FillBaseDifficulty(db, musicID); err != nil {
+		log.Printf("Warning: Failed to estimate base_difficulty for music_id %d: %v", musicID, err)
+	}
+	ctx.JSON(http.StatusCreated, gin.H{"sheet_id": sheetID, "difficulty": req.Difficulty, "instrument": req.Instrument, "part": req.Part, "analysis": analysis})
+}
+
+/*
+ * GET /music/:music_id/sheets/:difficulty.mid
+ *
+ * Exports a stored sheet as a Standard MIDI File for DAWs and playback.
+ * Query: ?instrument=<name>&part=<name> (see SheetPart), and ?transpose=<semitones> or
+ * ?key=<key name>, as for /select.
+ * The route is registered as /music/:music_id/sheets/:difficulty because the router
+ * cannot match a suffix after a parameter; other suffixes return 404.
+ */
+func sheet_midi_api(r gin.IRouter, db *sql.DB) {
+	r.GET("/music/:music_id/sheets/:difficulty", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+		param, ok := strings.CutSuffix(ctx.Param("difficulty"), ".mid")
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Unsupported sheet format, use .mid"})
+			return
+		}
+		difficulty, err := strconv.Atoi(param)
+		if err != nil || !isValidSheetDifficulty(difficulty) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid difficulty in path"})
+			return
+		}
+		var transpose TransposeOptions
+		if err := ctx.ShouldBindQuery(&transpose); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := transpose.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		var sheetPart SheetPart
+		if err := ctx.ShouldBindQuery(&sheetPart); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := sheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+
+		if sheetPart.Instrument, err = resolveInstrument(db, currentUser(ctx).ID, sheetPart.Instrument); err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export sheet as MIDI"})
+			return
+		}
+
+		data, err := ExportSheetMIDI(db, musicID, sheetPart, difficulty, transpose)
+		if err != nil {
+			if errors.Is(err, musicxml.ErrKeyMismatch) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+				return
+			}
+			if errors.Is(err, ErrSheetNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error exporting MIDI (music_id: %d, difficulty: %d): %v", musicID, difficulty, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export sheet as MIDI"})
+			return
+		}
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="music%d_%d.mid"`, musicID, difficulty))
+		ctx.Data(http.StatusOK, "audio/midi", data)
+	})
+}
+
+/*
+ * GET /music/:music_id/sheets/:difficulty/tab
+ *
+ * Returns a stored sheet as MusicXML with a TAB staff for guitar under its melody, with the
+ * string and fret of every note chosen to keep hand movement small.
+ * Query: ?tuning=<name or pitches> (standard, drop-d, half-step-down, open-g, open-d, dadgad,
+ * bass, ukulele, or open-string pitches from the lowest string such as "D2 A2 D3 G3 B3 E4";
+ * standard if omitted) and ?capo=<fret> (frets are counted from the capo),
+ * ?instrument=<name>&part=<name> (see SheetPart; the guitar sheets if there are, else the sheets
+ * of another instrument), and ?transpose=<semitones> or ?key=<key name>, as for /select.
+ */
+func sheet_tab_api(r *gin.Engine, db *sql.DB) {
+	r.GET("/music/:music_id/sheets/:difficulty/tab", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+		difficulty, err := strconv.Atoi(ctx.Param("difficulty"))
+		if err != nil || !isValidSheetDifficulty(difficulty) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid difficulty in path"})
+			return
+		}
+		var tab TabOptions
+		if err := ctx.ShouldBindQuery(&tab); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := tab.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		var transpose TransposeOptions
+		if err := ctx.ShouldBindQuery(&transpose); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := transpose.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		var sheetPart SheetPart
+		if err := ctx.ShouldBindQuery(&sheetPart); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := sheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+
+		sheet, err := GenerateTablature(db, musicID, sheetPart, difficulty, transpose, tab)
+		if err != nil {
+			if errors.Is(err, musicxml.ErrKeyMismatch) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+				return
+			}
+			if errors.Is(err, ErrSheetNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error generating tablature (music_id: %d, difficulty: %d): %v", musicID, difficulty, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tablature"})
+			return
+		}
+		ctx.Data(http.StatusOK, "application/vnd.recordare.musicxml+xml; charset=utf-8", []byte(sheet))
+	})
+}
+
+/*
+ * GET /genres
+ *
+ * Returns every genre: [{ "id": 1, "slug": "ANIME", "name": "アニメ", "names": { "ja": "アニメ", "en": "Anime" } }, ...]
+ * name is in the locale of ?locale= or Accept-Language, falling back to Japanese and then the slug.
+ */
+func genres_api(r *gin.Engine, db *sql.DB) {
+	r.GET("/genres", func(ctx *gin.Context) {
+		genres, err := ListGenres(db, requestLocale(ctx, ctx.Query("locale")))
+		if err != nil {
+			log.Printf("Error listing genres: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get genres"})
+			return
+		}
+		ctx.JSON(http.StatusOK, genres)
+	})
+}
+
+/*
+ * GET /music/:music_id/composed-sheet
+ *
+ * Returns one MusicXML document whose measures come from the sheets of the difficulties
+ * stored with PUT /music/:music_id/difficulty-settings for the instrument.
+ * Query: ?default=<difficulty> for measures without a setting (the level of the proficiency on
+ * the instrument if omitted), ?instrument=<name>&part=<name> to choose the part (see SheetPart),
+ * and ?transpose=<semitones> or ?key=<key name> as for /select.
+ */
+func composed_sheet_api(r gin.IRouter, db *sql.DB) {
+	r.GET("/music/:music_id/composed-sheet", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+		defaultDifficulty := 0
+		if s := ctx.Query("default"); s != "" {
+			defaultDifficulty, err = strconv.Atoi(s)
+			if err != nil || defaultDifficulty < minSheetDifficulty || defaultDifficulty > maxSheetDifficulty {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("default must be between %d and %d", minSheetDifficulty, maxSheetDifficulty)})
+				return
+			}
+		}
+		var transpose TransposeOptions
+		if err := ctx.ShouldBindQuery(&transpose); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := transpose.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		var sheetPart SheetPart
+		if err := ctx.ShouldBindQuery(&sheetPart); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := sheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+
+		sheet, err := ComposeSheet(db, currentUser(ctx).ID, musicID, sheetPart, defaultDifficulty, transpose)
+		if err != nil {
+			if errors.Is(err, musicxml.ErrKeyMismatch) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+				return
+			}
+			if errors.Is(err, ErrSheetNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error composing sheet for music_id %d: %v", musicID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compose sheet"})
+			return
+		}
+		ctx.Data(http.StatusOK, "application/vnd.recordare.musicxml+xml; charset=utf-8", []byte(sheet))
+	})
+}
+
+/*
+ * GET /music/:music_id/sheets/:difficulty/measures/:measure/pitches
+ *
+ * Returns the expected pitches of one measure, derived from the stored MusicXML,
+ * in the same format as correct_pitches of /calc_proficiency:
+ * [[frequency(Hz), duration(ms)], ...]
+ * Query: ?instrument=<name>&part=<name> to choose the part (see SheetPart), and
+ * ?transpose=<semitones> or ?key=<key name> to get the pitches of a transposed sheet.
+ */
+func sheet_pitches_api(r gin.IRouter, db *sql.DB) {
+	r.GET("/music/:music_id/sheets/:difficulty/measures/:measure/pitches", func(ctx *gin.Context) {
+		musicID, err := strconv.Atoi(ctx.Param("music_id"))
+		if err != nil || musicID <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid music_id in path"})
+			return
+		}
+		difficulty, err := strconv.Atoi(ctx.Param("difficulty"))
+		if err != nil || !isValidSheetDifficulty(difficulty) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid difficulty in path"})
+			return
+		}
+		measure, err := strconv.Atoi(ctx.Param("measure"))
+		if err != nil || measure <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid measure in path"})
+			return
+		}
+		var transpose TransposeOptions
+		if err := ctx.ShouldBindQuery(&transpose); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := transpose.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		var sheetPart SheetPart
+		if err := ctx.ShouldBindQuery(&sheetPart); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+		if err := sheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+			return
+		}
+
+		if sheetPart.Instrument, err = resolveInstrument(db, currentUser(ctx).ID, sheetPart.Instrument); err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to derive expected pitches from sheet"})
+			return
+		}
+
+		pitches, err := GetMeasurePitches(db, musicID, sheetPart, difficulty, measure, transpose)
+		if err != nil {
+			if errors.Is(err, musicxml.ErrKeyMismatch) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+				return
+			}
+			if errors.Is(err, ErrSheetNotFound) || errors.Is(err, ErrMeasureNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error deriving pitches (music_id: %d, difficulty: %d, measure: %d): %v", musicID, difficulty, measure, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to derive expected pitches from sheet"})
+			return
+		}
+		ctx.JSON(http.StatusOK, pitches)
+	})
+}
+
+func calc_proficiency_api(r gin.IRouter, db *sql.DB) {
+	r.POST("/calc_proficiency", func(ctx *gin.Context) {
+		const fixedSamplingRate = 48000.0
+		user := currentUser(ctx)
+
+		// Declare variables
+		var req CalculateProficiencyRequest // Request body structure
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+
+		if err := req.SheetPart.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+		var err error
+		if req.Instrument, err = resolveInstrument(db, user.ID, req.Instrument); err != nil {
+			log.Printf("Error fetching current instrument: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch current proficiency"})
+			return
+		}
+		if req.MusicID > 0 {
+			// サーバー側で保存済みの楽譜から正解ピッチを導出する (クライアントの correct_pitches は使わない)
+			if req.Measure <= 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'measure' is required when 'music_id' is given"})
+				return
+			}
+			if err := req.TransposeOptions.Validate(); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+				return
+			}
+			pitches, err := GetMeasurePitches(db, req.MusicID, req.SheetPart, req.Difficulty, req.Measure, req.TransposeOptions)
+			if err != nil {
+				if errors.Is(err, musicxml.ErrKeyMismatch) {
+					ctx.JSON(http.StatusBadRequest, gin.H{"error": "'key' must have the same mode (major/minor) as the sheet"})
+					return
+				}
+				if errors.Is(err, ErrSheetNotFound) || errors.Is(err, ErrMeasureNotFound) {
+					ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+					return
+				}
+				log.Printf("Error deriving pitches (music_id: %d, difficulty: %d, measure: %d): %v", req.MusicID, req.Difficulty, req.Measure, err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to derive expected pitches from sheet"})
+				return
+			}
+			if err := RecordPracticeProgress(db, user.ID, req.MusicID, req.SheetPart, req.Difficulty, req.Measure); err != nil {
+				log.Printf("Warning: Failed to record practice progress (music_id: %d, measure: %d): %v", req.MusicID, req.Measure, err)
+			}
+			audioMs := float64(len(req.Audio)) / fixedSamplingRate * 1000
+			req.CorrectPitches = scalePitchDurations(pitches, audioMs)
+		} else if len(req.CorrectPitches) == 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Either 'music_id' and 'measure' or 'correct_pitches' is required"})
+			return
+		}
+
+		// CorrectPitches の各要素が2つのfloatであることを検証 (オプションだが推奨)
+		for i, pitchPair := range req.CorrectPitches {
+			if len(pitchPair) != 2 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid format for 'correct_pitches' at index %d. Each item must be an array of two floats.", i)})
+				return
+			}
+		}
+
+		// 1. Get current proficiency on the instrument from DB (after validating request body)
+		currentProficiency, err := GetProficiency(db, user.ID, req.Instrument)
+		if err != nil {
+			if errors.Is(err, ErrInstrumentNotSelected) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error fetching current proficiency: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch current proficiency"})
+			return
+		}
+
+		// 2. Prepare data for Python script
+		pythonInputData := map[string]interface{}{
+			"audio":               req.Audio,
+			"difficulty":          req.Difficulty,
+			"current_proficiency": currentProficiency,
+			"correct_pitches":     req.CorrectPitches,
+			"sampling_rate":       fixedSamplingRate,
+		}
+		reqBytes, err := json.Marshal(pythonInputData)
+		if err != nil {
+			log.Printf("Error marshalling request for Python script: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare data for proficiency calculation"})
+			return
+		}
+
+		// 3. Call external proficiency calculation API
+		const proficiencyApiUrl = "http://localhost:8008/calculate_proficiency"
+		resp, err := http.Post(proficiencyApiUrl, "application/json", bytes.NewReader(reqBytes))
+		if err != nil {
+			log.Printf("Error calling proficiency calculation API: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to call proficiency calculation service"})
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			var errBody bytes.Buffer
+			_, _ = errBody.ReadFrom(resp.Body)
+			log.Printf("Proficiency calculation API returned error: %s, status code: %d, body: %s", err, resp.StatusCode, errBody.String())
+			// Try to parse error from API response
+			var apiError struct {
 				Error string `json:"error"`
 			}
 			if json.NewDecoder(bytes.NewReader(errBody.Bytes())).Decode(&apiError) == nil && apiError.Error != "" {
@@ -815,6 +2164,14 @@ func calc_proficiency_api(r *gin.Engine, db *sql.DB) {
 			return
 		}
 
+		// 4. Store the new proficiency with the scored measure in the history
+		change := ProficiencyChange{Source: proficiencySourceMeasure, MusicID: req.MusicID, Measure: req.Measure, Difficulty: &req.Difficulty}
+		if err := SetProficiency(db, user.ID, req.Instrument, apiResp.Proficiency, change); err != nil {
+			log.Printf("Error storing calculated proficiency: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store proficiency"})
+			return
+		}
+
 		/*
 			"os/exec"
 
@@ -854,3 +2211,50 @@ func calc_proficiency_api(r *gin.Engine, db *sql.DB) {
 		ctx.JSON(http.StatusOK, apiResp)
 	})
 }
+
+/*
+ * GET /images/:id?size=medium
+ *
+ * Serves a thumbnail from the local cache. :id comes from the thumbnail_url of music and the
+ * cached_image_url of Spotify tracks. size is thumb (64px), small (160px), medium (320px, default),
+ * large (640px) or original. Variants are JPEG scaled to fit in a square of that side.
+ * The image is downloaded on the first request. When its source is gone and nothing is cached,
+ * a grey placeholder PNG is served with the header X-Image-Placeholder: true.
+ * Responses carry an ETag, and If-None-Match is answered with 304 Not Modified.
+ */
+func images_api(r *gin.Engine, db *sql.DB) {
+	r.GET("/images/:id", func(ctx *gin.Context) {
+		size := ctx.Query("size")
+		if size == "" {
+			size = defaultImageVariant
+		}
+		img, err := GetCachedImage(db, ctx.Param("id"), size)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrUnknownImageSize):
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "'size' must be one of thumb, small, medium, large or original"})
+			case errors.Is(err, ErrImageNotFound):
+				ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			default:
+				if !errors.Is(err, ErrImageSourceMissing) {
+					log.Printf("Error getting image %s: %v", ctx.Param("id"), err)
+				}
+				// The source may come back (or the network), so the placeholder is not cached for long
+				ctx.Header("Cache-Control", "public, max-age=300")
+				ctx.Header("X-Image-Placeholder", "true")
+				ctx.Data(http.StatusOK, "image/png", placeholderImage(size))
+			}
+			return
+		}
+
+		// A cached image never changes: its ID is derived from the source URL
+		ctx.Header("Cache-Control", "public, max-age=2592000, immutable")
+		ctx.Header("ETag", img.ETag)
+		if ctx.GetHeader("If-None-Match") == img.ETag {
+			ctx.Status(http.StatusNotModified)
+			return
+		}
+		ctx.Header("Content-Type", img.ContentType)
+		ctx.File(img.Path)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+
+	"infosystem-musicapp/musicxml"
+)
+
+// SongMetadata is the musical metadata of a sheet, read from its MusicXML. A music has the
+// metadata of its reference sheet: the hardest hand-made one, as for base_difficulty.
+type SongMetadata struct {
+	Tempo           float64 `json:"tempo,omitempty"`            // Quarter-note BPM at the start
+	Key             string  `json:"key,omitempty"`              // Key signature, e.g. "C" or "F#m" (see musicxml.ParseKeyName)
+	TimeSignature   string  `json:"time_signature,omitempty"`   // e.g. "3/4"
+	DurationSeconds float64 `json:"duration_seconds,omitempty"` // Playing time at the marked tempos, without repeats
+	MeasureCount    int     `json:"measure_count,omitempty"`
+	LowestPitch     string  `json:"lowest_pitch,omitempty"`  // Lowest written pitch, e.g. "E2"
+	HighestPitch    string  `json:"highest_pitch,omitempty"` // Highest written pitch
+	Instrument      string  `json:"instrument,omitempty"`    // e.g. "guitar": the tag of the sheet, by default read by musicxml.Part.Instrument
+}
+
+// metadataColumns are the columns of SongMetadata, both in Sheets and in Music.
+// Pitches are stored as MIDI numbers so that they can be compared.
+const metadataColumns = "tempo, key_name, time_signature, duration_seconds, measure_count, lowest_pitch, highest_pitch, instrument"
+
+var metadataColumnDefinitions = []struct{ name, definition string }{
+	{"tempo", "REAL"},
+	{"key_name", "TEXT"},
+	{"time_signature", "TEXT"},
+	{"duration_seconds", "REAL"},
+	{"measure_count", "INTEGER"},
+	{"lowest_pitch", "INTEGER"},
+	{"highest_pitch", "INTEGER"},
+	{"instrument", "TEXT"},
+}
+
+// addMetadataColumns is the up step of the migration adding the metadata columns, which also
+// fills them from the sheets already stored.
+func addMetadataColumns(db execer) error {
+	for _, table := range []string{"Sheets", "Music"} {
+		for _, c := range metadataColumnDefinitions {
+			if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.definition)); err != nil {
+				return fmt.Errorf("failed to add column %s.%s: %w", table, c.name, err)
+			}
+		}
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_sheets_instrument ON Sheets(instrument)"); err != nil {
+		return fmt.Errorf("failed to create index on Sheets.instrument: %w", err)
+	}
+
+	ids, err := queryIDs(db, "SELECT id FROM Music ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := refreshMusicMetadata(db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropMetadataColumns is the down step of the migration adding the metadata columns.
+func dropMetadataColumns(db execer) error {
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_sheets_instrument"); err != nil {
+		return fmt.Errorf("failed to drop index on Sheets.instrument: %w", err)
+	}
+	for _, table := range []string{"Sheets", "Music"} {
+		for _, c := range metadataColumnDefinitions {
+			if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, c.name)); err != nil {
+				return fmt.Errorf("failed to drop column %s.%s: %w", table, c.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// queryIDs returns the integers selected by a query.
+func queryIDs(db execer, query string, args ...any) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ids: %w", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// metadataRow scans the metadataColumns of a row.
+type metadataRow struct {
+	tempo, duration                sql.NullFloat64
+	key, timeSignature, instrument sql.NullString
+	measureCount, lowest, highest  sql.NullInt64
+}
+
+func (r *metadataRow) dest() []any {
+	return []any{&r.tempo, &r.key, &r.timeSignature, &r.duration, &r.measureCount, &r.lowest, &r.highest, &r.instrument}
+}
+
+func (r metadataRow) metadata() SongMetadata {
+	md := SongMetadata{
+		Tempo:           r.tempo.Float64,
+		Key:             r.key.String,
+		TimeSignature:   r.timeSignature.String,
+		DurationSeconds: r.duration.Float64,
+		MeasureCount:    int(r.measureCount.Int64),
+		Instrument:      r.instrument.String,
+	}
+	// Spell the pitches in the key of the sheet
+	key, _ := musicxml.ParseKeyName(r.key.String)
+	if r.lowest.Valid {
+		md.LowestPitch = musicxml.PitchFromMIDI(int(r.lowest.Int64), key.Fifths).String()
+	}
+	if r.highest.Valid {
+		md.HighestPitch = musicxml.PitchFromMIDI(int(r.highest.Int64), key.Fifths).String()
+	}
+	return md
+}
+
+// metadataValues returns the values of the metadataColumns for a sheet.
+func metadataValues(md musicxml.Metadata) []any {
+	var lowest, highest any
+	if md.Lowest != nil {
+		lowest, highest = md.Lowest.MIDI(), md.Highest.MIDI()
+	}
+	var timeSignature, key any
+	if ts := md.TimeSignature(); ts != "" {
+		timeSignature = ts
+	}
+	if md.MeasureCount > 0 {
+		key = md.Key.Name()
+	}
+	return []any{roundTenth(md.Tempo), key, timeSignature, roundTenth(md.DurationSeconds),
+		md.MeasureCount, lowest, highest, md.Instrument}
+}
+
+// describeSheet reads the metadata of a MusicXML sheet, as it would be stored.
+func describeSheet(sheet string) (SongMetadata, error) {
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return SongMetadata{}, err
+	}
+	md := musicxml.Describe(score)
+	out := SongMetadata{
+		Tempo:           roundTenth(md.Tempo),
+		TimeSignature:   md.TimeSignature(),
+		DurationSeconds: roundTenth(md.DurationSeconds),
+		MeasureCount:    md.MeasureCount,
+		Instrument:      md.Instrument,
+	}
+	if md.MeasureCount > 0 {
+		out.Key = md.Key.Name()
+	}
+	if md.Lowest != nil {
+		out.LowestPitch = musicxml.PitchFromMIDI(md.Lowest.MIDI(), md.Key.Fifths).String()
+		out.HighestPitch = musicxml.PitchFromMIDI(md.Highest.MIDI(), md.Key.Fifths).String()
+	}
+	return out, nil
+}
+
+func roundTenth(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// refreshMusicMetadata reads the metadata of every sheet of a music from its MusicXML, and copies
+// the metadata of the reference sheet to the music. It is called whenever the sheets change.
+func refreshMusicMetadata(db execer, musicID int) error {
+	type sheetRow struct {
+		id         int
+		sheet      string
+		instrument string
+	}
+	// The reference sheet comes first: hand-made before generated, hardest first, accompaniment last
+	rows, err := db.Query(`
+		SELECT id, sheet, COALESCE(instrument, '') FROM Sheets WHERE music_id = ?
+		ORDER BY difficulty = ?, generated, difficulty DESC`, musicID, accompanimentDifficulty)
+	if err != nil {
+		return fmt.Errorf("failed to query sheets of music_id %d for metadata: %w", musicID, err)
+	}
+	var sheets []sheetRow
+	for rows.Next() {
+		var s sheetRow
+		if err := rows.Scan(&s.id, &s.sheet, &s.instrument); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan sheet of music_id %d for metadata: %w", musicID, err)
+		}
+		sheets = append(sheets, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating sheets of music_id %d for metadata: %w", musicID, err)
+	}
+
+	// A music without a readable sheet has no metadata
+	musicValues := make([]any, 8)
+	found := false
+	for _, s := range sheets {
+		score, err := musicxml.ParseString(s.sheet)
+		if err != nil {
+			log.Printf("Warning: Failed to read metadata of sheet %d (music_id: %d): %v", s.id, musicID, err)
+			continue
+		}
+		values := metadataValues(musicxml.Describe(score))
+		// The instrument a sheet is tagged with wins over the one read from the MusicXML
+		if s.instrument != "" {
+			values[len(values)-1] = s.instrument
+		}
+		if _, err := db.Exec("UPDATE Sheets SET ("+metadataColumns+") = (?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?", append(values, s.id)...); err != nil {
+			return fmt.Errorf("failed to store metadata of sheet %d: %w", s.id, err)
+		}
+		if !found {
+			musicValues, found = values, true
+		}
+	}
+	if _, err := db.Exec("UPDATE Music SET ("+metadataColumns+") = (?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?", append(musicValues, musicID)...); err != nil {
+		return fmt.Errorf("failed to store metadata of music_id %d: %w", musicID, err)
+	}
+	return nil
+}
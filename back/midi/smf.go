@@ -0,0 +1,404 @@
+// Package midi reads and writes Standard MIDI Files (SMF, formats 0 and 1).
+//
+// Events are held with absolute times in ticks; delta times and running status
+// only exist in the encoded file.
+package midi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Status bytes of the channel messages (upper nibble) and of meta events.
+const (
+	NoteOff       = 0x80
+	NoteOn        = 0x90
+	ProgramChange = 0xC0
+	Meta          = 0xFF
+)
+
+// Meta event types.
+const (
+	MetaTrackName     = 0x03
+	MetaEndOfTrack    = 0x2F
+	MetaTempo         = 0x51
+	MetaTimeSignature = 0x58
+	MetaKeySignature  = 0x59
+)
+
+// maxChunkSize bounds the size of a chunk, far above the tracks of real songs.
+const maxChunkSize = 64 << 20
+
+// PercussionChannel is the 0-based General MIDI drum channel (channel 10).
+const PercussionChannel = 9
+
+var (
+	ErrNotSMF      = errors.New("midi: not a Standard MIDI File")
+	ErrSMPTE       = errors.New("midi: SMPTE time division is not supported")
+	ErrMalformed   = errors.New("midi: malformed track data")
+	ErrUnsupported = errors.New("midi: unsupported file format")
+)
+
+// File is a Standard MIDI File.
+type File struct {
+	Format int
+	// Division is the number of ticks per quarter note.
+	Division int
+	Tracks   []Track
+}
+
+// Track is one MTrk chunk. Events are ordered by Tick.
+type Track struct {
+	Events []Event
+}
+
+// Event is a channel message, a meta event (Status 0xFF) or a system exclusive message (0xF0/0xF7).
+type Event struct {
+	// Tick is the absolute time of the event from the start of the track.
+	Tick   int
+	Status byte
+	// Meta is the meta event type when Status is Meta.
+	Meta byte
+	Data []byte
+}
+
+// Type returns the message type: the status without the channel for channel messages.
+func (e Event) Type() byte {
+	if e.Status >= 0xF0 {
+		return e.Status
+	}
+	return e.Status & 0xF0
+}
+
+// Channel returns the 0-based channel of a channel message.
+func (e Event) Channel() int {
+	return int(e.Status & 0x0F)
+}
+
+// IsNoteOn reports whether the event starts a note (a note-on with a velocity above zero).
+func (e Event) IsNoteOn() bool {
+	return e.Type() == NoteOn && len(e.Data) == 2 && e.Data[1] > 0
+}
+
+// IsNoteOff reports whether the event ends a note (a note-off or a note-on with zero velocity).
+func (e Event) IsNoteOff() bool {
+	return len(e.Data) == 2 && (e.Type() == NoteOff || (e.Type() == NoteOn && e.Data[1] == 0))
+}
+
+// Tempo returns the tempo of a tempo meta event in quarter notes per minute.
+func (e Event) Tempo() (bpm float64, ok bool) {
+	if e.Status != Meta || e.Meta != MetaTempo || len(e.Data) != 3 {
+		return 0, false
+	}
+	usPerQuarter := int(e.Data[0])<<16 | int(e.Data[1])<<8 | int(e.Data[2])
+	if usPerQuarter == 0 {
+		return 0, false
+	}
+	// Microsecond resolution cannot hold most tempos exactly (90 BPM is 666667us), so round it back.
+	return math.Round(60e6/float64(usPerQuarter)*1000) / 1000, true
+}
+
+// TimeSignature returns the time signature of a time signature meta event, e.g. 6 and 8 for 6/8.
+func (e Event) TimeSignature() (beats, beatType int, ok bool) {
+	if e.Status != Meta || e.Meta != MetaTimeSignature || len(e.Data) < 2 || e.Data[1] > 6 {
+		return 0, 0, false
+	}
+	return int(e.Data[0]), 1 << e.Data[1], true
+}
+
+// KeySignature returns the sharps (positive) or flats (negative) of a key signature meta event.
+func (e Event) KeySignature() (fifths int, minor bool, ok bool) {
+	if e.Status != Meta || e.Meta != MetaKeySignature || len(e.Data) != 2 {
+		return 0, false, false
+	}
+	return int(int8(e.Data[0])), e.Data[1] == 1, true
+}
+
+// NoteOnEvent returns a note-on message. channel is 0-based.
+func NoteOnEvent(tick, channel, key, velocity int) Event {
+	return Event{Tick: tick, Status: NoteOn | byte(channel&0x0F), Data: []byte{byte(key & 0x7F), byte(velocity & 0x7F)}}
+}
+
+// NoteOffEvent returns a note-off message. channel is 0-based.
+func NoteOffEvent(tick, channel, key int) Event {
+	return Event{Tick: tick, Status: NoteOff | byte(channel&0x0F), Data: []byte{byte(key & 0x7F), 0}}
+}
+
+// ProgramChangeEvent returns a program change to the 0-based General MIDI program.
+func ProgramChangeEvent(tick, channel, program int) Event {
+	return Event{Tick: tick, Status: ProgramChange | byte(channel&0x0F), Data: []byte{byte(program & 0x7F)}}
+}
+
+// TempoEvent returns a tempo meta event for the given quarter notes per minute.
+func TempoEvent(tick int, bpm float64) Event {
+	us := int(math.Round(60e6 / bpm))
+	return Event{Tick: tick, Status: Meta, Meta: MetaTempo, Data: []byte{byte(us >> 16), byte(us >> 8), byte(us)}}
+}
+
+// TimeSignatureEvent returns a time signature meta event. beatType must be a power of two.
+func TimeSignatureEvent(tick, beats, beatType int) Event {
+	power := 0
+	for 1<<power < beatType {
+		power++
+	}
+	return Event{Tick: tick, Status: Meta, Meta: MetaTimeSignature, Data: []byte{byte(beats), byte(power), 24, 8}}
+}
+
+// KeySignatureEvent returns a key signature meta event.
+func KeySignatureEvent(tick, fifths int, minor bool) Event {
+	mode := byte(0)
+	if minor {
+		mode = 1
+	}
+	return Event{Tick: tick, Status: Meta, Meta: MetaKeySignature, Data: []byte{byte(int8(fifths)), mode}}
+}
+
+// TrackNameEvent returns a track name meta event.
+func TrackNameEvent(tick int, name string) Event {
+	return Event{Tick: tick, Status: Meta, Meta: MetaTrackName, Data: []byte(name)}
+}
+
+// Read decodes a Standard MIDI File.
+func Read(r io.Reader) (*File, error) {
+	br := bufio.NewReader(r)
+
+	typ, header, err := readChunk(br)
+	if err != nil || typ != "MThd" || len(header) < 6 {
+		return nil, ErrNotSMF
+	}
+	f := &File{
+		Format:   int(binary.BigEndian.Uint16(header[0:2])),
+		Division: int(binary.BigEndian.Uint16(header[4:6])),
+	}
+	trackCount := int(binary.BigEndian.Uint16(header[2:4]))
+	if f.Division&0x8000 != 0 {
+		return nil, ErrSMPTE
+	}
+	if f.Format > 1 {
+		return nil, fmt.Errorf("%w: format %d", ErrUnsupported, f.Format)
+	}
+	if f.Division == 0 {
+		return nil, fmt.Errorf("%w: zero ticks per quarter note", ErrMalformed)
+	}
+
+	for len(f.Tracks) < trackCount {
+		typ, data, err := readChunk(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ != "MTrk" {
+			continue // Unknown chunks must be skipped.
+		}
+		track, err := parseTrack(data)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %w", len(f.Tracks), err)
+		}
+		f.Tracks = append(f.Tracks, track)
+	}
+	return f, nil
+}
+
+// Parse is Read for an in-memory file.
+func Parse(data []byte) (*File, error) {
+	return Read(bytes.NewReader(data))
+}
+
+func readChunk(r io.Reader) (string, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return "", nil, fmt.Errorf("%w: truncated chunk header", ErrMalformed)
+		}
+		return "", nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[4:]))
+	if size > maxChunkSize {
+		return "", nil, fmt.Errorf("%w: %s chunk of %d bytes", ErrMalformed, header[:4], size)
+	}
+	// The declared size is not trusted: the buffer only grows with the bytes actually read.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, size); err != nil {
+		return "", nil, fmt.Errorf("%w: truncated %s chunk", ErrMalformed, header[:4])
+	}
+	return string(header[:4]), data.Bytes(), nil
+}
+
+func parseTrack(data []byte) (Track, error) {
+	var track Track
+	pos, tick := 0, 0
+	var running byte
+	readVLQ := func() (int, error) {
+		value := 0
+		for i := 0; i < 4; i++ {
+			if pos >= len(data) {
+				return 0, ErrMalformed
+			}
+			b := data[pos]
+			pos++
+			value = value<<7 | int(b&0x7F)
+			if b&0x80 == 0 {
+				return value, nil
+			}
+		}
+		return 0, ErrMalformed
+	}
+	take := func(n int) ([]byte, error) {
+		if n < 0 || pos+n > len(data) {
+			return nil, ErrMalformed
+		}
+		b := append([]byte(nil), data[pos:pos+n]...)
+		pos += n
+		return b, nil
+	}
+
+	for pos < len(data) {
+		delta, err := readVLQ()
+		if err != nil {
+			return track, err
+		}
+		tick += delta
+
+		status := data[pos]
+		if status&0x80 != 0 {
+			pos++
+		} else if running != 0 {
+			status = running
+		} else {
+			return track, fmt.Errorf("%w: data byte without running status", ErrMalformed)
+		}
+
+		ev := Event{Tick: tick, Status: status}
+		switch {
+		case status == Meta:
+			running = 0
+			if pos >= len(data) {
+				return track, ErrMalformed
+			}
+			ev.Meta = data[pos]
+			pos++
+			n, err := readVLQ()
+			if err != nil {
+				return track, err
+			}
+			if ev.Data, err = take(n); err != nil {
+				return track, err
+			}
+			if ev.Meta == MetaEndOfTrack {
+				track.Events = append(track.Events, ev)
+				return track, nil
+			}
+		case status == 0xF0 || status == 0xF7:
+			running = 0
+			n, err := readVLQ()
+			if err != nil {
+				return track, err
+			}
+			if ev.Data, err = take(n); err != nil {
+				return track, err
+			}
+		case status >= 0xF0:
+			return track, fmt.Errorf("%w: unexpected system message 0x%X", ErrMalformed, status)
+		default:
+			running = status
+			n := 2
+			if t := status & 0xF0; t == ProgramChange || t == 0xD0 {
+				n = 1
+			}
+			if ev.Data, err = take(n); err != nil {
+				return track, err
+			}
+		}
+		track.Events = append(track.Events, ev)
+	}
+	return track, nil
+}
+
+// Write encodes the file. Events of each track are written in order of Tick,
+// and every track is closed with a single end-of-track event.
+func (f *File) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header[0:2], uint16(f.Format))
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(f.Tracks)))
+	binary.BigEndian.PutUint16(header[4:6], uint16(f.Division))
+	if err := writeChunk(bw, "MThd", header); err != nil {
+		return err
+	}
+	for _, t := range f.Tracks {
+		if err := writeChunk(bw, "MTrk", encodeTrack(t)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Bytes returns the encoded file.
+func (f *File) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var header [8]byte
+	copy(header[:4], typ)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func encodeTrack(t Track) []byte {
+	events := make([]Event, 0, len(t.Events))
+	last := 0
+	for _, ev := range t.Events {
+		last = max(last, ev.Tick)
+		if ev.Status == Meta && ev.Meta == MetaEndOfTrack {
+			continue
+		}
+		events = append(events, ev)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Tick < events[j].Tick })
+	events = append(events, Event{Tick: last, Status: Meta, Meta: MetaEndOfTrack})
+
+	var buf []byte
+	tick := 0
+	for _, ev := range events {
+		buf = appendVLQ(buf, max(0, ev.Tick-tick))
+		tick = max(tick, ev.Tick)
+		buf = append(buf, ev.Status)
+		switch {
+		case ev.Status == Meta:
+			buf = append(buf, ev.Meta)
+			buf = appendVLQ(buf, len(ev.Data))
+		case ev.Status == 0xF0 || ev.Status == 0xF7:
+			buf = appendVLQ(buf, len(ev.Data))
+		}
+		buf = append(buf, ev.Data...)
+	}
+	return buf
+}
+
+func appendVLQ(buf []byte, v int) []byte {
+	var tmp [4]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7F)
+	for v >>= 7; v > 0 && i > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7F) | 0x80
+	}
+	return append(buf, tmp[i:]...)
+}
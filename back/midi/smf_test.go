@@ -0,0 +1,140 @@
+package midi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	f := &File{Format: 1, Division: 480, Tracks: []Track{
+		{Events: []Event{
+			TrackNameEvent(0, "conductor"),
+			TempoEvent(0, 90),
+			TimeSignatureEvent(0, 6, 8),
+			KeySignatureEvent(0, -3, true),
+		}},
+		{Events: []Event{
+			ProgramChangeEvent(0, 1, 25),
+			NoteOnEvent(0, 1, 60, 80),
+			NoteOffEvent(480, 1, 60),
+			NoteOnEvent(200000, 1, 64, 80), // delta needs a three-byte VLQ
+			NoteOffEvent(200480, 1, 64),
+		}},
+	}}
+
+	data, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Format != 1 || got.Division != 480 || len(got.Tracks) != 2 {
+		t.Fatalf("header = format %d, division %d, %d tracks", got.Format, got.Division, len(got.Tracks))
+	}
+
+	conductor := got.Tracks[0].Events
+	if bpm, ok := conductor[1].Tempo(); !ok || bpm != 90 {
+		t.Errorf("tempo = %v, %v; want 90", bpm, ok)
+	}
+	if beats, beatType, ok := conductor[2].TimeSignature(); !ok || beats != 6 || beatType != 8 {
+		t.Errorf("time signature = %d/%d, %v; want 6/8", beats, beatType, ok)
+	}
+	if fifths, minor, ok := conductor[3].KeySignature(); !ok || fifths != -3 || !minor {
+		t.Errorf("key signature = %d minor=%v, %v; want -3 minor", fifths, minor, ok)
+	}
+	if last := conductor[len(conductor)-1]; last.Meta != MetaEndOfTrack {
+		t.Errorf("last event = %+v, want end of track", last)
+	}
+
+	notes := got.Tracks[1].Events
+	if len(notes) != 6 {
+		t.Fatalf("got %d events in track 1, want 6", len(notes))
+	}
+	for i, want := range f.Tracks[1].Events {
+		if notes[i].Tick != want.Tick || notes[i].Status != want.Status || !bytes.Equal(notes[i].Data, want.Data) {
+			t.Errorf("event[%d] = %+v, want %+v", i, notes[i], want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	header := []byte{'M', 'T', 'h', 'd', 0, 0, 0, 6, 0, 0, 0, 1, 0, 96}
+	tests := []struct {
+		name  string
+		track []byte
+		want  []Event
+		err   error
+	}{
+		{
+			name: "running status and zero-velocity note off",
+			track: []byte{
+				0x00, 0x90, 60, 100,
+				0x60, 60, 0, // running status note on with velocity 0
+				0x00, 62, 100,
+				0x60, 0x80, 62, 64,
+				0x00, 0xFF, 0x2F, 0x00,
+			},
+			want: []Event{
+				{Tick: 0, Status: 0x90, Data: []byte{60, 100}},
+				{Tick: 96, Status: 0x90, Data: []byte{60, 0}},
+				{Tick: 96, Status: 0x90, Data: []byte{62, 100}},
+				{Tick: 192, Status: 0x80, Data: []byte{62, 64}},
+				{Tick: 192, Status: 0xFF, Meta: 0x2F, Data: []byte{}},
+			},
+		},
+		{
+			name:  "data byte without status",
+			track: []byte{0x00, 60, 100},
+			err:   ErrMalformed,
+		},
+		{
+			name:  "truncated message",
+			track: []byte{0x00, 0x90, 60},
+			err:   ErrMalformed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), header...)
+			data = append(data, 'M', 'T', 'r', 'k', 0, 0, 0, byte(len(tt.track)))
+			data = append(data, tt.track...)
+
+			f, err := Parse(data)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := f.Tracks[0].Events
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d", len(events), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if events[i].Tick != want.Tick || events[i].Status != want.Status || events[i].Meta != want.Meta || !bytes.Equal(events[i].Data, want.Data) {
+					t.Errorf("event[%d] = %+v, want %+v", i, events[i], want)
+				}
+			}
+			if !events[1].IsNoteOff() || !events[2].IsNoteOn() || !events[3].IsNoteOff() {
+				t.Errorf("note on/off detection failed: %+v", events)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte("RIFF....")); !errors.Is(err, ErrNotSMF) {
+		t.Errorf("Parse(RIFF) err = %v, want ErrNotSMF", err)
+	}
+	for _, size := range [][]byte{{0x00, 0x01, 0x00, 0x00}, {0xFF, 0xFF, 0xFF, 0xFF}} {
+		data := append(append(append([]byte(nil), header...), 'M', 'T', 'r', 'k'), size...)
+		if _, err := Parse(append(data, 0x00, 0xFF, 0x2F, 0x00)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(chunk size % X) err = %v, want ErrMalformed", size, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"infosystem-musicapp/midi"
+	"infosystem-musicapp/musicxml"
+)
+
+// maxMIDIFileSize bounds uploaded .mid files; arrangements are a few kilobytes.
+const maxMIDIFileSize = 4 << 20
+
+// ConvertMIDIToSheet converts a Standard MIDI File into a MusicXML sheet quantized to
+// grid notes per quarter (16th notes if grid is 0).
+func ConvertMIDIToSheet(data []byte, grid int) (string, error) {
+	f, err := midi.Parse(data)
+	if err != nil {
+		return "", err
+	}
+	score, err := musicxml.FromMIDI(f, grid)
+	if err != nil {
+		return "", err
+	}
+	return musicxml.MarshalString(score)
+}
+
+// ExportSheetMIDI converts a stored sheet to a Standard MIDI File, transposed like /select.
+func ExportSheetMIDI(db *sql.DB, musicID int, part SheetPart, difficulty int, t TransposeOptions) ([]byte, error) {
+	sheet, err := GetSheet(db, musicID, part, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	if score, _, err = t.Apply(score); err != nil {
+		return nil, fmt.Errorf("failed to transpose sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	return musicxml.ToMIDI(score).Bytes()
+}
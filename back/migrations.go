@@ -0,0 +1,389 @@
+/*
+ * Versioned schema migrations.
+ *
+ * Every change of the schema is a numbered migration with an up and a down step. The
+ * schema_version table holds one row per applied migration, and each migration runs in its
+ * own transaction together with the update of schema_version, so a failing migration leaves
+ * the database at the previous version.
+ *
+ * On startup, pending migrations are applied unless AUTO_MIGRATE=false, in which case the
+ * server refuses to start until they are applied with "back migrate up". A database migrated
+ * by a newer build (unknown version) or by another branch (different name) is never opened.
+ *
+ * Migrations 1 to 5 are the schema that used to be created on every start with
+ * "CREATE TABLE IF NOT EXISTS". They are idempotent, so that databases created before
+ * schema_version existed are adopted as they are. Later migrations do not need to be.
+ * Never edit or renumber a released migration: add a new one.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSchemaTooNew      = errors.New("the database was migrated by a newer version of the backend")
+	ErrSchemaMismatch    = errors.New("the applied migrations do not match this version of the backend")
+	ErrPendingMigrations = errors.New("the database has pending migrations")
+)
+
+// migration is a numbered change of the schema.
+type migration struct {
+	version int
+	name    string
+	up      func(db execer) error
+	down    func(db execer) error
+}
+
+var migrations = []migration{
+	{1, "initial_schema", createInitialSchema, dropTables("SearchHistory", "UserMusicDifficultySettings", "Favorites", "UserProficiency", "Sheets", "Music")},
+	{2, "history", setupHistory, dropHistory},
+	{3, "practice_progress", setupPracticeProgress, dropTables("PracticeProgress")},
+	{4, "genres", setupGenres, dropTables("MusicGenres", "GenreNames", "Genres")},
+	{5, "image_cache", setupImages, dropTables("Images")},
+	{6, "unique_sheet_difficulty", uniqueSheetDifficulty, execAll("DROP INDEX IF EXISTS idx_sheets_music_difficulty")},
+	{7, "song_metadata", addMetadataColumns, dropMetadataColumns},
+	{8, "instruments", setupInstruments, dropInstruments},
+	{9, "users", setupUsers, dropUsers},
+	{10, "spotify", setupSpotify, dropTables("SpotifyLogins", "SpotifyTokens")},
+	{11, "proficiency_history", setupProficiencyHistory, dropTables("ProficiencyHistory")},
+	{12, "progress_parts", addProgressParts, dropProgressParts},
+	{13, "syllabic_n", renormalizeSearchText, execAll("DROP TABLE IF EXISTS MusicSearch")},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// execAll returns a migration step running the given statements.
+func execAll(stmts ...string) func(db execer) error {
+	return func(db execer) error {
+		for _, stmt := range stmts {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to run %q: %w", stmt, err)
+			}
+		}
+		return nil
+	}
+}
+
+// dropTables returns a migration step dropping tables, dependent tables first.
+func dropTables(tables ...string) func(db execer) error {
+	stmts := make([]string, len(tables))
+	for i, table := range tables {
+		stmts[i] = "DROP TABLE IF EXISTS " + table
+	}
+	return execAll(stmts...)
+}
+
+// createInitialSchema creates the catalog and the user data tables of the first release.
+func createInitialSchema(db execer) error {
+	cmd := `create table if not exists Music(
+	id integer primary key autoincrement,
+	title text not null,
+	artist text,
+	base_difficulty integer,
+	genre text,
+	thumbnail text,
+	reading text
+	)`
+
+	if _, err := db.Exec(cmd); err != nil {
+		return err
+	}
+	// Music created before the search index existed lacks the reading column
+	if err := addColumnIfMissing(db, "Music", "reading", "text"); err != nil {
+		return err
+	}
+
+	cmd = `create table if not exists Sheets(
+	id integer primary key autoincrement,
+	music_id integer,
+	difficulty integer not null,
+	sheet text not null,
+	generated integer not null default 0,
+	foreign key (music_id) references Music(id)
+	)`
+
+	if _, err := db.Exec(cmd); err != nil {
+		return err
+	}
+	// Sheets created before generated arrangements existed lack the generated column
+	if err := addColumnIfMissing(db, "Sheets", "generated", "integer not null default 0"); err != nil {
+		return err
+	}
+
+	// UserProficiency table
+	cmd = `CREATE TABLE IF NOT EXISTS UserProficiency (
+		singleton_key INTEGER PRIMARY KEY DEFAULT 1 CHECK (singleton_key = 1),
+		proficiency REAL NOT NULL DEFAULT 0.0
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create UserProficiency table: %w", err)
+	}
+	// Initialize proficiency if it doesn't exist
+	cmd = `INSERT OR IGNORE INTO UserProficiency (singleton_key, proficiency) VALUES (1, 0.0)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to initialize UserProficiency: %w", err)
+	}
+
+	// Favorites table
+	cmd = `CREATE TABLE IF NOT EXISTS Favorites (
+		music_id INTEGER PRIMARY KEY,
+		order_key INTEGER NOT NULL,
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create Favorites table: %w", err)
+	}
+
+	// UserMusicDifficultySettings table
+	cmd = `CREATE TABLE IF NOT EXISTS UserMusicDifficultySettings (
+		music_id INTEGER NOT NULL,
+		measure INTEGER NOT NULL,
+		difficulty INTEGER NOT NULL,
+		PRIMARY KEY (music_id, measure),
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return err
+	}
+
+	// SearchHistory table, moved into QueryHistory and ViewHistory by migration 2
+	cmd = `CREATE TABLE IF NOT EXISTS SearchHistory (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		music_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		artist TEXT,
+		thumbnail TEXT,
+		searched_at DATETIME NOT NULL
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create SearchHistory table: %w", err)
+	}
+	return nil
+}
+
+// uniqueSheetDifficulty enforces one sheet per difficulty of a music. Of duplicates left by
+// older versions, the sheet actually served (the first one inserted) is kept.
+func uniqueSheetDifficulty(db execer) error {
+	res, err := db.Exec(`
+		DELETE FROM Sheets WHERE id NOT IN (SELECT MIN(id) FROM Sheets GROUP BY music_id, difficulty)`)
+	if err != nil {
+		return fmt.Errorf("failed to remove duplicate sheets: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Printf("Removed %d duplicate sheets", n)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_sheets_music_difficulty ON Sheets(music_id, difficulty)"); err != nil {
+		return fmt.Errorf("failed to create unique index on Sheets: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table,
+// since "create table if not exists" leaves tables of older databases untouched.
+func addColumnIfMissing(db execer, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating columns of %s: %w", table, err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	log.Printf("Added column %s.%s", table, column)
+	return nil
+}
+
+// MigrationStatus is a migration known to the backend, and whether it is applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil when pending
+}
+
+func ensureSchemaVersionTable(db *sql.DB) error {
+	cmd := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	return nil
+}
+
+// schemaStatus returns every known migration with its state, and the current schema version.
+// It fails when the applied migrations are not a prefix of the known ones.
+func schemaStatus(db *sql.DB) ([]MigrationStatus, int, error) {
+	if err := ensureSchemaVersionTable(db); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_version ORDER BY version")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query schema_version: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = MigrationStatus{Version: m.version, Name: m.name}
+	}
+	current := 0
+	for rows.Next() {
+		var version int
+		var name string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan schema_version: %w", err)
+		}
+		if version > latestSchemaVersion() {
+			return nil, 0, fmt.Errorf("%w: schema version %d (%s), this build knows up to %d", ErrSchemaTooNew, version, name, latestSchemaVersion())
+		}
+		if version != current+1 || statuses[version-1].Name != name {
+			return nil, 0, fmt.Errorf("%w: applied migration %d is %q", ErrSchemaMismatch, version, name)
+		}
+		statuses[version-1].AppliedAt = &appliedAt
+		current = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating schema_version: %w", err)
+	}
+	return statuses, current, nil
+}
+
+// runMigration applies (up) or rolls back a migration in a transaction with its schema_version row.
+func runMigration(db *sql.DB, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %d: %w", m.version, err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	step, direction := m.up, "up"
+	if !up {
+		step, direction = m.down, "down"
+	}
+	if err := step(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) %s failed: %w", m.version, m.name, direction, err)
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_version WHERE version = ?", m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update schema_version for migration %d: %w", m.version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+	}
+	successfulCommit = true
+	return nil
+}
+
+// MigrateUp applies the pending migrations up to the target version and reports each one to w.
+func MigrateUp(db *sql.DB, target int, w io.Writer) error {
+	_, current, err := schemaStatus(db)
+	if err != nil {
+		return err
+	}
+	if target < current || target > latestSchemaVersion() {
+		return fmt.Errorf("cannot migrate up from version %d to %d (latest: %d)", current, target, latestSchemaVersion())
+	}
+	for _, m := range migrations[current:target] {
+		if err := runMigration(db, m, true); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "applied %d %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// MigrateDown rolls back the applied migrations above the target version, latest first,
+// and reports each one to w.
+func MigrateDown(db *sql.DB, target int, w io.Writer) error {
+	_, current, err := schemaStatus(db)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > current {
+		return fmt.Errorf("cannot migrate down from version %d to %d", current, target)
+	}
+	for i := current - 1; i >= target; i-- {
+		m := migrations[i]
+		if err := runMigration(db, m, false); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "rolled back %d %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// PrintMigrationStatus writes every known migration and whether it is applied to w.
+func PrintMigrationStatus(db *sql.DB, w io.Writer) error {
+	statuses, current, err := schemaStatus(db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "schema version %d (latest: %d)\n", current, latestSchemaVersion())
+	for _, s := range statuses {
+		state := "pending"
+		if s.AppliedAt != nil {
+			state = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%4d  %-26s %s\n", s.Version, s.Name, state)
+	}
+	return nil
+}
+
+// migrateOnStartup checks the schema version when the backend starts and applies the
+// pending migrations, unless AUTO_MIGRATE=false.
+func migrateOnStartup(db *sql.DB) error {
+	_, current, err := schemaStatus(db)
+	if err != nil {
+		return err
+	}
+	if current == latestSchemaVersion() {
+		return nil
+	}
+	if strings.EqualFold(os.Getenv("AUTO_MIGRATE"), "false") {
+		return fmt.Errorf("%w: schema version %d, latest %d; run \"%s migrate up\"", ErrPendingMigrations, current, latestSchemaVersion(), os.Args[0])
+	}
+	log.Printf("Migrating the database from schema version %d to %d", current, latestSchemaVersion())
+	return MigrateUp(db, latestSchemaVersion(), log.Writer())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the schema created on every start before schema_version existed.
+var baselineSchema = []string{
+	`create table if not exists Music(
+	id integer primary key autoincrement,
+	title text not null,
+	artist text,
+	base_difficulty integer,
+	genre text,
+	thumbnail text
+	)`,
+	`create table if not exists Sheets(
+	id integer primary key autoincrement,
+	music_id integer,
+	difficulty integer not null,
+	sheet text not null,
+	foreign key (music_id) references Music(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS UserProficiency (
+		singleton_key INTEGER PRIMARY KEY DEFAULT 1 CHECK (singleton_key = 1),
+		proficiency REAL NOT NULL DEFAULT 0.0
+	)`,
+	`INSERT OR IGNORE INTO UserProficiency (singleton_key, proficiency) VALUES (1, 0.0)`,
+	`CREATE TABLE IF NOT EXISTS Favorites (
+		music_id INTEGER PRIMARY KEY,
+		order_key INTEGER NOT NULL,
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS UserMusicDifficultySettings (
+		music_id INTEGER NOT NULL,
+		measure INTEGER NOT NULL,
+		difficulty INTEGER NOT NULL,
+		PRIMARY KEY (music_id, measure),
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS SearchHistory (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		music_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		artist TEXT,
+		thumbnail TEXT,
+		searched_at DATETIME NOT NULL
+	)`,
+}
+
+// schemaOf describes the tables, columns and indexes of a database, one line each. Columns are
+// read with PRAGMA table_info, as a column added by ALTER TABLE changes the SQL of its table.
+func schemaOf(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name, tbl_name, COALESCE(sql, '') FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' AND name != 'schema_version' ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type object struct{ kind, name, table, sql string }
+	var objects []object
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.kind, &o.name, &o.table, &o.sql); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+
+	var schema []string
+	for _, o := range objects {
+		if o.kind != "table" {
+			schema = append(schema, fmt.Sprintf("%s %s on %s: %s", o.kind, o.name, o.table, strings.Join(strings.Fields(o.sql), " ")))
+			continue
+		}
+		cols, err := db.Query(fmt.Sprintf("SELECT name, type, \"notnull\", COALESCE(dflt_value, ''), pk FROM pragma_table_info('%s')", o.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cols.Next() {
+			var name, colType, dflt string
+			var notNull, pk int
+			if err := cols.Scan(&name, &colType, &notNull, &dflt, &pk); err != nil {
+				t.Fatal(err)
+			}
+			schema = append(schema, fmt.Sprintf("table %s: %s %s notnull=%d default=%q pk=%d",
+				o.name, name, strings.ToUpper(colType), notNull, dflt, pk))
+		}
+		cols.Close()
+	}
+	return schema
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	_, current, err := schemaStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+// TestMigrationsRoundTrip migrates an empty database up one version at a time, rolls every
+// migration back, and migrates up again, comparing the schema at each version.
+func TestMigrationsRoundTrip(t *testing.T) {
+	db := openEmptyTestDB(t)
+	schemas := [][]string{schemaOf(t, db)}
+	for v := 1; v <= latestSchemaVersion(); v++ {
+		if err := MigrateUp(db, v, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		schemas = append(schemas, schemaOf(t, db))
+	}
+	latest := schemas[latestSchemaVersion()]
+
+	// Migrating up again changes nothing
+	if err := MigrateUp(db, latestSchemaVersion(), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaOf(t, db); !slices.Equal(got, latest) {
+		t.Errorf("schema after migrating up twice:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(latest, "\n"))
+	}
+
+	for v := latestSchemaVersion() - 1; v >= 0; v-- {
+		if err := MigrateDown(db, v, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if got := schemaOf(t, db); !slices.Equal(got, schemas[v]) {
+			t.Errorf("schema after rolling back to %d:\n%s\nwant:\n%s", v, strings.Join(got, "\n"), strings.Join(schemas[v], "\n"))
+		}
+	}
+	if v := schemaVersion(t, db); v != 0 {
+		t.Fatalf("schema version %d after rolling back, want 0", v)
+	}
+
+	if err := MigrateUp(db, latestSchemaVersion(), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := schemaOf(t, db); !slices.Equal(got, latest) {
+		t.Errorf("schema after migrating up again:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(latest, "\n"))
+	}
+}
+
+// TestMigrationsAdoptBaseline checks that a database created before schema_version existed is
+// taken over by migrations 1 to 5 with its data, and ends up with the schema of a new database.
+func TestMigrationsAdoptBaseline(t *testing.T) {
+	db := openEmptyTestDB(t)
+	stmts := append(slices.Clone(baselineSchema),
+		"INSERT INTO Music (id, title, artist, thumbnail) VALUES (1, 'Lemon', '米津玄師', 'lemon.jpg')",
+		"INSERT INTO Sheets (music_id, difficulty, sheet) VALUES (1, 3, '<score-partwise/>')",
+		"UPDATE UserProficiency SET proficiency = 0.4",
+		"INSERT INTO Favorites (music_id, order_key) VALUES (1, 1)",
+		"INSERT INTO UserMusicDifficultySettings (music_id, measure, difficulty) VALUES (1, 4, 2)",
+		"INSERT INTO SearchHistory (music_id, title, searched_at) VALUES (1, 'Lemon', '2025-04-01 12:00:00')",
+	)
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateUp(db, 5, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// Migrations 1 to 5 are idempotent: running them again changes nothing
+	adopted := schemaOf(t, db)
+	for _, m := range migrations[:5] {
+		if err := m.up(db); err != nil {
+			t.Fatalf("migration %d (%s) again: %v", m.version, m.name, err)
+		}
+	}
+	if got := schemaOf(t, db); !slices.Equal(got, adopted) {
+		t.Errorf("schema after running migrations 1 to 5 again:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(adopted, "\n"))
+	}
+	// The adopted schema is the one of a new database
+	fresh := openTestDBAt(t, 5)
+	if got, want := schemaOf(t, db), schemaOf(t, fresh); !slices.Equal(got, want) {
+		t.Errorf("adopted schema:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := MigrateUp(db, latestSchemaVersion(), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT title || ' ' || COALESCE(reading, '') FROM Music", "Lemon "},
+		{"SELECT instrument || ' ' || difficulty || ' ' || generated FROM Sheets", defaultInstrument + " 3 0"},
+		{"SELECT u.username || ' ' || i.instrument || ' ' || i.proficiency FROM UserInstruments i JOIN Users u ON u.id = i.user_id", defaultUsername + " " + defaultInstrument + " 0.4"},
+		{"SELECT user_id || ' ' || music_id FROM Favorites", fmt.Sprintf("%d 1", defaultUserID)},
+		{"SELECT user_id || ' ' || instrument || ' ' || measure || ' ' || difficulty FROM UserMusicDifficultySettings", fmt.Sprintf("%d %s 4 2", defaultUserID, defaultInstrument)},
+		{"SELECT user_id || ' ' || music_id FROM ViewHistory", fmt.Sprintf("%d 1", defaultUserID)},
+		{"SELECT COUNT(*) FROM sqlite_master WHERE name IN ('SearchHistory', 'UserProficiency')", "0"},
+	}
+	for _, c := range checks {
+		var got string
+		if err := db.QueryRow(c.query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got != c.want {
+			t.Errorf("%s = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
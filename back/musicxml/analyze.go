@@ -0,0 +1,180 @@
+package musicxml
+
+import (
+	"math"
+	"sort"
+)
+
+// Analysis holds the playing-difficulty metrics of the first part of a score.
+type Analysis struct {
+	// NotesPerSecond is the number of note onsets (a chord counts once) per second.
+	NotesPerSecond float64 `json:"notes_per_second"`
+	// PitchRange is the distance in semitones between the lowest and highest note.
+	PitchRange int `json:"pitch_range"`
+	// MeanLeap is the mean interval in semitones between consecutive melody notes.
+	MeanLeap float64 `json:"mean_leap"`
+	// LargeLeapRatio is the share of melody intervals larger than a perfect fifth.
+	LargeLeapRatio float64 `json:"large_leap_ratio"`
+	// AccidentalRatio is the share of notes altered against the key signature.
+	AccidentalRatio float64 `json:"accidental_ratio"`
+	// RhythmComplexity (0-1) combines off-beat onsets, tuplets, dotted and very short notes.
+	RhythmComplexity float64 `json:"rhythm_complexity"`
+	// ChordRatio is the share of onsets where more than one note is played.
+	ChordRatio float64 `json:"chord_ratio"`
+	// Tempo is the mean quarter-note BPM over the played onsets.
+	Tempo float64 `json:"tempo"`
+	// Rating is the overall difficulty on the 0-10 proficiency scale.
+	Rating float64 `json:"rating"`
+}
+
+// ratingWeights sets how much each normalized metric contributes to the rating.
+var ratingWeights = struct {
+	density, pitchRange, leaps, accidentals, rhythm, chords, tempo float64
+}{
+	density:     0.25,
+	pitchRange:  0.15,
+	leaps:       0.15,
+	accidentals: 0.10,
+	rhythm:      0.15,
+	chords:      0.10,
+	tempo:       0.10,
+}
+
+// Analyze measures the difficulty of the first staff of the first part of the score.
+func Analyze(score *Score) Analysis {
+	var a Analysis
+	if len(score.Parts) == 0 {
+		return a
+	}
+	part := score.Parts[0]
+
+	var (
+		totalSeconds, tempoSum                 float64
+		onsetCount, chordOnsets, offBeatOnsets int
+		noteCount, altered, complexNotes       int
+		leapCount, largeLeaps, leapSum         int
+		lowest, highest                        = math.MaxInt, math.MinInt
+		prevMelody                             = -1
+	)
+
+	for _, m := range part.Measures {
+		totalSeconds += part.DurationMs(m, 0, m.Length) / 1000
+
+		groupSizes := make(map[int]int)
+		var onsets []int
+		melody := make(map[int]int)
+		for _, n := range m.Notes {
+			if !n.IsSounding() || n.Staff != 1 || n.TieStop {
+				continue
+			}
+			midi := n.Pitch.MIDI()
+			lowest, highest = min(lowest, midi), max(highest, midi)
+			noteCount++
+			if n.Pitch.Alter != keyAlter(m.Key.Fifths, n.Pitch.Step) {
+				altered++
+			}
+			if n.Tuplet != nil || n.Dots > 0 || (m.Divisions > 0 && n.Duration*4 < m.Divisions) {
+				complexNotes++
+			}
+			if _, ok := groupSizes[n.Onset]; !ok {
+				onsets = append(onsets, n.Onset)
+				melody[n.Onset] = midi
+			}
+			groupSizes[n.Onset]++
+		}
+
+		sort.Ints(onsets)
+		for _, onset := range onsets {
+			onsetCount++
+			tempoSum += part.TempoAt(m.Index, onset)
+			if groupSizes[onset] > 1 {
+				chordOnsets++
+			}
+			if m.Divisions > 0 && onset%m.Divisions != 0 && (2*onset)%m.Divisions != 0 {
+				offBeatOnsets++
+			}
+			if prevMelody >= 0 {
+				leap := abs(melody[onset] - prevMelody)
+				leapSum += leap
+				leapCount++
+				if leap > 7 {
+					largeLeaps++
+				}
+			}
+			prevMelody = melody[onset]
+		}
+	}
+
+	if onsetCount == 0 {
+		return a
+	}
+	if totalSeconds > 0 {
+		a.NotesPerSecond = float64(onsetCount) / totalSeconds
+	}
+	a.PitchRange = highest - lowest
+	if leapCount > 0 {
+		a.MeanLeap = float64(leapSum) / float64(leapCount)
+		a.LargeLeapRatio = float64(largeLeaps) / float64(leapCount)
+	}
+	a.AccidentalRatio = float64(altered) / float64(noteCount)
+	a.RhythmComplexity = math.Min(1, (float64(offBeatOnsets)/float64(onsetCount)+float64(complexNotes)/float64(noteCount))/1.5)
+	a.ChordRatio = float64(chordOnsets) / float64(onsetCount)
+	a.Tempo = tempoSum / float64(onsetCount)
+	a.Rating = a.rating()
+	return a
+}
+
+// rating combines the metrics, each normalized to 0-1, into a 0-10 score.
+func (a Analysis) rating() float64 {
+	w := ratingWeights
+	score := w.density*normalize(a.NotesPerSecond, 0.5, 8) +
+		w.pitchRange*normalize(float64(a.PitchRange), 5, 36) +
+		w.leaps*(normalize(a.MeanLeap, 1, 9)+normalize(a.LargeLeapRatio, 0, 0.5))/2 +
+		w.accidentals*normalize(a.AccidentalRatio, 0, 0.3) +
+		w.rhythm*a.RhythmComplexity +
+		w.chords*a.ChordRatio +
+		w.tempo*normalize(a.Tempo, 60, 180)
+	total := w.density + w.pitchRange + w.leaps + w.accidentals + w.rhythm + w.chords + w.tempo
+	return math.Round(score/total*100) / 10
+}
+
+// SheetLevel maps the rating to a sheet difficulty between minLevel and maxLevel,
+// using the same proficiency-to-level mapping as the frontend (level = proficiency / 2).
+func (a Analysis) SheetLevel(minLevel, maxLevel int) int {
+	return max(minLevel, min(maxLevel, int(a.Rating/2)))
+}
+
+// sharpOrder and flatOrder are the steps altered by a key signature, in signature order.
+const (
+	sharpOrder = "FCGDAEB"
+	flatOrder  = "BEADGCF"
+)
+
+// keyAlter returns the alteration the key signature with the given fifths applies to step.
+func keyAlter(fifths int, step string) int {
+	if len(step) != 1 {
+		return 0
+	}
+	for i := 0; i < fifths && i < len(sharpOrder); i++ {
+		if sharpOrder[i] == step[0] {
+			return 1
+		}
+	}
+	for i := 0; i < -fifths && i < len(flatOrder); i++ {
+		if flatOrder[i] == step[0] {
+			return -1
+		}
+	}
+	return 0
+}
+
+func normalize(v, lo, hi float64) float64 {
+	return math.Max(0, math.Min(1, (v-lo)/(hi-lo)))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package musicxml
+
+import "testing"
+
+func TestAnalyzeRatingOrder(t *testing.T) {
+	easy := `<measure number="1">
+		<attributes><divisions>1</divisions></attributes>
+		<direction><sound tempo="70"/></direction>
+		<note><pitch><step>C</step><octave>4</octave></pitch><duration>2</duration><type>half</type></note>
+		<note><pitch><step>D</step><octave>4</octave></pitch><duration>2</duration><type>half</type></note>
+	</measure>
+	<measure number="2">
+		<note><pitch><step>E</step><octave>4</octave></pitch><duration>4</duration><type>whole</type></note>
+	</measure>`
+	hard := `<measure number="1">
+		<attributes><divisions>4</divisions><key><fifths>-3</fifths></key></attributes>
+		<direction><sound tempo="168"/></direction>
+		<note><pitch><step>C</step><octave>4</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>A</step><octave>5</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>E</step><octave>6</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>B</step><octave>3</octave></pitch><duration>3</duration><type>eighth</type><dot/></note>
+		<note><pitch><step>G</step><alter>1</alter><octave>5</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><chord/><pitch><step>B</step><octave>5</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>D</step><octave>4</octave></pitch><duration>4</duration><type>quarter</type></note>
+		<note><pitch><step>C</step><alter>1</alter><octave>6</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>A</step><octave>3</octave></pitch><duration>3</duration><type>eighth</type><dot/></note>
+	</measure>`
+
+	tests := []struct {
+		name      string
+		body      string
+		minRating float64
+		maxRating float64
+		level     int
+	}{
+		{name: "slow stepwise melody", body: easy, minRating: 0, maxRating: 2, level: 1},
+		{name: "fast leaping chromatic passage", body: hard, minRating: 6, maxRating: 10, level: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, err := ParseString(scoreHeader + tt.body + scoreFooter)
+			if err != nil {
+				t.Fatalf("ParseString: %v", err)
+			}
+			a := Analyze(score)
+			if a.Rating < tt.minRating || a.Rating > tt.maxRating {
+				t.Errorf("rating = %v, want between %v and %v (%+v)", a.Rating, tt.minRating, tt.maxRating, a)
+			}
+			if got := a.SheetLevel(1, 5); got < tt.level {
+				t.Errorf("level = %d, want at least %d", got, tt.level)
+			}
+		})
+	}
+}
+
+func TestAnalyzeTestSheets(t *testing.T) {
+	chords := Analyze(loadTestSheet(t, "testsheet.xml"))
+	melody := Analyze(loadTestSheet(t, "testsheet_pick.xml"))
+
+	if chords.ChordRatio != 1 || melody.ChordRatio != 0 {
+		t.Errorf("chord ratios = %v / %v, want 1 / 0", chords.ChordRatio, melody.ChordRatio)
+	}
+	if melody.PitchRange != 12 {
+		t.Errorf("melody pitch range = %d, want 12", melody.PitchRange)
+	}
+	if chords.Tempo != 120 || melody.Tempo != 120 {
+		t.Errorf("tempos = %v / %v, want 120", chords.Tempo, melody.Tempo)
+	}
+	if chords.Rating <= melody.Rating {
+		t.Errorf("chord sheet rating %v should be above single-note sheet rating %v", chords.Rating, melody.Rating)
+	}
+}
+
+func TestKeyAlter(t *testing.T) {
+	tests := []struct {
+		fifths int
+		step   string
+		want   int
+	}{
+		{0, "F", 0},
+		{1, "F", 1},
+		{1, "C", 0},
+		{3, "G", 1},
+		{-1, "B", -1},
+		{-1, "E", 0},
+		{-4, "D", -1},
+		{7, "B", 1},
+	}
+	for _, tt := range tests {
+		if got := keyAlter(tt.fifths, tt.step); got != tt.want {
+			t.Errorf("keyAlter(%d, %s) = %d, want %d", tt.fifths, tt.step, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package musicxml
+
+import "sort"
+
+// event is a single-voice chord (or single note) to be written into a measure.
+// Onset and End are in divisions from the start of the measure.
+type event struct {
+	Onset, End int
+	Pitches    []Pitch
+	TieStart   bool
+	TieStop    bool
+}
+
+// noteValue is a notatable length: a note type with dots and its length in quarter notes.
+type noteValue struct {
+	quarters float64
+	typ      string
+	dots     int
+}
+
+// noteValues lists the lengths used when writing generated notes, longest first.
+var noteValues = []noteValue{
+	{4, "whole", 0},
+	{3, "half", 1},
+	{2, "half", 0},
+	{1.5, "quarter", 1},
+	{1, "quarter", 0},
+	{0.75, "eighth", 1},
+	{0.5, "eighth", 0},
+	{0.375, "16th", 1},
+	{0.25, "16th", 0},
+	{0.125, "32nd", 0},
+}
+
+// notePart is one notated piece of a longer length, in divisions.
+type notePart struct {
+	units int
+	value noteValue
+}
+
+// splitDuration breaks a length in divisions into notatable values, longest first.
+// A remainder that no value can express is added to the last value.
+func splitDuration(length, divisions int) []notePart {
+	var parts []notePart
+	remaining := length
+	for remaining > 0 {
+		found := false
+		for _, v := range noteValues {
+			units := v.quarters * float64(divisions)
+			if units != float64(int(units)) || int(units) < 1 || int(units) > remaining {
+				continue
+			}
+			parts = append(parts, notePart{int(units), v})
+			remaining -= int(units)
+			found = true
+			break
+		}
+		if !found {
+			if len(parts) == 0 {
+				parts = append(parts, notePart{remaining, noteValues[len(noteValues)-1]})
+			} else {
+				parts[len(parts)-1].units += remaining
+			}
+			break
+		}
+	}
+	return parts
+}
+
+// fillMeasure writes non-overlapping events into one voice of a measure of the given length,
+// filling the gaps with rests and splitting lengths that need ties.
+func fillMeasure(events []event, length, divisions int) []*Note {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Onset < events[j].Onset })
+
+	var notes []*Note
+	rest := func(onset, length int) {
+		for _, p := range splitDuration(length, divisions) {
+			notes = append(notes, &Note{Rest: true, Onset: onset, Duration: p.units, Type: p.value.typ, Dots: p.value.dots, Voice: 1, Staff: 1})
+			onset += p.units
+		}
+	}
+
+	pos := 0
+	for i, ev := range events {
+		if ev.Onset < pos || ev.Onset >= length || len(ev.Pitches) == 0 {
+			continue
+		}
+		end := min(ev.End, length)
+		if i+1 < len(events) && events[i+1].Onset > ev.Onset {
+			end = min(end, events[i+1].Onset)
+		}
+		if end <= ev.Onset {
+			continue
+		}
+		if ev.Onset > pos {
+			rest(pos, ev.Onset-pos)
+		}
+
+		onset := ev.Onset
+		parts := splitDuration(end-ev.Onset, divisions)
+		for j, p := range parts {
+			for k, pitch := range ev.Pitches {
+				pitch := pitch
+				notes = append(notes, &Note{
+					Pitch:    &pitch,
+					Chord:    k > 0,
+					Onset:    onset,
+					Duration: p.units,
+					Type:     p.value.typ,
+					Dots:     p.value.dots,
+					Voice:    1,
+					Staff:    1,
+					TieStop:  (j == 0 && ev.TieStop) || j > 0,
+					TieStart: (j == len(parts)-1 && ev.TieStart) || j < len(parts)-1,
+				})
+			}
+			onset += p.units
+		}
+		pos = end
+	}
+	if pos < length {
+		rest(pos, length-pos)
+	}
+	return notes
+}
+
+// repairTies clears tie flags that do not connect two notes of the same pitch
+// in consecutive onsets of a single-voice part, e.g. after notes were dropped.
+func repairTies(part *Part) {
+	var groups [][]*Note
+	for _, m := range part.Measures {
+		for _, n := range m.Notes {
+			if n.Chord && len(groups) > 0 {
+				groups[len(groups)-1] = append(groups[len(groups)-1], n)
+				continue
+			}
+			groups = append(groups, []*Note{n})
+		}
+	}
+
+	tiedTo := func(n *Note, group []*Note, start bool) bool {
+		for _, other := range group {
+			if other.Pitch == nil || n.Pitch == nil || other.Pitch.MIDI() != n.Pitch.MIDI() {
+				continue
+			}
+			if (start && other.TieStart) || (!start && other.TieStop) {
+				return true
+			}
+		}
+		return false
+	}
+	for i, group := range groups {
+		for _, n := range group {
+			if n.TieStop && (i == 0 || !tiedTo(n, groups[i-1], true)) {
+				n.TieStop = false
+			}
+		}
+	}
+	for i, group := range groups {
+		for _, n := range group {
+			if n.TieStart && (i == len(groups)-1 || !tiedTo(n, groups[i+1], false)) {
+				n.TieStart = false
+			}
+		}
+	}
+}
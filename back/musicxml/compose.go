@@ -0,0 +1,185 @@
+package musicxml
+
+// Compose builds a single-part score with the measures of the first part of base, where each
+// measure is replaced by the measure with the same number in the first part of choose(number).
+// choose may return nil (or a score without that measure) to keep the measure of base.
+//
+// Since the measures come from different documents, the attributes, tempo marks and ties of
+// the result are rewritten: attributes are declared wherever the divisions, key, time,
+// transposition or clefs in effect change, a tempo mark is added where the tempo in effect
+// would otherwise differ from the source measure's, and ties that no longer connect two notes
+// across a barline are removed. Staves that a source measure lacks are filled with rests.
+func Compose(base *Score, choose func(number string) *Score) *Score {
+	out := &Score{Title: base.Title, Composer: base.Composer}
+	if len(base.Parts) == 0 {
+		return out
+	}
+	bp := base.Parts[0]
+	part := &Part{ID: bp.ID, Name: bp.Name, MIDIProgram: bp.MIDIProgram}
+	out.Parts = []*Part{part}
+
+	states := make(map[*Part][]staffState)
+	var (
+		prev      *Measure
+		staves    = 1
+		clefs     = make(map[int]Clef)
+		transpose *Transpose
+		tempo     = DefaultBPM
+	)
+	for i, bm := range bp.Measures {
+		src, m := bp, bm
+		if s := choose(bm.Number); s != nil && len(s.Parts) > 0 {
+			if sm, ok := s.Parts[0].MeasureByNumber(bm.Number); ok {
+				src, m = s.Parts[0], sm
+			}
+		}
+		if states[src] == nil {
+			states[src] = staffStates(src)
+		}
+		state := states[src][m.Index]
+
+		om := m.clone()
+		om.Number, om.Index = bm.Number, i
+		om.Attributes = nil
+
+		attrs := &Attributes{}
+		declared := false
+		if prev == nil || prev.Divisions != om.Divisions {
+			attrs.Divisions, declared = om.Divisions, true
+		}
+		if prev == nil || prev.Key != om.Key {
+			key := om.Key
+			attrs.Key, declared = &key, true
+		}
+		if prev == nil || prev.Time != om.Time {
+			time := om.Time
+			attrs.Time, declared = &time, true
+		}
+		if !sameTranspose(transpose, state.transpose) {
+			attrs.Transpose, declared = state.transpose, true
+			if attrs.Transpose == nil {
+				attrs.Transpose = &Transpose{}
+			}
+			transpose = state.transpose
+		}
+		if prev == nil || state.staves > staves {
+			staves = max(staves, state.staves)
+			attrs.Staves, declared = staves, true
+		}
+		for staff := 1; staff <= state.staves; staff++ {
+			if c, ok := clefs[staff]; !ok || c != state.clefs[staff] {
+				clefs[staff] = state.clefs[staff]
+				attrs.Clefs = append(attrs.Clefs, state.clefs[staff])
+				attrs.Staves, declared = staves, true
+			}
+		}
+		if declared {
+			om.Attributes = attrs
+		}
+
+		if want := src.TempoAt(m.Index, 0); (len(om.Tempos) == 0 || om.Tempos[0].Offset > 0) && want != tempo {
+			om.Tempos = append([]Tempo{{Offset: 0, BPM: want}}, om.Tempos...)
+		}
+		if len(om.Tempos) > 0 {
+			tempo = om.Tempos[len(om.Tempos)-1].BPM
+		}
+
+		for staff := state.staves + 1; staff <= staves; staff++ {
+			for _, n := range fillMeasure(nil, om.Length, om.Divisions) {
+				n.Staff, n.Voice = staff, 4*(staff-1)+1
+				om.Notes = append(om.Notes, n)
+			}
+		}
+
+		if prev != nil {
+			repairBarlineTies(prev, om)
+		}
+		part.Measures = append(part.Measures, om)
+		prev = om
+	}
+	if prev != nil {
+		repairBarlineTies(prev, nil)
+	}
+	return out
+}
+
+// staffState is the number of staves, the clef of each staff and the transposition
+// in effect in a measure.
+type staffState struct {
+	staves    int
+	clefs     map[int]Clef
+	transpose *Transpose
+}
+
+// staffStates returns the staffState of every measure of the part.
+func staffStates(p *Part) []staffState {
+	states := make([]staffState, len(p.Measures))
+	current := staffState{staves: 1, clefs: map[int]Clef{1: {Number: 1, Sign: "G", Line: 2}}}
+	for i, m := range p.Measures {
+		if a := m.Attributes; a != nil {
+			clefs := make(map[int]Clef, len(current.clefs))
+			for staff, c := range current.clefs {
+				clefs[staff] = c
+			}
+			for _, c := range a.Clefs {
+				c.Number = max(1, c.Number)
+				clefs[c.Number] = c
+			}
+			current.clefs = clefs
+			if a.Staves > 0 {
+				current.staves = a.Staves
+			}
+			if a.Transpose != nil {
+				current.transpose = a.Transpose
+			}
+		}
+		for staff := 2; staff <= current.staves; staff++ {
+			if _, ok := current.clefs[staff]; !ok {
+				current.clefs[staff] = Clef{Number: staff, Sign: "F", Line: 4}
+			}
+		}
+		states[i] = current
+	}
+	return states
+}
+
+func sameTranspose(a, b *Transpose) bool {
+	if a == nil || b == nil {
+		return (a == nil || *a == Transpose{}) && (b == nil || *b == Transpose{})
+	}
+	return *a == *b
+}
+
+// repairBarlineTies removes the ties between measures prev and next (nil for the end of the
+// part) that do not connect a note reaching the barline with a note of the same pitch on the
+// same staff at the start of next.
+func repairBarlineTies(prev, next *Measure) {
+	matches := func(a, b *Note) bool {
+		return a.Pitch != nil && b.Pitch != nil && a.Pitch.MIDI() == b.Pitch.MIDI() && a.Staff == b.Staff
+	}
+	for _, n := range prev.Notes {
+		if !n.TieStart || n.End() < prev.Length {
+			continue
+		}
+		tied := false
+		if next != nil {
+			for _, o := range next.Notes {
+				tied = tied || (o.TieStop && o.Onset == 0 && matches(n, o))
+			}
+		}
+		n.TieStart = tied
+	}
+	if next == nil {
+		return
+	}
+	for _, n := range next.Notes {
+		if !n.TieStop || n.Onset != 0 {
+			continue
+		}
+		tied := false
+		for _, o := range prev.Notes {
+			tied = tied || (o.TieStart && o.End() >= prev.Length && matches(n, o))
+		}
+		n.TieStop = tied
+	}
+}
@@ -0,0 +1,90 @@
+package musicxml
+
+import "testing"
+
+func TestCompose(t *testing.T) {
+	hard := loadTestSheet(t, "testsheet.xml")
+	easy := Simplify(hard, OptionsForLevel(1))
+	picks := map[string]*Score{"2": easy, "4": easy}
+
+	composed := Compose(hard, func(number string) *Score { return picks[number] })
+
+	// The composed document must survive a round trip through MusicXML.
+	data, err := MarshalString(composed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseString(data)
+	if err != nil {
+		t.Fatalf("composed sheet does not parse: %v", err)
+	}
+	part := parsed.Parts[0]
+	if len(part.Measures) != len(hard.Parts[0].Measures) {
+		t.Fatalf("got %d measures, want %d", len(part.Measures), len(hard.Parts[0].Measures))
+	}
+
+	for i, m := range part.Measures {
+		source := hard.Parts[0]
+		if picks[m.Number] != nil {
+			source = easy.Parts[0]
+		}
+		want := source.ExpectedPitches(source.Measures[i])
+		got := part.ExpectedPitches(m)
+		if len(got) != len(want) {
+			t.Fatalf("measure %s: got %d pitches, want %d", m.Number, len(got), len(want))
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("measure %s pitch[%d] = %+v, want %+v", m.Number, j, got[j], want[j])
+			}
+		}
+		if m.Divisions != source.Measures[i].Divisions || m.Transpose != source.Measures[i].Transpose {
+			t.Errorf("measure %s: divisions %d, transpose %d; want %d, %d",
+				m.Number, m.Divisions, m.Transpose, source.Measures[i].Divisions, source.Measures[i].Transpose)
+		}
+		for _, n := range m.Notes {
+			if n.Staff == 2 && picks[m.Number] != nil && !n.Rest {
+				t.Errorf("measure %s: staff 2 missing from the easy sheet should hold rests, got %s", m.Number, n.Pitch)
+			}
+		}
+	}
+}
+
+func TestComposeRepairsTies(t *testing.T) {
+	measure := func(number, step, tie string) string {
+		return `<measure number="` + number + `"><note><pitch><step>` + step + `</step><octave>4</octave></pitch>` +
+			`<duration>4</duration><type>whole</type>` + tie + `</note></measure>`
+	}
+	a, err := ParseString(scoreHeader +
+		`<measure number="1"><attributes><divisions>1</divisions></attributes><note><pitch><step>C</step><octave>4</octave></pitch><duration>4</duration><type>whole</type><tie type="start"/></note></measure>` +
+		measure("2", "C", `<tie type="stop"/><tie type="start"/>`) +
+		measure("3", "C", `<tie type="stop"/>`) + scoreFooter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseString(scoreHeader +
+		`<measure number="1"><attributes><divisions>1</divisions></attributes><note><pitch><step>D</step><octave>4</octave></pitch><duration>4</duration><type>whole</type></note></measure>` +
+		measure("2", "D", "") + measure("3", "D", "") + scoreFooter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Measure 2 from b breaks both ties of a.
+	composed := Compose(a, func(number string) *Score {
+		if number == "2" {
+			return b
+		}
+		return nil
+	})
+	for i, m := range composed.Parts[0].Measures {
+		if n := m.Notes[0]; n.TieStart || n.TieStop {
+			t.Errorf("measure %d: %s still tied (start %v, stop %v)", i+1, n.Pitch, n.TieStart, n.TieStop)
+		}
+	}
+
+	// Keeping every measure of a keeps its ties.
+	kept := Compose(a, func(string) *Score { return nil }).Parts[0].Measures
+	if !kept[0].Notes[0].TieStart || !kept[1].Notes[0].TieStop || !kept[1].Notes[0].TieStart || !kept[2].Notes[0].TieStop {
+		t.Errorf("ties of an unchanged part were removed")
+	}
+}
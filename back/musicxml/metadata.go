@@ -0,0 +1,120 @@
+package musicxml
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Metadata describes the first part of a score for display and search.
+type Metadata struct {
+	// Tempo is the quarter-note BPM at the start of the score.
+	Tempo float64
+	// Key and Time are the signatures of the first measure.
+	Key  Key
+	Time Time
+	// DurationSeconds is the playing time at the marked tempos, without expanding repeats.
+	DurationSeconds float64
+	MeasureCount    int
+	// Lowest and Highest are the extreme written pitches, as read by the player and by
+	// Analysis.PitchRange, or nil when the part has no notes.
+	Lowest, Highest *Pitch
+	// Instrument is the instrument the part is written for (see Part.Instrument).
+	Instrument string
+}
+
+// TimeSignature returns the time signature as "3/4", or "" when the score declares none.
+func (m Metadata) TimeSignature() string {
+	if m.Time.Beats <= 0 || m.Time.BeatType <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", m.Time.Beats, m.Time.BeatType)
+}
+
+// Describe reads the metadata of the first part of a score.
+func Describe(score *Score) Metadata {
+	var md Metadata
+	if len(score.Parts) == 0 {
+		return md
+	}
+	part := score.Parts[0]
+	md.Instrument = part.Instrument()
+	md.MeasureCount = len(part.Measures)
+	if md.MeasureCount == 0 {
+		return md
+	}
+	md.Tempo = part.TempoAt(0, 0)
+	md.Key = part.Measures[0].Key
+	md.Time = part.Measures[0].Time
+
+	lowest, highest := math.MaxInt, math.MinInt
+	for _, m := range part.Measures {
+		md.DurationSeconds += part.DurationMs(m, 0, m.Length) / 1000
+		for _, n := range m.Notes {
+			if !n.IsSounding() {
+				continue
+			}
+			midi := n.Pitch.MIDI()
+			lowest, highest = min(lowest, midi), max(highest, midi)
+		}
+	}
+	if lowest <= highest {
+		fifths := md.Key.Fifths
+		low, high := PitchFromMIDI(lowest, fifths), PitchFromMIDI(highest, fifths)
+		md.Lowest, md.Highest = &low, &high
+	}
+	return md
+}
+
+// gmInstruments names the General MIDI programs (1-based) that identify an instrument on their own.
+var gmInstruments = map[int]string{
+	41: "violin", 42: "viola", 43: "cello", 44: "contrabass", 47: "harp",
+	53: "voice", 54: "voice", 55: "voice",
+	57: "trumpet", 58: "trombone", 59: "tuba", 61: "horn",
+	65: "saxophone", 66: "saxophone", 67: "saxophone", 68: "saxophone",
+	69: "oboe", 71: "bassoon", 72: "clarinet",
+	73: "piccolo", 74: "flute", 76: "pan-flute", 77: "flute", 79: "whistle",
+	106: "banjo", 107: "shamisen", 108: "koto",
+}
+
+// gmFamilies names the General MIDI program families of 8 programs each, for the other programs.
+var gmFamilies = [16]string{
+	"piano", "chromatic-percussion", "organ", "guitar", "bass", "strings", "ensemble", "brass",
+	"reed", "pipe", "synth", "synth", "synth", "ethnic", "percussion", "sound-effects",
+}
+
+// partNameInstruments are keywords of part names, checked in order when there is no MIDI program.
+var partNameInstruments = []struct{ keyword, instrument string }{
+	{"bass", "bass"}, // before guitar: "Bass Guitar" is a bass
+	{"guitar", "guitar"}, {"ukulele", "ukulele"}, {"piano", "piano"}, {"keyboard", "piano"},
+	{"violin", "violin"}, {"viola", "viola"}, {"cello", "cello"}, {"flute", "flute"},
+	{"sax", "saxophone"}, {"clarinet", "clarinet"}, {"trumpet", "trumpet"},
+	{"vocal", "voice"}, {"voice", "voice"}, {"drum", "percussion"},
+	{"ギター", "guitar"}, {"ベース", "bass"}, {"ピアノ", "piano"}, {"ボーカル", "voice"},
+}
+
+// Instrument returns the lower-case name of the instrument the part is written for, such as
+// "guitar", "piano" or "violin". It is read from the MIDI program, else from the part name,
+// else a part with tablature is a guitar. It is "" when nothing identifies the instrument.
+func (p *Part) Instrument() string {
+	if p.MIDIProgram >= 1 && p.MIDIProgram <= 128 {
+		if name, ok := gmInstruments[p.MIDIProgram]; ok {
+			return name
+		}
+		return gmFamilies[(p.MIDIProgram-1)/8]
+	}
+	name := strings.ToLower(p.Name)
+	for _, k := range partNameInstruments {
+		if strings.Contains(name, k.keyword) {
+			return k.instrument
+		}
+	}
+	for _, m := range p.Measures {
+		for _, n := range m.Notes {
+			if n.Tab != nil {
+				return "guitar"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package musicxml
+
+import "testing"
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name          string
+		score         func(t *testing.T) *Score
+		tempo         float64
+		key           string
+		timeSignature string
+		seconds       float64
+		measures      int
+		lowest        string
+		highest       string
+		instrument    string
+	}{
+		{
+			name:          "testsheet.xml",
+			score:         func(t *testing.T) *Score { return loadTestSheet(t, "testsheet.xml") },
+			tempo:         120,
+			key:           "C",
+			timeSignature: "4/4",
+			seconds:       10,
+			measures:      5,
+			lowest:        "E2",
+			highest:       "G5",
+			instrument:    "guitar",
+		},
+		{
+			name: "inline score in 3/4 with a tempo change",
+			score: func(t *testing.T) *Score {
+				score, err := ParseString(scoreHeader + `<measure number="1">
+					<attributes><divisions>1</divisions><key><fifths>-3</fifths><mode>minor</mode></key><time><beats>3</beats><beat-type>4</beat-type></time></attributes>
+					<direction><sound tempo="60"/></direction>
+					<note><pitch><step>C</step><octave>4</octave></pitch><duration>3</duration><type>half</type><dot/></note>
+				</measure>
+				<measure number="2">
+					<direction><sound tempo="120"/></direction>
+					<note><pitch><step>E</step><alter>-1</alter><octave>5</octave></pitch><duration>1</duration><type>quarter</type></note>
+					<note><rest/><duration>2</duration><type>half</type></note>
+				</measure>` + scoreFooter)
+				if err != nil {
+					t.Fatalf("ParseString: %v", err)
+				}
+				return score
+			},
+			tempo:         60,
+			key:           "Cm",
+			timeSignature: "3/4",
+			seconds:       4.5,
+			measures:      2,
+			lowest:        "C4",
+			highest:       "Eb5",
+			instrument:    "piano",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := Describe(tt.score(t))
+			if md.Tempo != tt.tempo {
+				t.Errorf("Tempo = %v, want %v", md.Tempo, tt.tempo)
+			}
+			if got := md.Key.Name(); got != tt.key {
+				t.Errorf("Key = %s, want %s", got, tt.key)
+			}
+			if got := md.TimeSignature(); got != tt.timeSignature {
+				t.Errorf("TimeSignature = %s, want %s", got, tt.timeSignature)
+			}
+			if md.DurationSeconds != tt.seconds {
+				t.Errorf("DurationSeconds = %v, want %v", md.DurationSeconds, tt.seconds)
+			}
+			if md.MeasureCount != tt.measures {
+				t.Errorf("MeasureCount = %d, want %d", md.MeasureCount, tt.measures)
+			}
+			if md.Lowest == nil || md.Highest == nil {
+				t.Fatalf("pitch range is missing")
+			}
+			if md.Lowest.String() != tt.lowest || md.Highest.String() != tt.highest {
+				t.Errorf("range = %s-%s, want %s-%s", md.Lowest, md.Highest, tt.lowest, tt.highest)
+			}
+			if md.Instrument != tt.instrument {
+				t.Errorf("Instrument = %q, want %q", md.Instrument, tt.instrument)
+			}
+		})
+	}
+}
+
+func TestPartInstrument(t *testing.T) {
+	tests := []struct {
+		name string
+		part Part
+		want string
+	}{
+		{name: "program with its own instrument", part: Part{Name: "Solo", MIDIProgram: 41}, want: "violin"},
+		{name: "program family", part: Part{Name: "Steel Guitar", MIDIProgram: 26}, want: "guitar"},
+		{name: "bass guitar by name", part: Part{Name: "Bass Guitar"}, want: "bass"},
+		{name: "japanese part name", part: Part{Name: "アコースティックギター"}, want: "guitar"},
+		{name: "tablature", part: Part{Name: "P1", Measures: []*Measure{{Notes: []*Note{{Tab: &TabPosition{String: 6, Fret: 0}}}}}}, want: "guitar"},
+		{name: "unknown", part: Part{Name: "Part 1"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.part.Instrument(); got != tt.want {
+				t.Errorf("Instrument() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"infosystem-musicapp/midi"
+)
+
+// MIDIDivision is the number of ticks per quarter note of files written by ToMIDI.
+const MIDIDivision = 480
+
+// DefaultMIDIGrid is the quantization grid of FromMIDI when none is given: 16th notes.
+const DefaultMIDIGrid = 4
+
+// MaxMIDIMeasures bounds the length of the scores of FromMIDI, far above real songs, since the
+// delta times of a file can stretch a few notes over millions of measures.
+const MaxMIDIMeasures = 2000
+
+var (
+	ErrNoNotes     = errors.New("musicxml: MIDI file has no notes")
+	ErrMIDITooLong = errors.New("musicxml: MIDI file is too long")
+)
+
+const midiVelocity = 80
+
+// ToMIDI converts the score to a format 1 Standard MIDI File for playback.
+// Track 0 holds the tempo, time and key signatures of the first part; every part follows
+// in its own track at its sounding pitch, with tied notes merged and tablature staves left out.
+func ToMIDI(score *Score) *midi.File {
+	f := &midi.File{Format: 1, Division: MIDIDivision}
+	conductor := midi.Track{}
+	if score.Title != "" {
+		conductor.Events = append(conductor.Events, midi.TrackNameEvent(0, score.Title))
+	}
+
+	channel := 0
+	for i, p := range score.Parts {
+		if channel == midi.PercussionChannel {
+			channel++
+		}
+		track := midi.Track{}
+		if p.Name != "" {
+			track.Events = append(track.Events, midi.TrackNameEvent(0, p.Name))
+		}
+		if p.MIDIProgram > 0 {
+			track.Events = append(track.Events, midi.ProgramChangeEvent(0, channel, p.MIDIProgram-1))
+		}
+
+		type sounding struct{ start, end, key int }
+		var notes []sounding
+		tied := make(map[int]int) // key -> index in notes of a note waiting for its tie stop
+		tabStaves := make(map[int]bool)
+		start := 0.0
+		for j, m := range p.Measures {
+			tick := func(divs int) int {
+				return int(math.Round(start + float64(divs)*MIDIDivision/float64(max(1, m.Divisions))))
+			}
+			if i == 0 {
+				at := tick(0)
+				if j == 0 || p.Measures[j-1].Time != m.Time {
+					conductor.Events = append(conductor.Events, midi.TimeSignatureEvent(at, m.Time.Beats, m.Time.BeatType))
+				}
+				if j == 0 || p.Measures[j-1].Key != m.Key {
+					conductor.Events = append(conductor.Events, midi.KeySignatureEvent(at, m.Key.Fifths, m.Key.Mode == "minor"))
+				}
+				if j == 0 && (len(m.Tempos) == 0 || m.Tempos[0].Offset > 0) {
+					conductor.Events = append(conductor.Events, midi.TempoEvent(0, DefaultBPM))
+				}
+				for _, t := range m.Tempos {
+					conductor.Events = append(conductor.Events, midi.TempoEvent(tick(t.Offset), t.BPM))
+				}
+			}
+			if m.Attributes != nil {
+				for _, c := range m.Attributes.Clefs {
+					tabStaves[max(1, c.Number)] = c.Sign == "TAB"
+				}
+			}
+
+			for _, n := range m.Notes {
+				if !n.IsSounding() || tabStaves[max(1, n.Staff)] {
+					continue
+				}
+				key := n.Pitch.MIDI() + m.Transpose
+				if k, ok := tied[key]; ok && n.TieStop {
+					notes[k].end = tick(n.End())
+				} else {
+					notes = append(notes, sounding{tick(n.Onset), tick(n.End()), key})
+				}
+				delete(tied, key)
+				if n.TieStart {
+					tied[key] = len(notes) - 1
+				}
+			}
+			start += float64(m.Length) * MIDIDivision / float64(max(1, m.Divisions))
+		}
+
+		var events []midi.Event
+		for _, n := range notes {
+			if n.key < 0 || n.key > 127 || n.end <= n.start {
+				continue
+			}
+			events = append(events, midi.NoteOnEvent(n.start, channel, n.key, midiVelocity), midi.NoteOffEvent(n.end, channel, n.key))
+		}
+		// A note-off must come before a note-on of the same tick, or repeated notes would be cut short.
+		sort.SliceStable(events, func(a, b int) bool {
+			if events[a].Tick != events[b].Tick {
+				return events[a].Tick < events[b].Tick
+			}
+			return events[a].IsNoteOff() && !events[b].IsNoteOff()
+		})
+		track.Events = append(track.Events, events...)
+		f.Tracks = append(f.Tracks, track)
+		channel = (channel + 1) % 16
+	}
+
+	f.Tracks = append([]midi.Track{conductor}, f.Tracks...)
+	return f
+}
+
+// FromMIDI converts a Standard MIDI File into a single-part, single-voice score quantized
+// to grid notes per quarter (DefaultMIDIGrid if grid is 0 or less). Notes of every track
+// except the percussion channel are merged; notes starting together form a chord.
+// Time signatures, key signatures and tempo changes of the file are kept.
+func FromMIDI(f *midi.File, grid int) (*Score, error) {
+	if grid <= 0 {
+		grid = DefaultMIDIGrid
+	}
+	quantize := func(tick int) int {
+		return int(math.Round(float64(tick) * float64(grid) / float64(f.Division)))
+	}
+
+	type note struct{ onset, end, key int }
+	type timeChange struct {
+		at   int
+		time Time
+	}
+	type keyChange struct {
+		at  int
+		key Key
+	}
+	var (
+		notes       []note
+		times       []timeChange
+		keys        []keyChange
+		tempos      []Tempo // Offset in grid units from the start of the piece
+		title, name string
+		program     int
+	)
+	for i, t := range f.Tracks {
+		open := make(map[[2]int][]int) // channel, key -> start ticks
+		trackName := ""
+		hasNotes := false
+		for _, ev := range t.Events {
+			switch {
+			case ev.IsNoteOn() && ev.Channel() != midi.PercussionChannel:
+				k := [2]int{ev.Channel(), int(ev.Data[0])}
+				open[k] = append(open[k], ev.Tick)
+				hasNotes = true
+			case ev.IsNoteOff():
+				k := [2]int{ev.Channel(), int(ev.Data[0])}
+				if starts := open[k]; len(starts) > 0 {
+					notes = append(notes, note{quantize(starts[0]), quantize(ev.Tick), k[1]})
+					open[k] = starts[1:]
+				}
+			case ev.Type() == midi.ProgramChange && ev.Channel() != midi.PercussionChannel && program == 0:
+				program = int(ev.Data[0]) + 1
+			case ev.Status == midi.Meta && ev.Meta == midi.MetaTrackName:
+				trackName = string(ev.Data)
+			}
+			if bpm, ok := ev.Tempo(); ok {
+				tempos = append(tempos, Tempo{Offset: quantize(ev.Tick), BPM: bpm})
+			}
+			if beats, beatType, ok := ev.TimeSignature(); ok && beats > 0 {
+				times = append(times, timeChange{quantize(ev.Tick), Time{beats, beatType}})
+			}
+			if fifths, minor, ok := ev.KeySignature(); ok {
+				mode := "major"
+				if minor {
+					mode = "minor"
+				}
+				keys = append(keys, keyChange{quantize(ev.Tick), Key{fifths, mode}})
+			}
+		}
+		// Notes still sounding at the end of the track end there.
+		if len(t.Events) > 0 {
+			last := quantize(t.Events[len(t.Events)-1].Tick)
+			for k, starts := range open {
+				for _, s := range starts {
+					notes = append(notes, note{quantize(s), last, k[1]})
+				}
+			}
+		}
+		if i == 0 && f.Format == 1 && !hasNotes {
+			title = trackName
+		} else if hasNotes && name == "" {
+			name = trackName
+		}
+	}
+	if len(notes) == 0 {
+		return nil, ErrNoNotes
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].onset < notes[j].onset })
+	sort.SliceStable(times, func(i, j int) bool { return times[i].at < times[j].at })
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].at < keys[j].at })
+	sort.SliceStable(tempos, func(i, j int) bool { return tempos[i].Offset < tempos[j].Offset })
+
+	// Chords: notes that start together become one chord lasting as long as the longest note.
+	type chord struct {
+		onset, end int
+		keys       []int
+	}
+	var chords []chord
+	total := 0
+	for _, n := range notes {
+		end := max(n.end, n.onset+1)
+		total = max(total, end)
+		if len(chords) > 0 && chords[len(chords)-1].onset == n.onset {
+			c := &chords[len(chords)-1]
+			c.end = max(c.end, end)
+			if !slices.Contains(c.keys, n.key) {
+				c.keys = append(c.keys, n.key)
+			}
+			continue
+		}
+		chords = append(chords, chord{n.onset, end, []int{n.key}})
+	}
+
+	if name == "" {
+		name = "Music"
+	}
+	part := &Part{ID: "P1", Name: name, MIDIProgram: program}
+	score := &Score{Title: title, Parts: []*Part{part}}
+
+	current := Measure{Time: Time{4, 4}, Key: Key{Mode: "major"}}
+	// Every list is sorted, so each one is walked once: nextXxx is the first item not reached yet,
+	// and sounding holds the chords started before the measure that may still last.
+	var nextTime, nextKey, nextTempo, nextChord int
+	var sounding []chord
+	for start, index := 0, 0; start < total; index++ {
+		if index == MaxMIDIMeasures {
+			return nil, fmt.Errorf("%w: more than %d measures", ErrMIDITooLong, MaxMIDIMeasures)
+		}
+		for ; nextTime < len(times) && times[nextTime].at <= start; nextTime++ {
+			current.Time = times[nextTime].time
+		}
+		for ; nextKey < len(keys) && keys[nextKey].at <= start; nextKey++ {
+			current.Key = keys[nextKey].key
+		}
+		m := &Measure{Number: strconv.Itoa(index + 1), Index: index, Divisions: grid, Key: current.Key, Time: current.Time}
+		m.Length = max(1, m.FullLength())
+		end := start + m.Length
+		if index == 0 {
+			key, time := m.Key, m.Time
+			m.Attributes = &Attributes{Divisions: grid, Key: &key, Time: &time, Clefs: []Clef{clefFor(notes[0].key)}}
+		} else if prev := part.Measures[index-1]; prev.Key != m.Key || prev.Time != m.Time {
+			key, time := m.Key, m.Time
+			m.Attributes = &Attributes{Key: &key, Time: &time}
+		}
+		for ; nextTempo < len(tempos) && tempos[nextTempo].Offset < end; nextTempo++ {
+			if t := tempos[nextTempo]; t.Offset >= start {
+				m.Tempos = append(m.Tempos, Tempo{Offset: t.Offset - start, BPM: t.BPM})
+			}
+		}
+		sounding = slices.DeleteFunc(sounding, func(c chord) bool { return c.end <= start })
+		for ; nextChord < len(chords) && chords[nextChord].onset < end; nextChord++ {
+			sounding = append(sounding, chords[nextChord])
+		}
+
+		// Chords crossing the barline are split into notes tied across it.
+		var inMeasure []event
+		for _, c := range sounding {
+			e := event{Onset: max(c.onset, start) - start, End: min(c.end, end) - start, TieStop: c.onset < start, TieStart: c.end > end}
+			for _, key := range c.keys {
+				e.Pitches = append(e.Pitches, PitchFromMIDI(key, m.Key.Fifths))
+			}
+			sort.Slice(e.Pitches, func(i, j int) bool { return e.Pitches[i].MIDI() > e.Pitches[j].MIDI() })
+			inMeasure = append(inMeasure, e)
+		}
+		m.Notes = fillMeasure(inMeasure, m.Length, grid)
+		respellAccidentals(m)
+		part.Measures = append(part.Measures, m)
+		start = end
+	}
+	repairTies(part)
+	return score, nil
+}
+
+// PitchFromMIDI spells a MIDI note number, with sharps in sharp keys and C major and flats in flat keys.
+func PitchFromMIDI(midiNumber, fifths int) Pitch {
+	sharps := []Pitch{{"C", 0, 0}, {"C", 1, 0}, {"D", 0, 0}, {"D", 1, 0}, {"E", 0, 0}, {"F", 0, 0}, {"F", 1, 0}, {"G", 0, 0}, {"G", 1, 0}, {"A", 0, 0}, {"A", 1, 0}, {"B", 0, 0}}
+	flats := []Pitch{{"C", 0, 0}, {"D", -1, 0}, {"D", 0, 0}, {"E", -1, 0}, {"E", 0, 0}, {"F", 0, 0}, {"G", -1, 0}, {"G", 0, 0}, {"A", -1, 0}, {"A", 0, 0}, {"B", -1, 0}, {"B", 0, 0}}
+	names := sharps
+	if fifths < 0 {
+		names = flats
+	}
+	p := names[(midiNumber%12+12)%12]
+	p.Octave = floorDiv(midiNumber, 12) - 1
+	return p
+}
+
+// clefFor picks a bass clef for parts that start below the staff of a treble clef.
+func clefFor(firstKey int) Clef {
+	if firstKey < 55 {
+		return Clef{Number: 1, Sign: "F", Line: 4}
+	}
+	return Clef{Number: 1, Sign: "G", Line: 2}
+}
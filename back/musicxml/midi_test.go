@@ -0,0 +1,110 @@
+package musicxml
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"infosystem-musicapp/midi"
+)
+
+func TestMIDIRoundTrip(t *testing.T) {
+	for _, name := range []string{"testsheet.xml", "testsheet_pick.xml"} {
+		t.Run(name, func(t *testing.T) {
+			score := loadTestSheet(t, name)
+			data, err := ToMIDI(score).Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := midi.Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := FromMIDI(f, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src, dst := score.Parts[0], got.Parts[0]
+			if len(dst.Measures) != len(src.Measures) {
+				t.Fatalf("got %d measures, want %d", len(dst.Measures), len(src.Measures))
+			}
+			for i, m := range src.Measures {
+				want := src.ExpectedPitches(m)
+				have := dst.ExpectedPitches(dst.Measures[i])
+				if len(have) != len(want) {
+					t.Fatalf("measure %s: got %d pitches, want %d", m.Number, len(have), len(want))
+				}
+				for j := range want {
+					// MIDI holds the sounding pitch, so the imported score is written at concert pitch.
+					wantFreq := MIDIToFrequency(int(math.Round(12*math.Log2(want[j].Frequency/440))) + 69 + m.Transpose)
+					if math.Abs(have[j].Frequency-wantFreq) > 1e-6 || have[j].DurationMs != want[j].DurationMs {
+						t.Errorf("measure %s pitch[%d] = %+v, want {%v %v}", m.Number, j, have[j], wantFreq, want[j].DurationMs)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFromMIDIQuantizes(t *testing.T) {
+	f := &midi.File{Format: 0, Division: 480, Tracks: []midi.Track{{Events: []midi.Event{
+		midi.TempoEvent(0, 100),
+		midi.KeySignatureEvent(0, -1, false),
+		midi.NoteOnEvent(10, 0, 60, 90), // slightly late eighth note
+		midi.NoteOffEvent(245, 0, 60),
+		midi.NoteOnEvent(1445, 0, 70, 90), // half note crossing the barline
+		midi.NoteOffEvent(2405, 0, 70),
+		midi.NoteOnEvent(2400, 9, 36, 90), // percussion is ignored
+		midi.NoteOffEvent(2500, 9, 36),
+	}}}}
+
+	score, err := FromMIDI(f, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := score.Parts[0]
+	if len(part.Measures) != 2 {
+		t.Fatalf("got %d measures, want 2", len(part.Measures))
+	}
+	if bpm := part.TempoAt(0, 0); bpm != 100 {
+		t.Errorf("tempo = %v, want 100", bpm)
+	}
+
+	type want struct {
+		pitch             string
+		onset, duration   int
+		tieStart, tieStop bool
+	}
+	tests := [][]want{
+		{{"C4", 0, 2, false, false}, {"", 2, 8, false, false}, {"", 10, 2, false, false}, {"Bb4", 12, 4, true, false}},
+		{{"Bb4", 0, 4, false, true}, {"", 4, 12, false, false}},
+	}
+	for i, wants := range tests {
+		notes := part.Measures[i].Notes
+		if len(notes) != len(wants) {
+			t.Fatalf("measure %d: got %d notes, want %d", i+1, len(notes), len(wants))
+		}
+		for j, w := range wants {
+			n := notes[j]
+			pitch := ""
+			if n.Pitch != nil {
+				pitch = n.Pitch.String()
+			}
+			if pitch != w.pitch || n.Onset != w.onset || n.Duration != w.duration || n.TieStart != w.tieStart || n.TieStop != w.tieStop {
+				t.Errorf("measure %d note[%d] = %s at %d for %d (tie %v/%v), want %+v", i+1, j, pitch, n.Onset, n.Duration, n.TieStart, n.TieStop, w)
+			}
+		}
+	}
+}
+
+func TestFromMIDITooLong(t *testing.T) {
+	// A single note held for 0x0FFFFFFF ticks, as in a 37-byte file.
+	f := &midi.File{Format: 0, Division: 96, Tracks: []midi.Track{{Events: []midi.Event{
+		midi.NoteOnEvent(0, 0, 60, 90),
+		midi.NoteOffEvent(0x0FFFFFFF, 0, 60),
+	}}}}
+	if _, err := FromMIDI(f, 4); !errors.Is(err, ErrMIDITooLong) {
+		t.Fatalf("err = %v, want ErrMIDITooLong", err)
+	}
+}
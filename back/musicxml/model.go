@@ -0,0 +1,298 @@
+// Package musicxml parses MusicXML (score-partwise) documents into a typed model
+// that the backend can analyze without going through the Python tools or the frontend.
+//
+// Times inside a measure are expressed in divisions (MusicXML's unit per quarter note),
+// so Note.Onset and Note.Duration must always be read together with Measure.Divisions.
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPitch = errors.New("musicxml: invalid pitch name")
+
+// Score is a parsed MusicXML document.
+type Score struct {
+	Title    string
+	Composer string
+	Parts    []*Part
+}
+
+// Part is one <part> of the score together with its <score-part> metadata.
+type Part struct {
+	ID   string
+	Name string
+	// MIDIProgram is the 1-based General MIDI program from <midi-instrument>, or 0 if absent.
+	MIDIProgram int
+	Measures    []*Measure
+}
+
+// Measure is one <measure> of a part.
+// Divisions, Key, Time and Transpose hold the values in effect for this measure,
+// whether they were declared here or inherited from an earlier measure.
+type Measure struct {
+	Number string
+	// Index is the 0-based position of the measure in its part.
+	Index    int
+	Implicit bool
+
+	Divisions int
+	Key       Key
+	Time      Time
+	// Transpose is the written-to-sounding interval in semitones (chromatic + 12 * octave-change).
+	Transpose int
+
+	// Attributes holds what the measure's <attributes> declared, or nil if it declared nothing.
+	Attributes *Attributes
+	Tempos     []Tempo
+	Notes      []*Note
+
+	// Length is the measure length in divisions.
+	Length int
+}
+
+// Attributes is the content of an <attributes> element.
+// Zero values and nil pointers mean the element did not specify that field.
+type Attributes struct {
+	Divisions    int
+	Key          *Key
+	Time         *Time
+	Staves       int
+	Clefs        []Clef
+	StaffDetails []StaffDetails
+	Transpose    *Transpose
+}
+
+// Key is a key signature: the number of sharps (positive) or flats (negative) and the mode.
+type Key struct {
+	Fifths int
+	Mode   string
+}
+
+// Time is a time signature such as 3/4.
+type Time struct {
+	Beats    int
+	BeatType int
+}
+
+// Clef is a clef on the given staff (1-based).
+type Clef struct {
+	Number       int
+	Sign         string
+	Line         int
+	OctaveChange int
+}
+
+// StaffDetails is a <staff-details> element, which describes the strings of a TAB staff.
+type StaffDetails struct {
+	Number int // Staff number (1-based)
+	Lines  int // Number of staff lines, 0 if not specified
+	// Tuning holds the open-string pitches by staff line, the bottom line first.
+	Tuning Tuning
+	Capo   int
+}
+
+// Transpose is a <transpose> element, used by transposing instruments such as guitar.
+type Transpose struct {
+	Diatonic     int
+	Chromatic    int
+	OctaveChange int
+}
+
+// Semitones returns the written-to-sounding interval in semitones.
+func (t Transpose) Semitones() int {
+	return t.Chromatic + 12*t.OctaveChange
+}
+
+// Tempo is a tempo mark at Offset divisions from the start of the measure.
+// BPM is always expressed in quarter notes per minute.
+type Tempo struct {
+	Offset int
+	BPM    float64
+}
+
+// Note is a <note> element. Rests have a nil Pitch and Rest set to true.
+type Note struct {
+	Pitch *Pitch
+	Rest  bool
+	// Chord is true when the note sounds together with the previous note.
+	Chord bool
+	Grace bool
+
+	// Onset is the start of the note in divisions from the start of the measure.
+	Onset    int
+	Duration int
+
+	Type  string
+	Dots  int
+	Voice int
+	Staff int
+
+	TieStart bool
+	TieStop  bool
+
+	Accidental string
+	// Tuplet is the <time-modification> of the note, or nil if it is not part of a tuplet.
+	Tuplet *Tuplet
+	// Tab is the string/fret position for tablature staves, or nil if the note has none.
+	Tab *TabPosition
+}
+
+// Tuplet is a <time-modification>: Actual notes played in the time of Normal notes.
+type Tuplet struct {
+	Actual int
+	Normal int
+}
+
+// TabPosition is a string (1 = highest) and fret for a tablature note.
+type TabPosition struct {
+	String int
+	Fret   int
+}
+
+// Pitch is a written pitch: a step (C-B), a chromatic alteration and an octave (middle C is C4).
+type Pitch struct {
+	Step   string
+	Alter  int
+	Octave int
+}
+
+var stepSemitones = map[string]int{"C": 0, "D": 2, "E": 4, "F": 5, "G": 7, "A": 9, "B": 11}
+
+// MIDI returns the MIDI note number of the pitch (C4 = 60).
+func (p Pitch) MIDI() int {
+	return (p.Octave+1)*12 + stepSemitones[p.Step] + p.Alter
+}
+
+// Frequency returns the equal-tempered frequency of the pitch in Hz (A4 = 440Hz).
+func (p Pitch) Frequency() float64 {
+	return MIDIToFrequency(p.MIDI())
+}
+
+func (p Pitch) String() string {
+	accidental := ""
+	switch {
+	case p.Alter > 0:
+		for i := 0; i < p.Alter; i++ {
+			accidental += "#"
+		}
+	case p.Alter < 0:
+		for i := 0; i > p.Alter; i-- {
+			accidental += "b"
+		}
+	}
+	return fmt.Sprintf("%s%s%d", p.Step, accidental, p.Octave)
+}
+
+// ParsePitch parses a pitch name in the format of Pitch.String, such as "E2", "F#4" or "Bb3".
+func ParsePitch(name string) (Pitch, error) {
+	s := strings.TrimSpace(name)
+	if s == "" {
+		return Pitch{}, fmt.Errorf("%w: %q", ErrInvalidPitch, name)
+	}
+	p := Pitch{Step: strings.ToUpper(s[:1])}
+	if _, ok := stepSemitones[p.Step]; !ok {
+		return Pitch{}, fmt.Errorf("%w: %q", ErrInvalidPitch, name)
+	}
+	s = s[1:]
+	for len(s) > 0 && (s[0] == '#' || s[0] == 'b') {
+		if s[0] == '#' {
+			p.Alter++
+		} else {
+			p.Alter--
+		}
+		s = s[1:]
+	}
+	octave, err := strconv.Atoi(s)
+	if err != nil {
+		return Pitch{}, fmt.Errorf("%w: %q", ErrInvalidPitch, name)
+	}
+	p.Octave = octave
+	return p, nil
+}
+
+// MIDIToFrequency converts a MIDI note number to its equal-tempered frequency in Hz.
+func MIDIToFrequency(midi int) float64 {
+	return 440 * math.Pow(2, float64(midi-69)/12)
+}
+
+// IsSounding reports whether the note produces a pitch with a duration (not a rest and not a grace note).
+func (n *Note) IsSounding() bool {
+	return n.Pitch != nil && !n.Grace
+}
+
+// End returns the end of the note in divisions from the start of the measure.
+func (n *Note) End() int {
+	return n.Onset + n.Duration
+}
+
+// FullLength returns the length in divisions of a full measure under the measure's time signature.
+func (m *Measure) FullLength() int {
+	if m.Time.BeatType <= 0 {
+		return 0
+	}
+	return m.Time.Beats * m.Divisions * 4 / m.Time.BeatType
+}
+
+// Clone returns a deep copy of the score that can be modified without affecting s.
+func (s *Score) Clone() *Score {
+	out := &Score{Title: s.Title, Composer: s.Composer}
+	for _, p := range s.Parts {
+		cp := *p
+		cp.Measures = make([]*Measure, len(p.Measures))
+		for i, m := range p.Measures {
+			cp.Measures[i] = m.clone()
+		}
+		out.Parts = append(out.Parts, &cp)
+	}
+	return out
+}
+
+// clone returns a deep copy of the measure.
+func (m *Measure) clone() *Measure {
+	cm := *m
+	if m.Attributes != nil {
+		a := *m.Attributes
+		if a.Key != nil {
+			key := *a.Key
+			a.Key = &key
+		}
+		if a.Time != nil {
+			time := *a.Time
+			a.Time = &time
+		}
+		if a.Transpose != nil {
+			tr := *a.Transpose
+			a.Transpose = &tr
+		}
+		a.Clefs = append([]Clef(nil), a.Clefs...)
+		a.StaffDetails = append([]StaffDetails(nil), a.StaffDetails...)
+		for i := range a.StaffDetails {
+			a.StaffDetails[i].Tuning = append(Tuning(nil), a.StaffDetails[i].Tuning...)
+		}
+		cm.Attributes = &a
+	}
+	cm.Tempos = append([]Tempo(nil), m.Tempos...)
+	cm.Notes = make([]*Note, len(m.Notes))
+	for j, n := range m.Notes {
+		cn := *n
+		if n.Pitch != nil {
+			pitch := *n.Pitch
+			cn.Pitch = &pitch
+		}
+		if n.Tuplet != nil {
+			tuplet := *n.Tuplet
+			cn.Tuplet = &tuplet
+		}
+		if n.Tab != nil {
+			tab := *n.Tab
+			cn.Tab = &tab
+		}
+		cm.Notes[j] = &cn
+	}
+	return &cm
+}
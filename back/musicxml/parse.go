@@ -0,0 +1,500 @@
+package musicxml
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotPartwise = errors.New("musicxml: only score-partwise documents are supported")
+	ErrNoParts     = errors.New("musicxml: document has no parts")
+)
+
+const (
+	defaultDivisions = 1
+	defaultBeats     = 4
+	defaultBeatType  = 4
+)
+
+// ParseString parses a MusicXML document held in a string, such as Sheets.sheet.
+func ParseString(s string) (*Score, error) {
+	return Parse(strings.NewReader(s))
+}
+
+// Parse reads a score-partwise MusicXML document.
+func Parse(r io.Reader) (*Score, error) {
+	var raw rawScore
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Documents are stored as Go strings, so they are UTF-8 whatever the prolog says.
+		return input, nil
+	}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("musicxml: failed to decode document: %w", err)
+	}
+	if raw.XMLName.Local != "score-partwise" {
+		return nil, ErrNotPartwise
+	}
+	if len(raw.Parts) == 0 {
+		return nil, ErrNoParts
+	}
+
+	score := &Score{Title: strings.TrimSpace(raw.Work.Title)}
+	if score.Title == "" {
+		score.Title = strings.TrimSpace(raw.MovementTitle)
+	}
+	for _, c := range raw.Creators {
+		if c.Type == "composer" {
+			score.Composer = strings.TrimSpace(c.Value)
+			break
+		}
+	}
+
+	partInfo := make(map[string]rawScorePart, len(raw.PartList))
+	for _, sp := range raw.PartList {
+		partInfo[sp.ID] = sp
+	}
+
+	for _, rp := range raw.Parts {
+		part, err := buildPart(rp, partInfo[rp.ID])
+		if err != nil {
+			return nil, err
+		}
+		score.Parts = append(score.Parts, part)
+	}
+	return score, nil
+}
+
+// buildPart converts a raw part, computing note onsets and carrying attributes across measures.
+func buildPart(rp rawPart, info rawScorePart) (*Part, error) {
+	part := &Part{ID: rp.ID, Name: strings.TrimSpace(info.Name)}
+	if len(info.Instruments) > 0 {
+		part.MIDIProgram = info.Instruments[0].Program
+	}
+
+	divisions := defaultDivisions
+	key := Key{}
+	time := Time{Beats: defaultBeats, BeatType: defaultBeatType}
+	transpose := 0
+
+	for i, rm := range rp.Measures {
+		m := &Measure{Number: rm.Number, Index: i, Implicit: rm.Implicit == "yes"}
+
+		pos, maxPos := 0, 0
+		lastOnset := 0
+		for _, item := range rm.Items {
+			switch v := item.(type) {
+			case *rawAttributes:
+				attrs := v.toAttributes()
+				if m.Attributes == nil {
+					m.Attributes = attrs
+				} else {
+					m.Attributes.merge(attrs)
+				}
+				if attrs.Divisions > 0 {
+					divisions = attrs.Divisions
+				}
+				if attrs.Key != nil {
+					key = *attrs.Key
+				}
+				if attrs.Time != nil {
+					time = *attrs.Time
+				}
+				if attrs.Transpose != nil {
+					transpose = attrs.Transpose.Semitones()
+				}
+			case *rawNote:
+				n, err := v.toNote()
+				if err != nil {
+					return nil, fmt.Errorf("musicxml: part %s measure %s: %w", rp.ID, rm.Number, err)
+				}
+				if n.Chord {
+					n.Onset = lastOnset
+				} else {
+					n.Onset = pos
+					lastOnset = pos
+					if !n.Grace {
+						pos += n.Duration
+					}
+				}
+				maxPos = max(maxPos, n.End())
+				m.Notes = append(m.Notes, n)
+			case *rawShift:
+				if v.backward {
+					pos = max(0, pos-v.Duration)
+				} else {
+					pos += v.Duration
+					maxPos = max(maxPos, pos)
+				}
+			case *rawDirection:
+				if bpm, ok := v.tempo(); ok {
+					m.Tempos = append(m.Tempos, Tempo{Offset: pos + v.Offset, BPM: bpm})
+				}
+			case *rawSound:
+				if v.Tempo > 0 {
+					m.Tempos = append(m.Tempos, Tempo{Offset: pos, BPM: v.Tempo})
+				}
+			}
+		}
+
+		m.Divisions = divisions
+		m.Key = key
+		m.Time = time
+		m.Transpose = transpose
+		m.Length = maxPos
+		if m.Length == 0 {
+			m.Length = m.FullLength()
+		}
+		part.Measures = append(part.Measures, m)
+	}
+	return part, nil
+}
+
+// merge copies the fields declared in other over a.
+// A measure may contain several <attributes> elements (e.g. a clef change mid-measure).
+func (a *Attributes) merge(other *Attributes) {
+	if other.Divisions > 0 {
+		a.Divisions = other.Divisions
+	}
+	if other.Key != nil {
+		a.Key = other.Key
+	}
+	if other.Time != nil {
+		a.Time = other.Time
+	}
+	if other.Staves > 0 {
+		a.Staves = other.Staves
+	}
+	a.Clefs = append(a.Clefs, other.Clefs...)
+	a.StaffDetails = append(a.StaffDetails, other.StaffDetails...)
+	if other.Transpose != nil {
+		a.Transpose = other.Transpose
+	}
+}
+
+type rawScore struct {
+	XMLName xml.Name
+	Work    struct {
+		Title string `xml:"work-title"`
+	} `xml:"work"`
+	MovementTitle string `xml:"movement-title"`
+	Creators      []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"identification>creator"`
+	PartList []rawScorePart `xml:"part-list>score-part"`
+	Parts    []rawPart      `xml:"part"`
+}
+
+type rawScorePart struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"part-name"`
+	Instruments []struct {
+		Program int `xml:"midi-program"`
+	} `xml:"midi-instrument"`
+}
+
+type rawPart struct {
+	ID       string       `xml:"id,attr"`
+	Measures []rawMeasure `xml:"measure"`
+}
+
+// rawMeasure keeps the children of <measure> in document order,
+// because onsets depend on the sequence of notes, backups and forwards.
+type rawMeasure struct {
+	Number   string
+	Implicit string
+	Items    []any
+}
+
+func (m *rawMeasure) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "number":
+			m.Number = attr.Value
+		case "implicit":
+			m.Implicit = attr.Value
+		}
+	}
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var item any
+			switch t.Name.Local {
+			case "note":
+				item = &rawNote{}
+			case "backup":
+				item = &rawShift{backward: true}
+			case "forward":
+				item = &rawShift{}
+			case "attributes":
+				item = &rawAttributes{}
+			case "direction":
+				item = &rawDirection{}
+			case "sound":
+				item = &rawSound{}
+			default:
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.DecodeElement(item, &t); err != nil {
+				return err
+			}
+			m.Items = append(m.Items, item)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type rawAttributes struct {
+	Divisions string `xml:"divisions"`
+	Key       *struct {
+		Fifths int    `xml:"fifths"`
+		Mode   string `xml:"mode"`
+	} `xml:"key"`
+	Time *struct {
+		Beats    string `xml:"beats"`
+		BeatType string `xml:"beat-type"`
+	} `xml:"time"`
+	Staves int `xml:"staves"`
+	Clefs  []struct {
+		Number       int    `xml:"number,attr"`
+		Sign         string `xml:"sign"`
+		Line         int    `xml:"line"`
+		OctaveChange int    `xml:"clef-octave-change"`
+	} `xml:"clef"`
+	StaffDetails []struct {
+		Number  int              `xml:"number,attr"`
+		Lines   int              `xml:"staff-lines"`
+		Tunings []rawStaffTuning `xml:"staff-tuning"`
+		Capo    int              `xml:"capo"`
+	} `xml:"staff-details"`
+	Transpose *struct {
+		Diatonic     int `xml:"diatonic"`
+		Chromatic    int `xml:"chromatic"`
+		OctaveChange int `xml:"octave-change"`
+	} `xml:"transpose"`
+}
+
+type rawStaffTuning struct {
+	Line   int    `xml:"line,attr"`
+	Step   string `xml:"tuning-step"`
+	Alter  string `xml:"tuning-alter"`
+	Octave int    `xml:"tuning-octave"`
+}
+
+func (ra *rawAttributes) toAttributes() *Attributes {
+	a := &Attributes{Divisions: parseInt(ra.Divisions), Staves: ra.Staves}
+	if ra.Key != nil {
+		a.Key = &Key{Fifths: ra.Key.Fifths, Mode: strings.TrimSpace(ra.Key.Mode)}
+	}
+	if ra.Time != nil {
+		// Compound beats such as "3+2" are summed.
+		beats := 0
+		for _, b := range strings.Split(ra.Time.Beats, "+") {
+			beats += parseInt(b)
+		}
+		if beatType := parseInt(ra.Time.BeatType); beats > 0 && beatType > 0 {
+			a.Time = &Time{Beats: beats, BeatType: beatType}
+		}
+	}
+	for _, c := range ra.Clefs {
+		number := c.Number
+		if number == 0 {
+			number = 1
+		}
+		a.Clefs = append(a.Clefs, Clef{Number: number, Sign: strings.TrimSpace(c.Sign), Line: c.Line, OctaveChange: c.OctaveChange})
+	}
+	for _, sd := range ra.StaffDetails {
+		details := StaffDetails{Number: max(1, sd.Number), Lines: sd.Lines, Capo: sd.Capo}
+		tunings := slices.Clone(sd.Tunings)
+		slices.SortStableFunc(tunings, func(a, b rawStaffTuning) int { return a.Line - b.Line })
+		for _, t := range tunings {
+			step := strings.ToUpper(strings.TrimSpace(t.Step))
+			if _, ok := stepSemitones[step]; !ok {
+				continue
+			}
+			alter, _ := strconv.ParseFloat(strings.TrimSpace(t.Alter), 64)
+			details.Tuning = append(details.Tuning, Pitch{Step: step, Alter: int(math.Round(alter)), Octave: t.Octave})
+		}
+		a.StaffDetails = append(a.StaffDetails, details)
+	}
+	if ra.Transpose != nil {
+		a.Transpose = &Transpose{Diatonic: ra.Transpose.Diatonic, Chromatic: ra.Transpose.Chromatic, OctaveChange: ra.Transpose.OctaveChange}
+	}
+	return a
+}
+
+type rawNote struct {
+	Chord *struct{} `xml:"chord"`
+	Grace *struct{} `xml:"grace"`
+	Rest  *struct{} `xml:"rest"`
+	Pitch *struct {
+		Step   string `xml:"step"`
+		Alter  string `xml:"alter"`
+		Octave int    `xml:"octave"`
+	} `xml:"pitch"`
+	Duration int        `xml:"duration"`
+	Voice    string     `xml:"voice"`
+	Type     string     `xml:"type"`
+	Dots     []struct{} `xml:"dot"`
+	Staff    int        `xml:"staff"`
+	Ties     []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"tie"`
+	Tied []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"notations>tied"`
+	Accidental       string `xml:"accidental"`
+	TimeModification *struct {
+		Actual int `xml:"actual-notes"`
+		Normal int `xml:"normal-notes"`
+	} `xml:"time-modification"`
+	String *int `xml:"notations>technical>string"`
+	Fret   *int `xml:"notations>technical>fret"`
+}
+
+func (rn *rawNote) toNote() (*Note, error) {
+	n := &Note{
+		Rest:       rn.Rest != nil,
+		Chord:      rn.Chord != nil,
+		Grace:      rn.Grace != nil,
+		Duration:   rn.Duration,
+		Type:       strings.TrimSpace(rn.Type),
+		Dots:       len(rn.Dots),
+		Voice:      parseInt(rn.Voice),
+		Staff:      rn.Staff,
+		Accidental: strings.TrimSpace(rn.Accidental),
+	}
+	if n.Voice == 0 {
+		n.Voice = 1
+	}
+	if n.Staff == 0 {
+		n.Staff = 1
+	}
+	if n.Grace {
+		n.Duration = 0
+	}
+
+	if rn.Pitch != nil {
+		step := strings.ToUpper(strings.TrimSpace(rn.Pitch.Step))
+		if _, ok := stepSemitones[step]; !ok {
+			return nil, fmt.Errorf("invalid pitch step %q", rn.Pitch.Step)
+		}
+		alter := 0
+		if s := strings.TrimSpace(rn.Pitch.Alter); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pitch alter %q", rn.Pitch.Alter)
+			}
+			// Microtonal alterations are rounded to the nearest semitone.
+			alter = int(math.Round(f))
+		}
+		n.Pitch = &Pitch{Step: step, Alter: alter, Octave: rn.Pitch.Octave}
+	}
+
+	for _, t := range append(rn.Ties, rn.Tied...) {
+		switch t.Type {
+		case "start":
+			n.TieStart = true
+		case "stop":
+			n.TieStop = true
+		}
+	}
+	if rn.TimeModification != nil && rn.TimeModification.Actual > 0 && rn.TimeModification.Normal > 0 {
+		n.Tuplet = &Tuplet{Actual: rn.TimeModification.Actual, Normal: rn.TimeModification.Normal}
+	}
+	if rn.String != nil && rn.Fret != nil {
+		n.Tab = &TabPosition{String: *rn.String, Fret: *rn.Fret}
+	}
+	return n, nil
+}
+
+// rawShift is a <backup> (backward) or <forward> element.
+type rawShift struct {
+	Duration int `xml:"duration"`
+	backward bool
+}
+
+type rawDirection struct {
+	Metronomes []struct {
+		BeatUnit    string     `xml:"beat-unit"`
+		BeatUnitDot []struct{} `xml:"beat-unit-dot"`
+		PerMinute   string     `xml:"per-minute"`
+	} `xml:"direction-type>metronome"`
+	Sound  *rawSound `xml:"sound"`
+	Offset int       `xml:"offset"`
+}
+
+// tempo returns the quarter-note BPM of the direction.
+// <sound tempo> is authoritative; a <metronome> mark is used when it is absent.
+func (rd *rawDirection) tempo() (float64, bool) {
+	if rd.Sound != nil && rd.Sound.Tempo > 0 {
+		return rd.Sound.Tempo, true
+	}
+	for _, mm := range rd.Metronomes {
+		perMinute, err := strconv.ParseFloat(strings.TrimSpace(mm.PerMinute), 64)
+		if err != nil || perMinute <= 0 {
+			continue
+		}
+		quarters, ok := typeQuarters[strings.TrimSpace(mm.BeatUnit)]
+		if !ok {
+			continue
+		}
+		quarters *= dotFactor(len(mm.BeatUnitDot))
+		return perMinute * quarters, true
+	}
+	return 0, false
+}
+
+type rawSound struct {
+	Tempo float64 `xml:"tempo,attr"`
+}
+
+// typeQuarters is the length of each MusicXML note type in quarter notes.
+var typeQuarters = map[string]float64{
+	"maxima":  32,
+	"long":    16,
+	"breve":   8,
+	"whole":   4,
+	"half":    2,
+	"quarter": 1,
+	"eighth":  0.5,
+	"16th":    0.25,
+	"32nd":    0.125,
+	"64th":    0.0625,
+	"128th":   0.03125,
+	"256th":   0.015625,
+}
+
+// dotFactor returns the length multiplier for a note with the given number of dots.
+func dotFactor(dots int) float64 {
+	factor, add := 1.0, 0.5
+	for i := 0; i < dots; i++ {
+		factor += add
+		add /= 2
+	}
+	return factor
+}
+
+func parseInt(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0
+	}
+	return n
+}
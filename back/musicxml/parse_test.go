@@ -0,0 +1,364 @@
+package musicxml
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestSheet(t *testing.T, name string) *Score {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "..", "tech", "data", name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	score, err := ParseString(string(data))
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return score
+}
+
+func TestParseTestSheets(t *testing.T) {
+	tests := []struct {
+		file          string
+		partName      string
+		midiProgram   int
+		measures      int
+		notesPerMeas  []int
+		chordsPerMeas []int
+		restsPerMeas  []int
+		divisions     []int
+		tempo         float64
+		transpose     int
+	}{
+		{
+			file:          "testsheet.xml",
+			partName:      "Steel Guitar",
+			midiProgram:   26,
+			measures:      5,
+			notesPerMeas:  []int{60, 72, 60, 72, 10},
+			chordsPerMeas: []int{48, 60, 48, 60, 8},
+			restsPerMeas:  []int{0, 0, 0, 0, 0},
+			divisions:     []int{4, 4, 4, 4, 1},
+			tempo:         120,
+			transpose:     -12,
+		},
+		{
+			file:          "testsheet_pick.xml",
+			partName:      "Steel Guitar",
+			midiProgram:   26,
+			measures:      4,
+			notesPerMeas:  []int{16, 16, 16, 12},
+			chordsPerMeas: []int{0, 0, 0, 0},
+			restsPerMeas:  []int{0, 0, 0, 2},
+			divisions:     []int{2, 2, 2, 2},
+			tempo:         120,
+			transpose:     -12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			score := loadTestSheet(t, tt.file)
+			if len(score.Parts) != 1 {
+				t.Fatalf("parts = %d, want 1", len(score.Parts))
+			}
+			part := score.Parts[0]
+			if part.Name != tt.partName {
+				t.Errorf("part name = %q, want %q", part.Name, tt.partName)
+			}
+			if part.MIDIProgram != tt.midiProgram {
+				t.Errorf("midi program = %d, want %d", part.MIDIProgram, tt.midiProgram)
+			}
+			if len(part.Measures) != tt.measures {
+				t.Fatalf("measures = %d, want %d", len(part.Measures), tt.measures)
+			}
+
+			for i, m := range part.Measures {
+				var chords, rests int
+				for _, n := range m.Notes {
+					if n.Chord {
+						chords++
+					}
+					if n.Rest {
+						rests++
+					}
+					if n.End() > m.Length {
+						t.Errorf("measure %s: note ends at %d after measure length %d", m.Number, n.End(), m.Length)
+					}
+				}
+				if len(m.Notes) != tt.notesPerMeas[i] {
+					t.Errorf("measure %s: notes = %d, want %d", m.Number, len(m.Notes), tt.notesPerMeas[i])
+				}
+				if chords != tt.chordsPerMeas[i] {
+					t.Errorf("measure %s: chord notes = %d, want %d", m.Number, chords, tt.chordsPerMeas[i])
+				}
+				if rests != tt.restsPerMeas[i] {
+					t.Errorf("measure %s: rests = %d, want %d", m.Number, rests, tt.restsPerMeas[i])
+				}
+				if m.Divisions != tt.divisions[i] {
+					t.Errorf("measure %s: divisions = %d, want %d", m.Number, m.Divisions, tt.divisions[i])
+				}
+				if m.Time != (Time{Beats: 4, BeatType: 4}) {
+					t.Errorf("measure %s: time = %+v, want 4/4", m.Number, m.Time)
+				}
+				if m.Key.Fifths != 0 {
+					t.Errorf("measure %s: fifths = %d, want 0", m.Number, m.Key.Fifths)
+				}
+				if m.Transpose != tt.transpose {
+					t.Errorf("measure %s: transpose = %d, want %d", m.Number, m.Transpose, tt.transpose)
+				}
+			}
+
+			first := part.Measures[0]
+			if len(first.Tempos) != 1 || first.Tempos[0].BPM != tt.tempo {
+				t.Errorf("tempos = %+v, want one mark at %v BPM", first.Tempos, tt.tempo)
+			}
+			if first.Attributes == nil || first.Attributes.Staves != 2 || len(first.Attributes.Clefs) != 2 {
+				t.Errorf("first measure attributes = %+v, want 2 staves with 2 clefs", first.Attributes)
+			}
+		})
+	}
+}
+
+func TestParseTabPositions(t *testing.T) {
+	score := loadTestSheet(t, "testsheet_pick.xml")
+	for _, m := range score.Parts[0].Measures {
+		for _, n := range m.Notes {
+			if n.Rest {
+				continue
+			}
+			if n.Staff == 2 && n.Tab == nil {
+				t.Errorf("measure %s: TAB staff note %v has no string/fret", m.Number, n.Pitch)
+			}
+		}
+	}
+}
+
+const scoreHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<score-partwise version="3.1">
+<work><work-title>Test</work-title></work>
+<identification><creator type="composer">Someone</creator></identification>
+<part-list><score-part id="P1"><part-name>Piano</part-name></score-part></part-list>
+<part id="P1">`
+
+const scoreFooter = `</part></score-partwise>`
+
+func TestParseMeasureContents(t *testing.T) {
+	type wantNote struct {
+		pitch    string
+		rest     bool
+		chord    bool
+		onset    int
+		duration int
+		voice    int
+		tieStart bool
+		tieStop  bool
+	}
+	tests := []struct {
+		name    string
+		body    string
+		length  int
+		notes   []wantNote
+		tempos  []Tempo
+		key     Key
+		time    Time
+		measure int
+	}{
+		{
+			name: "notes, chord and rest",
+			body: `<measure number="1">
+				<attributes><divisions>2</divisions><key><fifths>-2</fifths><mode>major</mode></key><time><beats>3</beats><beat-type>4</beat-type></time></attributes>
+				<note><pitch><step>C</step><octave>4</octave></pitch><duration>2</duration><type>quarter</type></note>
+				<note><chord/><pitch><step>E</step><alter>-1</alter><octave>4</octave></pitch><duration>2</duration><type>quarter</type></note>
+				<note><rest/><duration>2</duration><type>quarter</type></note>
+				<note><pitch><step>B</step><alter>-1</alter><octave>3</octave></pitch><duration>2</duration><type>quarter</type></note>
+			</measure>`,
+			length: 6,
+			notes: []wantNote{
+				{pitch: "C4", onset: 0, duration: 2, voice: 1},
+				{pitch: "Eb4", chord: true, onset: 0, duration: 2, voice: 1},
+				{rest: true, onset: 2, duration: 2, voice: 1},
+				{pitch: "Bb3", onset: 4, duration: 2, voice: 1},
+			},
+			key:  Key{Fifths: -2, Mode: "major"},
+			time: Time{Beats: 3, BeatType: 4},
+		},
+		{
+			name: "backup for second voice",
+			body: `<measure number="1">
+				<attributes><divisions>1</divisions></attributes>
+				<note><pitch><step>G</step><octave>4</octave></pitch><duration>4</duration><voice>1</voice><type>whole</type></note>
+				<backup><duration>4</duration></backup>
+				<note><pitch><step>C</step><octave>3</octave></pitch><duration>2</duration><voice>2</voice><type>half</type></note>
+				<forward><duration>2</duration></forward>
+			</measure>`,
+			length: 4,
+			notes: []wantNote{
+				{pitch: "G4", onset: 0, duration: 4, voice: 1},
+				{pitch: "C3", onset: 0, duration: 2, voice: 2},
+			},
+			time: Time{Beats: 4, BeatType: 4},
+		},
+		{
+			name: "ties across measures and tempo change",
+			body: `<measure number="1">
+				<attributes><divisions>1</divisions></attributes>
+				<direction><direction-type><metronome><beat-unit>half</beat-unit><per-minute>40</per-minute></metronome></direction-type></direction>
+				<note><pitch><step>A</step><octave>4</octave></pitch><duration>4</duration><tie type="start"/><type>whole</type><notations><tied type="start"/></notations></note>
+			</measure>
+			<measure number="2">
+				<note><pitch><step>A</step><octave>4</octave></pitch><duration>2</duration><tie type="stop"/><type>half</type><notations><tied type="stop"/></notations></note>
+				<direction><sound tempo="96"/></direction>
+				<note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>2</duration><type>half</type></note>
+			</measure>`,
+			measure: 1,
+			length:  4,
+			notes: []wantNote{
+				{pitch: "A4", onset: 0, duration: 2, voice: 1, tieStop: true},
+				{pitch: "F#4", onset: 2, duration: 2, voice: 1},
+			},
+			tempos: []Tempo{{Offset: 2, BPM: 96}},
+			time:   Time{Beats: 4, BeatType: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, err := ParseString(scoreHeader + tt.body + scoreFooter)
+			if err != nil {
+				t.Fatalf("ParseString: %v", err)
+			}
+			if score.Title != "Test" || score.Composer != "Someone" {
+				t.Errorf("title/composer = %q/%q", score.Title, score.Composer)
+			}
+			m := score.Parts[0].Measures[tt.measure]
+			if m.Length != tt.length {
+				t.Errorf("length = %d, want %d", m.Length, tt.length)
+			}
+			if m.Key != tt.key {
+				t.Errorf("key = %+v, want %+v", m.Key, tt.key)
+			}
+			if m.Time != tt.time {
+				t.Errorf("time = %+v, want %+v", m.Time, tt.time)
+			}
+			if len(m.Tempos) != len(tt.tempos) {
+				t.Fatalf("tempos = %+v, want %+v", m.Tempos, tt.tempos)
+			}
+			for i := range tt.tempos {
+				if m.Tempos[i] != tt.tempos[i] {
+					t.Errorf("tempo[%d] = %+v, want %+v", i, m.Tempos[i], tt.tempos[i])
+				}
+			}
+			if len(m.Notes) != len(tt.notes) {
+				t.Fatalf("notes = %d, want %d", len(m.Notes), len(tt.notes))
+			}
+			for i, want := range tt.notes {
+				n := m.Notes[i]
+				pitch := ""
+				if n.Pitch != nil {
+					pitch = n.Pitch.String()
+				}
+				got := wantNote{pitch: pitch, rest: n.Rest, chord: n.Chord, onset: n.Onset, duration: n.Duration, voice: n.Voice, tieStart: n.TieStart, tieStop: n.TieStop}
+				if got != want {
+					t.Errorf("note[%d] = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMetronomeTempo(t *testing.T) {
+	body := `<measure number="1">
+		<direction><direction-type><metronome><beat-unit>quarter</beat-unit><beat-unit-dot/><per-minute>60</per-minute></metronome></direction-type></direction>
+		<note><rest/><duration>4</duration></note>
+	</measure>`
+	score, err := ParseString(scoreHeader + body + scoreFooter)
+	if err != nil {
+		t.Fatalf("ParseString: %v", err)
+	}
+	tempos := score.Parts[0].Measures[0].Tempos
+	if len(tempos) != 1 || tempos[0].BPM != 90 {
+		t.Errorf("tempos = %+v, want 90 quarter BPM", tempos)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want error
+	}{
+		{name: "timewise", xml: `<score-timewise><part-list/></score-timewise>`, want: ErrNotPartwise},
+		{name: "no parts", xml: `<score-partwise><part-list/></score-partwise>`, want: ErrNoParts},
+		{name: "malformed", xml: `<score-partwise><part id="P1">`},
+		{name: "bad step", xml: scoreHeader + `<measure number="1"><note><pitch><step>H</step><octave>4</octave></pitch><duration>1</duration></note></measure>` + scoreFooter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseString(tt.xml)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPitch(t *testing.T) {
+	tests := []struct {
+		pitch Pitch
+		midi  int
+		freq  float64
+	}{
+		{Pitch{Step: "A", Octave: 4}, 69, 440},
+		{Pitch{Step: "C", Octave: 4}, 60, 261.6256},
+		{Pitch{Step: "B", Alter: 1, Octave: 3}, 60, 261.6256},
+		{Pitch{Step: "E", Alter: -1, Octave: 2}, 39, 77.7817},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pitch.String(), func(t *testing.T) {
+			if got := tt.pitch.MIDI(); got != tt.midi {
+				t.Errorf("MIDI() = %d, want %d", got, tt.midi)
+			}
+			if got := tt.pitch.Frequency(); math.Abs(got-tt.freq) > 1e-3 {
+				t.Errorf("Frequency() = %f, want %f", got, tt.freq)
+			}
+		})
+	}
+}
+
+func TestParsePitch(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Pitch
+		wantErr bool
+	}{
+		{name: "E2", want: Pitch{Step: "E", Octave: 2}},
+		{name: "F#4", want: Pitch{Step: "F", Alter: 1, Octave: 4}},
+		{name: "bb3", want: Pitch{Step: "B", Alter: -1, Octave: 3}},
+		{name: " C-1 ", want: Pitch{Step: "C", Octave: -1}},
+		{name: "H4", wantErr: true},
+		{name: "C", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePitch(tt.name)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPitch) {
+					t.Errorf("ParsePitch(%q) error = %v, want ErrInvalidPitch", tt.name, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParsePitch(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package musicxml
+
+import "sort"
+
+// DefaultBPM is the tempo assumed when a score has no tempo mark (same default as the frontend player).
+const DefaultBPM = 120.0
+
+// ExpectedPitch is one note the player is expected to play in a measure.
+type ExpectedPitch struct {
+	Frequency  float64
+	DurationMs float64
+}
+
+// MeasureByNumber returns the measure whose number attribute matches number.
+func (p *Part) MeasureByNumber(number string) (*Measure, bool) {
+	for _, m := range p.Measures {
+		if m.Number == number {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// TempoAt returns the quarter-note BPM in effect at offset divisions into the measure at measureIndex.
+func (p *Part) TempoAt(measureIndex, offset int) float64 {
+	for i := min(measureIndex, len(p.Measures)-1); i >= 0; i-- {
+		tempos := p.Measures[i].Tempos
+		for j := len(tempos) - 1; j >= 0; j-- {
+			if i < measureIndex || tempos[j].Offset <= offset {
+				return tempos[j].BPM
+			}
+		}
+	}
+	return DefaultBPM
+}
+
+// DurationMs converts a length in divisions, starting at offset in measure m, to milliseconds.
+func (p *Part) DurationMs(m *Measure, offset, duration int) float64 {
+	if m.Divisions <= 0 {
+		return 0
+	}
+	return float64(duration) / float64(m.Divisions) * 60000 / p.TempoAt(m.Index, offset)
+}
+
+// ExpectedPitches returns the melody of measure m as the frontend player reads it:
+// notes of the first staff are grouped by onset, the first note of each group gives
+// the (written) pitch and the longest note of the group gives the duration.
+// Groups that start with a rest are skipped.
+func (p *Part) ExpectedPitches(m *Measure) []ExpectedPitch {
+	type group struct {
+		first    *Note
+		duration int
+	}
+	groups := make(map[int]*group)
+	var onsets []int
+	for _, n := range m.Notes {
+		if n.Grace || n.Staff != 1 {
+			continue
+		}
+		g, ok := groups[n.Onset]
+		if !ok {
+			g = &group{first: n}
+			groups[n.Onset] = g
+			onsets = append(onsets, n.Onset)
+		}
+		g.duration = max(g.duration, n.Duration)
+	}
+	sort.Ints(onsets)
+
+	pitches := make([]ExpectedPitch, 0, len(onsets))
+	for _, onset := range onsets {
+		g := groups[onset]
+		if g.first.Pitch == nil || g.duration == 0 {
+			continue
+		}
+		pitches = append(pitches, ExpectedPitch{
+			Frequency:  g.first.Pitch.Frequency(),
+			DurationMs: p.DurationMs(m, onset, g.duration),
+		})
+	}
+	return pitches
+}
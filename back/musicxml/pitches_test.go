@@ -0,0 +1,84 @@
+package musicxml
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpectedPitches(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		measure string
+		want    []ExpectedPitch
+	}{
+		{
+			name:    "scale in eighth notes",
+			file:    "testsheet_pick.xml",
+			measure: "1",
+			want: []ExpectedPitch{
+				{261.626, 250}, {293.665, 250}, {329.628, 250}, {349.228, 250},
+				{391.995, 250}, {440, 250}, {493.883, 250}, {523.251, 250},
+			},
+		},
+		{
+			name:    "rests are skipped",
+			file:    "testsheet_pick.xml",
+			measure: "4",
+			want: []ExpectedPitch{
+				{261.626, 250}, {329.628, 250}, {391.995, 250}, {329.628, 250}, {261.626, 500},
+			},
+		},
+		{
+			name:    "first note of a whole-note chord",
+			file:    "testsheet.xml",
+			measure: "5",
+			want:    []ExpectedPitch{{659.255, 2000}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := loadTestSheet(t, tt.file).Parts[0]
+			m, ok := part.MeasureByNumber(tt.measure)
+			if !ok {
+				t.Fatalf("measure %s not found", tt.measure)
+			}
+			got := part.ExpectedPitches(m)
+			if len(got) != len(tt.want) {
+				t.Fatalf("pitches = %+v, want %+v", got, tt.want)
+			}
+			for i := range tt.want {
+				if math.Abs(got[i].Frequency-tt.want[i].Frequency) > 1e-2 || math.Abs(got[i].DurationMs-tt.want[i].DurationMs) > 1e-6 {
+					t.Errorf("pitch[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTempoAt(t *testing.T) {
+	part := &Part{Measures: []*Measure{
+		{Index: 0, Tempos: []Tempo{{Offset: 0, BPM: 80}}},
+		{Index: 1},
+		{Index: 2, Tempos: []Tempo{{Offset: 4, BPM: 140}}},
+	}}
+	tests := []struct {
+		measure, offset int
+		want            float64
+	}{
+		{0, 0, 80},
+		{1, 3, 80},
+		{2, 0, 80},
+		{2, 4, 140},
+		{2, 8, 140},
+	}
+	for _, tt := range tests {
+		if got := part.TempoAt(tt.measure, tt.offset); got != tt.want {
+			t.Errorf("TempoAt(%d, %d) = %v, want %v", tt.measure, tt.offset, got, tt.want)
+		}
+	}
+	if got := (&Part{Measures: []*Measure{{}}}).TempoAt(0, 0); got != DefaultBPM {
+		t.Errorf("TempoAt without tempo marks = %v, want %v", got, DefaultBPM)
+	}
+}
@@ -0,0 +1,164 @@
+package musicxml
+
+import (
+	"math"
+	"sort"
+)
+
+// SimplifyOptions controls how Simplify reduces a score.
+type SimplifyOptions struct {
+	// MaxChordNotes is the number of notes kept per chord, highest first (0 keeps all).
+	MaxChordNotes int
+	// Grid is the shortest note value kept, in notes per quarter (1 = quarters, 2 = eighths, 4 = 16ths).
+	// Onsets are snapped to it, and notes that collide after snapping are dropped.
+	Grid int
+	// Lowest and Highest bound the MIDI range; notes outside it are moved by octaves.
+	Lowest, Highest int
+}
+
+// levelOptions are the reductions applied for each sheet difficulty (1 = easiest).
+var levelOptions = map[int]SimplifyOptions{
+	1: {MaxChordNotes: 1, Grid: 1, Lowest: 60, Highest: 72},
+	2: {MaxChordNotes: 1, Grid: 2, Lowest: 57, Highest: 76},
+	3: {MaxChordNotes: 1, Grid: 2, Lowest: 55, Highest: 79},
+	4: {MaxChordNotes: 2, Grid: 4, Lowest: 52, Highest: 84},
+	5: {MaxChordNotes: 0, Grid: 4, Lowest: 40, Highest: 96},
+}
+
+// OptionsForLevel returns the reduction used to generate a sheet of the given difficulty (1-5).
+func OptionsForLevel(level int) SimplifyOptions {
+	return levelOptions[max(1, min(5, level))]
+}
+
+// Simplify produces an easier single-voice arrangement of the first staff of the first part.
+// Key, time signature, transposition and tempo marks are kept; everything else is rewritten
+// on a regular grid with Divisions equal to opts.Grid.
+func Simplify(score *Score, opts SimplifyOptions) *Score {
+	if opts.Grid <= 0 {
+		opts.Grid = 1
+	}
+	out := &Score{Title: score.Title, Composer: score.Composer}
+	if len(score.Parts) == 0 {
+		return out
+	}
+	src := score.Parts[0]
+	part := &Part{ID: "P1", Name: src.Name, MIDIProgram: src.MIDIProgram}
+	out.Parts = []*Part{part}
+
+	for i, m := range src.Measures {
+		om := &Measure{
+			Number:    m.Number,
+			Index:     i,
+			Implicit:  m.Implicit,
+			Divisions: opts.Grid,
+			Key:       m.Key,
+			Time:      m.Time,
+			Transpose: m.Transpose,
+		}
+		if i == 0 {
+			key, time := m.Key, m.Time
+			om.Attributes = &Attributes{Divisions: opts.Grid, Key: &key, Time: &time, Clefs: []Clef{{Number: 1, Sign: "G", Line: 2}}}
+			if m.Transpose != 0 {
+				om.Attributes.Transpose = &Transpose{Chromatic: m.Transpose % 12, OctaveChange: m.Transpose / 12}
+			}
+		} else if prev := src.Measures[i-1]; prev.Key != m.Key || prev.Time != m.Time {
+			key, time := m.Key, m.Time
+			om.Attributes = &Attributes{Key: &key, Time: &time}
+		}
+
+		snap := func(divs int) int { return snapToGrid(divs, m.Divisions, opts.Grid) }
+		om.Length = max(1, snap(m.Length))
+		for _, t := range m.Tempos {
+			om.Tempos = append(om.Tempos, Tempo{Offset: min(snap(t.Offset), om.Length-1), BPM: t.BPM})
+		}
+		om.Notes = fillMeasure(simplifiedEvents(m, opts, snap), om.Length, opts.Grid)
+		part.Measures = append(part.Measures, om)
+	}
+	repairTies(part)
+	return out
+}
+
+// simplifiedEvents picks the notes of the first voice of staff 1, reduces chords,
+// folds pitches into range and snaps them to the grid.
+func simplifiedEvents(m *Measure, opts SimplifyOptions, snap func(int) int) []event {
+	voice := 0
+	groups := make(map[int][]*Note)
+	var onsets []int
+	for _, n := range m.Notes {
+		if !n.IsSounding() || n.Staff != 1 {
+			continue
+		}
+		if voice == 0 {
+			voice = n.Voice
+		}
+		if n.Voice != voice {
+			continue
+		}
+		if _, ok := groups[n.Onset]; !ok {
+			onsets = append(onsets, n.Onset)
+		}
+		groups[n.Onset] = append(groups[n.Onset], n)
+	}
+	sort.Ints(onsets)
+
+	var events []event
+	lastOnset, lastDistance := -1, 0
+	for _, onset := range onsets {
+		q := snap(onset)
+		distance := abs(onset*opts.Grid - q*m.Divisions)
+		if q <= lastOnset {
+			// Thin out: of the notes that collide on the grid, keep the one closest to the grid line.
+			if q < lastOnset || distance >= lastDistance {
+				continue
+			}
+			events = events[:len(events)-1]
+		}
+		group := groups[onset]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Pitch.MIDI() > group[j].Pitch.MIDI() })
+
+		ev := event{Onset: q}
+		seen := make(map[int]bool)
+		end := onset
+		for _, n := range group {
+			p := foldPitch(*n.Pitch, opts.Lowest, opts.Highest)
+			if seen[p.MIDI()] {
+				continue
+			}
+			if opts.MaxChordNotes > 0 && len(ev.Pitches) >= opts.MaxChordNotes {
+				break
+			}
+			seen[p.MIDI()] = true
+			ev.Pitches = append(ev.Pitches, p)
+			ev.TieStart = ev.TieStart || n.TieStart
+			ev.TieStop = ev.TieStop || n.TieStop
+			end = max(end, n.End())
+		}
+		ev.End = max(q+1, snap(end))
+		events = append(events, ev)
+		lastOnset, lastDistance = q, distance
+	}
+	return events
+}
+
+// foldPitch moves a pitch by octaves until it lies within [lowest, highest].
+// When the range is narrower than an octave, the pitch is only raised above lowest.
+func foldPitch(p Pitch, lowest, highest int) Pitch {
+	if lowest == 0 && highest == 0 {
+		return p
+	}
+	for p.MIDI() > highest && p.MIDI()-12 >= lowest {
+		p.Octave--
+	}
+	for p.MIDI() < lowest {
+		p.Octave++
+	}
+	return p
+}
+
+// snapToGrid converts a position in divisions to the nearest grid step.
+func snapToGrid(divs, divisions, grid int) int {
+	if divisions <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(divs) * float64(grid) / float64(divisions)))
+}
@@ -0,0 +1,103 @@
+package musicxml
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSimplifyLevels(t *testing.T) {
+	original := loadTestSheet(t, "testsheet.xml")
+	originalRating := Analyze(original).Rating
+
+	for level := 1; level <= 4; level++ {
+		opts := OptionsForLevel(level)
+		t.Run(fmt.Sprintf("level %d", level), func(t *testing.T) {
+			simple := Simplify(original, opts)
+
+			// The result must survive a write/parse cycle unchanged.
+			data, err := MarshalString(simple)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			parsed, err := ParseString(data)
+			if err != nil {
+				t.Fatalf("parsing simplified sheet: %v", err)
+			}
+			assertSameScore(t, simple, parsed)
+
+			part := parsed.Parts[0]
+			if len(part.Measures) != len(original.Parts[0].Measures) {
+				t.Fatalf("measures = %d, want %d", len(part.Measures), len(original.Parts[0].Measures))
+			}
+			for _, m := range part.Measures {
+				if m.Divisions != opts.Grid {
+					t.Errorf("measure %s: divisions = %d, want %d", m.Number, m.Divisions, opts.Grid)
+				}
+				filled, chordSize := 0, 0
+				for _, n := range m.Notes {
+					if n.Chord {
+						chordSize++
+						if opts.MaxChordNotes > 0 && chordSize >= opts.MaxChordNotes {
+							t.Errorf("measure %s: chord larger than %d notes", m.Number, opts.MaxChordNotes)
+						}
+						continue
+					}
+					chordSize = 0
+					filled += n.Duration
+					if n.Pitch != nil && (n.Pitch.MIDI() < opts.Lowest || n.Pitch.MIDI() > opts.Highest) {
+						t.Errorf("measure %s: %v outside range %d-%d", m.Number, n.Pitch, opts.Lowest, opts.Highest)
+					}
+				}
+				if filled != m.Length {
+					t.Errorf("measure %s: notes fill %d of %d divisions", m.Number, filled, m.Length)
+				}
+			}
+
+			if rating := Analyze(parsed).Rating; rating > originalRating {
+				t.Errorf("rating = %v, want at most the original %v", rating, originalRating)
+			}
+		})
+	}
+}
+
+func TestSimplifyThinsAndKeepsTies(t *testing.T) {
+	score, err := ParseString(scoreHeader + `<measure number="1">
+		<attributes><divisions>4</divisions></attributes>
+		<note><pitch><step>C</step><octave>5</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>D</step><octave>5</octave></pitch><duration>1</duration><type>16th</type></note>
+		<note><pitch><step>E</step><octave>5</octave></pitch><duration>2</duration><type>eighth</type></note>
+		<note><pitch><step>G</step><octave>3</octave></pitch><duration>4</duration><type>quarter</type></note>
+		<note><pitch><step>A</step><octave>4</octave></pitch><duration>8</duration><type>half</type><tie type="start"/></note>
+	</measure>
+	<measure number="2">
+		<note><pitch><step>A</step><octave>4</octave></pitch><duration>16</duration><type>whole</type><tie type="stop"/></note>
+	</measure>` + scoreFooter)
+	if err != nil {
+		t.Fatalf("ParseString: %v", err)
+	}
+
+	simple := Simplify(score, SimplifyOptions{MaxChordNotes: 1, Grid: 1, Lowest: 60, Highest: 72})
+	m1, m2 := simple.Parts[0].Measures[0], simple.Parts[0].Measures[1]
+
+	var got []string
+	for _, n := range m1.Notes {
+		got = append(got, n.Pitch.String())
+	}
+	// D5 snaps onto C5's beat and E5 onto G3's beat; the notes closer to the beat win.
+	// G3 is then folded up an octave into range.
+	want := []string{"C5", "G4", "A4"}
+	if len(got) != len(want) {
+		t.Fatalf("measure 1 = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("measure 1 = %v, want %v", got, want)
+		}
+	}
+	if last := m1.Notes[len(m1.Notes)-1]; !last.TieStart {
+		t.Error("tie start of A4 was lost")
+	}
+	if first := m2.Notes[0]; !first.TieStop {
+		t.Error("tie stop of A4 was lost")
+	}
+}
@@ -0,0 +1,442 @@
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidTuning = errors.New("musicxml: invalid tuning")
+	ErrInvalidCapo   = errors.New("musicxml: invalid capo")
+)
+
+const (
+	// MaxCapo is the highest fret a capo may be placed at.
+	MaxCapo = 12
+	// TabFrets is the highest fret used in generated tablature, counted from the nut.
+	TabFrets = 20
+	// maxTabStrings bounds the number of strings of a tuning.
+	maxTabStrings = 10
+	// maxHandSpan is the widest distance in frets between the fretted notes of a chord.
+	maxHandSpan = 4
+	// maxShapes bounds the fingerings kept for each chord, the cheapest first.
+	maxShapes = 32
+	// droppedNoteCost and tieMoveCost are the costs of leaving a note of a chord out and of
+	// moving a tied note to another string, both far above any hand movement.
+	droppedNoteCost = 100
+	tieMoveCost     = 100
+)
+
+// Tuning is the open-string pitches of a fretted instrument by TAB staff line, the bottom
+// line (usually the lowest string) first, as in <staff-tuning>.
+type Tuning []Pitch
+
+// StandardTuning is the standard tuning of a six-string guitar.
+var StandardTuning = Tuning{{"E", 0, 2}, {"A", 0, 2}, {"D", 0, 3}, {"G", 0, 3}, {"B", 0, 3}, {"E", 0, 4}}
+
+// namedTunings are the tunings ParseTuning accepts by name.
+var namedTunings = map[string]string{
+	"standard":       "E2 A2 D3 G3 B3 E4",
+	"drop-d":         "D2 A2 D3 G3 B3 E4",
+	"half-step-down": "Eb2 Ab2 Db3 Gb3 Bb3 Eb4",
+	"open-g":         "D2 G2 D3 G3 B3 D4",
+	"open-d":         "D2 A2 D3 F#3 A3 D4",
+	"dadgad":         "D2 A2 D3 G3 A3 D4",
+	"bass":           "E1 A1 D2 G2",
+	"ukulele":        "G4 C4 E4 A4",
+}
+
+// TuningNames returns the tuning names accepted by ParseTuning, sorted.
+func TuningNames() []string {
+	names := make([]string, 0, len(namedTunings))
+	for name := range namedTunings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTuning parses a tuning name such as "standard" or "drop-d" (see TuningNames), or the
+// open-string pitches from the bottom line of the TAB staff up, separated by spaces or commas,
+// such as "D2 A2 D3 G3 B3 E4".
+func ParseTuning(s string) (Tuning, error) {
+	if pitches, ok := namedTunings[strings.ToLower(strings.TrimSpace(s))]; ok {
+		s = pitches
+	}
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) == 0 || len(fields) > maxTabStrings {
+		return nil, fmt.Errorf("%w: %q must name a tuning or list 1 to %d open-string pitches", ErrInvalidTuning, s, maxTabStrings)
+	}
+	tuning := make(Tuning, 0, len(fields))
+	for _, f := range fields {
+		p, err := ParsePitch(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTuning, err)
+		}
+		tuning = append(tuning, p)
+	}
+	return tuning, nil
+}
+
+func (t Tuning) String() string {
+	names := make([]string, len(t))
+	for i, p := range t {
+		names[i] = p.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// TabOptions configures AddTablature.
+type TabOptions struct {
+	Tuning Tuning // StandardTuning if empty
+	Capo   int    // Fret of the capo: the frets of the TAB are counted from it
+}
+
+// AddTablature returns a copy of the score whose first part has a TAB staff (staff 2) under
+// its melody staff (staff 1). Other staves of the part are removed; other parts are kept.
+//
+// The notes starting together on the melody staff form a chord, and every chord gets the
+// string/fret positions that minimize hand movement over the whole part: fingerings wider
+// than maxHandSpan frets are ruled out, and the cost is the span of each fingering plus the
+// distance the hand moves between consecutive fingerings (open strings do not move the hand).
+// Tied notes stay on their string. Notes out of the range of the instrument are moved by
+// octaves into it; a note that still cannot be played, such as a note of a chord with more
+// notes than strings, is left out of the TAB staff.
+func AddTablature(score *Score, opts TabOptions) (*Score, error) {
+	if len(opts.Tuning) == 0 {
+		opts.Tuning = StandardTuning
+	}
+	if len(opts.Tuning) > maxTabStrings {
+		return nil, fmt.Errorf("%w: at most %d strings", ErrInvalidTuning, maxTabStrings)
+	}
+	if opts.Capo < 0 || opts.Capo > MaxCapo {
+		return nil, fmt.Errorf("%w: %d is not between 0 and %d", ErrInvalidCapo, opts.Capo, MaxCapo)
+	}
+	out := score.Clone()
+	if len(out.Parts) == 0 {
+		return out, nil
+	}
+	part := out.Parts[0]
+	fb := newFretboard(opts)
+
+	chords := melodyChords(part, fb)
+	shapes := make([][]tabShape, len(chords))
+	for i, c := range chords {
+		shapes[i] = c.shapes(fb)
+	}
+	positions := make(map[*Note]TabPosition)
+	for i, k := range cheapestPath(chords, shapes) {
+		for j, n := range chords[i].notes {
+			if pos := shapes[i][k].positions[j]; pos.String > 0 {
+				positions[n.note] = pos
+			}
+		}
+	}
+	octaves := make(map[*Note]int)
+	for _, c := range chords {
+		for _, n := range c.notes {
+			octaves[n.note] = n.octaves
+		}
+	}
+
+	for i, m := range part.Measures {
+		m.Notes = tabMeasureNotes(m, positions, octaves)
+		if i == 0 && m.Attributes == nil {
+			key, time := m.Key, m.Time
+			m.Attributes = &Attributes{Divisions: m.Divisions, Key: &key, Time: &time}
+			if m.Transpose != 0 {
+				m.Attributes.Transpose = &Transpose{Chromatic: m.Transpose % 12, OctaveChange: m.Transpose / 12}
+			}
+		}
+		if a := m.Attributes; a != nil {
+			tabAttributes(a, i == 0, opts)
+		}
+	}
+	return out, nil
+}
+
+// fretboard is the pitches an instrument can play.
+type fretboard struct {
+	open  []int // Sounding MIDI note of each open string with the capo, string 1 (the top line) first
+	frets int   // Highest fret above the capo
+}
+
+func newFretboard(opts TabOptions) fretboard {
+	fb := fretboard{frets: TabFrets - opts.Capo}
+	for i := len(opts.Tuning) - 1; i >= 0; i-- {
+		fb.open = append(fb.open, opts.Tuning[i].MIDI()+opts.Capo)
+	}
+	return fb
+}
+
+// fold moves a pitch by octaves into the range of the instrument when it can, and returns
+// the pitch with the number of octaves it was moved by.
+func (fb fretboard) fold(midi int) (int, int) {
+	lowest, highest := slices.Min(fb.open), slices.Max(fb.open)+fb.frets
+	octaves := 0
+	for midi < lowest && midi+12 <= highest {
+		midi += 12
+		octaves++
+	}
+	for midi > highest && midi-12 >= lowest {
+		midi -= 12
+		octaves--
+	}
+	return midi, octaves
+}
+
+// positions returns every string/fret that plays a pitch.
+func (fb fretboard) positions(midi int) []TabPosition {
+	var positions []TabPosition
+	for i, open := range fb.open {
+		if fret := midi - open; fret >= 0 && fret <= fb.frets {
+			positions = append(positions, TabPosition{String: i + 1, Fret: fret})
+		}
+	}
+	return positions
+}
+
+// tabNote is a sounding note of the melody staff.
+type tabNote struct {
+	note    *Note
+	midi    int // Sounding pitch, moved into the range of the instrument
+	octaves int // Octaves the pitch was moved by
+	choices []TabPosition
+}
+
+// tabChord is the notes of the melody staff starting together.
+type tabChord struct {
+	notes []*tabNote
+}
+
+// tabShape is a fingering of a chord.
+type tabShape struct {
+	positions []TabPosition // By note of the chord; String is 0 for a note left out
+	hand      int           // Lowest fretted fret, or -1 when only open strings are played
+	cost      float64
+}
+
+// melodyChords returns the chords of the melody staff of a part in playing order.
+func melodyChords(p *Part, fb fretboard) []*tabChord {
+	var chords []*tabChord
+	for _, m := range p.Measures {
+		byOnset := make(map[int]*tabChord)
+		var onsets []int
+		for _, n := range m.Notes {
+			if n.Staff != 1 || !n.IsSounding() {
+				continue
+			}
+			c, ok := byOnset[n.Onset]
+			if !ok {
+				c = &tabChord{}
+				byOnset[n.Onset] = c
+				onsets = append(onsets, n.Onset)
+			}
+			midi, octaves := fb.fold(n.Pitch.MIDI() + m.Transpose)
+			c.notes = append(c.notes, &tabNote{note: n, midi: midi, octaves: octaves, choices: fb.positions(midi)})
+		}
+		sort.Ints(onsets)
+		for _, onset := range onsets {
+			chords = append(chords, byOnset[onset])
+		}
+	}
+	return chords
+}
+
+// shapes returns the cheapest fingerings of the chord. Notes are only left out when no
+// fingering plays them all, so there is always at least one shape.
+func (c *tabChord) shapes(fb fretboard) []tabShape {
+	var shapes []tabShape
+	positions := make([]TabPosition, len(c.notes))
+	used := make([]bool, len(fb.open)+1)
+	var search func(i, low, high int, dropping bool)
+	search = func(i, low, high int, dropping bool) {
+		if i == len(c.notes) {
+			shapes = append(shapes, newTabShape(positions, low, high))
+			return
+		}
+		for _, pos := range c.notes[i].choices {
+			if used[pos.String] {
+				continue
+			}
+			l, h := low, high
+			if pos.Fret > 0 {
+				l, h = min(l, pos.Fret), max(h, pos.Fret)
+				if h-l > maxHandSpan {
+					continue
+				}
+			}
+			used[pos.String] = true
+			positions[i] = pos
+			search(i+1, l, h, dropping)
+			used[pos.String] = false
+		}
+		if dropping {
+			positions[i] = TabPosition{}
+			search(i+1, low, high, dropping)
+		}
+	}
+	search(0, math.MaxInt, math.MinInt, false)
+	if len(shapes) == 0 {
+		search(0, math.MaxInt, math.MinInt, true)
+	}
+	sort.SliceStable(shapes, func(i, j int) bool { return shapes[i].cost < shapes[j].cost })
+	return shapes[:min(len(shapes), maxShapes)]
+}
+
+func newTabShape(positions []TabPosition, low, high int) tabShape {
+	s := tabShape{positions: slices.Clone(positions), hand: -1}
+	if low <= high {
+		s.hand = low
+		// Lower positions are slightly easier to play
+		s.cost = float64(high-low) + 0.1*float64(low)
+	}
+	for _, pos := range positions {
+		if pos.String == 0 {
+			s.cost += droppedNoteCost
+		}
+	}
+	return s
+}
+
+// moveCost is the cost of playing shape b of chord cb right after shape a of chord ca.
+func moveCost(ca *tabChord, a tabShape, cb *tabChord, b tabShape) float64 {
+	cost := 0.0
+	if a.hand >= 0 && b.hand >= 0 {
+		cost = math.Abs(float64(b.hand - a.hand))
+	}
+	for j, n := range cb.notes {
+		if !n.note.TieStop || b.positions[j].String == 0 {
+			continue
+		}
+		for i, prev := range ca.notes {
+			if prev.note.TieStart && prev.midi == n.midi && a.positions[i] != b.positions[j] {
+				cost += tieMoveCost
+			}
+		}
+	}
+	return cost
+}
+
+// cheapestPath returns the index of the shape of each chord that minimizes the total cost
+// of the shapes and of the moves between them.
+func cheapestPath(chords []*tabChord, shapes [][]tabShape) []int {
+	if len(chords) == 0 {
+		return nil
+	}
+	costs := make([][]float64, len(chords))
+	from := make([][]int, len(chords))
+	for i := range chords {
+		costs[i] = make([]float64, len(shapes[i]))
+		from[i] = make([]int, len(shapes[i]))
+		for k, s := range shapes[i] {
+			if i == 0 {
+				costs[i][k] = s.cost
+				continue
+			}
+			best := math.Inf(1)
+			for j, prev := range shapes[i-1] {
+				if c := costs[i-1][j] + moveCost(chords[i-1], prev, chords[i], s); c < best {
+					best, from[i][k] = c, j
+				}
+			}
+			costs[i][k] = best + s.cost
+		}
+	}
+
+	path := make([]int, len(chords))
+	last := len(chords) - 1
+	for k := range costs[last] {
+		if costs[last][k] < costs[last][path[last]] {
+			path[last] = k
+		}
+	}
+	for i := last; i > 0; i-- {
+		path[i-1] = from[i][path[i]]
+	}
+	return path
+}
+
+// tabMeasureNotes returns the notes of the melody staff of a measure followed by their copies
+// on the TAB staff. Notes of the TAB staff left without a position are removed, and a chord
+// whose notes are all removed becomes a rest.
+func tabMeasureNotes(m *Measure, positions map[*Note]TabPosition, octaves map[*Note]int) []*Note {
+	var melody, tab []*Note
+	var group []*Note // A note of the melody staff and the notes of its chord
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		kept := 0
+		for _, n := range group {
+			pos, ok := positions[n]
+			if n.Pitch != nil && !ok {
+				continue
+			}
+			t := *n
+			t.Staff, t.Voice = 2, n.Voice+4
+			t.Chord = kept > 0
+			if n.Pitch != nil {
+				pitch := *n.Pitch
+				pitch.Octave += octaves[n]
+				t.Pitch, t.Tab = &pitch, &pos
+			}
+			tab = append(tab, &t)
+			kept++
+		}
+		if kept == 0 {
+			rest := *group[0]
+			rest.Staff, rest.Voice = 2, rest.Voice+4
+			rest.Pitch, rest.Rest, rest.Accidental, rest.TieStart, rest.TieStop = nil, true, "", false, false
+			tab = append(tab, &rest)
+		}
+		group = nil
+	}
+	for _, n := range m.Notes {
+		if n.Staff != 1 {
+			continue
+		}
+		n.Tab = nil
+		melody = append(melody, n)
+		if n.Grace {
+			continue
+		}
+		if !n.Chord {
+			flush()
+		}
+		group = append(group, n)
+	}
+	flush()
+	return append(melody, tab...)
+}
+
+// tabAttributes rewrites the attributes of a measure for the melody and TAB staves.
+// The first measure declares the TAB staff.
+func tabAttributes(a *Attributes, first bool, opts TabOptions) {
+	var clefs []Clef
+	for _, c := range a.Clefs {
+		if c.Number <= 1 {
+			if c.Sign == "TAB" {
+				c = Clef{Number: 1, Sign: "G", Line: 2}
+			}
+			clefs = append(clefs, c)
+		}
+	}
+	a.StaffDetails = nil
+	if first {
+		if len(clefs) == 0 {
+			clefs = append(clefs, Clef{Number: 1, Sign: "G", Line: 2})
+		}
+		clefs = append(clefs, Clef{Number: 2, Sign: "TAB", Line: 5})
+		a.StaffDetails = []StaffDetails{{Number: 2, Lines: len(opts.Tuning), Tuning: slices.Clone(opts.Tuning), Capo: opts.Capo}}
+	}
+	a.Clefs = clefs
+	if first || a.Staves > 0 {
+		a.Staves = 2
+	}
+}
@@ -0,0 +1,214 @@
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseTuning(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{in: "standard", want: "E2 A2 D3 G3 B3 E4"},
+		{in: " Drop-D ", want: "D2 A2 D3 G3 B3 E4"},
+		{in: "eb2, ab2, db3, gb3, bb3, eb4", want: "Eb2 Ab2 Db3 Gb3 Bb3 Eb4"},
+		{in: "B1 E2 A2 D3 G3 B3 E4", want: "B1 E2 A2 D3 G3 B3 E4"},
+		{in: "", err: ErrInvalidTuning},
+		{in: "E2 A2 X3", err: ErrInvalidTuning},
+		{in: strings.Repeat("E2 ", 11), err: ErrInvalidTuning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			tuning, err := ParseTuning(tt.in)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tuning.String(); got != tt.want {
+				t.Errorf("tuning = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// tabTestSheet is one measure of quarter notes on a piano staff.
+func tabTestSheet(notes ...string) string {
+	var b strings.Builder
+	b.WriteString(scoreHeader + `<measure number="1"><attributes><divisions>1</divisions><key><fifths>0</fifths></key><time><beats>4</beats><beat-type>4</beat-type></time></attributes>`)
+	for _, n := range notes {
+		for i, name := range strings.Split(n, "+") {
+			p, _ := ParsePitch(name)
+			chord := ""
+			if i > 0 {
+				chord = "<chord/>"
+			}
+			fmt.Fprintf(&b, `<note>%s<pitch><step>%s</step><alter>%d</alter><octave>%d</octave></pitch><duration>1</duration><voice>1</voice><type>quarter</type></note>`,
+				chord, p.Step, p.Alter, p.Octave)
+		}
+	}
+	b.WriteString(`</measure>` + scoreFooter)
+	return b.String()
+}
+
+func TestAddTablature(t *testing.T) {
+	tests := []struct {
+		name  string
+		notes []string // Chords are joined with "+"
+		opts  TabOptions
+		tab   []string // "string/fret" of each TAB note, "rest" for a rest
+		pitch []string // Written pitches of the TAB notes, if they differ from the melody
+	}{
+		{
+			name:  "stays in first position",
+			notes: []string{"C4", "D4", "E4", "F4"},
+			tab:   []string{"2/1", "2/3", "1/0", "1/1"},
+		},
+		{
+			name:  "capo",
+			notes: []string{"C4", "D4", "E4", "F4"},
+			opts:  TabOptions{Capo: 2},
+			tab:   []string{"3/3", "2/1", "2/3", "2/4"},
+		},
+		{
+			name:  "chord on distinct strings",
+			notes: []string{"C4+E4+G4"},
+			tab:   []string{"3/5", "2/5", "1/3"},
+		},
+		{
+			name:  "drop-d tuning",
+			notes: []string{"D2", "A2"},
+			opts:  TabOptions{Tuning: mustParseTuning(t, "drop-d")},
+			tab:   []string{"6/0", "5/0"},
+		},
+		{
+			name:  "low note moves up an octave",
+			notes: []string{"C2"},
+			tab:   []string{"5/3"},
+			pitch: []string{"C3"},
+		},
+		{
+			name:  "high note moves down an octave",
+			notes: []string{"C7"},
+			tab:   []string{"1/20"},
+			pitch: []string{"C6"},
+		},
+		{
+			name:  "more notes than strings",
+			notes: []string{"C4+E4+G4+A4+C5"},
+			opts:  TabOptions{Tuning: mustParseTuning(t, "ukulele")},
+			tab:   []string{"3/0", "2/0", "4/0", "1/0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, err := ParseString(tabTestSheet(tt.notes...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := AddTablature(score, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := out.Parts[0].Measures[0]
+			var tab, pitches []string
+			for _, n := range m.Notes {
+				if n.Staff != 2 {
+					continue
+				}
+				if n.Tab == nil {
+					tab = append(tab, "rest")
+					continue
+				}
+				tab = append(tab, fmt.Sprintf("%d/%d", n.Tab.String, n.Tab.Fret))
+				pitches = append(pitches, n.Pitch.String())
+			}
+			if fmt.Sprint(tab) != fmt.Sprint(tt.tab) {
+				t.Errorf("tab = %v, want %v", tab, tt.tab)
+			}
+			if tt.pitch != nil && fmt.Sprint(pitches) != fmt.Sprint(tt.pitch) {
+				t.Errorf("TAB pitches = %v, want %v", pitches, tt.pitch)
+			}
+
+			a := m.Attributes
+			if a.Staves != 2 || len(a.Clefs) != 2 || a.Clefs[1].Sign != "TAB" || len(a.StaffDetails) != 1 {
+				t.Fatalf("attributes = %+v, want a TAB staff 2", a)
+			}
+			tuning := tt.opts.Tuning
+			if tuning == nil {
+				tuning = StandardTuning
+			}
+			if sd := a.StaffDetails[0]; sd.Number != 2 || sd.Lines != len(tuning) || sd.Tuning.String() != tuning.String() || sd.Capo != tt.opts.Capo {
+				t.Errorf("staff details = %+v", sd)
+			}
+		})
+	}
+
+	if _, err := AddTablature(&Score{}, TabOptions{Capo: MaxCapo + 1}); !errors.Is(err, ErrInvalidCapo) {
+		t.Errorf("capo %d: err = %v, want %v", MaxCapo+1, err, ErrInvalidCapo)
+	}
+}
+
+func mustParseTuning(t *testing.T, s string) Tuning {
+	t.Helper()
+	tuning, err := ParseTuning(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tuning
+}
+
+func TestAddTablatureTestSheets(t *testing.T) {
+	for _, name := range []string{"testsheet.xml", "testsheet_pick.xml"} {
+		t.Run(name, func(t *testing.T) {
+			score := loadTestSheet(t, name)
+			opts := TabOptions{Tuning: StandardTuning, Capo: 3}
+			out, err := AddTablature(score, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := Parse(strings.NewReader(string(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sd := back.Parts[0].Measures[0].Attributes.StaffDetails; len(sd) != 1 || sd[0].Tuning.String() != StandardTuning.String() || sd[0].Capo != 3 {
+				t.Fatalf("staff details after a round trip = %+v", sd)
+			}
+
+			fb := newFretboard(opts)
+			melody, tabbed := 0, 0
+			for _, m := range back.Parts[0].Measures {
+				for _, n := range m.Notes {
+					switch {
+					case n.Staff == 1 && n.IsSounding():
+						melody++
+					case n.Staff == 2 && n.Tab != nil:
+						tabbed++
+						// The fret plays the written pitch of the TAB note
+						if got, want := fb.open[n.Tab.String-1]+n.Tab.Fret, n.Pitch.MIDI()+m.Transpose; got != want {
+							t.Errorf("measure %s: %s on string %d fret %d sounds %d, want %d", m.Number, n.Pitch, n.Tab.String, n.Tab.Fret, got, want)
+						}
+					case n.Staff > 2:
+						t.Errorf("measure %s: note on staff %d", m.Number, n.Staff)
+					}
+				}
+			}
+			if tabbed == 0 || tabbed > melody {
+				t.Errorf("%d TAB notes for %d melody notes", tabbed, melody)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidKey  = errors.New("musicxml: invalid key name")
+	ErrKeyMismatch = errors.New("musicxml: target key mode does not match the score")
+)
+
+const (
+	maxFifths = 7
+	stepOrder = "CDEFGAB"
+	// fifthsTonicStep is the major tonic step for fifths -1 to 5, repeating every 7 fifths.
+	fifthsTonicStep = "FCGDAEB"
+)
+
+// ParseKeyName parses a key name such as "C", "F#", "Bb" or "C#m" (minor) into its key signature.
+func ParseKeyName(name string) (Key, error) {
+	s := strings.TrimSpace(name)
+	mode := "major"
+	switch {
+	case strings.HasSuffix(s, "m"):
+		mode, s = "minor", strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "M"):
+		s = strings.TrimSuffix(s, "M")
+	}
+	if s == "" {
+		return Key{}, fmt.Errorf("%w: %q", ErrInvalidKey, name)
+	}
+
+	step := strings.ToUpper(s[:1])
+	fifths := strings.Index(fifthsTonicStep, step) - 1
+	if fifths < -1 || len(step) != 1 {
+		return Key{}, fmt.Errorf("%w: %q", ErrInvalidKey, name)
+	}
+	switch s[1:] {
+	case "":
+	case "#", "♯":
+		fifths += 7
+	case "b", "♭":
+		fifths -= 7
+	default:
+		return Key{}, fmt.Errorf("%w: %q", ErrInvalidKey, name)
+	}
+	if mode == "minor" {
+		// The relative major of a minor key is a minor third up, three fifths down the circle.
+		fifths -= 3
+	}
+	if fifths < -maxFifths || fifths > maxFifths {
+		return Key{}, fmt.Errorf("%w: %q has more than 7 accidentals", ErrInvalidKey, name)
+	}
+	return Key{Fifths: fifths, Mode: mode}, nil
+}
+
+// Name returns the key name in the format accepted by ParseKeyName.
+func (k Key) Name() string {
+	fifths, suffix := k.Fifths, ""
+	if k.Mode == "minor" {
+		fifths, suffix = fifths+3, "m"
+	}
+	step := fifthsTonicStep[((fifths+1)%7+7)%7]
+	accidental := ""
+	switch {
+	case fifths > 5:
+		accidental = "#"
+	case fifths < -1:
+		accidental = "b"
+	}
+	return string(step) + accidental + suffix
+}
+
+// TransposeBy returns a copy of the score transposed by the given number of semitones.
+// The new key signature is the one with the fewest accidentals (flats for six, unless
+// the score already uses sharps), and notes are spelled diatonically in that key.
+func TransposeBy(score *Score, semitones int) *Score {
+	fifths := firstKey(score).Fifths
+	shift := ((7*semitones)%12 + 12) % 12
+	target := fifths + shift
+	for target > 6 || (target == 6 && fifths <= 0) {
+		target -= 12
+	}
+	for target < -6 {
+		target += 12
+	}
+	return transpose(score, semitones, target-fifths)
+}
+
+// TransposeToKey returns a copy of the score transposed to the named key, the nearest way
+// (at most a fifth down or a tritone up), together with the transposition in semitones.
+// The key must have the same mode as the score.
+func TransposeToKey(score *Score, name string) (*Score, int, error) {
+	key, err := ParseKeyName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	from := firstKey(score)
+	if (from.Mode == "minor") != (key.Mode == "minor") {
+		return nil, 0, fmt.Errorf("%w: score is in %s", ErrKeyMismatch, from.Name())
+	}
+	delta := key.Fifths - from.Fifths
+	semitones := ((7*delta)%12 + 12) % 12
+	if semitones > 6 {
+		semitones -= 12
+	}
+	return transpose(score, semitones, delta), semitones, nil
+}
+
+// firstKey returns the key signature at the start of the first part.
+func firstKey(score *Score) Key {
+	if len(score.Parts) == 0 || len(score.Parts[0].Measures) == 0 {
+		return Key{}
+	}
+	return score.Parts[0].Measures[0].Key
+}
+
+// transpose moves every pitch by semitones and every key signature by fifthsDelta.
+// The two together fix the diatonic interval (fifthsDelta = 7*semitones - 12*diatonic),
+// which keeps the spelling of each note relative to the key.
+func transpose(score *Score, semitones, fifthsDelta int) *Score {
+	diatonic := (7*semitones - fifthsDelta) / 12
+	out := score.Clone()
+	for _, p := range out.Parts {
+		for _, m := range p.Measures {
+			m.Key.Fifths += fifthsDelta
+			if m.Attributes != nil && m.Attributes.Key != nil {
+				m.Attributes.Key.Fifths += fifthsDelta
+			}
+			for _, n := range m.Notes {
+				if n.Pitch != nil {
+					*n.Pitch = transposePitch(*n.Pitch, diatonic, semitones)
+				}
+				if n.Tab != nil {
+					if fret := n.Tab.Fret + semitones; fret >= 0 && fret <= 24 {
+						n.Tab.Fret = fret
+					} else {
+						n.Tab = nil
+					}
+				}
+			}
+			respellAccidentals(m)
+		}
+	}
+	return out
+}
+
+// transposePitch moves the step by diatonic steps and picks the alteration that gives
+// the pitch semitones higher. Alterations beyond a double sharp or flat move to the next step.
+func transposePitch(p Pitch, diatonic, semitones int) Pitch {
+	midi := p.MIDI() + semitones
+	index := p.Octave*7 + strings.Index(stepOrder, p.Step) + diatonic
+	for {
+		q := Pitch{Step: stepOrder[(index%7+7)%7:][:1], Octave: floorDiv(index, 7)}
+		q.Alter = midi - q.MIDI()
+		switch {
+		case q.Alter > 2:
+			index++
+		case q.Alter < -2:
+			index--
+		default:
+			return q
+		}
+	}
+}
+
+// respellAccidentals rewrites the printed accidentals of a measure for its key signature:
+// an accidental is printed when a note differs from the key or from an earlier note
+// of the same step and octave in the measure.
+func respellAccidentals(m *Measure) {
+	current := make(map[string]int)
+	for _, n := range m.Notes {
+		if n.Pitch == nil {
+			continue
+		}
+		n.Accidental = ""
+		id := n.Pitch.Step + fmt.Sprint(n.Pitch.Octave)
+		alter, ok := current[id]
+		if !ok {
+			alter = keyAlter(m.Key.Fifths, n.Pitch.Step)
+		}
+		if n.Pitch.Alter != alter && !n.TieStop {
+			n.Accidental = accidentalNames[n.Pitch.Alter]
+		}
+		current[id] = n.Pitch.Alter
+	}
+}
+
+var accidentalNames = map[int]string{-2: "flat-flat", -1: "flat", 0: "natural", 1: "sharp", 2: "double-sharp"}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,124 @@
+package musicxml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// transposeTestSheet is one measure in C major: C4 F#4 Bb4 B4 (quarter notes).
+const transposeTestSheet = scoreHeader + `
+    <measure number="1">
+      <attributes><divisions>1</divisions><key><fifths>0</fifths></key><time><beats>4</beats><beat-type>4</beat-type></time></attributes>
+      <note><pitch><step>C</step><octave>4</octave></pitch><duration>1</duration><voice>1</voice><type>quarter</type></note>
+      <note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>1</duration><voice>1</voice><type>quarter</type><accidental>sharp</accidental></note>
+      <note><pitch><step>B</step><alter>-1</alter><octave>4</octave></pitch><duration>1</duration><voice>1</voice><type>quarter</type><accidental>flat</accidental></note>
+      <note><pitch><step>B</step><octave>4</octave></pitch><duration>1</duration><voice>1</voice><type>quarter</type><accidental>natural</accidental></note>
+    </measure>` + scoreFooter
+
+func TestTransposeBy(t *testing.T) {
+	tests := []struct {
+		semitones   int
+		fifths      int
+		pitches     []string
+		accidentals []string
+	}{
+		{0, 0, []string{"C4", "F#4", "Bb4", "B4"}, []string{"", "sharp", "flat", "natural"}},
+		{2, 2, []string{"D4", "G#4", "C5", "C#5"}, []string{"", "sharp", "natural", "sharp"}},
+		{3, -3, []string{"Eb4", "A4", "Db5", "D5"}, []string{"", "natural", "flat", "natural"}},
+		{-1, 5, []string{"B3", "E#4", "A4", "A#4"}, []string{"", "sharp", "natural", "sharp"}},
+		{6, -6, []string{"Gb4", "C5", "Fb5", "F5"}, []string{"", "natural", "flat", "natural"}},
+		{12, 0, []string{"C5", "F#5", "Bb5", "B5"}, []string{"", "sharp", "flat", "natural"}},
+	}
+
+	score, err := ParseString(transposeTestSheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+d semitones", tt.semitones), func(t *testing.T) {
+			m := TransposeBy(score, tt.semitones).Parts[0].Measures[0]
+			if m.Key.Fifths != tt.fifths || m.Attributes.Key.Fifths != tt.fifths {
+				t.Errorf("fifths = %d (attributes %d), want %d", m.Key.Fifths, m.Attributes.Key.Fifths, tt.fifths)
+			}
+			for i, n := range m.Notes {
+				if n.Pitch.String() != tt.pitches[i] || n.Accidental != tt.accidentals[i] {
+					t.Errorf("note[%d] = %s (%q), want %s (%q)", i, n.Pitch, n.Accidental, tt.pitches[i], tt.accidentals[i])
+				}
+				if want := score.Parts[0].Measures[0].Notes[i].Pitch.MIDI() + tt.semitones; n.Pitch.MIDI() != want {
+					t.Errorf("note[%d] MIDI = %d, want %d", i, n.Pitch.MIDI(), want)
+				}
+			}
+		})
+	}
+
+	if got := score.Parts[0].Measures[0].Notes[0].Pitch.String(); got != "C4" {
+		t.Errorf("original score was modified: first note = %s", got)
+	}
+}
+
+func TestTransposeToKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		semitones int
+		fifths    int
+		first     string
+		err       error
+	}{
+		{key: "D", semitones: 2, fifths: 2, first: "D4"},
+		{key: "Bb", semitones: -2, fifths: -2, first: "Bb3"},
+		{key: "F#", semitones: 6, fifths: 6, first: "F#4"},
+		{key: "Gb", semitones: 6, fifths: -6, first: "Gb4"},
+		{key: "G", semitones: -5, fifths: 1, first: "G3"},
+		{key: "Am", err: ErrKeyMismatch},
+		{key: "H", err: ErrInvalidKey},
+	}
+
+	score, err := ParseString(transposeTestSheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, semitones, err := TransposeToKey(score, tt.key)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := got.Parts[0].Measures[0]
+			if semitones != tt.semitones || m.Key.Fifths != tt.fifths || m.Notes[0].Pitch.String() != tt.first {
+				t.Errorf("got %+d semitones, fifths %d, first note %s; want %+d, %d, %s",
+					semitones, m.Key.Fifths, m.Notes[0].Pitch, tt.semitones, tt.fifths, tt.first)
+			}
+		})
+	}
+}
+
+func TestParseKeyName(t *testing.T) {
+	tests := []struct {
+		name string
+		want Key
+	}{
+		{"C", Key{0, "major"}},
+		{"Eb", Key{-3, "major"}},
+		{"C#", Key{7, "major"}},
+		{"Am", Key{0, "minor"}},
+		{"f#m", Key{3, "minor"}},
+		{"Bbm", Key{-5, "minor"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeyName(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseKeyName(%q) = %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+		if name := got.Name(); err == nil && name != strings.ToUpper(tt.name[:1])+tt.name[1:] {
+			t.Errorf("Key%+v.Name() = %q, want %q", got, name, tt.name)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package musicxml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
+
+const partwiseHeader = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 3.1 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">
+`
+
+// Marshal writes the score as a score-partwise MusicXML 3.1 document.
+// Only what the model holds is written: layout, dynamics and articulations of a parsed
+// document are not preserved.
+func Marshal(score *Score) ([]byte, error) {
+	out := outScore{Version: "3.1"}
+	if score.Title != "" {
+		out.Work = &outWork{Title: score.Title}
+	}
+	if score.Composer != "" {
+		out.Identification = &outIdentification{Creators: []outCreator{{Type: "composer", Value: score.Composer}}}
+	}
+
+	for i, p := range score.Parts {
+		id := p.ID
+		if id == "" {
+			id = "P" + strconv.Itoa(i+1)
+		}
+		sp := outScorePart{ID: id, Name: p.Name}
+		if p.MIDIProgram > 0 {
+			sp.Instrument = &outMIDIInstrument{ID: id + "-I1", Channel: min(i+1, 16), Program: p.MIDIProgram}
+		}
+		out.PartList = append(out.PartList, sp)
+
+		op := outPart{ID: id}
+		for j, m := range p.Measures {
+			op.Measures = append(op.Measures, marshalMeasure(m, j))
+		}
+		out.Parts = append(out.Parts, op)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(partwiseHeader)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return nil, fmt.Errorf("musicxml: failed to encode score: %w", err)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// MarshalString is Marshal for callers that store the document as a string.
+func MarshalString(score *Score) (string, error) {
+	b, err := Marshal(score)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func marshalMeasure(m *Measure, index int) outMeasure {
+	number := m.Number
+	if number == "" {
+		number = strconv.Itoa(index + 1)
+	}
+	om := outMeasure{Number: number}
+	if m.Implicit {
+		om.Implicit = "yes"
+	}
+
+	attrs := m.Attributes
+	if attrs == nil && index == 0 {
+		// The first measure must declare what the rest of the part relies on.
+		attrs = &Attributes{Divisions: m.Divisions, Key: &m.Key, Time: &m.Time}
+		if m.Transpose != 0 {
+			attrs.Transpose = &Transpose{Chromatic: m.Transpose % 12, OctaveChange: m.Transpose / 12}
+		}
+	}
+	if attrs != nil {
+		om.Items = append(om.Items, marshalAttributes(attrs))
+	}
+
+	for _, t := range m.Tempos {
+		om.Items = append(om.Items, outDirection{
+			Placement: "above",
+			Metronome: &outMetronome{BeatUnit: "quarter", PerMinute: formatFloat(t.BPM)},
+			Offset:    t.Offset,
+			Sound:     outSound{Tempo: formatFloat(t.BPM)},
+		})
+	}
+
+	pos := 0
+	for _, n := range m.Notes {
+		if !n.Chord {
+			switch {
+			case n.Onset < pos:
+				om.Items = append(om.Items, outShift{XMLName: xml.Name{Local: "backup"}, Duration: pos - n.Onset})
+			case n.Onset > pos:
+				om.Items = append(om.Items, outShift{XMLName: xml.Name{Local: "forward"}, Duration: n.Onset - pos})
+			}
+			pos = n.Onset
+			if !n.Grace {
+				pos += n.Duration
+			}
+		}
+		om.Items = append(om.Items, marshalNote(n))
+	}
+	return om
+}
+
+func marshalAttributes(a *Attributes) outAttributes {
+	oa := outAttributes{Divisions: a.Divisions, Staves: a.Staves}
+	if a.Key != nil {
+		oa.Key = &outKey{Fifths: a.Key.Fifths, Mode: a.Key.Mode}
+	}
+	if a.Time != nil && a.Time.Beats > 0 && a.Time.BeatType > 0 {
+		oa.Time = &outTime{Beats: a.Time.Beats, BeatType: a.Time.BeatType}
+	}
+	for _, c := range a.Clefs {
+		oc := outClef{Sign: c.Sign, Line: c.Line, OctaveChange: c.OctaveChange}
+		if a.Staves > 1 {
+			oc.Number = c.Number
+		}
+		oa.Clefs = append(oa.Clefs, oc)
+	}
+	for _, sd := range a.StaffDetails {
+		od := outStaffDetails{Lines: sd.Lines, Capo: sd.Capo}
+		if a.Staves > 1 {
+			od.Number = sd.Number
+		}
+		for i, p := range sd.Tuning {
+			od.Tunings = append(od.Tunings, outStaffTuning{Line: i + 1, Step: p.Step, Alter: p.Alter, Octave: p.Octave})
+		}
+		oa.StaffDetails = append(oa.StaffDetails, od)
+	}
+	if a.Transpose != nil {
+		oa.Transpose = &outTranspose{Diatonic: a.Transpose.Diatonic, Chromatic: a.Transpose.Chromatic, OctaveChange: a.Transpose.OctaveChange}
+	}
+	return oa
+}
+
+func marshalNote(n *Note) outNote {
+	on := outNote{
+		Duration:   n.Duration,
+		Type:       n.Type,
+		Accidental: n.Accidental,
+		Staff:      n.Staff,
+	}
+	if n.Grace {
+		on.Grace = &struct{}{}
+		on.Duration = 0
+	}
+	if n.Chord {
+		on.Chord = &struct{}{}
+	}
+	if n.Pitch != nil {
+		on.Pitch = &outPitch{Step: n.Pitch.Step, Alter: n.Pitch.Alter, Octave: n.Pitch.Octave}
+	} else {
+		on.Rest = &struct{}{}
+	}
+	if n.Voice > 0 {
+		on.Voice = strconv.Itoa(n.Voice)
+	}
+	for i := 0; i < n.Dots; i++ {
+		on.Dots = append(on.Dots, struct{}{})
+	}
+	if n.Tuplet != nil {
+		on.TimeModification = &outTimeModification{Actual: n.Tuplet.Actual, Normal: n.Tuplet.Normal}
+	}
+
+	var notations outNotations
+	if n.TieStop {
+		on.Ties = append(on.Ties, outTie{Type: "stop"})
+		notations.Tied = append(notations.Tied, outTie{Type: "stop"})
+	}
+	if n.TieStart {
+		on.Ties = append(on.Ties, outTie{Type: "start"})
+		notations.Tied = append(notations.Tied, outTie{Type: "start"})
+	}
+	if n.Tab != nil {
+		notations.Technical = &outTechnical{String: n.Tab.String, Fret: n.Tab.Fret}
+	}
+	if len(notations.Tied) > 0 || notations.Technical != nil {
+		on.Notations = &notations
+	}
+	return on
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+type outScore struct {
+	XMLName        xml.Name           `xml:"score-partwise"`
+	Version        string             `xml:"version,attr"`
+	Work           *outWork           `xml:"work,omitempty"`
+	Identification *outIdentification `xml:"identification,omitempty"`
+	PartList       []outScorePart     `xml:"part-list>score-part"`
+	Parts          []outPart          `xml:"part"`
+}
+
+type outWork struct {
+	Title string `xml:"work-title"`
+}
+
+type outIdentification struct {
+	Creators []outCreator `xml:"creator"`
+}
+
+type outCreator struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type outScorePart struct {
+	ID         string             `xml:"id,attr"`
+	Name       string             `xml:"part-name"`
+	Instrument *outMIDIInstrument `xml:"midi-instrument,omitempty"`
+}
+
+type outMIDIInstrument struct {
+	ID      string `xml:"id,attr"`
+	Channel int    `xml:"midi-channel"`
+	Program int    `xml:"midi-program"`
+}
+
+type outPart struct {
+	ID       string       `xml:"id,attr"`
+	Measures []outMeasure `xml:"measure"`
+}
+
+type outMeasure struct {
+	XMLName  xml.Name `xml:"measure"`
+	Number   string   `xml:"number,attr"`
+	Implicit string   `xml:"implicit,attr,omitempty"`
+	Items    []any
+}
+
+type outAttributes struct {
+	XMLName      xml.Name          `xml:"attributes"`
+	Divisions    int               `xml:"divisions,omitempty"`
+	Key          *outKey           `xml:"key,omitempty"`
+	Time         *outTime          `xml:"time,omitempty"`
+	Staves       int               `xml:"staves,omitempty"`
+	Clefs        []outClef         `xml:"clef"`
+	StaffDetails []outStaffDetails `xml:"staff-details"`
+	Transpose    *outTranspose     `xml:"transpose,omitempty"`
+}
+
+type outKey struct {
+	Fifths int    `xml:"fifths"`
+	Mode   string `xml:"mode,omitempty"`
+}
+
+type outTime struct {
+	Beats    int `xml:"beats"`
+	BeatType int `xml:"beat-type"`
+}
+
+type outClef struct {
+	Number       int    `xml:"number,attr,omitempty"`
+	Sign         string `xml:"sign"`
+	Line         int    `xml:"line,omitempty"`
+	OctaveChange int    `xml:"clef-octave-change,omitempty"`
+}
+
+type outStaffDetails struct {
+	Number  int              `xml:"number,attr,omitempty"`
+	Lines   int              `xml:"staff-lines,omitempty"`
+	Tunings []outStaffTuning `xml:"staff-tuning"`
+	Capo    int              `xml:"capo,omitempty"`
+}
+
+type outStaffTuning struct {
+	Line   int    `xml:"line,attr"`
+	Step   string `xml:"tuning-step"`
+	Alter  int    `xml:"tuning-alter,omitempty"`
+	Octave int    `xml:"tuning-octave"`
+}
+
+type outTranspose struct {
+	Diatonic     int `xml:"diatonic"`
+	Chromatic    int `xml:"chromatic"`
+	OctaveChange int `xml:"octave-change,omitempty"`
+}
+
+type outDirection struct {
+	XMLName   xml.Name      `xml:"direction"`
+	Placement string        `xml:"placement,attr,omitempty"`
+	Metronome *outMetronome `xml:"direction-type>metronome,omitempty"`
+	Offset    int           `xml:"offset,omitempty"`
+	Sound     outSound      `xml:"sound"`
+}
+
+type outMetronome struct {
+	BeatUnit  string `xml:"beat-unit"`
+	PerMinute string `xml:"per-minute"`
+}
+
+type outSound struct {
+	Tempo string `xml:"tempo,attr,omitempty"`
+}
+
+type outShift struct {
+	XMLName  xml.Name
+	Duration int `xml:"duration"`
+}
+
+type outNote struct {
+	XMLName          xml.Name             `xml:"note"`
+	Grace            *struct{}            `xml:"grace,omitempty"`
+	Chord            *struct{}            `xml:"chord,omitempty"`
+	Pitch            *outPitch            `xml:"pitch,omitempty"`
+	Rest             *struct{}            `xml:"rest,omitempty"`
+	Duration         int                  `xml:"duration,omitempty"`
+	Ties             []outTie             `xml:"tie"`
+	Voice            string               `xml:"voice,omitempty"`
+	Type             string               `xml:"type,omitempty"`
+	Dots             []struct{}           `xml:"dot"`
+	Accidental       string               `xml:"accidental,omitempty"`
+	TimeModification *outTimeModification `xml:"time-modification,omitempty"`
+	Staff            int                  `xml:"staff,omitempty"`
+	Notations        *outNotations        `xml:"notations,omitempty"`
+}
+
+type outPitch struct {
+	Step   string `xml:"step"`
+	Alter  int    `xml:"alter,omitempty"`
+	Octave int    `xml:"octave"`
+}
+
+type outTie struct {
+	Type string `xml:"type,attr"`
+}
+
+type outTimeModification struct {
+	Actual int `xml:"actual-notes"`
+	Normal int `xml:"normal-notes"`
+}
+
+type outNotations struct {
+	Tied      []outTie      `xml:"tied"`
+	Technical *outTechnical `xml:"technical,omitempty"`
+}
+
+type outTechnical struct {
+	String int `xml:"string"`
+	Fret   int `xml:"fret"`
+}
@@ -0,0 +1,94 @@
+package musicxml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		score func(t *testing.T) *Score
+	}{
+		{name: "testsheet.xml", score: func(t *testing.T) *Score { return loadTestSheet(t, "testsheet.xml") }},
+		{name: "testsheet_pick.xml", score: func(t *testing.T) *Score { return loadTestSheet(t, "testsheet_pick.xml") }},
+		{name: "voices, ties and tempo", score: func(t *testing.T) *Score {
+			score, err := ParseString(scoreHeader + `<measure number="1">
+				<attributes><divisions>2</divisions><key><fifths>2</fifths><mode>major</mode></key><time><beats>3</beats><beat-type>4</beat-type></time><clef><sign>G</sign><line>2</line></clef></attributes>
+				<direction><sound tempo="88"/></direction>
+				<note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>6</duration><voice>1</voice><type>half</type><dot/><tie type="start"/></note>
+				<backup><duration>6</duration></backup>
+				<note><rest/><duration>2</duration><voice>2</voice><type>quarter</type></note>
+				<note><pitch><step>D</step><octave>3</octave></pitch><duration>4</duration><voice>2</voice><type>half</type></note>
+			</measure>
+			<measure number="2">
+				<note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>2</duration><voice>1</voice><type>quarter</type><tie type="stop"/></note>
+				<note><pitch><step>G</step><octave>4</octave></pitch><duration>1</duration><voice>1</voice><type>eighth</type><time-modification><actual-notes>3</actual-notes><normal-notes>2</normal-notes></time-modification></note>
+			</measure>` + scoreFooter)
+			if err != nil {
+				t.Fatalf("ParseString: %v", err)
+			}
+			return score
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.score(t)
+			data, err := MarshalString(original)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if !strings.HasPrefix(data, "<?xml") || !strings.Contains(data, "<score-partwise") {
+				t.Fatalf("unexpected document start: %.120s", data)
+			}
+			parsed, err := ParseString(data)
+			if err != nil {
+				t.Fatalf("parsing marshaled document: %v\n%s", err, data)
+			}
+			assertSameScore(t, original, parsed)
+		})
+	}
+}
+
+// assertSameScore compares everything the writer is expected to preserve.
+func assertSameScore(t *testing.T, want, got *Score) {
+	t.Helper()
+	if got.Title != want.Title || got.Composer != want.Composer {
+		t.Errorf("title/composer = %q/%q, want %q/%q", got.Title, got.Composer, want.Title, want.Composer)
+	}
+	if len(got.Parts) != len(want.Parts) {
+		t.Fatalf("parts = %d, want %d", len(got.Parts), len(want.Parts))
+	}
+	for i, wp := range want.Parts {
+		gp := got.Parts[i]
+		if gp.Name != wp.Name || gp.MIDIProgram != wp.MIDIProgram {
+			t.Errorf("part %d = %q/%d, want %q/%d", i, gp.Name, gp.MIDIProgram, wp.Name, wp.MIDIProgram)
+		}
+		if len(gp.Measures) != len(wp.Measures) {
+			t.Fatalf("part %d measures = %d, want %d", i, len(gp.Measures), len(wp.Measures))
+		}
+		for j, wm := range wp.Measures {
+			gm := gp.Measures[j]
+			if gm.Number != wm.Number || gm.Divisions != wm.Divisions || gm.Key != wm.Key || gm.Time != wm.Time || gm.Transpose != wm.Transpose || gm.Length != wm.Length {
+				t.Errorf("measure %s = %+v, want %+v", wm.Number, *gm, *wm)
+			}
+			if len(gm.Tempos) != len(wm.Tempos) {
+				t.Errorf("measure %s tempos = %+v, want %+v", wm.Number, gm.Tempos, wm.Tempos)
+			}
+			if len(gm.Notes) != len(wm.Notes) {
+				t.Fatalf("measure %s notes = %d, want %d", wm.Number, len(gm.Notes), len(wm.Notes))
+			}
+			for k, wn := range wm.Notes {
+				gn := gm.Notes[k]
+				if (gn.Pitch == nil) != (wn.Pitch == nil) || (gn.Pitch != nil && *gn.Pitch != *wn.Pitch) ||
+					gn.Rest != wn.Rest || gn.Chord != wn.Chord || gn.Onset != wn.Onset || gn.Duration != wn.Duration ||
+					gn.Voice != wn.Voice || gn.Staff != wn.Staff || gn.Type != wn.Type || gn.Dots != wn.Dots ||
+					gn.TieStart != wn.TieStart || gn.TieStop != wn.TieStop ||
+					(gn.Tuplet == nil) != (wn.Tuplet == nil) || (gn.Tab == nil) != (wn.Tab == nil) {
+					t.Errorf("measure %s note %d = %+v, want %+v", wm.Number, k, *gn, *wn)
+				}
+			}
+		}
+	}
+}
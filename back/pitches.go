@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"infosystem-musicapp/musicxml"
+)
+
+var ErrMeasureNotFound = errors.New("measure not found")
+
+// GetMeasurePitches derives the expected [frequency(Hz), duration(ms)] pairs of one measure
+// from the stored MusicXML, in the same format the frontend sends as correct_pitches.
+// measure is the measure number as written in the score (1-based).
+// The sheet is transposed first, so that the pitches match the sheet returned by /select.
+func GetMeasurePitches(db *sql.DB, musicID int, sheetPart SheetPart, difficulty int, measure int, t TransposeOptions) ([][]float64, error) {
+	sheet, err := GetSheet(db, musicID, sheetPart, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	if score, _, err = t.Apply(score); err != nil {
+		return nil, fmt.Errorf("failed to transpose sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+
+	part := score.Parts[0]
+	m, ok := part.MeasureByNumber(strconv.Itoa(measure))
+	if !ok {
+		return nil, ErrMeasureNotFound
+	}
+
+	pitches := [][]float64{}
+	for _, p := range part.ExpectedPitches(m) {
+		pitches = append(pitches, []float64{p.Frequency, p.DurationMs})
+	}
+	return pitches, nil
+}
+
+// scalePitchDurations stretches the durations so that they add up to totalMs,
+// as the frontend does to match the length of the recorded audio.
+func scalePitchDurations(pitches [][]float64, totalMs float64) [][]float64 {
+	sheetMs := 0.0
+	for _, p := range pitches {
+		sheetMs += p[1]
+	}
+	if sheetMs <= 0 || totalMs <= 0 {
+		return pitches
+	}
+	factor := totalMs / sheetMs
+	scaled := make([][]float64, len(pitches))
+	for i, p := range pitches {
+		scaled[i] = []float64{p[0], p[1] * factor}
+	}
+	return scaled
+}
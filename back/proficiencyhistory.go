@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sources of a proficiency change.
+const (
+	proficiencySourceManual    = "manual"    // PUT /proficiency
+	proficiencySourceMeasure   = "measure"   // Scoring of a measure by /calc_proficiency
+	proficiencySourcePlacement = "placement" // PUT /proficiency with the result of a placement test
+)
+
+var proficiencySources = []string{proficiencySourceManual, proficiencySourceMeasure, proficiencySourcePlacement}
+
+const (
+	defaultProficiencyHistoryLimit = 200
+	maxProficiencyHistoryLimit     = 1000
+)
+
+// ProficiencyChange tells where a new proficiency comes from, for the history.
+type ProficiencyChange struct {
+	Source     string
+	MusicID    int  // 0 if the change is not about a song
+	Measure    int  // 0 if the change is not about a measure
+	Difficulty *int // Difficulty of the sheet that was played, if any
+}
+
+// ProficiencyHistoryEntry is one change of the proficiency of a user on an instrument.
+type ProficiencyHistoryEntry struct {
+	ID          int       `json:"id"`
+	Instrument  string    `json:"instrument"`
+	Proficiency float64   `json:"proficiency"`
+	Previous    float64   `json:"previous"` // Proficiency before the change
+	Source      string    `json:"source"`
+	MusicID     *int      `json:"music_id,omitempty"` // Omitted if the music was deleted since
+	Title       string    `json:"title,omitempty"`
+	Measure     *int      `json:"measure,omitempty"`
+	Difficulty  *int      `json:"difficulty,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// ProficiencyPeriod aggregates the changes of a day or a week, for charts.
+type ProficiencyPeriod struct {
+	Start   time.Time      `json:"start"` // Midnight of the day, or of the Monday of the week, in the requested time zone
+	Open    float64        `json:"open"`  // Proficiency before the first change of the period
+	Close   float64        `json:"close"` // Proficiency after the last change of the period
+	Min     float64        `json:"min"`   // Min, Max and Average are of the values reached during the period
+	Max     float64        `json:"max"`
+	Average float64        `json:"average"`
+	Count   int            `json:"count"`   // Number of changes
+	Sources map[string]int `json:"sources"` // Number of changes by source
+}
+
+// ProficiencyHistoryQuery is the query of GET /proficiency/history.
+type ProficiencyHistoryQuery struct {
+	Instrument string `form:"instrument"` // Optional: the current instrument if omitted
+	Group      string `form:"group"`      // Optional: "day" or "week"; the changes themselves if omitted
+	From       string `form:"from"`       // Optional: first day (YYYY-MM-DD), inclusive
+	To         string `form:"to"`         // Optional: last day (YYYY-MM-DD), inclusive
+	TimeZone   string `form:"tz"`         // Optional: IANA time zone of the days and weeks, such as "Asia/Tokyo" (default UTC)
+	Source     string `form:"source"`     // Optional: only the changes of this source
+	Limit      int    `form:"limit"`      // Optional: the latest changes returned without group (default 200, max 1000)
+
+	location *time.Location
+	from, to time.Time // Bounds in UTC; zero if unbounded
+}
+
+// Validate checks the query and resolves its time zone and bounds.
+func (q *ProficiencyHistoryQuery) Validate() error {
+	q.Group = strings.ToLower(strings.TrimSpace(q.Group))
+	if q.Group != "" && q.Group != "day" && q.Group != "week" {
+		return errors.New("'group' must be day or week")
+	}
+	q.Source = strings.ToLower(strings.TrimSpace(q.Source))
+	if q.Source != "" && !slices.Contains(proficiencySources, q.Source) {
+		return fmt.Errorf("'source' must be one of %s", strings.Join(proficiencySources, ", "))
+	}
+	if q.Limit < 0 || q.Limit > maxProficiencyHistoryLimit {
+		return fmt.Errorf("'limit' must be between 1 and %d", maxProficiencyHistoryLimit)
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultProficiencyHistoryLimit
+	}
+
+	q.location = time.UTC
+	if tz := strings.TrimSpace(q.TimeZone); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("unknown time zone %q", tz)
+		}
+		q.location, q.TimeZone = loc, tz
+	}
+	if q.From != "" {
+		day, err := time.ParseInLocation(time.DateOnly, q.From, q.location)
+		if err != nil {
+			return errors.New("'from' must be a date such as 2025-06-01")
+		}
+		q.from = day.UTC()
+	}
+	if q.To != "" {
+		day, err := time.ParseInLocation(time.DateOnly, q.To, q.location)
+		if err != nil {
+			return errors.New("'to' must be a date such as 2025-06-30")
+		}
+		q.to = day.AddDate(0, 0, 1).UTC()
+	}
+	if !q.from.IsZero() && !q.to.IsZero() && !q.from.Before(q.to) {
+		return errors.New("'from' must not be after 'to'")
+	}
+	return nil
+}
+
+// ProficiencyHistory is the answer of GET /proficiency/history: the changes without group,
+// the periods with changes otherwise (periods without changes are left out). The other list is empty.
+type ProficiencyHistory struct {
+	Instrument string                    `json:"instrument"`
+	Group      string                    `json:"group,omitempty"`
+	TimeZone   string                    `json:"time_zone,omitempty"`
+	Entries    []ProficiencyHistoryEntry `json:"entries"`
+	Periods    []ProficiencyPeriod       `json:"periods"`
+}
+
+// setupProficiencyHistory creates the ProficiencyHistory table. Changes keep their music_id
+// until the music is deleted.
+func setupProficiencyHistory(db execer) error {
+	return execAll(
+		`CREATE TABLE ProficiencyHistory (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			proficiency REAL NOT NULL,
+			previous REAL NOT NULL,
+			source TEXT NOT NULL,
+			music_id INTEGER,
+			measure INTEGER,
+			difficulty INTEGER,
+			recorded_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		"CREATE INDEX idx_proficiency_history_user ON ProficiencyHistory(user_id, instrument, recorded_at)",
+	)(db)
+}
+
+// recordProficiencyChange adds a change to the history, within the transaction of the update.
+func recordProficiencyChange(db execer, userID int, instrument string, previous, proficiency float64, change ProficiencyChange) error {
+	var musicID, measure sql.NullInt64
+	if change.MusicID > 0 {
+		musicID = sql.NullInt64{Int64: int64(change.MusicID), Valid: true}
+	}
+	if change.Measure > 0 {
+		measure = sql.NullInt64{Int64: int64(change.Measure), Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO ProficiencyHistory (user_id, instrument, proficiency, previous, source, music_id, measure, difficulty, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, instrument, proficiency, previous, change.Source, musicID, measure, change.Difficulty, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record proficiency change on %s: %w", instrument, err)
+	}
+	return nil
+}
+
+// GetProficiencyHistory returns the proficiency changes of a user on a selected instrument,
+// oldest first, or their aggregation by day or week. The query must already have been validated.
+func GetProficiencyHistory(db *sql.DB, userID int, q ProficiencyHistoryQuery) (ProficiencyHistory, error) {
+	instrument, err := resolveInstrument(db, userID, q.Instrument)
+	if err != nil {
+		return ProficiencyHistory{}, err
+	}
+	if _, err := GetProficiency(db, userID, instrument); err != nil {
+		return ProficiencyHistory{}, err
+	}
+	history := ProficiencyHistory{Instrument: instrument, Group: q.Group, Entries: []ProficiencyHistoryEntry{}, Periods: []ProficiencyPeriod{}}
+
+	where := []string{"h.user_id = ?", "h.instrument = ?"}
+	args := []any{userID, instrument}
+	if !q.from.IsZero() {
+		where = append(where, "h.recorded_at >= ?")
+		args = append(args, q.from)
+	}
+	if !q.to.IsZero() {
+		where = append(where, "h.recorded_at < ?")
+		args = append(args, q.to)
+	}
+	if q.Source != "" {
+		where = append(where, "h.source = ?")
+		args = append(args, q.Source)
+	}
+	query := `
+		SELECT h.id, h.proficiency, h.previous, h.source, h.music_id, COALESCE(m.title, ''), h.measure, h.difficulty, h.recorded_at
+		FROM ProficiencyHistory h LEFT JOIN Music m ON m.id = h.music_id
+		WHERE ` + strings.Join(where, " AND ")
+	if q.Group == "" {
+		// The latest changes, put back in chronological order below
+		query += " ORDER BY h.recorded_at DESC, h.id DESC LIMIT ?"
+		args = append(args, q.Limit)
+	} else {
+		query += " ORDER BY h.recorded_at, h.id"
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return history, fmt.Errorf("failed to query proficiency history on %s: %w", instrument, err)
+	}
+	defer rows.Close()
+	entries := []ProficiencyHistoryEntry{}
+	for rows.Next() {
+		e := ProficiencyHistoryEntry{Instrument: instrument}
+		var musicID, measure, difficulty sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Proficiency, &e.Previous, &e.Source, &musicID, &e.Title, &measure, &difficulty, &e.RecordedAt); err != nil {
+			return history, fmt.Errorf("failed to scan proficiency history: %w", err)
+		}
+		e.MusicID, e.Measure, e.Difficulty = nullIntPtr(musicID), nullIntPtr(measure), nullIntPtr(difficulty)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return history, fmt.Errorf("error iterating proficiency history: %w", err)
+	}
+
+	if q.Group == "" {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		history.Entries = entries
+		return history, nil
+	}
+	history.TimeZone = q.location.String()
+	history.Periods = aggregateProficiency(entries, q.Group, q.location)
+	return history, nil
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// aggregateProficiency groups chronological changes by day or week (starting on Monday) in loc.
+func aggregateProficiency(entries []ProficiencyHistoryEntry, group string, loc *time.Location) []ProficiencyPeriod {
+	periods := []ProficiencyPeriod{}
+	var sum float64
+	for _, e := range entries {
+		t := e.RecordedAt.In(loc)
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if group == "week" {
+			start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+		}
+		if n := len(periods); n == 0 || !periods[n-1].Start.Equal(start) {
+			if n > 0 {
+				periods[n-1].Average = sum / float64(periods[n-1].Count)
+			}
+			periods = append(periods, ProficiencyPeriod{
+				Start: start, Open: e.Previous, Min: e.Proficiency, Max: e.Proficiency, Sources: map[string]int{},
+			})
+			sum = 0
+		}
+		p := &periods[len(periods)-1]
+		p.Close = e.Proficiency
+		p.Min = min(p.Min, e.Proficiency)
+		p.Max = max(p.Max, e.Proficiency)
+		p.Count++
+		p.Sources[e.Source]++
+		sum += e.Proficiency
+	}
+	if n := len(periods); n > 0 {
+		periods[n-1].Average = sum / float64(periods[n-1].Count)
+	}
+	return periods
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"infosystem-musicapp/musicxml"
+)
+
+const (
+	defaultQuickAccessLimit = 10
+	maxQuickAccessLimit     = 50
+	// inProgressBonus raises music practiced part of the way, and lowers finished music, in quick access.
+	inProgressBonus = 0.5
+)
+
+// QuickAccessItem is a music to continue practicing, with where to resume it.
+type QuickAccessItem struct {
+	DisplayMusic
+	Instrument    string    `json:"instrument,omitempty"`    // Instrument of the sheet last practiced (omitted when only opened)
+	Part          string    `json:"part,omitempty"`          // Part of that sheet (omitted for the unnamed part)
+	Difficulty    int       `json:"difficulty,omitempty"`    // Sheet difficulty last practiced (omitted when only opened)
+	LastMeasure   int       `json:"last_measure,omitempty"`  // Measure number last practiced
+	MeasureCount  int       `json:"measure_count,omitempty"` // Number of measures of that sheet
+	Progress      float64   `json:"progress"`                // Share of the sheet practiced so far (0-1)
+	ResumeMeasure int       `json:"resume_measure"`          // Measure to start from: the last one, or 1 once finished
+	LastActivity  time.Time `json:"last_activity"`           // When the music was last opened or practiced
+}
+
+// setupPracticeProgress creates the PracticeProgress table, which keeps the last measure
+// practiced through /calc_proficiency for each music (and since migration 12, for each part).
+func setupPracticeProgress(db execer) error {
+	cmd := `CREATE TABLE IF NOT EXISTS PracticeProgress (
+		music_id INTEGER PRIMARY KEY,
+		difficulty INTEGER NOT NULL,
+		last_measure INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		measure_count INTEGER NOT NULL,
+		practiced_at DATETIME NOT NULL,
+		FOREIGN KEY (music_id) REFERENCES Music(id)
+	)`
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create PracticeProgress table: %w", err)
+	}
+	return nil
+}
+
+// addProgressParts keys the practice progress by instrument and part as well, so that every
+// part of a music keeps its own progress. Existing progress belongs to the first part of the
+// default instrument, as only those sheets could be practiced before.
+func addProgressParts(db execer) error {
+	return execAll(
+		`CREATE TABLE PracticeProgress_new (
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			part TEXT NOT NULL DEFAULT '',
+			difficulty INTEGER NOT NULL,
+			last_measure INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			measure_count INTEGER NOT NULL,
+			practiced_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, music_id, instrument, part),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		`INSERT INTO PracticeProgress_new (user_id, music_id, instrument, part, difficulty, last_measure, position, measure_count, practiced_at)
+			SELECT p.user_id, p.music_id, '`+defaultInstrument+`',
+				COALESCE((SELECT s.part FROM Sheets s WHERE s.music_id = p.music_id AND s.instrument = '`+defaultInstrument+`' ORDER BY s.part LIMIT 1), ''),
+				p.difficulty, p.last_measure, p.position, p.measure_count, p.practiced_at
+			FROM PracticeProgress p`,
+		"DROP TABLE PracticeProgress",
+		"ALTER TABLE PracticeProgress_new RENAME TO PracticeProgress",
+	)(db)
+}
+
+// dropProgressParts is the down step of addProgressParts. Of the parts of a music, only the
+// one practiced last keeps its progress.
+func dropProgressParts(db execer) error {
+	return execAll(
+		`CREATE TABLE PracticeProgress_old (
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			last_measure INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			measure_count INTEGER NOT NULL,
+			practiced_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, music_id),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		`INSERT INTO PracticeProgress_old (user_id, music_id, difficulty, last_measure, position, measure_count, practiced_at)
+			SELECT user_id, music_id, difficulty, last_measure, position, measure_count, practiced_at FROM (
+				SELECT *, ROW_NUMBER() OVER (PARTITION BY user_id, music_id ORDER BY practiced_at DESC) AS latest
+				FROM PracticeProgress
+			) WHERE latest = 1`,
+		"DROP TABLE PracticeProgress",
+		"ALTER TABLE PracticeProgress_old RENAME TO PracticeProgress",
+	)(db)
+}
+
+// RecordPracticeProgress stores the measure of a sheet a user has just practiced, for the
+// instrument and part of the sheet.
+func RecordPracticeProgress(db *sql.DB, userID, musicID int, sheetPart SheetPart, difficulty, measure int) error {
+	sheetPart, err := resolveSheetPart(db, musicID, sheetPart)
+	if err != nil {
+		return err
+	}
+	sheet, err := GetSheet(db, musicID, sheetPart, difficulty)
+	if err != nil {
+		return err
+	}
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return fmt.Errorf("failed to parse sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	part := score.Parts[0]
+	m, ok := part.MeasureByNumber(strconv.Itoa(measure))
+	if !ok {
+		return ErrMeasureNotFound
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO PracticeProgress (user_id, music_id, instrument, part, difficulty, last_measure, position, measure_count, practiced_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, music_id, instrument, part) DO UPDATE SET
+			difficulty = excluded.difficulty, last_measure = excluded.last_measure, position = excluded.position,
+			measure_count = excluded.measure_count, practiced_at = excluded.practiced_at`,
+		userID, musicID, sheetPart.Instrument, sheetPart.Part, difficulty, measure, m.Index+1, len(part.Measures), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record practice progress for music_id %d: %w", musicID, err)
+	}
+	return nil
+}
+
+// GetQuickAccess ranks the music a user recently opened or practiced. Recent activity
+// ranks first, and music practiced part of the way is preferred to finished music. Of the
+// parts of a music, the one practiced last is resumed.
+func GetQuickAccess(db *sql.DB, userID, limit int) ([]QuickAccessItem, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.title, COALESCE(m.artist, ''), COALESCE(m.thumbnail, ''), v.viewed_at,
+			p.instrument, p.part, p.difficulty, p.last_measure, p.position, p.measure_count, p.practiced_at
+		FROM Music m
+		LEFT JOIN ViewHistory v ON v.music_id = m.id AND v.user_id = ?1
+		LEFT JOIN (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY music_id ORDER BY practiced_at DESC) AS latest
+			FROM PracticeProgress WHERE user_id = ?1
+		) p ON p.music_id = m.id AND p.latest = 1
+		WHERE v.music_id IS NOT NULL OR p.music_id IS NOT NULL`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent music: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	type rankedItem struct {
+		item  QuickAccessItem
+		score float64
+	}
+	var ranked []rankedItem
+	for rows.Next() {
+		var item QuickAccessItem
+		var viewedAt, practicedAt sql.NullTime
+		var instrument, part sql.NullString
+		var difficulty, lastMeasure, position, measureCount sql.NullInt64
+		if err := rows.Scan(&item.MusicID, &item.Title, &item.Artist, &item.Thumbnail, &viewedAt,
+			&instrument, &part, &difficulty, &lastMeasure, &position, &measureCount, &practicedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan recent music: %w", err)
+		}
+		item.ThumbnailURL = cachedImagePath(item.Thumbnail)
+
+		item.ResumeMeasure = 1
+		if viewedAt.Valid {
+			item.LastActivity = viewedAt.Time
+		}
+		if practicedAt.Valid {
+			if practicedAt.Time.After(item.LastActivity) {
+				item.LastActivity = practicedAt.Time
+			}
+			item.Instrument, item.Part = instrument.String, part.String
+			item.Difficulty = int(difficulty.Int64)
+			item.LastMeasure = int(lastMeasure.Int64)
+			item.MeasureCount = int(measureCount.Int64)
+			if item.MeasureCount > 0 {
+				item.Progress = min(1, float64(position.Int64)/float64(item.MeasureCount))
+			}
+			if item.Progress < 1 {
+				item.ResumeMeasure = item.LastMeasure
+			}
+		}
+
+		// Recency decays over days (1 now, 1/2 a day ago, 1/3 two days ago, ...)
+		score := 1 / (1 + now.Sub(item.LastActivity).Hours()/24)
+		switch {
+		case item.Progress >= 1:
+			score -= inProgressBonus
+		case item.Progress > 0:
+			score += inProgressBonus
+		}
+		ranked = append(ranked, rankedItem{item, score})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating recent music: %w", err)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].item.LastActivity.After(ranked[j].item.LastActivity)
+	})
+	items := []QuickAccessItem{}
+	for _, r := range ranked[:min(limit, len(ranked))] {
+		items = append(items, r.item)
+	}
+	return items, nil
+}
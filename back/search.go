@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"infosystem-musicapp/musicxml"
+)
+
+const (
+	defaultSearchLimit          = 20
+	maxSearchLimit              = 100
+	defaultProficiencyTolerance = 1
+	defaultSearchSort           = "title"
+	// defaultTextSearchSort is the default order when the query has a text search.
+	defaultTextSearchSort = "relevance"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// searchSortKeys maps the sort names accepted by /search to their SQL expressions.
+// Every order is completed by the music ID so that cursors are stable.
+var searchSortKeys = map[string]string{
+	"title":      "title COLLATE NOCASE",
+	"artist":     "COALESCE(artist, '') COLLATE NOCASE",
+	"difficulty": "COALESCE(base_difficulty, 0)",
+	"added":      "id",
+	"tempo":      "COALESCE(tempo, 0)",
+	"duration":   "COALESCE(duration_seconds, 0)",
+	"relevance":  "hits.score", // Only with a text search; other queries fall back to title
+}
+
+// SearchQuery is the request body of /search. All filters are optional and combined with AND.
+type SearchQuery struct {
+	TextSearch      string   `json:"text_search"`      // Matches title, artist or reading (see normalizeSearchText)
+	Artist          string   `json:"artist"`           // Exact artist, ignoring case
+	MinDifficulty   *int     `json:"min_difficulty"`   // Lowest base_difficulty
+	MaxDifficulty   *int     `json:"max_difficulty"`   // Highest base_difficulty
+	Genres          []string `json:"genres"`           // Slugs or localized names; any of them matches
+	HasSheet        *int     `json:"has_sheet"`        // Only music with a sheet at this difficulty
+	FitsProficiency bool     `json:"fits_proficiency"` // Only music within tolerance of the user's proficiency, with a sheet for the instrument
+	// ProficiencyTolerance is the allowed distance from the rounded proficiency (default 1).
+	ProficiencyTolerance *int `json:"proficiency_tolerance"`
+	// Instrument is the instrument of fits_proficiency (the current one if empty).
+	Instrument string `json:"instrument"`
+
+	// Musical metadata of the reference sheet (see SongMetadata)
+	MinTempo       *float64 `json:"min_tempo"`       // Lowest BPM
+	MaxTempo       *float64 `json:"max_tempo"`       // Highest BPM
+	Keys           []string `json:"keys"`            // Key names such as "G" or "Em"; any of them matches
+	TimeSignatures []string `json:"time_signatures"` // Such as "3/4"; any of them matches
+	MinDuration    *float64 `json:"min_duration"`    // Shortest duration in seconds
+	MaxDuration    *float64 `json:"max_duration"`    // Longest duration in seconds
+	MinMeasures    *int     `json:"min_measures"`
+	MaxMeasures    *int     `json:"max_measures"`
+	// LowestPitch and HighestPitch, such as "E2", bound the pitch range: only music whose notes
+	// all lie between them matches, e.g. to fit the range of a voice or an instrument.
+	LowestPitch  string   `json:"lowest_pitch"`
+	HighestPitch string   `json:"highest_pitch"`
+	Instruments  []string `json:"instruments"` // Only music with a sheet for any of these instruments
+
+	lowestMIDI, highestMIDI *int // Parsed LowestPitch and HighestPitch
+	userID                  int  // The user of fits_proficiency, set by the handler
+
+	// Sort is one of "relevance", "title", "artist", "difficulty", "added", "tempo" or "duration",
+	// prefixed by "-" for descending order. It defaults to relevance for a text search and to title otherwise.
+	Sort   string `json:"sort"`
+	Limit  int    `json:"limit"`  // Page size (default 20, at most 100)
+	Cursor string `json:"cursor"` // next_cursor of the previous page
+
+	// Legacy category search: search_category selects which of the fields below is used.
+	SearchCategory *SearchCategory `json:"search_category"`
+	DiffSearch     *int            `json:"diff_search"`
+	GenreSearch    string          `json:"genre_search"`
+}
+
+// SearchResult is one page of search results.
+type SearchResult struct {
+	Items      []DisplayMusic `json:"items"`
+	Total      int            `json:"total"`                 // Number of matches across all pages
+	NextCursor string         `json:"next_cursor,omitempty"` // Empty on the last page
+	// Fuzzy is set when a text search found too few exact matches and was completed by similar ones,
+	// ranked by similarity after the exact matches. Such results are not paginated.
+	Fuzzy      bool   `json:"fuzzy,omitempty"`
+	DidYouMean string `json:"did_you_mean,omitempty"` // Closest title or artist to a misspelled text search
+}
+
+// searchCursor is the position after the last item of a page, for keyset pagination.
+type searchCursor struct {
+	Sort    string `json:"s"`
+	Value   any    `json:"v"`
+	MusicID int    `json:"id"`
+}
+
+func (c searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Validate applies the legacy category fields and defaults, and checks the filters.
+func (q *SearchQuery) Validate() error {
+	if q.SearchCategory != nil {
+		switch *q.SearchCategory {
+		case DiffSearch:
+			if q.DiffSearch == nil {
+				return errors.New("'diff_search' is required for DiffSearch")
+			}
+			q.MinDifficulty, q.MaxDifficulty = q.DiffSearch, q.DiffSearch
+		case GenreSearch:
+			if strings.TrimSpace(q.GenreSearch) == "" {
+				return errors.New("'genre_search' is required for GenreSearch")
+			}
+			q.Genres = append(q.Genres, q.GenreSearch)
+		}
+	}
+
+	if q.MinDifficulty != nil && q.MaxDifficulty != nil && *q.MinDifficulty > *q.MaxDifficulty {
+		return errors.New("'min_difficulty' must not be greater than 'max_difficulty'")
+	}
+	if q.HasSheet != nil && !isValidSheetDifficulty(*q.HasSheet) {
+		return fmt.Errorf("'has_sheet' must be between %d and %d", minSheetDifficulty, maxSheetDifficulty)
+	}
+	if q.ProficiencyTolerance != nil && *q.ProficiencyTolerance < 0 {
+		return errors.New("'proficiency_tolerance' must not be negative")
+	}
+	if err := q.validateMetadata(); err != nil {
+		return err
+	}
+
+	if q.Sort == "" {
+		q.Sort = defaultSearchSort
+		if strings.TrimSpace(q.TextSearch) != "" {
+			q.Sort = defaultTextSearchSort
+		}
+	}
+	if _, ok := searchSortKeys[strings.TrimPrefix(q.Sort, "-")]; !ok {
+		return fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	switch {
+	case q.Limit < 0:
+		return errors.New("'limit' must not be negative")
+	case q.Limit == 0:
+		q.Limit = defaultSearchLimit
+	case q.Limit > maxSearchLimit:
+		q.Limit = maxSearchLimit
+	}
+	return nil
+}
+
+// validateMetadata checks the metadata filters and normalizes keys, time signatures and instruments
+// to their stored form.
+func (q *SearchQuery) validateMetadata() error {
+	if q.MinTempo != nil && q.MaxTempo != nil && *q.MinTempo > *q.MaxTempo {
+		return errors.New("'min_tempo' must not be greater than 'max_tempo'")
+	}
+	if q.MinDuration != nil && q.MaxDuration != nil && *q.MinDuration > *q.MaxDuration {
+		return errors.New("'min_duration' must not be greater than 'max_duration'")
+	}
+	if q.MinMeasures != nil && q.MaxMeasures != nil && *q.MinMeasures > *q.MaxMeasures {
+		return errors.New("'min_measures' must not be greater than 'max_measures'")
+	}
+	for i, name := range q.Keys {
+		key, err := musicxml.ParseKeyName(name)
+		if err != nil {
+			return fmt.Errorf("invalid key %q in 'keys'", name)
+		}
+		q.Keys[i] = key.Name()
+	}
+	for i, ts := range q.TimeSignatures {
+		var beats, beatType int
+		if n, err := fmt.Sscanf(strings.TrimSpace(ts), "%d/%d", &beats, &beatType); err != nil || n != 2 || beats <= 0 || beatType <= 0 {
+			return fmt.Errorf("invalid time signature %q in 'time_signatures'", ts)
+		}
+		q.TimeSignatures[i] = fmt.Sprintf("%d/%d", beats, beatType)
+	}
+	for i, instrument := range q.Instruments {
+		q.Instruments[i] = strings.ToLower(strings.TrimSpace(instrument))
+	}
+	for _, bound := range []struct {
+		field, pitch string
+		midi         **int
+	}{{"lowest_pitch", q.LowestPitch, &q.lowestMIDI}, {"highest_pitch", q.HighestPitch, &q.highestMIDI}} {
+		if bound.pitch == "" {
+			continue
+		}
+		p, err := musicxml.ParsePitch(bound.pitch)
+		if err != nil {
+			return fmt.Errorf("'%s' must be a pitch such as \"E2\" or \"C#5\"", bound.field)
+		}
+		midi := p.MIDI()
+		*bound.midi = &midi
+	}
+	if q.lowestMIDI != nil && q.highestMIDI != nil && *q.lowestMIDI > *q.highestMIDI {
+		return errors.New("'lowest_pitch' must not be higher than 'highest_pitch'")
+	}
+	return nil
+}
+
+// likePattern returns a LIKE pattern matching s anywhere, with its wildcards escaped by '\'.
+func likePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(s) + "%"
+}
+
+// searchClauses is the FROM clause and the WHERE conditions of a search, with their arguments in order.
+type searchClauses struct {
+	from   string
+	where  []string
+	args   []any
+	ranked bool // A text search joined its matches as "hits"
+}
+
+func (c searchClauses) sql() string {
+	if len(c.where) == 0 {
+		return c.from
+	}
+	return c.from + " WHERE " + strings.Join(c.where, " AND ")
+}
+
+// searchFilters builds the clauses of a validated query.
+func searchFilters(db *sql.DB, q SearchQuery) (searchClauses, error) {
+	c := searchClauses{from: " FROM Music"}
+	if hits, args := textSearchJoin(q.TextSearch); hits != "" {
+		c.from += " JOIN (" + hits + ") AS hits ON hits.music_id = Music.id"
+		c.args = append(c.args, args...)
+		c.ranked = true
+	}
+	if artist := strings.TrimSpace(q.Artist); artist != "" {
+		c.where = append(c.where, "artist = ? COLLATE NOCASE")
+		c.args = append(c.args, artist)
+	}
+	if q.MinDifficulty != nil {
+		c.where = append(c.where, "base_difficulty >= ?")
+		c.args = append(c.args, *q.MinDifficulty)
+	}
+	if q.MaxDifficulty != nil {
+		c.where = append(c.where, "base_difficulty <= ?")
+		c.args = append(c.args, *q.MaxDifficulty)
+	}
+	if len(q.Genres) > 0 {
+		ids, err := resolveGenreIDs(db, q.Genres)
+		if err != nil {
+			return c, err
+		}
+		c.where = append(c.where, "id IN (SELECT music_id FROM MusicGenres WHERE genre_id IN ("+inPlaceholders(len(ids))+"))")
+		for _, id := range ids {
+			c.args = append(c.args, id)
+		}
+	}
+	if q.HasSheet != nil {
+		c.where = append(c.where, "EXISTS (SELECT 1 FROM Sheets WHERE Sheets.music_id = Music.id AND Sheets.difficulty = ?)")
+		c.args = append(c.args, *q.HasSheet)
+	}
+	c.addMetadataFilters(q)
+	if q.FitsProficiency {
+		instrument, err := resolveInstrument(db, q.userID, q.Instrument)
+		if err != nil {
+			return c, err
+		}
+		proficiency, err := GetProficiency(db, q.userID, instrument)
+		if err != nil {
+			return c, err
+		}
+		tolerance := defaultProficiencyTolerance
+		if q.ProficiencyTolerance != nil {
+			tolerance = *q.ProficiencyTolerance
+		}
+		// Same range as /recommendations/proficiency.
+		rounded := int(math.Round(proficiency))
+		c.where = append(c.where, "base_difficulty BETWEEN ? AND ?",
+			"EXISTS (SELECT 1 FROM Sheets WHERE Sheets.music_id = Music.id AND Sheets.instrument = ?)")
+		c.args = append(c.args, rounded-tolerance, rounded+tolerance, instrument)
+	}
+	return c, nil
+}
+
+// inPlaceholders returns the placeholders of an IN list of n values.
+func inPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// addMetadataFilters adds the conditions on the musical metadata of a validated query.
+func (c *searchClauses) addMetadataFilters(q SearchQuery) {
+	ranges := []struct {
+		column string
+		op     string
+		value  any
+		isSet  bool
+	}{
+		{"tempo", ">=", q.MinTempo, q.MinTempo != nil},
+		{"tempo", "<=", q.MaxTempo, q.MaxTempo != nil},
+		{"duration_seconds", ">=", q.MinDuration, q.MinDuration != nil},
+		{"duration_seconds", "<=", q.MaxDuration, q.MaxDuration != nil},
+		{"measure_count", ">=", q.MinMeasures, q.MinMeasures != nil},
+		{"measure_count", "<=", q.MaxMeasures, q.MaxMeasures != nil},
+		{"lowest_pitch", ">=", q.lowestMIDI, q.lowestMIDI != nil},
+		{"highest_pitch", "<=", q.highestMIDI, q.highestMIDI != nil},
+	}
+	for _, r := range ranges {
+		if r.isSet {
+			c.where = append(c.where, fmt.Sprintf("Music.%s %s ?", r.column, r.op))
+			c.args = append(c.args, r.value)
+		}
+	}
+	if len(q.Keys) > 0 {
+		c.where = append(c.where, "Music.key_name IN ("+inPlaceholders(len(q.Keys))+")")
+		for _, k := range q.Keys {
+			c.args = append(c.args, k)
+		}
+	}
+	if len(q.TimeSignatures) > 0 {
+		c.where = append(c.where, "Music.time_signature IN ("+inPlaceholders(len(q.TimeSignatures))+")")
+		for _, ts := range q.TimeSignatures {
+			c.args = append(c.args, ts)
+		}
+	}
+	if len(q.Instruments) > 0 {
+		c.where = append(c.where, "EXISTS (SELECT 1 FROM Sheets WHERE Sheets.music_id = Music.id AND Sheets.instrument IN ("+
+			inPlaceholders(len(q.Instruments))+"))")
+		for _, instrument := range q.Instruments {
+			c.args = append(c.args, instrument)
+		}
+	}
+}
+
+// SearchMusic returns one page of the music matching a validated query, with the total number of matches.
+func SearchMusic(db *sql.DB, q SearchQuery) (SearchResult, error) {
+	result := SearchResult{Items: []DisplayMusic{}}
+
+	clauses, err := searchFilters(db, q)
+	if err != nil {
+		return result, err
+	}
+	if err := db.QueryRow("SELECT COUNT(*)"+clauses.sql(), clauses.args...).Scan(&result.Total); err != nil {
+		return result, fmt.Errorf("failed to count search results: %w", err)
+	}
+
+	sortName := strings.TrimPrefix(q.Sort, "-")
+	if sortName == "relevance" && !clauses.ranked {
+		sortName = defaultSearchSort
+	}
+	key := searchSortKeys[sortName]
+	direction, after := "ASC", ">"
+	if strings.HasPrefix(q.Sort, "-") {
+		direction, after = "DESC", "<"
+	}
+
+	page := clauses
+	if q.Cursor != "" {
+		c, err := decodeSearchCursor(q.Cursor)
+		if err != nil {
+			return result, err
+		}
+		if c.Sort != q.Sort {
+			return result, fmt.Errorf("%w: it was issued for sort %q", ErrInvalidCursor, c.Sort)
+		}
+		page.where = append(slices.Clip(page.where), fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", key, after))
+		page.args = append(slices.Clip(page.args), c.Value, c.Value, c.MusicID)
+	}
+
+	query := fmt.Sprintf("SELECT id, title, artist, thumbnail, %[1]s%[2]s ORDER BY %[1]s %[3]s, id %[3]s LIMIT ?",
+		key, page.sql(), direction)
+	// One extra row tells whether there is a next page.
+	rows, err := db.Query(query, append(slices.Clip(page.args), q.Limit+1)...)
+	if err != nil {
+		return result, fmt.Errorf("failed to execute search query: %w", err)
+	}
+	defer rows.Close()
+
+	var last any
+	for rows.Next() {
+		var dm DisplayMusic
+		var artist, thumbnail sql.NullString
+		var sortValue any
+		if err := rows.Scan(&dm.MusicID, &dm.Title, &artist, &thumbnail, &sortValue); err != nil {
+			return result, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		if len(result.Items) == q.Limit {
+			result.NextCursor = searchCursor{Sort: q.Sort, Value: last, MusicID: result.Items[len(result.Items)-1].MusicID}.encode()
+			break
+		}
+		dm.Artist, dm.Thumbnail = artist.String, thumbnail.String
+		dm.ThumbnailURL = cachedImagePath(dm.Thumbnail)
+		result.Items = append(result.Items, dm)
+		last = sortValue
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating search results: %w", err)
+	}
+
+	if clauses.ranked && q.Cursor == "" && result.Total < fuzzyMinExactResults {
+		return addFuzzyMatches(db, q, result)
+	}
+	return result, nil
+}
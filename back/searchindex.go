@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// searchUsesFTS tells whether MusicSearch is an FTS5 index. The backend has to be built with
+// "-tags sqlite_fts5" for it; otherwise MusicSearch is a plain table of the same normalized
+// text, searched with LIKE and without relevance ranking.
+var searchUsesFTS bool
+
+// minFTSQueryLength is the shortest search term the trigram tokenizer can match.
+const minFTSQueryLength = 3
+
+// setupSearchIndex creates the MusicSearch table, which holds the normalized title, artist and
+// reading of every music (rowid = Music.id), and fills it when it is out of date.
+func setupSearchIndex(db *sql.DB) error {
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&searchUsesFTS); err != nil {
+		return fmt.Errorf("failed to check FTS5 support: %w", err)
+	}
+	if searchUsesFTS {
+		log.Printf("Search index: FTS5 with the trigram tokenizer")
+	} else {
+		log.Printf("Warning: SQLite was built without FTS5 (build with -tags sqlite_fts5); search falls back to LIKE")
+	}
+
+	var ddl string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'MusicSearch'").Scan(&ddl)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return fmt.Errorf("failed to look up MusicSearch table: %w", err)
+	case strings.Contains(strings.ToLower(ddl), "fts5") != searchUsesFTS:
+		// The database was last opened by a build with the other kind of index.
+		if _, err := db.Exec("DROP TABLE MusicSearch"); err != nil {
+			return fmt.Errorf("failed to drop outdated MusicSearch table: %w", err)
+		}
+	}
+
+	cmd := `CREATE TABLE IF NOT EXISTS MusicSearch (title TEXT, artist TEXT, reading TEXT)`
+	if searchUsesFTS {
+		cmd = `CREATE VIRTUAL TABLE IF NOT EXISTS MusicSearch USING fts5(title, artist, reading, tokenize = 'trigram')`
+	}
+	if _, err := db.Exec(cmd); err != nil {
+		return fmt.Errorf("failed to create MusicSearch table: %w", err)
+	}
+
+	var indexed, music int
+	if err := db.QueryRow("SELECT (SELECT COUNT(*) FROM MusicSearch), (SELECT COUNT(*) FROM Music)").Scan(&indexed, &music); err != nil {
+		return fmt.Errorf("failed to count indexed music: %w", err)
+	}
+	if indexed != music {
+		return rebuildSearchIndex(db)
+	}
+	return nil
+}
+
+// rebuildSearchIndex re-indexes the whole catalog.
+func rebuildSearchIndex(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for rebuilding the search index: %w", err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.Exec("DELETE FROM MusicSearch"); err != nil {
+		return fmt.Errorf("failed to clear the search index: %w", err)
+	}
+	rows, err := tx.Query("SELECT id, title, COALESCE(artist, ''), COALESCE(reading, '') FROM Music")
+	if err != nil {
+		return fmt.Errorf("failed to query music for the search index: %w", err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var id int
+		var title, artist, reading string
+		if err := rows.Scan(&id, &title, &artist, &reading); err != nil {
+			return fmt.Errorf("failed to scan music for the search index: %w", err)
+		}
+		if err := insertSearchEntry(tx, id, title, artist, reading); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating music for the search index: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit the search index: %w", err)
+	}
+	successfulCommit = true
+	log.Printf("Rebuilt the search index of %d music", count)
+	return nil
+}
+
+// renormalizeSearchText is the up step of a migration changing normalizeSearchText: the search
+// index is dropped, so that setupSearchIndex rebuilds it, and the query history is normalized again.
+func renormalizeSearchText(db execer) error {
+	if _, err := db.Exec("DROP TABLE IF EXISTS MusicSearch"); err != nil {
+		return fmt.Errorf("failed to drop MusicSearch table: %w", err)
+	}
+
+	rows, err := db.Query("SELECT id, query FROM QueryHistory")
+	if err != nil {
+		return fmt.Errorf("failed to query the query history: %w", err)
+	}
+	queries := map[int]string{}
+	for rows.Next() {
+		var id int
+		var query string
+		if err := rows.Scan(&id, &query); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan the query history: %w", err)
+		}
+		queries[id] = query
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating the query history: %w", err)
+	}
+	for id, query := range queries {
+		normalized := strings.Join(strings.Fields(normalizeSearchText(query)), " ")
+		if _, err := db.Exec("UPDATE QueryHistory SET normalized = ? WHERE id = ?", normalized, id); err != nil {
+			return fmt.Errorf("failed to normalize query history entry %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// indexMusic updates the search index entry of a music from its current row.
+func indexMusic(db execer, musicID int) error {
+	var title, artist, reading string
+	err := db.QueryRow("SELECT title, COALESCE(artist, ''), COALESCE(reading, '') FROM Music WHERE id = ?", musicID).
+		Scan(&title, &artist, &reading)
+	if err != nil {
+		return fmt.Errorf("failed to read music_id %d for the search index: %w", musicID, err)
+	}
+	if err := unindexMusic(db, musicID); err != nil {
+		return err
+	}
+	return insertSearchEntry(db, musicID, title, artist, reading)
+}
+
+// unindexMusic removes a music from the search index.
+func unindexMusic(db execer, musicID int) error {
+	if _, err := db.Exec("DELETE FROM MusicSearch WHERE rowid = ?", musicID); err != nil {
+		return fmt.Errorf("failed to remove music_id %d from the search index: %w", musicID, err)
+	}
+	return nil
+}
+
+func insertSearchEntry(db execer, musicID int, title, artist, reading string) error {
+	_, err := db.Exec("INSERT INTO MusicSearch (rowid, title, artist, reading) VALUES (?, ?, ?, ?)",
+		musicID, normalizeSearchText(title), normalizeSearchText(artist), normalizeSearchText(reading))
+	if err != nil {
+		return fmt.Errorf("failed to index music_id %d: %w", musicID, err)
+	}
+	return nil
+}
+
+// textSearchJoin returns a subquery of the music matching every word of a text search,
+// with a "score" column to sort by relevance (lower is better), or "" when the text has no words.
+// Words long enough for the trigram index are matched with FTS5 and ranked by bm25,
+// where a hit in the title weighs most; shorter words and builds without FTS5 use LIKE.
+func textSearchJoin(text string) (string, []any) {
+	var conds, phrases []string
+	var args []any
+	for _, word := range strings.Fields(normalizeSearchText(text)) {
+		if searchUsesFTS && utf8.RuneCountInString(word) >= minFTSQueryLength {
+			phrases = append(phrases, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+			continue
+		}
+		conds = append(conds, `(title LIKE ? ESCAPE '\' OR artist LIKE ? ESCAPE '\' OR reading LIKE ? ESCAPE '\')`)
+		args = append(args, likePattern(word), likePattern(word), likePattern(word))
+	}
+	if len(phrases) == 0 && len(conds) == 0 {
+		return "", nil
+	}
+
+	score := "0"
+	if len(phrases) > 0 {
+		score = "bm25(MusicSearch, 10.0, 4.0, 8.0)"
+		conds = append([]string{"MusicSearch MATCH ?"}, conds...)
+		args = append([]any{strings.Join(phrases, " ")}, args...)
+	}
+	return fmt.Sprintf("SELECT rowid AS music_id, %s AS score FROM MusicSearch WHERE %s", score, strings.Join(conds, " AND ")), args
+}
@@ -0,0 +1,83 @@
+//go:build sqlite_fts5
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestTextSearchFTS runs text searches on the FTS5 index, which only exists in builds
+// with -tags sqlite_fts5; other builds search the same normalized text with LIKE.
+func TestTextSearchFTS(t *testing.T) {
+	db := openTestDB(t)
+	if !searchUsesFTS {
+		t.Fatal("built with sqlite_fts5, but the search index is not an FTS5 table")
+	}
+	var ddl string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'MusicSearch'").Scan(&ddl); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ddl, "trigram") {
+		t.Fatalf("MusicSearch = %s, want an FTS5 table with the trigram tokenizer", ddl)
+	}
+
+	for _, m := range []struct{ title, artist, reading string }{
+		{"アイドル", "YOASOBI", "あいどる"},
+		{"夜に駆ける", "YOASOBI", "よるにかける"},
+		{"Idol Song", "Aidoru Band", ""},
+		{"禁煙", "Artist", "きんえん"},
+		{"記念", "Artist", "きねん"},
+	} {
+		id := insertTestMusic(t, db, m.title)
+		if _, err := db.Exec("UPDATE Music SET artist = ?, reading = ? WHERE id = ?", m.artist, m.reading, id); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexMusic(db, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want []string // titles, best first (a hit in the title ranks first)
+	}{
+		{"katakana typed in romaji", "aidoru", []string{"アイドル", "Idol Song"}},
+		{"half-width katakana", "ｱｲﾄﾞﾙ", []string{"アイドル", "Idol Song"}},
+		{"part of a word", "oasob", []string{"アイドル", "夜に駆ける"}},
+		{"reading in hiragana", "よるに", []string{"夜に駆ける"}},
+		{"every word must match", "yoasobi yoru", []string{"夜に駆ける"}},
+		{"word shorter than a trigram", "yoasobi ni", []string{"夜に駆ける"}},
+		{"ん before a vowel", "kin'en", []string{"禁煙"}},
+		{"ね after ki", "kinen", []string{"記念"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, args := textSearchJoin(tt.text)
+			if !strings.Contains(hits, "MusicSearch MATCH ?") {
+				t.Fatalf("textSearchJoin(%q) does not use the FTS5 index: %s", tt.text, hits)
+			}
+			rows, err := db.Query("SELECT Music.title FROM ("+hits+") AS hits JOIN Music ON Music.id = hits.music_id ORDER BY hits.score, Music.id", args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var titles []string
+			for rows.Next() {
+				var title string
+				if err := rows.Scan(&title); err != nil {
+					t.Fatal(err)
+				}
+				titles = append(titles, title)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("search %q = %v, want %v", tt.text, titles, tt.want)
+			}
+		})
+	}
+}
@@ -5,17 +5,15 @@
  * recommendation API is no longer publicly available. Instead, we fetch the user's
  * recently played tracks and randomly select from them to create a simple recommendation
  * system. The randomization provides variety while still being personalized to the user's
- * listening history.
+ * listening history. The tokens of the users are managed by spotifyauth.go.
  */
 
 package main
 
 import (
-	"encoding/json"
+	"database/sql"
 	"fmt"
-	"io"
 	"math/rand"
-	"net/http"
 	"time"
 )
 
@@ -47,14 +45,16 @@ type RecommendedTrack struct {
 	Artist   string `json:"artist"`
 	Album    string `json:"album"`
 	ImageURL string `json:"image_url"`
+	// CachedImageURL is the path of the album art in the local cache ("/images/<id>")
+	CachedImageURL string `json:"cached_image_url,omitempty"`
 }
 
 // GetRecommendationsFromRecentlyPlayed randomly selects tracks from user's recently played tracks
 // Parameters:
-// - accessToken: Spotify API access token
+// - userID: user whose Spotify account is used (see StartSpotifyLogin)
 // - limit: maximum number of recently played tracks to fetch (defaults to 10)
 // - count: number of tracks to recommend (defaults to 2)
-func GetRecommendationsFromRecentlyPlayed(accessToken string, limit int, count int) ([]RecommendedTrack, error) {
+func GetRecommendationsFromRecentlyPlayed(db *sql.DB, userID int, limit int, count int) ([]RecommendedTrack, error) {
 	// Set default values
 	if limit <= 0 {
 		limit = 10
@@ -69,7 +69,7 @@ func GetRecommendationsFromRecentlyPlayed(accessToken string, limit int, count i
 	}
 
 	// Get recently played tracks
-	recentTracks, err := getRecentlyPlayedTracks(accessToken, limit)
+	recentTracks, err := getRecentlyPlayedTracks(db, userID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -110,32 +110,11 @@ func GetRecommendationsFromRecentlyPlayed(accessToken string, limit int, count i
 }
 
 // Fetch recently played tracks from Spotify API
-func getRecentlyPlayedTracks(accessToken string, limit int) (*SpotifyRecentlyPlayedResponse, error) {
-	url := fmt.Sprintf("https://api.spotify.com/v1/me/player/recently-played?limit=%d", limit)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("error response from Spotify API: %s, status code: %d", string(body), resp.StatusCode)
-	}
-
+func getRecentlyPlayedTracks(db *sql.DB, userID int, limit int) (*SpotifyRecentlyPlayedResponse, error) {
 	var result SpotifyRecentlyPlayedResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("error decoding response: %v", err)
+	if err := spotifyGet(db, userID, fmt.Sprintf("/me/player/recently-played?limit=%d", limit), &result); err != nil {
+		return nil, err
 	}
-
 	return &result, nil
 }
 
@@ -0,0 +1,406 @@
+/*
+ * Spotify accounts of the users, connected with the authorization code flow with PKCE.
+ *
+ * GET /auth/spotify/login starts a login: the backend keeps the PKCE verifier with a random
+ * state and returns the authorize URL of Spotify. Spotify sends the browser back to
+ * /auth/spotify/callback, where the code is exchanged for tokens that are stored per user, so
+ * the browser never sees them. Access tokens are refreshed when they expire or when the
+ * Spotify API answers 401.
+ *
+ * Configuration (environment variables):
+ *
+ *	SPOTIFY_CLIENT_ID       Client ID of the Spotify app. Spotify login is disabled without it
+ *	SPOTIFY_CLIENT_SECRET   Optional. PKCE does not need it, but it is sent when set
+ *	SPOTIFY_REDIRECT_URI    URL of /auth/spotify/callback as registered in the Spotify app
+ *	                        (default http://127.0.0.1:8080/auth/spotify/callback)
+ *	SPOTIFY_LOGIN_REDIRECT  Optional page the browser is sent to after the callback, with
+ *	                        ?spotify=connected or ?spotify=error&error=<message>
+ *	SPOTIFY_ACCOUNTS_URL    Default https://accounts.spotify.com
+ *	SPOTIFY_API_URL         Default https://api.spotify.com/v1
+ *
+ * The two base URLs let a local stub stand in for Spotify (see test_tools/spotify_client.go).
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spotifyScope = "user-read-recently-played"
+	// spotifyLoginLifetime is how long a login started by /auth/spotify/login can be completed.
+	spotifyLoginLifetime = 10 * time.Minute
+	// spotifyExpiryMargin refreshes access tokens a little before Spotify expires them.
+	spotifyExpiryMargin = 30 * time.Second
+)
+
+var (
+	ErrSpotifyNotConfigured = errors.New("Spotify login is not configured (SPOTIFY_CLIENT_ID is not set)")
+	ErrSpotifyNotConnected  = errors.New("no Spotify account is connected; log in with /auth/spotify/login")
+	ErrSpotifyLoginState    = errors.New("unknown or expired Spotify login")
+	ErrSpotifyRequestFailed = errors.New("request to Spotify failed")
+
+	// errSpotifyInvalidGrant is the answer of the token endpoint to a revoked or unknown code or refresh token.
+	errSpotifyInvalidGrant = errors.New("Spotify rejected the authorization")
+)
+
+// spotifyConfig is the Spotify app of the backend, read from the environment on startup.
+var spotifyConfig = struct {
+	ClientID      string
+	ClientSecret  string
+	RedirectURI   string
+	LoginRedirect string
+	AccountsURL   string
+	APIURL        string
+}{
+	ClientID:      os.Getenv("SPOTIFY_CLIENT_ID"),
+	ClientSecret:  os.Getenv("SPOTIFY_CLIENT_SECRET"),
+	RedirectURI:   envOr("SPOTIFY_REDIRECT_URI", "http://127.0.0.1:8080/auth/spotify/callback"),
+	LoginRedirect: os.Getenv("SPOTIFY_LOGIN_REDIRECT"),
+	AccountsURL:   strings.TrimSuffix(envOr("SPOTIFY_ACCOUNTS_URL", "https://accounts.spotify.com"), "/"),
+	APIURL:        strings.TrimSuffix(envOr("SPOTIFY_API_URL", "https://api.spotify.com/v1"), "/"),
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+var spotifyHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// spotifyRefreshLocks serializes the refresh of the tokens of each user, as Spotify may rotate
+// the refresh token and only the first of two concurrent refreshes would succeed.
+var spotifyRefreshLocks sync.Map // user ID -> *sync.Mutex
+
+// SpotifyConnection is the state of the Spotify account of a user, as shown by GET /auth/spotify.
+type SpotifyConnection struct {
+	Connected bool       `json:"connected"`
+	Scope     string     `json:"scope,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Of the current access token; it is refreshed automatically
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// spotifyToken is a stored token of a user.
+type spotifyToken struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// spotifyTokenResponse is the answer of the token endpoint of Spotify.
+type spotifyTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"` // May be empty on refresh: the current one stays valid
+}
+
+func setupSpotify(db execer) error {
+	return execAll(
+		`CREATE TABLE SpotifyTokens (
+			user_id INTEGER PRIMARY KEY,
+			access_token TEXT NOT NULL,
+			refresh_token TEXT NOT NULL DEFAULT '',
+			scope TEXT NOT NULL DEFAULT '',
+			expires_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES Users(id)
+		)`,
+		`CREATE TABLE SpotifyLogins (
+			state TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			code_verifier TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES Users(id)
+		)`,
+	)(db)
+}
+
+func randomURLToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// StartSpotifyLogin records a new login of the user and returns the URL of Spotify to open.
+func StartSpotifyLogin(db *sql.DB, userID int) (string, error) {
+	if spotifyConfig.ClientID == "" {
+		return "", ErrSpotifyNotConfigured
+	}
+	state, err := randomURLToken(16)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	verifier, err := randomURLToken(64) // 86 characters, within the 43-128 of RFC 7636
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code verifier: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.Exec("DELETE FROM SpotifyLogins WHERE created_at <= ?", now.Add(-spotifyLoginLifetime)); err != nil {
+		return "", fmt.Errorf("failed to remove expired Spotify logins: %w", err)
+	}
+	if _, err := db.Exec("INSERT INTO SpotifyLogins (state, user_id, code_verifier, created_at) VALUES (?, ?, ?, ?)",
+		state, userID, verifier, now); err != nil {
+		return "", fmt.Errorf("failed to store Spotify login of user %d: %w", userID, err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"client_id":             {spotifyConfig.ClientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {spotifyConfig.RedirectURI},
+		"scope":                 {spotifyScope},
+		"state":                 {state},
+		"code_challenge_method": {"S256"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+	}
+	return spotifyConfig.AccountsURL + "/authorize?" + params.Encode(), nil
+}
+
+// FinishSpotifyLogin exchanges the code of a login started by StartSpotifyLogin and stores the
+// tokens for its user, which is returned. A state can only be used once.
+func FinishSpotifyLogin(db *sql.DB, state, code string) (int, error) {
+	userID, verifier, err := takeSpotifyLogin(db, state)
+	if err != nil {
+		return 0, err
+	}
+	tok, err := requestSpotifyToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {spotifyConfig.RedirectURI},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return userID, err
+	}
+	if tok.RefreshToken == "" {
+		return userID, fmt.Errorf("%w: no refresh token in the answer of the token endpoint", ErrSpotifyRequestFailed)
+	}
+	if err := saveSpotifyToken(db, userID, tok); err != nil {
+		return userID, err
+	}
+	return userID, nil
+}
+
+// CancelSpotifyLogin forgets a login that Spotify reported as failed (e.g. the user denied access).
+func CancelSpotifyLogin(db *sql.DB, state string) error {
+	_, _, err := takeSpotifyLogin(db, state)
+	return err
+}
+
+// takeSpotifyLogin removes a pending login and returns its user and code verifier.
+func takeSpotifyLogin(db *sql.DB, state string) (int, string, error) {
+	var userID int
+	var verifier string
+	var createdAt time.Time
+	err := db.QueryRow("SELECT user_id, code_verifier, created_at FROM SpotifyLogins WHERE state = ?", state).Scan(&userID, &verifier, &createdAt)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrSpotifyLoginState
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to look up Spotify login: %w", err)
+	}
+	if _, err := db.Exec("DELETE FROM SpotifyLogins WHERE state = ?", state); err != nil {
+		return 0, "", fmt.Errorf("failed to remove Spotify login of user %d: %w", userID, err)
+	}
+	if time.Since(createdAt) > spotifyLoginLifetime {
+		return 0, "", ErrSpotifyLoginState
+	}
+	return userID, verifier, nil
+}
+
+// requestSpotifyToken calls the token endpoint of Spotify with a code or a refresh token.
+func requestSpotifyToken(form url.Values) (spotifyTokenResponse, error) {
+	var tok spotifyTokenResponse
+	form.Set("client_id", spotifyConfig.ClientID)
+	req, err := http.NewRequest(http.MethodPost, spotifyConfig.AccountsURL+"/api/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return tok, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if spotifyConfig.ClientSecret != "" {
+		req.SetBasicAuth(spotifyConfig.ClientID, spotifyConfig.ClientSecret)
+	}
+
+	resp, err := spotifyHTTPClient.Do(req)
+	if err != nil {
+		return tok, fmt.Errorf("%w: %v", ErrSpotifyRequestFailed, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return tok, fmt.Errorf("%w: failed to read token response: %v", ErrSpotifyRequestFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error == "invalid_grant" {
+			return tok, fmt.Errorf("%w: %s", errSpotifyInvalidGrant, e.Description)
+		}
+		return tok, fmt.Errorf("%w: token endpoint answered %d: %s", ErrSpotifyRequestFailed, resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, &tok); err != nil || tok.AccessToken == "" {
+		return tok, fmt.Errorf("%w: invalid token response: %s", ErrSpotifyRequestFailed, string(body))
+	}
+	return tok, nil
+}
+
+// saveSpotifyToken stores the tokens of a user, keeping the refresh token when Spotify did not send a new one.
+func saveSpotifyToken(db *sql.DB, userID int, tok spotifyTokenResponse) error {
+	now := time.Now().UTC()
+	_, err := db.Exec(`
+		INSERT INTO SpotifyTokens (user_id, access_token, refresh_token, scope, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = CASE WHEN excluded.refresh_token = '' THEN refresh_token ELSE excluded.refresh_token END,
+			scope = CASE WHEN excluded.scope = '' THEN scope ELSE excluded.scope END,
+			expires_at = excluded.expires_at,
+			updated_at = excluded.updated_at`,
+		userID, tok.AccessToken, tok.RefreshToken, tok.Scope, now.Add(time.Duration(tok.ExpiresIn)*time.Second), now)
+	if err != nil {
+		return fmt.Errorf("failed to store Spotify tokens of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func loadSpotifyToken(db *sql.DB, userID int) (spotifyToken, error) {
+	var t spotifyToken
+	err := db.QueryRow("SELECT access_token, refresh_token, expires_at FROM SpotifyTokens WHERE user_id = ?", userID).Scan(
+		&t.AccessToken, &t.RefreshToken, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return t, ErrSpotifyNotConnected
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to load Spotify tokens of user %d: %w", userID, err)
+	}
+	return t, nil
+}
+
+// refreshSpotifyToken replaces the access token stale of a user and returns the new one. If
+// another request has already replaced it, that one is returned without asking Spotify again.
+// A refresh token revoked by the user disconnects the account.
+func refreshSpotifyToken(db *sql.DB, userID int, stale string) (string, error) {
+	lock, _ := spotifyRefreshLocks.LoadOrStore(userID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	t, err := loadSpotifyToken(db, userID)
+	if err != nil {
+		return "", err
+	}
+	if t.AccessToken != stale {
+		return t.AccessToken, nil
+	}
+	if t.RefreshToken == "" {
+		return "", ErrSpotifyNotConnected
+	}
+	tok, err := requestSpotifyToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+	})
+	if errors.Is(err, errSpotifyInvalidGrant) {
+		if err := DisconnectSpotify(db, userID); err != nil {
+			return "", err
+		}
+		return "", ErrSpotifyNotConnected
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh Spotify token of user %d: %w", userID, err)
+	}
+	if err := saveSpotifyToken(db, userID, tok); err != nil {
+		return "", err
+	}
+	return tok.AccessToken, nil
+}
+
+// spotifyGet calls the Spotify Web API on behalf of a user and decodes the JSON answer into out.
+// path is relative to SPOTIFY_API_URL, e.g. "/me/player/recently-played?limit=10". The access
+// token is refreshed before the call when it has expired, and once more if Spotify answers 401.
+func spotifyGet(db *sql.DB, userID int, path string, out any) error {
+	t, err := loadSpotifyToken(db, userID)
+	if err != nil {
+		return err
+	}
+	accessToken := t.AccessToken
+	if time.Now().Add(spotifyExpiryMargin).After(t.ExpiresAt) {
+		if accessToken, err = refreshSpotifyToken(db, userID, accessToken); err != nil {
+			return err
+		}
+	}
+
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest(http.MethodGet, spotifyConfig.APIURL+path, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := spotifyHTTPClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSpotifyRequestFailed, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			resp.Body.Close()
+			if accessToken, err = refreshSpotifyToken(db, userID, accessToken); err != nil {
+				return err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%w: error response from Spotify API: %s, status code: %d", ErrSpotifyRequestFailed, string(body), resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%w: error decoding response: %v", ErrSpotifyRequestFailed, err)
+		}
+		return nil
+	}
+}
+
+// GetSpotifyConnection returns whether the user has connected a Spotify account.
+func GetSpotifyConnection(db *sql.DB, userID int) (SpotifyConnection, error) {
+	var c SpotifyConnection
+	var expiresAt, updatedAt time.Time
+	err := db.QueryRow("SELECT scope, expires_at, updated_at FROM SpotifyTokens WHERE user_id = ?", userID).Scan(
+		&c.Scope, &expiresAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed to get Spotify connection of user %d: %w", userID, err)
+	}
+	c.Connected, c.ExpiresAt, c.UpdatedAt = true, &expiresAt, &updatedAt
+	return c, nil
+}
+
+// DisconnectSpotify forgets the Spotify tokens of a user. Spotify has no revocation endpoint:
+// the user can remove the access of the app in the settings of their Spotify account.
+func DisconnectSpotify(db *sql.DB, userID int) error {
+	if _, err := db.Exec("DELETE FROM SpotifyTokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to remove Spotify tokens of user %d: %w", userID, err)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spotifyStub stands in for the accounts service and the Web API of Spotify.
+type spotifyStub struct {
+	mu        sync.Mutex
+	next      int
+	codes     map[string]string // code -> code_challenge
+	access    map[string]bool   // access tokens accepted by the Web API
+	refresh   map[string]bool   // refresh tokens accepted by the token endpoint
+	refreshes int               // refresh_token grants answered
+}
+
+// newSpotifyStub serves a stub and points spotifyConfig at it for the duration of the test.
+func newSpotifyStub(t *testing.T) *spotifyStub {
+	t.Helper()
+	s := &spotifyStub{codes: map[string]string{}, access: map[string]bool{}, refresh: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/token", s.token)
+	mux.HandleFunc("/v1/me", s.me)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	saved := spotifyConfig
+	t.Cleanup(func() { spotifyConfig = saved })
+	spotifyConfig.ClientID = "test-client"
+	spotifyConfig.ClientSecret = ""
+	spotifyConfig.RedirectURI = "http://127.0.0.1:8080/auth/spotify/callback"
+	spotifyConfig.AccountsURL = server.URL
+	spotifyConfig.APIURL = server.URL + "/v1"
+	return s
+}
+
+func (s *spotifyStub) newToken(prefix string) string {
+	s.next++
+	return fmt.Sprintf("%s-%d", prefix, s.next)
+}
+
+// authorize plays the authorize page of Spotify: the user grants access, and the code and the
+// state are sent back to the callback.
+func (s *spotifyStub) authorize(t *testing.T, authorizeURL string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	for name, want := range map[string]string{
+		"client_id": "test-client", "response_type": "code", "code_challenge_method": "S256",
+		"scope": spotifyScope, "redirect_uri": spotifyConfig.RedirectURI,
+	} {
+		if q.Get(name) != want {
+			t.Errorf("authorize URL: %s = %q, want %q", name, q.Get(name), want)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code = s.newToken("code")
+	s.codes[code] = q.Get("code_challenge")
+	return code, q.Get("state")
+}
+
+func (s *spotifyStub) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invalidGrant := func() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "rejected by the stub"})
+	}
+	if r.PostFormValue("client_id") != "test-client" {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusBadRequest)
+		return
+	}
+
+	answer := map[string]any{"token_type": "Bearer", "scope": spotifyScope, "expires_in": 3600}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		challenge, ok := s.codes[r.PostFormValue("code")]
+		delete(s.codes, r.PostFormValue("code"))
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			invalidGrant()
+			return
+		}
+		refresh := s.newToken("refresh")
+		s.refresh[refresh] = true
+		answer["refresh_token"] = refresh
+	case "refresh_token":
+		if !s.refresh[r.PostFormValue("refresh_token")] {
+			invalidGrant()
+			return
+		}
+		s.refreshes++
+	default:
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	access := s.newToken("access")
+	s.access[access] = true
+	answer["access_token"] = access
+	json.NewEncoder(w).Encode(answer)
+}
+
+func (s *spotifyStub) me(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var access string
+	fmt.Sscanf(r.Header.Get("Authorization"), "Bearer %s", &access)
+	if !s.access[access] {
+		http.Error(w, `{"error": {"status": 401, "message": "The access token expired"}}`, http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id": "stub-user"})
+}
+
+// revokeAccess makes the Web API reject every access token issued so far, and also the refresh
+// tokens when the user removed the access of the app.
+func (s *spotifyStub) revokeAccess(refresh bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.access)
+	if refresh {
+		clear(s.refresh)
+	}
+}
+
+// connectSpotify runs a whole login of a user against the stub.
+func connectSpotify(t *testing.T, db *sql.DB, s *spotifyStub, userID int) {
+	t.Helper()
+	authorizeURL, err := StartSpotifyLogin(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := s.authorize(t, authorizeURL)
+	if got, err := FinishSpotifyLogin(db, state, code); err != nil || got != userID {
+		t.Fatalf("FinishSpotifyLogin = %d, %v, want %d", got, err, userID)
+	}
+}
+
+func TestSpotifyLogin(t *testing.T) {
+	db := openTestDB(t)
+	s := newSpotifyStub(t)
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+
+	tests := []struct {
+		name string
+		// finish completes the login started for alice, given the code and the state Spotify sent back
+		finish  func(code, state string) (int, error)
+		wantErr error
+	}{
+		{
+			name:   "code exchanged with the code verifier",
+			finish: func(code, state string) (int, error) { return FinishSpotifyLogin(db, state, code) },
+		},
+		{
+			name:    "code of another login",
+			finish:  func(code, state string) (int, error) { return FinishSpotifyLogin(db, state, "code-unknown") },
+			wantErr: errSpotifyInvalidGrant,
+		},
+		{
+			name: "state used twice",
+			finish: func(code, state string) (int, error) {
+				if _, err := FinishSpotifyLogin(db, state, code); err != nil {
+					return 0, err
+				}
+				return FinishSpotifyLogin(db, state, code)
+			},
+			wantErr: ErrSpotifyLoginState,
+		},
+		{
+			name: "state of a cancelled login",
+			finish: func(code, state string) (int, error) {
+				if err := CancelSpotifyLogin(db, state); err != nil {
+					return 0, err
+				}
+				return FinishSpotifyLogin(db, state, code)
+			},
+			wantErr: ErrSpotifyLoginState,
+		},
+		{
+			name: "expired state",
+			finish: func(code, state string) (int, error) {
+				if _, err := db.Exec("UPDATE SpotifyLogins SET created_at = ? WHERE state = ?", time.Now().UTC().Add(-spotifyLoginLifetime-time.Minute), state); err != nil {
+					return 0, err
+				}
+				return FinishSpotifyLogin(db, state, code)
+			},
+			wantErr: ErrSpotifyLoginState,
+		},
+		{
+			name:    "unknown state",
+			finish:  func(code, state string) (int, error) { return FinishSpotifyLogin(db, "forged", code) },
+			wantErr: ErrSpotifyLoginState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DisconnectSpotify(db, alice.ID); err != nil {
+				t.Fatal(err)
+			}
+			authorizeURL, err := StartSpotifyLogin(db, alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, state := s.authorize(t, authorizeURL)
+			userID, err := tt.finish(code, state)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID != alice.ID {
+				t.Errorf("user = %d, want %d", userID, alice.ID)
+			}
+			conn, err := GetSpotifyConnection(db, alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !conn.Connected || conn.Scope != spotifyScope {
+				t.Errorf("connection = %+v, want connected with scope %s", conn, spotifyScope)
+			}
+		})
+	}
+
+	spotifyConfig.ClientID = ""
+	if _, err := StartSpotifyLogin(db, alice.ID); !errors.Is(err, ErrSpotifyNotConfigured) {
+		t.Errorf("StartSpotifyLogin without client ID: err = %v, want ErrSpotifyNotConfigured", err)
+	}
+}
+
+func TestSpotifyGet(t *testing.T) {
+	db := openTestDB(t)
+	s := newSpotifyStub(t)
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+
+	tests := []struct {
+		name string
+		// prepare breaks the tokens of alice once the account is connected
+		prepare       func()
+		wantErr       error
+		wantRefreshes int
+		wantConnected bool
+	}{
+		{
+			name:          "valid access token",
+			prepare:       func() {},
+			wantConnected: true,
+		},
+		{
+			name: "access token past its expiry",
+			prepare: func() {
+				if _, err := db.Exec("UPDATE SpotifyTokens SET expires_at = ? WHERE user_id = ?", time.Now().UTC().Add(-time.Minute), alice.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantRefreshes: 1,
+			wantConnected: true,
+		},
+		{
+			name:          "access token rejected with 401",
+			prepare:       func() { s.revokeAccess(false) },
+			wantRefreshes: 1,
+			wantConnected: true,
+		},
+		{
+			name:    "refresh token revoked",
+			prepare: func() { s.revokeAccess(true) },
+			wantErr: ErrSpotifyNotConnected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connectSpotify(t, db, s, alice.ID)
+			tt.prepare()
+			before := s.refreshes
+
+			var me struct {
+				ID string `json:"id"`
+			}
+			err := spotifyGet(db, alice.ID, "/me", &me)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if me.ID != "stub-user" {
+				t.Errorf("answer = %+v, want the stub user", me)
+			}
+			if n := s.refreshes - before; n != tt.wantRefreshes {
+				t.Errorf("%d refreshes, want %d", n, tt.wantRefreshes)
+			}
+			conn, err := GetSpotifyConnection(db, alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.Connected != tt.wantConnected {
+				t.Errorf("connected = %v, want %v", conn.Connected, tt.wantConnected)
+			}
+		})
+	}
+
+	bob := mustCreateUser(t, db, "bob", "battery staple")
+	if err := spotifyGet(db, bob.ID, "/me", &struct{}{}); !errors.Is(err, ErrSpotifyNotConnected) {
+		t.Errorf("spotifyGet of a user without account: err = %v, want ErrSpotifyNotConnected", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 20
+)
+
+// Suggestion is a completion for a search being typed.
+type Suggestion struct {
+	Type    string `json:"type"` // "title", "artist" or "genre"
+	Text    string `json:"text"`
+	MusicID int    `json:"music_id,omitempty"` // Set for titles
+	Slug    string `json:"slug,omitempty"`     // Set for genres
+}
+
+// suggestEntry is one key of the prefix index. A suggestion has a key for the start of every
+// word of its normalized text (and of the reading of a title), so that "back" completes "KICK BACK".
+type suggestEntry struct {
+	key        string
+	suggestion Suggestion
+	weight     int // Number of music for artists and genres, 1 for titles
+}
+
+// suggestIndex is an in-memory prefix index of the titles, artists and genres of the catalog.
+type suggestIndex struct {
+	mu      sync.RWMutex
+	entries []suggestEntry // Sorted by key
+}
+
+// catalogSuggestions serves /search/suggest. It is rebuilt after every change of the catalog.
+var catalogSuggestions = &suggestIndex{}
+
+// refreshSuggestions rebuilds the suggestion index after a change of the catalog.
+// A failure only leaves the completions outdated, so it is logged instead of returned.
+func refreshSuggestions(db *sql.DB) {
+	if err := catalogSuggestions.Rebuild(db); err != nil {
+		log.Printf("Warning: Failed to rebuild the suggestion index: %v", err)
+	}
+}
+
+// Rebuild reads the whole catalog into the index.
+func (ix *suggestIndex) Rebuild(db *sql.DB) error {
+	var entries []suggestEntry
+	add := func(text string, s Suggestion, weight int) {
+		words := strings.Fields(normalizeSearchText(text))
+		for i := range words {
+			entries = append(entries, suggestEntry{key: strings.Join(words[i:], " "), suggestion: s, weight: weight})
+		}
+	}
+
+	rows, err := db.Query("SELECT id, title, COALESCE(artist, ''), COALESCE(reading, '') FROM Music")
+	if err != nil {
+		return fmt.Errorf("failed to query music for suggestions: %w", err)
+	}
+	artists := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var title, artist, reading string
+		if err := rows.Scan(&id, &title, &artist, &reading); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan music for suggestions: %w", err)
+		}
+		s := Suggestion{Type: "title", Text: title, MusicID: id}
+		add(title, s, 1)
+		add(reading, s, 1)
+		if artist != "" {
+			artists[artist]++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating music for suggestions: %w", err)
+	}
+	for artist, count := range artists {
+		add(artist, Suggestion{Type: "artist", Text: artist}, count)
+	}
+
+	rows, err = db.Query(`
+		SELECT g.slug, gn.name, (SELECT COUNT(*) FROM MusicGenres mg WHERE mg.genre_id = g.id)
+		FROM Genres g JOIN GenreNames gn ON gn.genre_id = g.id`)
+	if err != nil {
+		return fmt.Errorf("failed to query genres for suggestions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug, name string
+		var count int
+		if err := rows.Scan(&slug, &name, &count); err != nil {
+			return fmt.Errorf("failed to scan genre for suggestions: %w", err)
+		}
+		add(name, Suggestion{Type: "genre", Text: name, Slug: slug}, count)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating genres for suggestions: %w", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	ix.mu.Lock()
+	ix.entries = entries
+	ix.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the completions of a typed text, best first: whole-word matches, then
+// artists and genres with more music, then shorter texts.
+func (ix *suggestIndex) Lookup(text string, limit int) []Suggestion {
+	prefix := strings.Join(strings.Fields(normalizeSearchText(text)), " ")
+	if prefix == "" {
+		return []Suggestion{}
+	}
+
+	type candidate struct {
+		suggestion Suggestion
+		exact      bool
+		weight     int
+	}
+	var candidates []candidate
+	seen := make(map[Suggestion]int)
+
+	ix.mu.RLock()
+	start := sort.Search(len(ix.entries), func(i int) bool { return ix.entries[i].key >= prefix })
+	for _, e := range ix.entries[start:] {
+		if !strings.HasPrefix(e.key, prefix) {
+			break
+		}
+		exact := len(e.key) == len(prefix) || e.key[len(prefix)] == ' '
+		// A genre is suggested once, in the first of its names that matches.
+		id := e.suggestion
+		if id.Type == "genre" {
+			id.Text = ""
+		}
+		if i, ok := seen[id]; ok {
+			candidates[i].exact = candidates[i].exact || exact
+			continue
+		}
+		seen[id] = len(candidates)
+		candidates = append(candidates, candidate{e.suggestion, exact, e.weight})
+	}
+	ix.mu.RUnlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.exact != b.exact {
+			return a.exact
+		}
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		if len(a.suggestion.Text) != len(b.suggestion.Text) {
+			return len(a.suggestion.Text) < len(b.suggestion.Text)
+		}
+		return a.suggestion.Text < b.suggestion.Text
+	})
+	suggestions := []Suggestion{}
+	for _, c := range candidates[:min(limit, len(candidates))] {
+		suggestions = append(suggestions, c.suggestion)
+	}
+	return suggestions
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSuggestLookup(t *testing.T) {
+	db := openTestDB(t)
+	music := make(map[string]int)
+	for _, m := range []struct{ title, artist, reading string }{
+		{"KICK BACK", "米津玄師", "きっくばっく"},
+		{"Backlight", "back number", ""},
+		{"Rock Me", "back number", ""},
+		{"Rock Around", "back number", ""},
+		{"ハッピーエンド", "back number", ""},
+		{"Rock On", "Back On", ""},
+		{"Blue", "Back On", ""},
+	} {
+		id := insertTestMusic(t, db, m.title)
+		if _, err := db.Exec("UPDATE Music SET artist = ?, reading = ? WHERE id = ?", m.artist, m.reading, id); err != nil {
+			t.Fatal(err)
+		}
+		music[m.title] = id
+	}
+	rockabilly, err := CreateGenre(db, GenreInput{Slug: "ROCKABILLY", Names: map[string]string{"en": "Rockabilly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rock int
+	if err := db.QueryRow("SELECT id FROM Genres WHERE slug = 'ROCK'").Scan(&rock); err != nil {
+		t.Fatal(err)
+	}
+	// ROCK is named "Rock", "ロック" and "Roca"
+	if _, err := db.Exec("INSERT INTO GenreNames (genre_id, locale, name) VALUES (?, 'es', 'Roca')", rock); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []struct {
+		title string
+		genre int
+	}{
+		{"Rock Me", rock}, {"Rock Around", rock}, {"Rock On", rock}, {"KICK BACK", rockabilly},
+	} {
+		if _, err := db.Exec("INSERT INTO MusicGenres (music_id, genre_id) VALUES (?, ?)", music[tag.title], tag.genre); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ix := &suggestIndex{}
+	if err := ix.Rebuild(db); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string // type:text
+	}{
+		{
+			name:  "whole words first, then by number of music",
+			text:  "back",
+			limit: 10,
+			want:  []string{"artist:back number", "artist:Back On", "title:KICK BACK", "title:Backlight"},
+		},
+		{
+			name:  "then shorter texts, then by text",
+			text:  "rock",
+			limit: 10,
+			want:  []string{"genre:Rock", "title:Rock Me", "title:Rock On", "title:Rock Around", "genre:Rockabilly"},
+		},
+		{
+			name:  "word inside a text",
+			text:  "on",
+			limit: 10,
+			want:  []string{"artist:Back On", "title:Rock On"},
+		},
+		{
+			name:  "genre once across locales",
+			text:  "ro",
+			limit: 10,
+			want:  []string{"genre:Roca", "title:Rock Me", "title:Rock On", "genre:Rockabilly", "title:Rock Around"},
+		},
+		{
+			name:  "genre by a localized name",
+			text:  "ロック",
+			limit: 10,
+			want:  []string{"genre:ロック"},
+		},
+		{
+			name:  "title by its reading",
+			text:  "きっく",
+			limit: 10,
+			want:  []string{"title:KICK BACK"},
+		},
+		{
+			name:  "kana title typed in hiragana",
+			text:  "はっぴー",
+			limit: 10,
+			want:  []string{"title:ハッピーエンド"},
+		},
+		{
+			name:  "normalized like the index",
+			text:  "ＢＡＣＫ　ＮＵＭ",
+			limit: 10,
+			want:  []string{"artist:back number"},
+		},
+		{
+			name:  "limit",
+			text:  "back",
+			limit: 2,
+			want:  []string{"artist:back number", "artist:Back On"},
+		},
+		{
+			name:  "no match",
+			text:  "zzz",
+			limit: 10,
+			want:  []string{},
+		},
+		{
+			name:  "empty text",
+			text:  "  ",
+			limit: 10,
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, s := range ix.Lookup(tt.text, tt.limit) {
+				got = append(got, s.Type+":"+s.Text)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Lookup(%q, %d) = %v, want %v", tt.text, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"infosystem-musicapp/musicxml"
+)
+
+// tabInstrument is the instrument whose sheets are preferred for tablature.
+const tabInstrument = "guitar"
+
+// TabOptions are the query parameters of the tablature variant of a sheet.
+type TabOptions struct {
+	Tuning string `form:"tuning"` // Optional: a name such as "drop-d", or open-string pitches such as "D2 A2 D3 G3 B3 E4"
+	Capo   int    `form:"capo"`   // Optional: fret of the capo
+}
+
+// Validate checks the tuning and the capo without needing a sheet.
+func (o TabOptions) Validate() error {
+	if _, err := o.tuning(); err != nil {
+		return fmt.Errorf("'tuning' must be one of %s or a list of open-string pitches such as \"D2 A2 D3 G3 B3 E4\"",
+			strings.Join(musicxml.TuningNames(), ", "))
+	}
+	if o.Capo < 0 || o.Capo > musicxml.MaxCapo {
+		return fmt.Errorf("'capo' must be between 0 and %d", musicxml.MaxCapo)
+	}
+	return nil
+}
+
+func (o TabOptions) tuning() (musicxml.Tuning, error) {
+	if strings.TrimSpace(o.Tuning) == "" {
+		return musicxml.StandardTuning, nil
+	}
+	return musicxml.ParseTuning(o.Tuning)
+}
+
+// GenerateTablature returns a stored sheet with a TAB staff under its melody, transposed like
+// /select first. Without an instrument, the guitar sheets are used if the music has one with
+// this difficulty, else the sheets of another instrument, so that any music can be played on
+// the guitar.
+func GenerateTablature(db *sql.DB, musicID int, part SheetPart, difficulty int, t TransposeOptions, tab TabOptions) (string, error) {
+	tuning, err := tab.tuning()
+	if err != nil {
+		return "", err
+	}
+	if part.Instrument == "" {
+		// The reference instrument of the music comes after the guitar
+		err := db.QueryRow(`
+			SELECT instrument FROM Sheets WHERE music_id = ? AND difficulty = ?
+			ORDER BY instrument = ? DESC, instrument = (SELECT instrument FROM Music WHERE id = ?) DESC, instrument
+			LIMIT 1`, musicID, difficulty, tabInstrument, musicID).Scan(&part.Instrument)
+		if err == sql.ErrNoRows {
+			return "", ErrSheetNotFound
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to choose the instrument for tablature of music_id %d: %w", musicID, err)
+		}
+	}
+	sheet, err := GetSheet(db, musicID, part, difficulty)
+	if err != nil {
+		return "", err
+	}
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	if score, _, err = t.Apply(score); err != nil {
+		return "", fmt.Errorf("failed to transpose sheet (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	if score, err = musicxml.AddTablature(score, musicxml.TabOptions{Tuning: tuning, Capo: tab.Capo}); err != nil {
+		return "", fmt.Errorf("failed to generate tablature (music_id: %d, difficulty: %d): %w", musicID, difficulty, err)
+	}
+	return musicxml.MarshalString(score)
+}
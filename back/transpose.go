@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"infosystem-musicapp/musicxml"
+)
+
+const maxTransposeSemitones = 24
+
+// TransposeOptions are the optional transposition fields accepted by /select and /calc_proficiency.
+// At most one of them may be set.
+type TransposeOptions struct {
+	Transpose int    `json:"transpose" form:"transpose"` // Optional: semitones to shift the sheets by
+	Key       string `json:"key" form:"key"`             // Optional: target key such as "D", "Bb" or "F#m"
+}
+
+// IsZero reports whether no transposition was requested.
+func (t TransposeOptions) IsZero() bool {
+	return t.Transpose == 0 && t.Key == ""
+}
+
+// Validate checks the transposition fields without needing a sheet.
+func (t TransposeOptions) Validate() error {
+	if t.Transpose != 0 && t.Key != "" {
+		return errors.New("only one of 'transpose' and 'key' may be given")
+	}
+	if t.Transpose < -maxTransposeSemitones || t.Transpose > maxTransposeSemitones {
+		return fmt.Errorf("'transpose' must be between %d and %d semitones", -maxTransposeSemitones, maxTransposeSemitones)
+	}
+	if t.Key != "" {
+		if _, err := musicxml.ParseKeyName(t.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply returns the transposed score and the applied transposition in semitones.
+func (t TransposeOptions) Apply(score *musicxml.Score) (*musicxml.Score, int, error) {
+	if t.Key != "" {
+		return musicxml.TransposeToKey(score, t.Key)
+	}
+	if t.Transpose == 0 {
+		return score, 0, nil
+	}
+	return musicxml.TransposeBy(score, t.Transpose), t.Transpose, nil
+}
+
+// transposeSheet transposes a stored MusicXML sheet and writes it back as MusicXML.
+func transposeSheet(sheet string, t TransposeOptions) (string, int, error) {
+	score, err := musicxml.ParseString(sheet)
+	if err != nil {
+		return "", 0, err
+	}
+	transposed, semitones, err := t.Apply(score)
+	if err != nil {
+		return "", 0, err
+	}
+	out, err := musicxml.MarshalString(transposed)
+	if err != nil {
+		return "", 0, err
+	}
+	return out, semitones, nil
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// defaultUserID is the account that owns the user data of databases created before accounts.
+	defaultUserID   = 1
+	defaultUsername = "default"
+
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores longer passwords
+
+	// Sessions come from POST /auth/login and expire; API tokens are created on purpose and do not.
+	tokenKindSession = "session"
+	tokenKindAPI     = "api"
+	sessionLifetime  = 30 * 24 * time.Hour
+)
+
+var (
+	ErrUserExists         = errors.New("the username is already taken")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrTokenNotFound      = errors.New("token not found")
+	ErrNoPassword         = errors.New("the account has no password yet")
+)
+
+// User is an account. Every user data (instruments, favorites, histories...) belongs to one.
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Credentials is the request body of POST /auth/register and POST /auth/login.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Validate trims the username and checks both fields.
+func (c *Credentials) Validate() error {
+	c.Username = strings.TrimSpace(c.Username)
+	if err := validateUsername(c.Username); err != nil {
+		return err
+	}
+	return validatePassword(c.Password)
+}
+
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("'username' must be %d to %d characters", minUsernameLength, maxUsernameLength)
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == '-') {
+			return errors.New("'username' may only contain letters, digits, '_', '.' and '-'")
+		}
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("'password' must be %d to %d bytes", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+// UserToken describes a token of a user; the token itself is only known when it is issued.
+type UserToken struct {
+	ID         int        `json:"id"`
+	Kind       string     `json:"kind"` // "session" or "api"
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"` // Null for API tokens
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// userTable is a table of user data, with its definition before and after it was scoped by user.
+type userTable struct {
+	name    string
+	columns string    // Columns other than user_id
+	before  string    // CREATE TABLE %s of migration 8
+	after   string    // CREATE TABLE %s with user_id
+	indexes [2]string // Index created before and after, if any
+}
+
+var userTables = []userTable{
+	{
+		name:    "UserInstruments",
+		columns: "instrument, proficiency, selected, current",
+		before: `CREATE TABLE %s (
+			instrument TEXT PRIMARY KEY,
+			proficiency REAL NOT NULL DEFAULT 0.0,
+			selected INTEGER NOT NULL DEFAULT 1,
+			current INTEGER NOT NULL DEFAULT 0
+		)`,
+		after: `CREATE TABLE %s (
+			user_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			proficiency REAL NOT NULL DEFAULT 0.0,
+			selected INTEGER NOT NULL DEFAULT 1,
+			current INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, instrument),
+			FOREIGN KEY (user_id) REFERENCES Users(id)
+		)`,
+		indexes: [2]string{
+			"CREATE UNIQUE INDEX idx_user_instruments_current ON UserInstruments(current) WHERE current = 1",
+			"CREATE UNIQUE INDEX idx_user_instruments_current ON UserInstruments(user_id) WHERE current = 1",
+		},
+	},
+	{
+		name:    "Favorites",
+		columns: "music_id, order_key",
+		before: `CREATE TABLE %s (
+			music_id INTEGER PRIMARY KEY,
+			order_key INTEGER NOT NULL,
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		after: `CREATE TABLE %s (
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			order_key INTEGER NOT NULL,
+			PRIMARY KEY (user_id, music_id),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+	},
+	{
+		name:    "UserMusicDifficultySettings",
+		columns: "music_id, instrument, measure, difficulty",
+		before: `CREATE TABLE %s (
+			music_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			measure INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			PRIMARY KEY (music_id, instrument, measure),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		after: `CREATE TABLE %s (
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			instrument TEXT NOT NULL,
+			measure INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			PRIMARY KEY (user_id, music_id, instrument, measure),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+	},
+	{
+		name:    "QueryHistory",
+		columns: "id, query, normalized, searched_at",
+		before: `CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			query TEXT NOT NULL,
+			normalized TEXT NOT NULL UNIQUE,
+			searched_at DATETIME NOT NULL
+		)`,
+		after: `CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			query TEXT NOT NULL,
+			normalized TEXT NOT NULL,
+			searched_at DATETIME NOT NULL,
+			UNIQUE (user_id, normalized),
+			FOREIGN KEY (user_id) REFERENCES Users(id)
+		)`,
+	},
+	{
+		name:    "ViewHistory",
+		columns: "id, music_id, viewed_at",
+		before: `CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			music_id INTEGER NOT NULL UNIQUE,
+			viewed_at DATETIME NOT NULL,
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		after: `CREATE TABLE %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			viewed_at DATETIME NOT NULL,
+			UNIQUE (user_id, music_id),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+	},
+	{
+		name:    "PracticeProgress",
+		columns: "music_id, difficulty, last_measure, position, measure_count, practiced_at",
+		before: `CREATE TABLE %s (
+			music_id INTEGER PRIMARY KEY,
+			difficulty INTEGER NOT NULL,
+			last_measure INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			measure_count INTEGER NOT NULL,
+			practiced_at DATETIME NOT NULL,
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+		after: `CREATE TABLE %s (
+			user_id INTEGER NOT NULL,
+			music_id INTEGER NOT NULL,
+			difficulty INTEGER NOT NULL,
+			last_measure INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			measure_count INTEGER NOT NULL,
+			practiced_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, music_id),
+			FOREIGN KEY (user_id) REFERENCES Users(id),
+			FOREIGN KEY (music_id) REFERENCES Music(id)
+		)`,
+	},
+}
+
+// setupUsers creates the accounts and their tokens, and scopes every table of user data by
+// user_id. The data of older databases belongs to the default account, which has no password
+// until one is set with "back user password default".
+func setupUsers(db execer) error {
+	stmts := []string{
+		`CREATE TABLE Users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash TEXT NOT NULL DEFAULT '', -- Empty: no password login
+			created_at DATETIME NOT NULL
+		)`,
+		fmt.Sprintf("INSERT INTO Users (id, username, created_at) VALUES (%d, '%s', CURRENT_TIMESTAMP)", defaultUserID, defaultUsername),
+		`CREATE TABLE UserTokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE, -- SHA-256 of the token
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES Users(id)
+		)`,
+		"CREATE INDEX idx_user_tokens_user ON UserTokens(user_id)",
+	}
+	for _, t := range userTables {
+		stmts = append(stmts,
+			fmt.Sprintf(t.after, t.name+"_new"),
+			fmt.Sprintf("INSERT INTO %[1]s_new (user_id, %[2]s) SELECT %[3]d, %[2]s FROM %[1]s", t.name, t.columns, defaultUserID),
+			"DROP TABLE "+t.name,
+			fmt.Sprintf("ALTER TABLE %[1]s_new RENAME TO %[1]s", t.name),
+		)
+		if t.indexes[1] != "" {
+			stmts = append(stmts, t.indexes[1])
+		}
+	}
+	return execAll(stmts...)(db)
+}
+
+// dropUsers is the down step of setupUsers. Only the data of the default account is kept.
+func dropUsers(db execer) error {
+	var stmts []string
+	for _, t := range userTables {
+		stmts = append(stmts,
+			fmt.Sprintf(t.before, t.name+"_old"),
+			fmt.Sprintf("INSERT INTO %[1]s_old (%[2]s) SELECT %[2]s FROM %[1]s WHERE user_id = %[3]d", t.name, t.columns, defaultUserID),
+			"DROP TABLE "+t.name,
+			fmt.Sprintf("ALTER TABLE %[1]s_old RENAME TO %[1]s", t.name),
+		)
+		if t.indexes[0] != "" {
+			stmts = append(stmts, t.indexes[0])
+		}
+	}
+	stmts = append(stmts, "DROP TABLE UserTokens", "DROP TABLE Users")
+	return execAll(stmts...)(db)
+}
+
+// CreateUser adds an account whose current instrument is defaultInstrument. An empty password
+// creates an account that can only be used with API tokens; otherwise it must be valid.
+func CreateUser(db *sql.DB, username, password string) (User, error) {
+	user := User{Username: strings.TrimSpace(username), CreatedAt: time.Now().UTC()}
+	if err := validateUsername(user.Username); err != nil {
+		return user, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return user, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return user, fmt.Errorf("failed to begin transaction for user %s: %w", user.Username, err)
+	}
+	successfulCommit := false
+	defer func() {
+		if !successfulCommit {
+			tx.Rollback()
+		}
+	}()
+
+	var taken int
+	err = tx.QueryRow("SELECT COUNT(*) FROM Users WHERE username = ?", user.Username).Scan(&taken)
+	if err != nil {
+		return user, fmt.Errorf("failed to look up user %s: %w", user.Username, err)
+	}
+	if taken > 0 {
+		return user, ErrUserExists
+	}
+	res, err := tx.Exec("INSERT INTO Users (username, password_hash, created_at) VALUES (?, ?, ?)", user.Username, hash, user.CreatedAt)
+	if err != nil {
+		return user, fmt.Errorf("failed to insert user %s: %w", user.Username, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return user, fmt.Errorf("failed to get inserted user id: %w", err)
+	}
+	user.ID = int(id)
+	_, err = tx.Exec("INSERT INTO UserInstruments (user_id, instrument, selected, current) VALUES (?, ?, 1, 1)", user.ID, defaultInstrument)
+	if err != nil {
+		return user, fmt.Errorf("failed to select the default instrument of user %s: %w", user.Username, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return user, fmt.Errorf("failed to commit user %s: %w", user.Username, err)
+	}
+	successfulCommit = true
+	log.Printf("Created user %d (%s)", user.ID, user.Username)
+	return user, nil
+}
+
+// hashPassword returns the bcrypt hash of a password, or "" for no password.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if err := validatePassword(password); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// Authenticate returns the account of a username and password, or ErrInvalidCredentials.
+func Authenticate(db *sql.DB, username, password string) (User, error) {
+	var user User
+	var hash string
+	err := db.QueryRow("SELECT id, username, password_hash, created_at FROM Users WHERE username = ?", strings.TrimSpace(username)).Scan(
+		&user.ID, &user.Username, &hash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidCredentials
+	}
+	if err != nil {
+		return user, fmt.Errorf("failed to look up user %s: %w", username, err)
+	}
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return user, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// SetPassword replaces the password of a user; an empty password disables password login.
+func SetPassword(db *sql.DB, userID int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE Users SET password_hash = ? WHERE id = ?", hash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password of user %d: %w", userID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check updated password of user %d: %w", userID, err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ChangePassword sets the password of a user after checking the current one, or returns
+// ErrInvalidCredentials. Accounts without a password, such as the default account of older
+// databases, return ErrNoPassword: their first password is set by an admin with SetPassword,
+// as anyone can act as the default account before it has one.
+func ChangePassword(db *sql.DB, userID int, current, password string) error {
+	var hash string
+	err := db.QueryRow("SELECT password_hash FROM Users WHERE id = ?", userID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up user %d: %w", userID, err)
+	}
+	if hash == "" {
+		return ErrNoPassword
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(current)) != nil {
+		return ErrInvalidCredentials
+	}
+	return SetPassword(db, userID, password)
+}
+
+// RegistrationOpen tells whether anyone may create an account. Registration stays closed while
+// the default account has no password: the first password would stop serving requests without
+// a token as the default account (see AnonymousUser), locking out the frontend.
+func RegistrationOpen(db *sql.DB) (bool, error) {
+	var unprotected bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM Users WHERE username = ? AND password_hash = '')", defaultUsername).Scan(&unprotected)
+	if err != nil {
+		return false, fmt.Errorf("failed to check the default account: %w", err)
+	}
+	return !unprotected, nil
+}
+
+// GetUserByName returns the account of a username, ignoring case.
+func GetUserByName(db *sql.DB, username string) (User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, username, created_at FROM Users WHERE username = ?", strings.TrimSpace(username)).Scan(
+		&user.ID, &user.Username, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return user, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err != nil {
+		return user, fmt.Errorf("failed to look up user %s: %w", username, err)
+	}
+	return user, nil
+}
+
+// AnonymousUser returns the account that serves requests without a token: the one named by
+// anonymous (ANONYMOUS_USER) when it is set, otherwise the default account as long as no account
+// has a password, so that a single-user setup works without logging in. ok is false when such
+// requests must log in.
+func AnonymousUser(db *sql.DB, anonymous string) (user User, ok bool, err error) {
+	if anonymous = strings.TrimSpace(anonymous); anonymous != "" {
+		user, err = GetUserByName(db, anonymous)
+		return user, err == nil, err
+	}
+	var protected bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM Users WHERE password_hash != '')").Scan(&protected); err != nil {
+		return user, false, fmt.Errorf("failed to check passwords: %w", err)
+	}
+	if protected {
+		return user, false, nil
+	}
+	user, err = GetUserByName(db, defaultUsername)
+	if errors.Is(err, ErrUserNotFound) {
+		return user, false, nil
+	}
+	return user, err == nil, err
+}
+
+// ListUsers returns every account by ID.
+func ListUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT id, username, created_at FROM Users ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// hashToken returns how a token is stored: only its SHA-256, so that the database does not hold
+// usable tokens. Tokens are random, so a salted hash is not needed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueToken creates a token of the given kind for a user and returns it with its description.
+// Expired sessions of the user are removed at the same time.
+func IssueToken(db *sql.DB, userID int, kind, name string) (string, UserToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", UserToken{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	t := UserToken{Kind: kind, Name: strings.TrimSpace(name), CreatedAt: now}
+	if kind == tokenKindSession {
+		expiresAt := now.Add(sessionLifetime)
+		t.ExpiresAt = &expiresAt
+	}
+	if _, err := db.Exec("DELETE FROM UserTokens WHERE user_id = ? AND expires_at <= ?", userID, now); err != nil {
+		return "", t, fmt.Errorf("failed to remove expired tokens of user %d: %w", userID, err)
+	}
+	res, err := db.Exec("INSERT INTO UserTokens (user_id, token_hash, kind, name, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, hashToken(token), kind, t.Name, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return "", t, fmt.Errorf("failed to store token of user %d: %w", userID, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", t, fmt.Errorf("failed to get inserted token id: %w", err)
+	}
+	t.ID = int(id)
+	return token, t, nil
+}
+
+// UserByToken returns the account of a valid token and records its use.
+func UserByToken(db *sql.DB, token string) (User, error) {
+	var user User
+	now := time.Now().UTC()
+	hash := hashToken(token)
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.created_at FROM UserTokens t JOIN Users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND (t.expires_at IS NULL OR t.expires_at > ?)`, hash, now).Scan(
+		&user.ID, &user.Username, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidToken
+	}
+	if err != nil {
+		return user, fmt.Errorf("failed to look up token: %w", err)
+	}
+	if _, err := db.Exec("UPDATE UserTokens SET last_used_at = ? WHERE token_hash = ?", now, hash); err != nil {
+		log.Printf("Warning: Failed to record the use of a token of user %d: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// RevokeToken deletes a token, e.g. on logout.
+func RevokeToken(db *sql.DB, token string) error {
+	res, err := db.Exec("DELETE FROM UserTokens WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check revoked token: %w", err)
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// ListTokens returns the tokens of a user that have not expired, newest first.
+func ListTokens(db *sql.DB, userID int) ([]UserToken, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, name, created_at, expires_at, last_used_at FROM UserTokens
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY created_at DESC, id DESC`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tokens of user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	tokens := []UserToken{}
+	for rows.Next() {
+		var t UserToken
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Kind, &t.Name, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan token of user %d: %w", userID, err)
+		}
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteToken revokes a token of a user by its ID.
+func DeleteToken(db *sql.DB, userID, tokenID int) error {
+	res, err := db.Exec("DELETE FROM UserTokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete token %d of user %d: %w", tokenID, userID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check deleted token %d: %w", tokenID, err)
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
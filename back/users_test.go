@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func mustCreateUser(t *testing.T, db *sql.DB, username, password string) User {
+	t.Helper()
+	user, err := CreateUser(db, username, password)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return user
+}
+
+func TestAuthenticate(t *testing.T) {
+	db := openTestDB(t)
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+	bob := mustCreateUser(t, db, "bob", "")
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     int // user ID, 0 for ErrInvalidCredentials
+	}{
+		{"right password", "alice", "correct horse", alice.ID},
+		{"username ignores case", " ALICE ", "correct horse", alice.ID},
+		{"wrong password", "alice", "correct horse!", 0},
+		{"unknown user", "carol", "correct horse", 0},
+		{"account without password", "bob", "", 0},
+		{"default account", defaultUsername, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := Authenticate(db, tt.username, tt.password)
+			if tt.want == 0 {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != tt.want {
+				t.Errorf("user = %d, want %d", user.ID, tt.want)
+			}
+		})
+	}
+
+	if err := ChangePassword(db, alice.ID, "wrong password", "new password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("ChangePassword with a wrong password: err = %v, want ErrInvalidCredentials", err)
+	}
+	if err := ChangePassword(db, alice.ID, "correct horse", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(db, "alice", "new password"); err != nil {
+		t.Errorf("Authenticate after ChangePassword: %v", err)
+	}
+	if err := ChangePassword(db, bob.ID, "", "new password"); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("ChangePassword of an account without password: err = %v, want ErrNoPassword", err)
+	}
+}
+
+// TestAuthAPIDefaultAccount checks that requests without a token, served as the default account
+// while it has no password, can neither give it a password nor register the first one of another
+// account, which only an admin can do.
+func TestAuthAPIDefaultAccount(t *testing.T) {
+	db := openTestDB(t)
+	t.Setenv("ADMIN_TOKEN", "admin token")
+	t.Setenv("ANONYMOUS_USER", "")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	auth_api(r, db)
+	do := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	anonymous := func() bool {
+		_, ok, err := AnonymousUser(db, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	steps := []struct {
+		name      string
+		method    string
+		path      string
+		token     string
+		body      string
+		want      int
+		anonymous bool // whether requests without a token are still served afterwards
+	}{
+		{"password of the default account", "PUT", "/auth/password", "", `{"new_password": "taken over"}`, http.StatusForbidden, true},
+		{"registration", "POST", "/auth/register", "", `{"username": "mallory", "password": "taken over"}`, http.StatusForbidden, true},
+		{"password set without the admin token", "PUT", "/admin/users/default/password", "", `{"password": "correct horse"}`, http.StatusUnauthorized, true},
+		{"registration by an admin", "POST", "/auth/register", "admin token", `{"username": "alice", "password": "correct horse"}`, http.StatusCreated, false},
+		{"password set by an admin", "PUT", "/admin/users/default/password", "admin token", `{"password": "correct horse"}`, http.StatusOK, false},
+		{"registration once the default account has a password", "POST", "/auth/register", "", `{"username": "bob", "password": "battery staple"}`, http.StatusCreated, false},
+		{"password without a login", "PUT", "/auth/password", "", `{"new_password": "taken over"}`, http.StatusUnauthorized, false},
+	}
+	for _, s := range steps {
+		if got := do(s.method, s.path, s.token, s.body); got != s.want {
+			t.Errorf("%s: %s %s = %d, want %d", s.name, s.method, s.path, got, s.want)
+		}
+		if got := anonymous(); got != s.anonymous {
+			t.Errorf("%s: requests without a token served = %v, want %v", s.name, got, s.anonymous)
+		}
+	}
+	if _, err := Authenticate(db, defaultUsername, "correct horse"); err != nil {
+		t.Errorf("Authenticate(default) after the admin set its password: %v", err)
+	}
+	if _, err := GetUserByName(db, "mallory"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("mallory was registered: err = %v", err)
+	}
+}
+
+func TestUserByToken(t *testing.T) {
+	db := openTestDB(t)
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+	issue := func(kind string) string {
+		token, _, err := IssueToken(db, alice.ID, kind, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	session, api, expired, revoked := issue(tokenKindSession), issue(tokenKindAPI), issue(tokenKindSession), issue(tokenKindAPI)
+	if _, err := db.Exec("UPDATE UserTokens SET expires_at = ? WHERE token_hash = ?", time.Now().UTC().Add(-time.Minute), hashToken(expired)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeToken(db, revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"session", session, true},
+		{"api token", api, true},
+		{"expired session", expired, false},
+		{"revoked token", revoked, false},
+		{"unknown token", "not-a-token", false},
+		{"empty token", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := UserByToken(db, tt.token)
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("err = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != alice.ID {
+				t.Errorf("user = %d, want %d", user.ID, alice.ID)
+			}
+		})
+	}
+
+	// Sessions expire after sessionLifetime; API tokens never do. Expired sessions are not listed
+	// and are removed when the next token is issued.
+	tokens, err := ListTokens(db, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("ListTokens returned %d tokens, want 2", len(tokens))
+	}
+	for _, tok := range tokens {
+		switch {
+		case tok.Kind == tokenKindAPI && tok.ExpiresAt != nil:
+			t.Errorf("api token expires at %v", tok.ExpiresAt)
+		case tok.Kind == tokenKindSession && (tok.ExpiresAt == nil || tok.ExpiresAt.Sub(tok.CreatedAt) != sessionLifetime):
+			t.Errorf("session expires at %v, want %v after %v", tok.ExpiresAt, sessionLifetime, tok.CreatedAt)
+		}
+	}
+	issue(tokenKindAPI)
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM UserTokens WHERE token_hash = ?", hashToken(expired)).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Error("expired session was not removed")
+	}
+}
+
+func TestAnonymousUser(t *testing.T) {
+	db := openTestDB(t)
+	alice := mustCreateUser(t, db, "alice", "")
+
+	tests := []struct {
+		name      string
+		anonymous string
+		password  bool // whether alice has a password
+		want      int  // user ID, 0 when a login is required
+	}{
+		{"no password", "", false, defaultUserID},
+		{"password set", "", true, 0},
+		{"named account", "alice", true, alice.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password := ""
+			if tt.password {
+				password = "correct horse"
+			}
+			if err := SetPassword(db, alice.ID, password); err != nil {
+				t.Fatal(err)
+			}
+			user, ok, err := AnonymousUser(db, tt.anonymous)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tt.want != 0) || user.ID != tt.want {
+				t.Errorf("AnonymousUser = %d, %v, want %d", user.ID, ok, tt.want)
+			}
+		})
+	}
+	if _, _, err := AnonymousUser(db, "carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown ANONYMOUS_USER: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+// TestSetupUsers checks that migration 9 gives the user data of older databases to the default
+// account, and that rolling it back keeps only the data of that account.
+func TestSetupUsers(t *testing.T) {
+	db := openTestDBAt(t, 8)
+	stmts := []string{
+		"INSERT INTO Music (id, title) VALUES (1, 'Song')",
+		"INSERT INTO Favorites (music_id, order_key) VALUES (1, 1)",
+		"INSERT INTO UserMusicDifficultySettings (music_id, instrument, measure, difficulty) VALUES (1, 'guitar', 1, 2)",
+		"INSERT INTO QueryHistory (query, normalized, searched_at) VALUES ('Song', 'song', CURRENT_TIMESTAMP)",
+		"INSERT INTO ViewHistory (music_id, viewed_at) VALUES (1, CURRENT_TIMESTAMP)",
+		"INSERT INTO PracticeProgress (music_id, difficulty, last_measure, position, measure_count, practiced_at) VALUES (1, 1, 2, 2, 4, CURRENT_TIMESTAMP)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MigrateUp(db, 9, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range userTables {
+		var total, owned int
+		if err := db.QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id = ?) FROM "+table.name, defaultUserID).Scan(&total, &owned); err != nil {
+			t.Fatalf("%s: %v", table.name, err)
+		}
+		if total != 1 || owned != 1 {
+			t.Errorf("%s: %d rows of which %d belong to the default account, want 1 and 1", table.name, total, owned)
+		}
+	}
+	if user, ok, err := AnonymousUser(db, ""); err != nil || !ok || user.Username != defaultUsername {
+		t.Errorf("AnonymousUser = %+v, %v, %v, want the default account", user, ok, err)
+	}
+
+	// Every user has a current instrument of their own, and rows of several users can coexist
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+	for _, stmt := range []string{
+		"INSERT INTO Favorites (user_id, music_id, order_key) VALUES (?, 1, 1)",
+		"INSERT INTO ViewHistory (user_id, music_id, viewed_at) VALUES (?, 1, CURRENT_TIMESTAMP)",
+		"INSERT INTO QueryHistory (user_id, query, normalized, searched_at) VALUES (?, 'Song', 'song', CURRENT_TIMESTAMP)",
+	} {
+		if _, err := db.Exec(stmt, alice.ID); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	if err := MigrateDown(db, 8, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range userTables {
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table.name).Scan(&total); err != nil {
+			t.Fatalf("%s: %v", table.name, err)
+		}
+		if total != 1 {
+			t.Errorf("%s after rollback: %d rows, want the 1 of the default account", table.name, total)
+		}
+	}
+}
+
+// TestUserDataIsolation checks that the user_id filters keep the data of a user out of the
+// reach of another one.
+func TestUserDataIsolation(t *testing.T) {
+	db := openTestDB(t)
+	alice := mustCreateUser(t, db, "alice", "correct horse")
+	bob := mustCreateUser(t, db, "bob", "battery staple")
+	musicID := insertTestMusic(t, db, "Song")
+
+	tests := []struct {
+		name  string
+		add   func(userID int) error
+		count func(userID int) (int, error)
+		// remove tries to delete the data of alice as bob
+		remove func(t *testing.T) error
+	}{
+		{
+			name: "favorites",
+			add:  func(userID int) error { return AddFavorite(db, userID, musicID) },
+			count: func(userID int) (int, error) {
+				favorites, err := GetFavorites(db, userID)
+				return len(favorites), err
+			},
+			remove: func(t *testing.T) error { return SetFavorites(db, bob.ID, nil) },
+		},
+		{
+			name: "view history",
+			add:  func(userID int) error { return AddViewToHistory(db, userID, musicID) },
+			count: func(userID int) (int, error) {
+				history, err := GetViewHistory(db, userID, defaultHistoryLimit)
+				return len(history), err
+			},
+			remove: func(t *testing.T) error {
+				history, err := GetViewHistory(db, alice.ID, defaultHistoryLimit)
+				if err != nil {
+					return err
+				}
+				if err := DeleteHistoryEntry(db, bob.ID, "ViewHistory", history[0].ID); !errors.Is(err, ErrHistoryEntryNotFound) {
+					t.Errorf("DeleteHistoryEntry of another user: err = %v, want ErrHistoryEntryNotFound", err)
+				}
+				_, err = ClearHistory(db, bob.ID, "ViewHistory")
+				return err
+			},
+		},
+		{
+			name: "query history",
+			add:  func(userID int) error { return AddQueryToHistory(db, userID, "Song") },
+			count: func(userID int) (int, error) {
+				history, err := GetQueryHistory(db, userID, defaultHistoryLimit)
+				return len(history), err
+			},
+			remove: func(t *testing.T) error {
+				history, err := GetQueryHistory(db, alice.ID, defaultHistoryLimit)
+				if err != nil {
+					return err
+				}
+				if err := DeleteHistoryEntry(db, bob.ID, "QueryHistory", history[0].ID); !errors.Is(err, ErrHistoryEntryNotFound) {
+					t.Errorf("DeleteHistoryEntry of another user: err = %v, want ErrHistoryEntryNotFound", err)
+				}
+				_, err = ClearHistory(db, bob.ID, "QueryHistory")
+				return err
+			},
+		},
+		{
+			name: "practice progress",
+			add: func(userID int) error {
+				return RecordPracticeProgress(db, userID, musicID, SheetPart{}, 1, 2)
+			},
+			count: func(userID int) (int, error) {
+				var n int
+				err := db.QueryRow("SELECT COUNT(*) FROM PracticeProgress WHERE user_id = ?", userID).Scan(&n)
+				return n, err
+			},
+			remove: func(t *testing.T) error {
+				items, err := GetQuickAccess(db, bob.ID, maxQuickAccessLimit)
+				if len(items) != 0 {
+					t.Errorf("quick access of bob shows the progress of alice: %+v", items)
+				}
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.add(alice.ID); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := tt.count(bob.ID); err != nil || n != 0 {
+				t.Fatalf("bob sees %d entries of alice (err: %v)", n, err)
+			}
+			if err := tt.remove(t); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := tt.count(alice.ID); err != nil || n != 1 {
+				t.Errorf("alice has %d entries after bob tried to remove them, want 1 (err: %v)", n, err)
+			}
+		})
+	}
+}
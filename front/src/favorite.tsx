@@ -73,6 +73,7 @@ export const Favorite = () => {
                     title={music.title}
                     artist={music.artist}
                     thumbnail={music.thumbnail}
+                    thumbnailURL={music.thumbnail_url}
                     />
                 ))
             }
@@ -141,6 +141,7 @@ export const Practice = () => {
     const musicbpmRef = useRef<number>(120);
     const prevDifficultyRef = useRef<Difficulty>(difficulty);
     const cursorPositionToRestoreRef = useRef<CursorPosition | null>(null);
+    const resumeMeasureRef = useRef<number | null>(null); // クイックアクセスから再開する小節番号
     const isUpdatingXmlForProficiencyRef = useRef<boolean>(false);
     const accompanimentXmlRef = useRef<string | null>(null);
 
@@ -175,6 +176,15 @@ export const Practice = () => {
             setXml([]); return;
         }
         setCurrentMusicID(musicId);
+        // クイックアクセスから開いた場合は前回練習した小節から再開する
+        const resumeMeasure = Number(queryParams.get("measure"));
+        resumeMeasureRef.current = resumeMeasure > 1 ? resumeMeasure : null;
+        // 前回練習した難易度の楽譜で開く（楽譜を読み込む前に設定し、カーソル位置の保存は行わない）
+        const resumeDifficulty = Number(queryParams.get("difficulty"));
+        if (Number.isInteger(resumeDifficulty) && resumeDifficulty >= 1 && resumeDifficulty <= MAX_DIFFICULTY) {
+            prevDifficultyRef.current = resumeDifficulty;
+            setDifficulty(resumeDifficulty);
+        }
 
         (async () => {
             try {
@@ -331,6 +341,18 @@ export const Practice = () => {
         } else if (osmd && osmd.cursor) {
             console.log("[Practice] 復元する位置がないか、OSMDが完全に準備できていません。カーソルをリセットします。");
             osmd.cursor.reset();
+            const resumeMeasure = resumeMeasureRef.current;
+            if (resumeMeasure !== null && osmd.cursor.iterator) {
+                while (!osmd.cursor.iterator.EndReached &&
+                    (osmd.cursor.iterator.CurrentMeasure?.MeasureNumber ?? resumeMeasure) < resumeMeasure) {
+                    osmd.cursor.next();
+                }
+                if (osmd.cursor.iterator.EndReached) {
+                    osmd.cursor.reset();
+                }
+                console.log("[Practice] 前回の小節から再開します:", resumeMeasure);
+                resumeMeasureRef.current = null;
+            }
             osmd.cursor.show();
             cursorRef.current = osmd.cursor;
         }
@@ -11,16 +11,15 @@ import { DysplayMusic } from "./types/types";
 export const Recommend = () => {
     const title: string = "推薦画面";
     const [recommendMusic, setRecommendMusic] = useState<DysplayMusic[]>([]);
-    const { spotifyAccessToken, isSpotifyAuthenticated } = useAuth(); // Contextから取得
+    const { isSpotifyConnected } = useAuth(); // Contextから取得
 
     useEffect(() => {
       const fetchRecommendations = async () => {
-        if (isSpotifyAuthenticated() && spotifyAccessToken) {
+        if (isSpotifyConnected) {
           try {
-            console.log("Recommend.tsx: Fetching recommendations with Spotify token:", spotifyAccessToken);
+            // Spotifyのトークンはバックエンドが保持している
               const recoData = await axios.post("http://localhost:8080/recommendations/spotify",
               {
-                access_token: spotifyAccessToken,
                 limit: 10,
                 count: 10
               },
@@ -47,7 +46,7 @@ export const Recommend = () => {
             fetchProficiencyRecommendations();
           }
         } else {
-          console.log("Recommend.tsx: Spotify not authenticated or token not available. Fetching proficiency recommendations.");
+          console.log("Recommend.tsx: Spotify not connected. Fetching proficiency recommendations.");
           fetchProficiencyRecommendations();
         }
       };
@@ -85,7 +84,7 @@ export const Recommend = () => {
       };
 
       fetchRecommendations();
-    }, [spotifyAccessToken, isSpotifyAuthenticated]); // spotifyAccessTokenとisSpotifyAuthenticatedを依存配列に追加
+    }, [isSpotifyConnected]); // 連携状態が変わったら取り直す
     return (
       <div className="Recommend">
         {/* ヘッダー */}
@@ -113,6 +112,7 @@ export const Recommend = () => {
                       title={music.title}
                       artist={music.artist}
                       thumbnail={music.thumbnail}
+                      thumbnailURL={music.thumbnail_url}
                     />
                   ))
                 ) : (
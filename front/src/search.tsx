@@ -97,7 +97,7 @@ export const Search = () => {//検索画面と結果表示画面をもつ
                 //     setMusicList([]);
                 //     return;
                 // }
-                setMusicList(response.data || []);
+                setMusicList(response.data.items || []);
             } catch (error) {
                 console.error("検索に失敗:", error);
                 setMusicList([]); // Clear list on error
@@ -201,6 +201,7 @@ export const Search = () => {//検索画面と結果表示画面をもつ
                                 title={music.title}
                                 artist={music.artist}
                                 thumbnail={music.thumbnail}
+                                thumbnailURL={music.thumbnail_url}
                             />
                         ))}
                         </div>
@@ -221,6 +222,7 @@ export const Search = () => {//検索画面と結果表示画面をもつ
                                         title={music.title}
                                         artist={music.artist}
                                         thumbnail={music.thumbnail}
+                                        thumbnailURL={music.thumbnail_url}
                                     />
                                 ))}
                             </div>
@@ -40,6 +40,17 @@ export type DysplayMusic ={
     title : string;
     artist : string;
     thumbnail : string;//Base64形式の画像データ
+    thumbnail_url? : string;//サムネイルがURLの場合、バックエンドのキャッシュのパス ("/images/<id>")
+}
+export type QuickAccessMusic = DysplayMusic & {
+    instrument? : string;//最後に練習した楽譜の楽器
+    part? : string;//最後に練習した楽譜のパート
+    difficulty? : number;//最後に練習した楽譜の難易度
+    last_measure? : number;//最後に練習した小節番号
+    measure_count? : number;
+    progress : number;//練習済みの割合 (0-1)
+    resume_measure : number;//再開する小節番号
+    last_activity : string;
 }
 export enum SearchCategory {
     Difficulty = "DiffSearch",